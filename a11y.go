@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// a11yIssue is an accessibility problem found in a rendered page.
+type a11yIssue struct {
+	Rule    string
+	Message string
+}
+
+// a11yMaxReports is the most paths whose issues are kept for the status page.
+const a11yMaxReports = 1000
+
+var (
+	a11yReportsMutex sync.RWMutex
+	a11yReports      = map[string][]a11yIssue{}
+)
+
+// checkA11y analyzes the HTML b for heading level skips, empty links and
+// missing landmarks. The landmark check is skipped when the b is a fragment,
+// such as a post's content, in which case the headings are assumed to be
+// nested under the page's <h1>.
+func checkA11y(b []byte, fragment bool) []a11yIssue {
+	issues := []a11yIssue{}
+
+	level := 0
+	if fragment {
+		level = 1
+	}
+
+	hasMain := false
+	inLink := false
+	linkHref := ""
+	linkNamed := false
+
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if attr(t, "role") == "main" {
+				hasMain = true
+			}
+
+			switch t.Data {
+			case "main":
+				hasMain = true
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				l := int(t.Data[1] - '0')
+				if level > 0 && l > level+1 {
+					issues = append(issues, a11yIssue{
+						Rule: "heading-skip",
+						Message: fmt.Sprintf(
+							"<h%d> follows <h%d>",
+							l,
+							level,
+						),
+					})
+				}
+
+				level = l
+			case "a":
+				inLink = tt == html.StartTagToken
+				linkHref = attr(t, "href")
+				linkNamed = attr(t, "aria-label") != "" ||
+					attr(t, "title") != ""
+			case "img":
+				if alt := attr(t, "alt"); inLink &&
+					strings.TrimSpace(alt) != "" {
+					linkNamed = true
+				}
+			}
+		case html.TextToken:
+			if inLink && strings.TrimSpace(t.Data) != "" {
+				linkNamed = true
+			}
+		case html.EndTagToken:
+			if t.Data == "a" && inLink {
+				if !linkNamed {
+					issues = append(issues, a11yIssue{
+						Rule: "empty-link",
+						Message: fmt.Sprintf(
+							"link to %q is empty",
+							linkHref,
+						),
+					})
+				}
+
+				inLink = false
+			}
+		}
+	}
+
+	if !fragment && !hasMain {
+		issues = append(issues, a11yIssue{
+			Rule:    "missing-landmark",
+			Message: "page has no <main> landmark",
+		})
+	}
+
+	return issues
+}
+
+// attr returns the value of the attribute named key in the t.
+func attr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+// a11yGas is an `air.Gas` that runs the `checkA11y` over every HTML page it
+// serves and records the issues found by path. Only the pages served
+// successfully are recorded, and only up to the `a11yMaxReports` paths, so
+// that the requests for made-up paths can't grow the records without end.
+func a11yGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		rw := &teeResponseWriter{
+			ResponseWriter: httpResponseWriter(req, res),
+		}
+		setHTTPResponseWriter(req, res, rw)
+
+		err := next(req, res)
+		if !rw.tee || rw.buf.Len() == 0 {
+			return err
+		}
+
+		issues := checkA11y(rw.buf.Bytes(), false)
+		path := strings.SplitN(req.Path, "?", 2)[0]
+
+		a11yReportsMutex.Lock()
+		if len(issues) == 0 {
+			delete(a11yReports, path)
+		} else if _, ok := a11yReports[path]; ok ||
+			res.Status == 200 && len(a11yReports) < a11yMaxReports {
+			a11yReports[path] = issues
+		}
+		a11yReportsMutex.Unlock()
+
+		for _, issue := range issues {
+			air.WARN(
+				"accessibility issue found",
+				map[string]interface{}{
+					"path":    path,
+					"rule":    issue.Rule,
+					"message": issue.Message,
+				},
+			)
+		}
+
+		return err
+	}
+}
+
+// teeResponseWriter is an `http.ResponseWriter` that keeps a copy of
+// everything written through it if it is HTML. Whether it is is known by the
+// "Content-Type" once the header is written, so the other responses, such as
+// the images and the videos, are passed through without being held in memory.
+type teeResponseWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	tee         bool
+	buf         bytes.Buffer
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (rw *teeResponseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader && status >= 200 {
+		rw.wroteHeader = true
+		rw.tee = strings.HasPrefix(
+			rw.Header().Get("content-type"),
+			"text/html",
+		)
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (rw *teeResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.tee {
+		rw.buf.Write(b)
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
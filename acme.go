@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serveACMEHTTP serves the HTTP-01 challenges of the ACME on the
+// `config.ACMEHTTPAddress` and redirects all the other requests to HTTPS.
+//
+// The challenge tokens are shared with the certificate manager of Air through
+// the cache in the `air.ACMECertRoot`, so both sides must use the same one.
+func serveACMEHTTP() {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(air.ACMECertRoot),
+	}
+	if len(air.HostWhitelist) > 0 {
+		m.HostPolicy = autocert.HostWhitelist(air.HostWhitelist...)
+	}
+
+	h := m.HTTPHandler(http.HandlerFunc(redirectHTTPS))
+
+	s := &http.Server{
+		Addr:              config.ACMEHTTPAddress,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	if err := s.ListenAndServe(); err != nil {
+		air.ERROR(
+			"acme http server error",
+			map[string]interface{}{
+				"address": config.ACMEHTTPAddress,
+				"error":   err.Error(),
+			},
+		)
+	}
+}
+
+// redirectHTTPS permanently redirects the r to the same URL over HTTPS on the
+// port of the `air.Address`, or straight to the scheme and the host of the
+// `config.BaseURL` if the canonical host is enforced. The URL of the r already
+// has the `basePath` in it.
+func redirectHTTPS(rw http.ResponseWriter, r *http.Request) {
+	if config.CanonicalHostEnforced {
+		http.Redirect(
+			rw,
+			r,
+			fmt.Sprintf(
+				"%s://%s%s",
+				canonicalURL.Scheme,
+				canonicalURL.Host,
+				r.URL.RequestURI(),
+			),
+			http.StatusMovedPermanently,
+		)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if _, port, err := net.SplitHostPort(air.Address); err == nil &&
+		port != "" &&
+		port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(
+		rw,
+		r,
+		"https://"+host+r.URL.RequestURI(),
+		http.StatusMovedPermanently,
+	)
+}
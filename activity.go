@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// activityMaxEntries is the maximum number of entries of the activity feed.
+const activityMaxEntries = 50
+
+// activityFeed is the Atom feed of everything happening on the blog.
+type activityFeed struct {
+	XMLName xml.Name        `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string          `xml:"title"`
+	ID      string          `xml:"id"`
+	Links   []activityLink  `xml:"link"`
+	Updated string          `xml:"updated"`
+	Author  activityAuthor  `xml:"author"`
+	Entries []activityEntry `xml:"entry"`
+}
+
+// activityAuthor is the author of the `activityFeed`.
+type activityAuthor struct {
+	Name string `xml:"name"`
+}
+
+// activityLink is a link of the `activityFeed` or the `activityEntry`.
+type activityLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// activityEntry is an entry of the `activityFeed`.
+type activityEntry struct {
+	Title    string           `xml:"title"`
+	ID       string           `xml:"id"`
+	Link     activityLink     `xml:"link"`
+	Updated  string           `xml:"updated"`
+	Category activityCategory `xml:"category"`
+	Content  activityContent  `xml:"content"`
+
+	when time.Time
+}
+
+// activityCategory is the kind of an `activityEntry`.
+type activityCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// activityContent is the content of an `activityEntry`.
+type activityContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// activityEntries returns the newest entries of the new posts and the
+// comments, including the ones waiting for moderation.
+func activityEntries() ([]activityEntry, error) {
+	snap := loadedPosts()
+
+	aes := []activityEntry{}
+	for _, p := range snap.orderedPosts {
+		aes = append(aes, activityEntry{
+			Title: "New post: " + p.Title,
+			ID:    p.EntryID,
+			Link: activityLink{
+				Href: config.BaseURL + p.Permalink,
+			},
+			Category: activityCategory{"post"},
+			Content: activityContent{
+				Type: "html",
+				Body: p.AbsoluteContent(),
+			},
+			when: p.Datetime,
+		})
+	}
+
+	cs, err := allComments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		title := fmt.Sprintf("Comment by %s on %s", c.Name, c.PostID)
+		link := config.BaseURL + "/posts/" + c.PostID + "#comments"
+		if p, ok := snap.posts[c.PostID]; ok {
+			link = config.BaseURL + p.Permalink + "#comments"
+		}
+
+		if !c.Approved {
+			title += " (awaiting moderation)"
+			link = config.BaseURL + "/admin/comments"
+		}
+
+		aes = append(aes, activityEntry{
+			Title: title,
+			ID: fmt.Sprintf(
+				"%s/posts/%s#comment-%s",
+				config.BaseURL,
+				c.PostID,
+				c.ID,
+			),
+			Link:     activityLink{Href: link},
+			Category: activityCategory{"comment"},
+			Content: activityContent{
+				Type: "text",
+				Body: c.Content,
+			},
+			when: c.CreatedAt,
+		})
+	}
+
+	sort.SliceStable(aes, func(i, j int) bool {
+		return aes[i].when.After(aes[j].when)
+	})
+
+	if len(aes) > activityMaxEntries {
+		aes = aes[:activityMaxEntries]
+	}
+
+	for i := range aes {
+		aes[i].Updated = aes[i].when.UTC().Format(time.RFC3339)
+	}
+
+	return aes, nil
+}
+
+func activityHandler(req *air.Request, res *air.Response) error {
+	aes, err := activityEntries()
+	if err != nil {
+		return err
+	}
+
+	updated := time.Unix(0, 0).UTC().Format(time.RFC3339)
+	if len(aes) > 0 {
+		updated = aes[0].Updated
+	}
+
+	b, err := xml.MarshalIndent(activityFeed{
+		Title: config.Title + " Activity",
+		ID:    config.BaseURL + "/activity.atom",
+		Links: []activityLink{
+			{Href: config.BaseURL},
+			{
+				Href: config.BaseURL + "/activity.atom",
+				Rel:  "self",
+			},
+		},
+		Updated: updated,
+		Author:  activityAuthor{config.Title},
+		Entries: aes,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/atom+xml; charset=utf-8")
+
+	return res.WriteBlob(append([]byte(xml.Header), b...))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// postError is a failure to parse a post file.
+type postError struct {
+	File  string
+	Error string
+}
+
+// startedAt is when the blog started.
+var startedAt = time.Now().UTC()
+
+// newPostError returns a new `postError` of the filename with the err.
+func newPostError(filename string, err error) postError {
+	return postError{
+		File:  filename,
+		Error: err.Error(),
+	}
+}
+
+// adminAccount is an account of an administrator.
+type adminAccount struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// adminAccounts returns all the administrator accounts with a password.
+func adminAccounts() []adminAccount {
+	aas := []adminAccount{}
+	if config.AdminPassword != "" {
+		aas = append(aas, adminAccount{
+			Username: config.AdminUsername,
+			Password: config.AdminPassword,
+		})
+	}
+
+	for _, aa := range config.Admins {
+		if aa.Password != "" {
+			aas = append(aas, aa)
+		}
+	}
+
+	return aas
+}
+
+// paramValue returns the first value of the param named name of the req, or
+// "" if there is no such param.
+func paramValue(req *air.Request, name string) string {
+	p := req.Param(name)
+	if p == nil || p.Value() == nil {
+		return ""
+	}
+
+	return p.Value().String()
+}
+
+func adminStatusHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	a11yReportsMutex.RLock()
+	a11yPaths := make([]string, 0, len(a11yReports))
+	a11yIssues := make(map[string][]a11yIssue, len(a11yReports))
+	for p, issues := range a11yReports {
+		a11yPaths = append(a11yPaths, p)
+		a11yIssues[p] = issues
+	}
+	a11yReportsMutex.RUnlock()
+
+	sort.Strings(a11yPaths)
+
+	caches := make([]lruCacheStats, 0, len(lruCaches))
+	for _, c := range lruCaches {
+		caches = append(caches, c.stats())
+	}
+
+	reloadedAt, _ := contentVersionReloadedAt.Load().(time.Time)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	req.Values["PageTitle"] = "Status"
+	req.Values["ContentVersion"] = currentContentVersion()
+	req.Values["ReloadedAt"] = reloadedAt
+	req.Values["PostCount"] = len(snap.orderedPosts)
+	req.Values["PostsErr"] = snap.err
+	req.Values["PostErrors"] = snap.postErrors
+	req.Values["PostCollisions"] = snap.postCollisions
+	req.Values["A11yPaths"] = a11yPaths
+	req.Values["A11yIssues"] = a11yIssues
+	req.Values["Caches"] = caches
+	req.Values["CDNProvider"] = config.CDNProvider
+	req.Values["Subsystems"] = heartbeatSnapshot()
+	req.Values["Jobs"] = jobSnapshot()
+	req.Values["PostsWatcherRunning"] = atomic.LoadInt32(
+		&postsWatcherRunning,
+	) == 1
+	req.Values["FeedBytes"] = len(snap.feed)
+	req.Values["FeedETag"] = snap.feedETag
+	req.Values["FeedLastModified"] = snap.feedLastModified
+	req.Values["StartedAt"] = startedAt
+	req.Values["Uptime"] = time.Since(startedAt).Round(time.Second)
+	req.Values["Goroutines"] = runtime.NumGoroutine()
+	req.Values["HeapAlloc"] = ms.HeapAlloc
+	req.Values["Sys"] = ms.Sys
+	req.Values["NumGC"] = ms.NumGC
+
+	return res.Render(
+		req.Values,
+		"admin/status.html",
+		"layouts/default.html",
+	)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// postIDPattern is the pattern of the IDs of the posts created in the admin.
+var postIDPattern = regexp.MustCompile(
+	`^[a-z0-9][a-z0-9-]*(/[a-z0-9][a-z0-9-]*)*$`,
+)
+
+// pendingPost is a post waiting for approval.
+type pendingPost struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+
+	// Submitter is the `principal.Actor` of the Author, so that an
+	// administrator and an API token of the same name can't be mistaken
+	// for each other.
+	Submitter string `json:"submitter,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	Source    string    `json:"source"`
+}
+
+// checkApprover returns an error if the p may not approve the pp. The posts
+// must be approved by an administrator other than the one who created them,
+// and never by an API token, which may be kept by anyone and so can't stand
+// for a second pair of eyes.
+func checkApprover(p principal, pp pendingPost) error {
+	submitter := pp.Submitter
+	if submitter == "" {
+		submitter = principal{Name: pp.Author}.Actor()
+	}
+
+	if p.Token {
+		return errors.New("Posts must be approved by an administrator")
+	} else if p.Actor() == submitter {
+		return errors.New("Posts must be approved by someone else")
+	}
+
+	return nil
+}
+
+// pendingPostFilename returns the name of the file of the pending post of
+// the id.
+func pendingPostFilename(id string) string {
+	return filepath.Join(config.PendingRoot, url.PathEscape(id)+".json")
+}
+
+// pendingPosts returns all the pending posts, oldest first.
+func pendingPosts() ([]pendingPost, error) {
+	fns, err := filepath.Glob(filepath.Join(config.PendingRoot, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	pps := make([]pendingPost, 0, len(fns))
+	for _, fn := range fns {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		pp := pendingPost{}
+		if err := json.Unmarshal(b, &pp); err != nil {
+			return nil, err
+		}
+
+		pps = append(pps, pp)
+	}
+
+	sort.Slice(pps, func(i, j int) bool {
+		return pps[i].CreatedAt.Before(pps[j].CreatedAt)
+	})
+
+	return pps, nil
+}
+
+// postSource returns the source of a post file with the title, the datetime
+// and the content.
+func postSource(title string, datetime time.Time, content string) string {
+	buf := bytes.Buffer{}
+	buf.WriteString("+++\n")
+	toml.NewEncoder(&buf).Encode(struct {
+		Title    string    `toml:"title"`
+		Datetime time.Time `toml:"datetime"`
+	}{title, datetime.UTC()})
+	buf.WriteString("+++\n\n")
+	buf.WriteString(strings.Replace(content, "\r\n", "\n", -1))
+	buf.WriteString("\n")
+
+	return buf.String()
+}
+
+// publishPost adds the source as the post of the id to the `store`.
+func publishPost(id, source string) error {
+	if err := store.PublishPost(id, []byte(source)); err != nil {
+		return err
+	}
+
+	reloadUnwatchedPosts()
+
+	return nil
+}
+
+// notifyApproval tells the `config.ApprovalNotifyURL` (if any) about the event
+// of the pp.
+func notifyApproval(event string, pp pendingPost, by string) {
+	if config.ApprovalNotifyURL == "" {
+		return
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"event":  event,
+		"id":     pp.ID,
+		"title":  pp.Title,
+		"author": pp.Author,
+		"by":     by,
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if _, err := fetch(
+			"POST",
+			config.ApprovalNotifyURL,
+			http.Header{"Content-Type": {"application/json"}},
+			b,
+		); err != nil {
+			air.ERROR(
+				"failed to send approval notification",
+				map[string]interface{}{
+					"event": event,
+					"id":    pp.ID,
+					"error": err.Error(),
+				},
+			)
+		}
+	}()
+}
+
+func adminNewPostHandler(req *air.Request, res *air.Response) error {
+	req.Values["PageTitle"] = "New Post"
+	req.Values["ApprovalEnabled"] = config.ApprovalEnabled
+	return res.Render(
+		req.Values,
+		"admin/new.html",
+		"layouts/default.html",
+	)
+}
+
+func adminCreatePostHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	id := strings.TrimSpace(paramValue(req, "id"))
+	title := strings.TrimSpace(paramValue(req, "title"))
+	content := paramValue(req, "content")
+	if !postIDPattern.MatchString(id) || title == "" {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	if _, ok := snap.posts[id]; ok {
+		res.Status = 409
+		return errors.New("Conflict")
+	}
+
+	author := req.Values["AdminUsername"].(string)
+	submitter := req.Values["Principal"].(principal).Actor()
+	source := postSource(title, time.Now(), content)
+	if !config.ApprovalEnabled {
+		if err := publishPost(id, source); err != nil {
+			res.Status = 409
+			return err
+		}
+
+		return res.Redirect(sitePath("/posts/" + id))
+	}
+
+	filename := pendingPostFilename(id)
+	if _, err := os.Stat(filename); err == nil {
+		res.Status = 409
+		return errors.New("Conflict")
+	}
+
+	pp := pendingPost{
+		ID:        id,
+		Title:     title,
+		Author:    author,
+		Submitter: submitter,
+		CreatedAt: time.Now().UTC(),
+		Source:    source,
+	}
+
+	b, err := json.MarshalIndent(pp, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.PendingRoot, 0700); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filename, b, 0600); err != nil {
+		return err
+	}
+
+	notifyApproval("pending", pp, author)
+
+	return res.Redirect(sitePath("/admin/pending"))
+}
+
+func adminPendingHandler(req *air.Request, res *air.Response) error {
+	pps, err := pendingPosts()
+	if err != nil {
+		return err
+	}
+
+	req.Values["PageTitle"] = "Pending Posts"
+	req.Values["PendingPosts"] = pps
+
+	return res.Render(
+		req.Values,
+		"admin/pending.html",
+		"layouts/default.html",
+	)
+}
+
+func adminReviewPendingHandler(req *air.Request, res *air.Response) error {
+	id := paramValue(req, "id")
+	approved := paramValue(req, "action") == "approve"
+	if !postIDPattern.MatchString(id) {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	filename := pendingPostFilename(id)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return air.NotFoundHandler(req, res)
+	}
+
+	pp := pendingPost{}
+	if err := json.Unmarshal(b, &pp); err != nil {
+		return err
+	}
+
+	reviewer := req.Values["AdminUsername"].(string)
+	if approved {
+		p := req.Values["Principal"].(principal)
+		if err := checkApprover(p, pp); err != nil {
+			res.Status = 403
+			return err
+		}
+	}
+
+	if approved {
+		if err := publishPost(pp.ID, pp.Source); err != nil {
+			res.Status = 409
+			return err
+		}
+	}
+
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	if approved {
+		notifyApproval("approved", pp, reviewer)
+	} else {
+		notifyApproval("rejected", pp, reviewer)
+	}
+
+	return res.Redirect(sitePath("/admin/pending"))
+}
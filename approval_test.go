@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCheckApprover(t *testing.T) {
+	alice := principal{Name: "alice"}
+	bob := principal{Name: "bob"}
+	alicesToken := principal{Name: "alice-ci", Token: true}
+	namesakeToken := principal{Name: "bob", Token: true}
+
+	bySubmitter := func(p principal) pendingPost {
+		return pendingPost{
+			ID:        "foo",
+			Author:    p.Name,
+			Submitter: p.Actor(),
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		approver principal
+		pp       pendingPost
+		ok       bool
+	}{
+		{"another admin", bob, bySubmitter(alice), true},
+		{"the author", alice, bySubmitter(alice), false},
+		{"the author's token", alicesToken, bySubmitter(alice), false},
+		{"a namesake token", namesakeToken, bySubmitter(alice), false},
+		{"a namesake admin", bob, bySubmitter(namesakeToken), true},
+		{"a token", alicesToken, bySubmitter(bob), false},
+		{"the author before submitters", alice, pendingPost{
+			ID:     "foo",
+			Author: "alice",
+		}, false},
+		{"another admin before submitters", bob, pendingPost{
+			ID:     "foo",
+			Author: "alice",
+		}, true},
+	} {
+		err := checkApprover(tc.approver, tc.pp)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: got %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+)
+
+var (
+	assetHashesMutex sync.RWMutex
+	assetHashes      = map[string]string{}
+)
+
+// hashAssets hashes all the files in the `air.AssetRoot`, and rebuilds the
+// bundles of them.
+func hashAssets() {
+	ahs := map[string]string{}
+	filepath.Walk(
+		air.AssetRoot,
+		func(filename string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(air.AssetRoot, filename)
+			if err != nil {
+				return nil
+			}
+
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil
+			}
+
+			ahs["/assets/"+filepath.ToSlash(rel)] = fmt.Sprintf(
+				"%x",
+				md5.Sum(b),
+			)[:8]
+
+			return nil
+		},
+	)
+
+	assetHashesMutex.Lock()
+	assetHashes = ahs
+	assetHashesMutex.Unlock()
+
+	buildBundles()
+}
+
+// assetURL returns the fingerprinted URL of the asset at the p. For example,
+// "/assets/css/main.css" becomes "/assets/css/main.1a2b3c4d.css". The p is
+// returned as is if there is no such asset. The URL is under the `basePath`.
+func assetURL(p string) string {
+	assetHashesMutex.RLock()
+	hash, ok := assetHashes[p]
+	assetHashesMutex.RUnlock()
+	if !ok {
+		return sitePath(p)
+	}
+
+	ext := path.Ext(p)
+
+	return sitePath(strings.TrimSuffix(p, ext) + "." + hash + ext)
+}
+
+// assetPath returns the p with its fingerprint (if any) removed, and reports
+// whether the p carries the current fingerprint of the asset.
+func assetPath(p string) (string, bool) {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	i := strings.LastIndexByte(base, '.')
+	if i < 0 || strings.Contains(base[i:], "/") {
+		return p, false
+	}
+
+	up := base[:i] + ext
+
+	assetHashesMutex.RLock()
+	hash, ok := assetHashes[up]
+	assetHashesMutex.RUnlock()
+	if !ok {
+		return p, false
+	}
+
+	return up, base[i+1:] == hash
+}
+
+// assetFilename returns the name of the file that the asset path p refers to.
+func assetFilename(p string) string {
+	return filepath.Join(
+		air.AssetRoot,
+		filepath.FromSlash(path.Clean(
+			"/"+strings.TrimPrefix(p, "/assets"),
+		)),
+	)
+}
+
+// assetGases is the gases of the asset routes.
+var assetGases = []air.Gas{assetCacheGas, precompressedAssetGas}
+
+// assetCacheGas is an `air.Gas` that sets the caching policy of the assets.
+// The fingerprinted ones never change, so they can be cached forever.
+func assetCacheGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		_, fingerprinted := assetPath(routePath(req))
+		if fingerprinted {
+			res.SetHeader(
+				"cache-control",
+				"max-age=31536000, immutable",
+			)
+		} else {
+			res.SetHeader("cache-control", "max-age=3600")
+		}
+
+		return next(req, res)
+	}
+}
+
+func assetHandler(req *air.Request, res *air.Response) error {
+	p, _ := assetPath(routePath(req))
+	filename := assetFilename(p)
+	if fi, err := os.Stat(filename); err != nil || fi.IsDir() {
+		return air.NotFoundHandler(req, res)
+	}
+
+	return res.WriteFile(filename)
+}
@@ -32,9 +32,70 @@ window.onscroll = function() {
 };
 
 for (var i = 0; i < times.length; i++) {
+	if (!times[i].hasAttribute("format")) {
+		continue;
+	}
+
 	times[i].innerHTML = moment(times[i].getAttribute("datetime")).format(times[i].getAttribute("format"));
 }
 
+var searchInputs = document.getElementsByClassName("search-input");
+for (var i = 0; i < searchInputs.length; i++) {
+	searchInputs[i].oninput = function() {
+		var input = this;
+		var datalist = document.getElementById(input.getAttribute("list"));
+		if (input.value === "") {
+			return;
+		}
+
+		var xhr = new XMLHttpRequest();
+		xhr.open("GET", input.form.getAttribute("action") + "/suggest?q=" + encodeURIComponent(input.value));
+		xhr.onload = function() {
+			if (xhr.status !== 200) {
+				return;
+			}
+
+			var suggestions = JSON.parse(xhr.responseText)[1];
+			datalist.innerHTML = "";
+			for (var j = 0; j < suggestions.length; j++) {
+				var option = document.createElement("option");
+				option.value = suggestions[j];
+				datalist.appendChild(option);
+			}
+		};
+		xhr.send();
+	};
+}
+
+var reactionForms = document.querySelectorAll(".reactions form");
+for (var i = 0; i < reactionForms.length; i++) {
+	reactionForms[i].onsubmit = function(event) {
+		var form = this;
+		var kind = form.elements.kind.value;
+		var xhr = new XMLHttpRequest();
+		xhr.open("POST", form.getAttribute("action"));
+		xhr.setRequestHeader("Accept", "application/json");
+		xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+		xhr.onload = function() {
+			if (xhr.status !== 200) {
+				return;
+			}
+
+			var counts = JSON.parse(xhr.responseText);
+			for (var j = 0; j < reactionForms.length; j++) {
+				var count = counts[reactionForms[j].elements.kind.value];
+				if (count !== undefined) {
+					reactionForms[j].getElementsByClassName("count")[0].textContent = count;
+				}
+			}
+
+			form.getElementsByTagName("button")[0].setAttribute("aria-pressed", "true");
+		};
+		xhr.send("kind=" + encodeURIComponent(kind));
+		event.preventDefault();
+	};
+}
+
 for (var i = 0; i < pres.length; i++) {
 	hljs.highlightBlock(pres[i].getElementsByTagName("code")[0]);
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// auditPageSize is the number of the latest entries of the audit log shown at
+// the "/admin/audit".
+const auditPageSize = 200
+
+// auditEntry is an entry of the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor,omitempty"`
+	Action string    `json:"action"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	IP     string    `json:"ip"`
+}
+
+var auditMutex sync.Mutex
+
+// auditLogFilename returns the name of the file of the audit log, which has
+// an `auditEntry` as JSON on each line.
+func auditLogFilename() string {
+	return filepath.Join(config.DataRoot, "audit.log")
+}
+
+// audit appends what the actor did with the req to the audit log, which is
+// the action with the status as the outcome. The actor is empty if it is not
+// known who did it. The audit log is only ever appended to.
+func audit(req *air.Request, actor, action string, status int) {
+	b, err := json.Marshal(auditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Action: action,
+		Method: req.Method,
+		Path:   routePath(req),
+		Status: status,
+		IP:     clientIP(req),
+	})
+	if err == nil {
+		err = appendAuditLog(append(b, '\n'))
+	}
+
+	if err != nil {
+		air.ERROR("failed to write audit log", map[string]interface{}{
+			"actor":  actor,
+			"action": action,
+			"error":  err.Error(),
+		})
+	}
+}
+
+// appendAuditLog appends the b to the file of the audit log.
+func appendAuditLog(b []byte) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if err := os.MkdirAll(config.DataRoot, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(
+		auditLogFilename(),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// latestAuditEntries returns the n latest entries of the audit log, from the
+// latest.
+func latestAuditEntries(n int) ([]auditEntry, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.Open(auditLogFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	aes := []auditEntry{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		ae := auditEntry{}
+		if err := json.Unmarshal(s.Bytes(), &ae); err != nil {
+			continue
+		}
+
+		aes = append(aes, ae)
+		if len(aes) > n {
+			aes = aes[1:]
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(aes)-1; i < j; i, j = i+1, j-1 {
+		aes[i], aes[j] = aes[j], aes[i]
+	}
+
+	return aes, nil
+}
+
+func adminAuditHandler(req *air.Request, res *air.Response) error {
+	aes, err := latestAuditEntries(auditPageSize)
+	if err != nil {
+		return err
+	}
+
+	req.Values["PageTitle"] = "Audit Log"
+	req.Values["AuditEntries"] = aes
+
+	return res.Render(
+		req.Values,
+		"admin/audit.html",
+		"layouts/default.html",
+	)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// The scopes that the requests to the admin pages, the API and the hooks are
+// authorized by. The administrators have all of them, while the API tokens
+// only have the ones given to them.
+const (
+	scopeAdminRead     = "admin:read"
+	scopeAdminWrite    = "admin:write"
+	scopePostsWrite    = "posts:write"
+	scopeCommentsWrite = "comments:write"
+	scopeMembersWrite  = "members:write"
+	scopeHooks         = "hooks"
+)
+
+// authScopes is all the scopes.
+var authScopes = []string{
+	scopeAdminRead,
+	scopeAdminWrite,
+	scopePostsWrite,
+	scopeCommentsWrite,
+	scopeMembersWrite,
+	scopeHooks,
+}
+
+const (
+	// adminSessionCookieName is the name of the cookie of the sessions of
+	// the administrators who logged in with the form.
+	adminSessionCookieName = "admin_session"
+
+	// adminSessionMaxAge is how long a session of an administrator lasts.
+	adminSessionMaxAge = 12 * time.Hour
+
+	// csrfParam is the param of the forms that carries the CSRF token,
+	// which may also be sent in the "X-CSRF-Token" header.
+	csrfParam = "csrf_token"
+
+	// apiTokenMinLength is the minimum length of an API token.
+	apiTokenMinLength = 16
+)
+
+// apiToken is a bearer token of the API, sent in the "Authorization" header,
+// that grants the Scopes to whoever has it.
+type apiToken struct {
+	Name   string   `toml:"name"`
+	Token  string   `toml:"token"`
+	Scopes []string `toml:"scopes"`
+}
+
+// principal is who a request is authenticated as.
+type principal struct {
+	// Name is the username of the administrator or the name of the API
+	// token.
+	Name string
+
+	// Token reports whether the principal is an API token, which is not
+	// sent by the browsers on their own and so needs no CSRF token.
+	Token bool
+
+	Scopes []string
+
+	// csrfToken is the CSRF token that the forms of the principal carry.
+	csrfToken string
+}
+
+// Actor returns the principal as it appears in the audit log.
+func (p principal) Actor() string {
+	if p.Token {
+		return "token:" + p.Name
+	}
+
+	return "admin:" + p.Name
+}
+
+// HasScope reports whether the p has the scope.
+func (p principal) HasScope(scope string) bool {
+	return stringSliceContains(p.Scopes, scope)
+}
+
+// checkAPITokens checks the `config.APITokens`.
+func checkAPITokens() error {
+	names := map[string]bool{}
+	for _, at := range config.APITokens {
+		if at.Name == "" {
+			return errors.New("api token without a name")
+		} else if names[at.Name] {
+			return fmt.Errorf("duplicate api token %q", at.Name)
+		} else if len(at.Token) < apiTokenMinLength {
+			return fmt.Errorf(
+				"api token %q is shorter than %d characters",
+				at.Name,
+				apiTokenMinLength,
+			)
+		}
+
+		for _, s := range at.Scopes {
+			if !stringSliceContains(authScopes, s) {
+				return fmt.Errorf(
+					"unknown scope %q of api token %q",
+					s,
+					at.Name,
+				)
+			}
+		}
+
+		names[at.Name] = true
+	}
+
+	return nil
+}
+
+// authEnabled reports whether there is any administrator account or API
+// token. The admin pages don't exist at all without one.
+func authEnabled() bool {
+	return len(adminAccounts()) > 0 || len(config.APITokens) > 0
+}
+
+// csrfToken returns the CSRF token of the forms of the session, which is
+// either the value of a session cookie or the username of an administrator
+// authenticated otherwise.
+func csrfToken(session string) string {
+	mac := hmac.New(sha256.New, getCookieSecret())
+	mac.Write([]byte("csrf\x00" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// adminSessionKind returns the kind of the session tokens of the aa, which
+// changes along with its password, so that changing the password ends its
+// sessions.
+func adminSessionKind(aa adminAccount) string {
+	h := sha256.Sum256([]byte(aa.Password))
+	return "admin-session\x00" + hex.EncodeToString(h[:8])
+}
+
+// checkAdminPassword returns the administrator account of the username and
+// the password, or false if there is none. Every account is compared in
+// constant time, so that the time taken gives nothing away.
+func checkAdminPassword(username, password string) (adminAccount, bool) {
+	found := adminAccount{}
+	ok := false
+	for _, aa := range adminAccounts() {
+		if subtle.ConstantTimeCompare(
+			[]byte(username),
+			[]byte(aa.Username),
+		)&subtle.ConstantTimeCompare(
+			[]byte(password),
+			[]byte(aa.Password),
+		) == 1 {
+			found, ok = aa, true
+		}
+	}
+
+	return found, ok
+}
+
+// authenticate returns who the req is from, by its bearer token, its session
+// cookie or its HTTP basic authentication, in that order. It also reports
+// whether the req carries any credentials at all.
+func authenticate(req *air.Request) (p principal, ok, presented bool) {
+	authz := req.Header("authorization").Value()
+	if strings.HasPrefix(authz, "Bearer ") {
+		token := strings.TrimPrefix(authz, "Bearer ")
+		for _, at := range config.APITokens {
+			if subtle.ConstantTimeCompare(
+				[]byte(token),
+				[]byte(at.Token),
+			) == 1 {
+				p, ok = principal{
+					Name:   at.Name,
+					Token:  true,
+					Scopes: at.Scopes,
+				}, true
+			}
+		}
+
+		return p, ok, true
+	}
+
+	if c := req.Cookie(adminSessionCookieName); c != nil {
+		for _, aa := range adminAccounts() {
+			u, valid := verifyMemberToken(
+				adminSessionKind(aa),
+				c.Value,
+			)
+			if valid && u == aa.Username {
+				return principal{
+					Name:      aa.Username,
+					Scopes:    authScopes,
+					csrfToken: csrfToken(c.Value),
+				}, true, true
+			}
+		}
+	}
+
+	username, password, basic := httpRequest(req).BasicAuth()
+	if !basic {
+		return principal{}, false, false
+	}
+
+	if aa, valid := checkAdminPassword(username, password); valid {
+		return principal{
+			Name:      aa.Username,
+			Scopes:    authScopes,
+			csrfToken: csrfToken("basic\x00" + aa.Username),
+		}, true, true
+	}
+
+	return principal{}, false, true
+}
+
+// authorize returns who the req is from and true if it has the scope.
+// Otherwise, it writes the rejection of the req to the res and returns false,
+// along with the error of writing it, if any. The browsers of the people who
+// are not logged in are sent to the login form instead.
+func authorize(
+	req *air.Request,
+	res *air.Response,
+	scope string,
+) (principal, bool, error) {
+	p, ok, presented := authenticate(req)
+	if !ok {
+		if presented {
+			audit(req, "", "auth.failed", 401)
+		} else if req.Method == "GET" &&
+			len(adminAccounts()) > 0 &&
+			acceptQuality(
+				req.Header("accept").Value(),
+				"text/html",
+			) > 0 {
+			return p, false, res.Redirect(sitePath(
+				"/admin/login?next=" +
+					url.QueryEscape(routePath(req)),
+			))
+		}
+
+		res.Status = 401
+		res.SetHeader(
+			"www-authenticate",
+			`Basic realm="admin", charset="UTF-8"`,
+		)
+
+		return p, false, res.WriteString("Unauthorized")
+	}
+
+	if !p.HasScope(scope) {
+		audit(req, p.Actor(), "scope.denied", 403)
+		res.Status = 403
+		return p, false, res.WriteString("Forbidden")
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" && !p.Token {
+		token := req.Header("x-csrf-token").Value()
+		if token == "" {
+			token = paramValue(req, csrfParam)
+		}
+
+		if subtle.ConstantTimeCompare(
+			[]byte(token),
+			[]byte(p.csrfToken),
+		) != 1 {
+			audit(req, p.Actor(), "csrf.failed", 403)
+			res.Status = 403
+			return p, false, res.WriteString("Forbidden")
+		}
+	}
+
+	return p, true, nil
+}
+
+// authGas returns an `air.Gas` that only lets the requests with the scope
+// through. The requests that change anything are recorded in the audit log
+// with their outcomes. The one who sent the req is kept in the "Principal" of
+// the `req.Values`, their name in the "AdminUsername", and the CSRF token its
+// forms need in the "CSRFToken".
+func authGas(scope string) air.Gas {
+	return func(next air.Handler) air.Handler {
+		return func(req *air.Request, res *air.Response) error {
+			if !authEnabled() {
+				return air.NotFoundHandler(req, res)
+			}
+
+			res.SetHeader("cache-control", "no-store")
+			res.SetHeader("x-robots-tag", "noindex")
+
+			p, ok, err := authorize(req, res, scope)
+			if !ok {
+				return err
+			}
+
+			req.Values["Principal"] = p
+			req.Values["AdminUsername"] = p.Name
+			req.Values["CSRFToken"] = p.csrfToken
+
+			err = next(req, res)
+			if req.Method != "GET" && req.Method != "HEAD" {
+				status := res.Status
+				if err != nil && status < 400 {
+					status = 500
+				}
+
+				audit(req, p.Actor(), scope, status)
+			}
+
+			return err
+		}
+	}
+}
+
+// setAdminSessionCookie sets the value of the session cookie of the res, which
+// removes it if the value is empty. It is only sent back to the same site.
+func setAdminSessionCookie(
+	req *air.Request,
+	res *air.Response,
+	value string,
+) {
+	c := &http.Cookie{
+		Name:     adminSessionCookieName,
+		Value:    value,
+		Path:     sitePath("/"),
+		MaxAge:   int(adminSessionMaxAge / time.Second),
+		Secure:   requestScheme(req) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	}
+
+	setCookie(res, c)
+}
+
+func adminLoginHandler(req *air.Request, res *air.Response) error {
+	if len(adminAccounts()) == 0 {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("cache-control", "no-store")
+	res.SetHeader("x-robots-tag", "noindex")
+
+	next := paramValue(req, "next")
+	if !isLocalPath(next) || !strings.HasPrefix(next, "/admin") {
+		next = "/admin/status"
+	}
+
+	if req.Method == "POST" {
+		aa, ok := checkAdminPassword(
+			paramValue(req, "username"),
+			paramValue(req, "password"),
+		)
+		if ok {
+			setAdminSessionCookie(req, res, memberToken(
+				adminSessionKind(aa),
+				aa.Username,
+				time.Now().Add(adminSessionMaxAge),
+			))
+			audit(req, "admin:"+aa.Username, "login", 200)
+			return res.Redirect(sitePath(next))
+		}
+
+		audit(req, "", "login.failed", 401)
+		res.Status = 401
+		req.Values["LoginFailed"] = true
+	}
+
+	req.Values["PageTitle"] = "Log In"
+	req.Values["NoIndex"] = true
+	req.Values["Next"] = next
+
+	return res.Render(
+		req.Values,
+		"admin/login.html",
+		"layouts/default.html",
+	)
+}
+
+func adminLogoutHandler(req *air.Request, res *air.Response) error {
+	setAdminSessionCookie(req, res, "")
+	return res.Redirect(sitePath("/admin/login"))
+}
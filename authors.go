@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// author is an author of the posts, as defined in the `config.AuthorsFile`.
+type author struct {
+	ID     string       `toml:"-"`
+	Name   string       `toml:"name"`
+	Bio    string       `toml:"bio"`
+	Avatar string       `toml:"avatar"`
+	Links  []authorLink `toml:"links"`
+}
+
+// authorLink is a link of an author to elsewhere, such as a profile.
+type authorLink struct {
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+}
+
+// Path returns the path of the page of the a.
+func (a *author) Path() string {
+	return "/authors/" + a.ID
+}
+
+// AvatarURL returns the URL of the avatar of the a, or an empty string if
+// there is none. An avatar under the "/assets/" is fingerprinted.
+func (a *author) AvatarURL() string {
+	if a.Avatar == "" || strings.Contains(a.Avatar, "://") {
+		return a.Avatar
+	}
+
+	return assetURL(a.Avatar)
+}
+
+// loadAuthors returns the authors of the `config.AuthorsFile` by their IDs,
+// which are the names of their tables. A missing file defines no author.
+func loadAuthors() (map[string]*author, error) {
+	as := map[string]*author{}
+	if config.AuthorsFile == "" {
+		return as, nil
+	}
+
+	_, err := toml.DecodeFile(config.AuthorsFile, &as)
+	if os.IsNotExist(err) {
+		return as, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for id, a := range as {
+		a.ID = id
+		if a.Name == "" {
+			a.Name = id
+		}
+	}
+
+	return as, nil
+}
+
+// AuthorProfile returns the author of the p, or nil if the p has none.
+func (p post) AuthorProfile() *author {
+	return p.authorProfile
+}
+
+// postJSONLD returns the JSON-LD of the p as a schema.org "BlogPosting".
+func postJSONLD(p post) map[string]interface{} {
+	ld := map[string]interface{}{
+		"@context":      "https://schema.org",
+		"@type":         "BlogPosting",
+		"headline":      p.Title,
+		"datePublished": p.Datetime,
+		"dateModified":  p.Updated,
+		"url":           postCanonicalURL(p),
+		"mainEntityOfPage": map[string]interface{}{
+			"@type": "WebPage",
+			"@id":   postCanonicalURL(p),
+		},
+	}
+
+	if img := postImageURL(p); img != "" {
+		ld["image"] = img
+	}
+
+	if d := p.MetaDescription(); d != "" {
+		ld["description"] = d
+	}
+
+	if k := p.MetaKeywords(); k != "" {
+		ld["keywords"] = k
+	}
+
+	if a := p.AuthorProfile(); a != nil {
+		ld["author"] = map[string]interface{}{
+			"@type": "Person",
+			"name":  a.Name,
+			"url":   config.BaseURL + a.Path(),
+		}
+	} else {
+		ld["author"] = map[string]interface{}{
+			"@type": "Person",
+			"name":  config.Title,
+			"url":   config.BaseURL + "/",
+		}
+	}
+
+	return ld
+}
+
+func authorHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	a, ok := snap.authors[paramValue(req, "ID")]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	aps := []post{}
+	for _, p := range snap.orderedPosts {
+		if p.Author == a.ID {
+			aps = append(aps, p)
+		}
+	}
+
+	req.Values["PageTitle"] = a.Name
+	req.Values["CanonicalPath"] = a.Path()
+	req.Values["Author"] = a
+	req.Values["Posts"] = aps
+	req.Values["Summaries"] = translatedSummaries(aps, requestLocale(req))
+	return res.Render(req.Values, "author.html", "layouts/default.html")
+}
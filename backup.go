@@ -0,0 +1,502 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// backupDir is a directory that goes into the backup archives under its Name.
+type backupDir struct {
+	Name string
+	Root string
+}
+
+// backupDirs returns the directories that go into the backup archives as they
+// are. The posts, their comments and their view counts go in through the
+// `store` instead, so that they are backed up whichever store holds them.
+func backupDirs() []backupDir {
+	return []backupDir{
+		{Name: "pages", Root: pageRoot},
+		{Name: "uploads", Root: config.UploadRoot},
+		{Name: "data", Root: config.DataRoot},
+	}
+}
+
+// backupConfigFiles returns the configuration files that go into the backup
+// archives, by their names in the archives.
+func backupConfigFiles() map[string]string {
+	cfs := map[string]string{"config/config.toml": air.ConfigFile}
+	if config.AuthorsFile != "" {
+		cfs["config/authors.toml"] = config.AuthorsFile
+	}
+
+	if config.RelatedFile != "" {
+		cfs["config/related.toml"] = config.RelatedFile
+	}
+
+	if config.BlogrollFile != "" {
+		cfs["config/blogroll.toml"] = config.BlogrollFile
+	}
+
+	return cfs
+}
+
+// isBackedUpThroughStore reports whether the file of the name under the
+// `config.DataRoot` is what the `store` backs up by itself, and is left out
+// of the "data" of the backup archives.
+func isBackedUpThroughStore(name string) bool {
+	if name == "views.json" || name == "reactions.json" ||
+		strings.HasPrefix(name, "comments/") {
+		return true
+	}
+
+	rel, err := filepath.Rel(config.DataRoot, config.SQLitePath)
+
+	return err == nil && (name == filepath.ToSlash(rel) ||
+		strings.HasPrefix(name, filepath.ToSlash(rel)+"-"))
+}
+
+// writeBackup writes the backup archive of the blog into the w as a zip.
+func writeBackup(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(b)
+
+		return err
+	}
+
+	sps, err := store.Posts()
+	if err != nil {
+		return err
+	}
+
+	for _, sp := range sps {
+		if sp.Err != nil {
+			return fmt.Errorf(
+				"failed to read %s: %v",
+				sp.File,
+				sp.Err,
+			)
+		}
+
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     "posts/" + sp.ID + ".md",
+			Method:   zip.Deflate,
+			Modified: sp.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(sp.Source); err != nil {
+			return err
+		}
+	}
+
+	commentsMutex.RLock()
+	cs, err := store.AllComments()
+	commentsMutex.RUnlock()
+	if err != nil {
+		return err
+	} else if err := writeJSON("comments.json", cs); err != nil {
+		return err
+	}
+
+	if err := saveViews(); err != nil {
+		return err
+	}
+
+	vs, err := store.Views()
+	if err != nil {
+		return err
+	} else if err := writeJSON("views.json", vs); err != nil {
+		return err
+	}
+
+	if err := saveReactions(); err != nil {
+		return err
+	}
+
+	rc, err := store.Reactions()
+	if err != nil {
+		return err
+	} else if err := writeJSON("reactions.json", rc); err != nil {
+		return err
+	}
+
+	for _, bd := range backupDirs() {
+		if bd.Root == "" {
+			continue
+		}
+
+		if err := filepath.Walk(bd.Root, func(
+			filename string,
+			fi os.FileInfo,
+			err error,
+		) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			} else if !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(bd.Root, filename)
+			if err != nil {
+				return err
+			}
+
+			rel = filepath.ToSlash(rel)
+			if bd.Name == "data" && isBackedUpThroughStore(rel) ||
+				strings.HasSuffix(rel, ".tmp") {
+				return nil
+			}
+
+			return addFileToZip(zw, bd.Name+"/"+rel, filename, fi)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for name, filename := range backupConfigFiles() {
+		fi, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := addFileToZip(zw, name, filename, fi); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// addFileToZip adds the file of the filename and the fi to the zw as the name.
+func addFileToZip(zw *zip.Writer, name, filename string, fi os.FileInfo) error {
+	fh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+
+	fh.Name = name
+	fh.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
+
+// importPlan is what an archive brings in, checked before anything of it is
+// unpacked.
+type importPlan struct {
+	posts     map[string][]byte
+	files     map[string]*zip.File
+	comments  []comment
+	views     *viewStats
+	reactions reactionCounts
+}
+
+// planImport checks the archive of the zr and returns what it brings in. It
+// fails on anything that doesn't belong in a backup archive, such as the
+// names that step out of their directories.
+func planImport(zr *zip.Reader) (*importPlan, error) {
+	ip := &importPlan{
+		posts: map[string][]byte{},
+		files: map[string]*zip.File{},
+	}
+
+	roots := map[string]string{}
+	for _, bd := range backupDirs() {
+		roots[bd.Name] = bd.Root
+	}
+
+	cfs := backupConfigFiles()
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		name := path.Clean(f.Name)
+		if name != f.Name || path.IsAbs(name) || name == ".." ||
+			strings.HasPrefix(name, "../") ||
+			strings.Contains(name, "\\") {
+			return nil, fmt.Errorf("bad file name %q", f.Name)
+		} else if !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("irregular file %q", f.Name)
+		}
+
+		dir := strings.SplitN(name, "/", 2)[0]
+		switch {
+		case name == "comments.json":
+			if err := readZipJSON(f, &ip.comments); err != nil {
+				return nil, fmt.Errorf("bad %s: %v", name, err)
+			}
+		case name == "views.json":
+			ip.views = &viewStats{}
+			if err := readZipJSON(f, ip.views); err != nil {
+				return nil, fmt.Errorf("bad %s: %v", name, err)
+			}
+		case name == "reactions.json":
+			ip.reactions = reactionCounts{}
+			if err := readZipJSON(f, &ip.reactions); err != nil {
+				return nil, fmt.Errorf("bad %s: %v", name, err)
+			}
+		case dir == "posts" && strings.HasSuffix(name, ".md"):
+			b, err := readZipFile(f)
+			if err != nil {
+				return nil, err
+			} else if _, _, err := splitFrontMatter(b); err != nil {
+				return nil, fmt.Errorf("bad %s: %v", name, err)
+			}
+
+			ip.posts[strings.TrimSuffix(
+				strings.TrimPrefix(name, "posts/"),
+				".md",
+			)] = b
+		case cfs[name] != "":
+			ip.files[cfs[name]] = f
+		case roots[dir] != "":
+			rel := strings.TrimPrefix(name, dir+"/")
+			fn := filepath.Join(roots[dir], filepath.FromSlash(rel))
+
+			// The audit log tells what has been done here, the
+			// import included, so no archive may rewrite it.
+			if fn == auditLogFilename() {
+				continue
+			}
+
+			ip.files[fn] = f
+		default:
+			return nil, fmt.Errorf("unexpected file %q", f.Name)
+		}
+	}
+
+	return ip, nil
+}
+
+// readZipFile returns the content of the f.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// readZipJSON decodes the JSON content of the f into the v.
+func readZipJSON(f *zip.File, v interface{}) error {
+	b, err := readZipFile(f)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// runImport unpacks what the ip brings in. The posts that already exist are
+// kept as they are, and the other files are overwritten. It returns the
+// number of the posts and the files unpacked.
+func runImport(ip *importPlan) (int, int, error) {
+	sps, err := store.Posts()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	existing := make(map[string]bool, len(sps))
+	for _, sp := range sps {
+		existing[sp.ID] = true
+	}
+
+	ids := make([]string, 0, len(ip.posts))
+	for id := range ip.posts {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	posts := 0
+	for _, id := range ids {
+		if existing[id] {
+			continue
+		}
+
+		if err := store.PublishPost(id, ip.posts[id]); err != nil {
+			return posts, 0, fmt.Errorf(
+				"failed to import post %s: %v",
+				id,
+				err,
+			)
+		}
+
+		posts++
+	}
+
+	files := 0
+	for filename, f := range ip.files {
+		b, err := readZipFile(f)
+		if err != nil {
+			return posts, files, err
+		}
+
+		if err := writeFileAtomically(filename, b); err != nil {
+			return posts, files, err
+		}
+
+		files++
+	}
+
+	if ip.comments != nil {
+		pcs := map[string][]comment{}
+		for _, c := range ip.comments {
+			pcs[c.PostID] = append(pcs[c.PostID], c)
+		}
+
+		commentsMutex.Lock()
+		for postID, cs := range pcs {
+			if err := store.SaveComments(postID, cs); err != nil {
+				commentsMutex.Unlock()
+				return posts, files, err
+			}
+		}
+		commentsMutex.Unlock()
+	}
+
+	if ip.views != nil {
+		if err := store.SaveViews(*ip.views); err != nil {
+			return posts, files, err
+		}
+
+		if err := loadViews(); err != nil {
+			return posts, files, err
+		}
+	}
+
+	if ip.reactions != nil {
+		if err := store.SaveReactions(ip.reactions); err != nil {
+			return posts, files, err
+		}
+
+		if err := loadReactions(); err != nil {
+			return posts, files, err
+		}
+	}
+
+	return posts, files, nil
+}
+
+func adminExportHandler(req *air.Request, res *air.Response) error {
+	res.SetHeader("content-type", "application/zip")
+	res.SetHeader(
+		"content-disposition",
+		fmt.Sprintf(
+			`attachment; filename="blog-%s.zip"`,
+			time.Now().UTC().Format("20060102-150405"),
+		),
+	)
+	res.SetHeader("cache-control", "no-store")
+
+	if err := writeBackup(httpResponseWriter(req, res)); err != nil {
+		// The headers are gone by now, so the best that can be done is
+		// to cut the archive short and log why.
+		air.ERROR(
+			"failed to export backup",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+	}
+
+	return nil
+}
+
+var importMutex sync.Mutex
+
+func adminImportHandler(req *air.Request, res *air.Response) error {
+	f, _, err := httpRequest(req).FormFile("archive")
+	if err != nil {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile("", "blog-import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, f)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		res.Status = 400
+		return fmt.Errorf("bad archive: %v", err)
+	}
+
+	ip, err := planImport(zr)
+	if err != nil {
+		res.Status = 400
+		return err
+	}
+
+	importMutex.Lock()
+	posts, files, err := runImport(ip)
+	importMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reloadPosts()
+	bumpContentVersion()
+
+	return res.WriteString(fmt.Sprintf(
+		"imported %d posts and %d files\n",
+		posts,
+		files,
+	))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// basePath is the path prefix that the blog is served under, such as the
+// "/blog" of the "https://example.com/blog/". It is empty for the root.
+var basePath string
+
+// setupBasePath sets the `basePath` from the `config.BasePath`, or from the
+// path of the `config.BaseURL` if there isn't one, and makes the path of the
+// `config.BaseURL` be it.
+func setupBasePath() {
+	bp := config.BasePath
+	if bp == "" {
+		bp = canonicalURL.Path
+	}
+
+	bp = strings.TrimSuffix(bp, "/")
+	if bp != "" && !strings.HasPrefix(bp, "/") {
+		bp = "/" + bp
+	}
+
+	basePath = bp
+	canonicalURL.Path = bp
+	config.BaseURL = canonicalURL.String()
+}
+
+// sitePath returns the p (a path of a route) as seen from the outside, that
+// is, under the `basePath`.
+func sitePath(p string) string {
+	return basePath + p
+}
+
+// routePath returns the path of the req that the routing goes by, which is
+// the path of the req without the `basePath` and after the rewrites of the
+// pregases.
+func routePath(req *air.Request) string {
+	return httpRequest(req).URL.Path
+}
+
+// basePathGas is an `air.Gas` that strips the `basePath` off the requests
+// before the routing, so that the routes are registered as if the blog was
+// served at the root. It must be a pregas.
+func basePathGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if basePath == "" {
+			return next(req, res)
+		}
+
+		for _, p := range canonicalExemptPaths {
+			if strings.HasPrefix(req.Path, p) {
+				return next(req, res)
+			}
+		}
+
+		u := httpRequest(req).URL
+		if u.Path == basePath {
+			res.Status = 301
+			return res.Redirect(basePath + "/")
+		} else if !strings.HasPrefix(u.Path, basePath+"/") {
+			return air.NotFoundHandler(req, res)
+		}
+
+		u.Path = strings.TrimPrefix(u.Path, basePath)
+		u.RawPath = ""
+
+		return next(req, res)
+	}
+}
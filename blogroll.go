@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// blogrollEntry is a blog followed, as listed in the `config.BlogrollFile`.
+type blogrollEntry struct {
+	Title       string `toml:"title"`
+	Feed        string `toml:"feed"`
+	Site        string `toml:"site"`
+	Description string `toml:"description"`
+}
+
+// loadBlogroll returns the blogs of the `config.BlogrollFile`, a TOML file
+// such as:
+//
+//	[[blogs]]
+//	title = "Samwell Tarly"
+//	feed = "https://samwell.citadel.example/feed"
+//	site = "https://samwell.citadel.example"
+//
+// A missing file lists no blog.
+func loadBlogroll() ([]blogrollEntry, error) {
+	if config.BlogrollFile == "" {
+		return nil, nil
+	}
+
+	var br struct {
+		Blogs []blogrollEntry `toml:"blogs"`
+	}
+
+	_, err := toml.DecodeFile(config.BlogrollFile, &br)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, b := range br.Blogs {
+		if b.Feed == "" {
+			return nil, fmt.Errorf("blog %d has no feed", i+1)
+		}
+
+		if b.Title == "" {
+			br.Blogs[i].Title = b.Feed
+		}
+	}
+
+	return br.Blogs, nil
+}
+
+// opml is an OPML 2.0 document.
+type opml struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated,omitempty"`
+	Owner   string        `xml:"head>ownerName,omitempty"`
+	Outline []opmlOutline `xml:"body>outline"`
+}
+
+// opmlOutline is an outline of an `opml`.
+type opmlOutline struct {
+	Type        string `xml:"type,attr"`
+	Text        string `xml:"text,attr"`
+	Title       string `xml:"title,attr,omitempty"`
+	XMLURL      string `xml:"xmlUrl,attr"`
+	HTMLURL     string `xml:"htmlUrl,attr,omitempty"`
+	Description string `xml:"description,attr,omitempty"`
+}
+
+func blogrollOPMLHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	o := opml{
+		Version: "2.0",
+		Title:   config.Title + " " + req.LocalizedString("Blogroll"),
+		Created: snap.blogrollUpdated.Format(time.RFC1123Z),
+		Owner:   config.Title,
+	}
+	for _, b := range snap.blogroll {
+		o.Outline = append(o.Outline, opmlOutline{
+			Type:        "rss",
+			Text:        b.Title,
+			Title:       b.Title,
+			XMLURL:      b.Feed,
+			HTMLURL:     b.Site,
+			Description: b.Description,
+		})
+	}
+
+	b, err := xml.MarshalIndent(o, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "text/x-opml; charset=utf-8")
+
+	return res.WriteBlob(append([]byte(xml.Header), b...))
+}
+
+func blogrollHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	req.Values["PageTitle"] = req.LocalizedString("Blogroll")
+	req.Values["CanonicalPath"] = "/blogroll"
+	req.Values["Blogroll"] = snap.blogroll
+	req.Values["BlogrollOPMLURL"] = sitePath("/blogroll.opml")
+	return res.Render(req.Values, "blogroll.html", "layouts/default.html")
+}
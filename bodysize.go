@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// defaultBodySizeLimit is the body size limit of "/" unless configured.
+const defaultBodySizeLimit = 1 << 20
+
+// errBodyTooLarge is the error of reading past the body size limit.
+var errBodyTooLarge = errors.New("Request Entity Too Large")
+
+// checkBodySizeLimits checks the `config.BodySizeLimits`, which get the
+// `defaultBodySizeLimit` as the one of "/" if they have none.
+func checkBodySizeLimits() error {
+	if _, ok := config.BodySizeLimits["/"]; !ok {
+		if config.BodySizeLimits == nil {
+			config.BodySizeLimits = map[string]int64{}
+		}
+
+		config.BodySizeLimits["/"] = defaultBodySizeLimit
+	}
+
+	for prefix, n := range config.BodySizeLimits {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("bad body size prefix %q", prefix)
+		} else if n <= 0 {
+			return fmt.Errorf("bad body size limit of %s", prefix)
+		}
+	}
+
+	return nil
+}
+
+// bodySizeLimit returns the maximum number of the bytes of the bodies of the
+// requests to the path, which is that of the longest of the path prefixes of
+// the `config.BodySizeLimits` that the path has.
+func bodySizeLimit(path string) int64 {
+	longest := ""
+	for prefix := range config.BodySizeLimits {
+		if strings.HasPrefix(path, prefix) &&
+			len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+
+	return config.BodySizeLimits[longest]
+}
+
+// limitedBody is a request body that can't be read past its limit.
+type limitedBody struct {
+	io.ReadCloser
+
+	remaining int64
+	exceeded  bool
+}
+
+// Read implements the `io.Reader`.
+func (lb *limitedBody) Read(b []byte) (int, error) {
+	// One byte more than what remains is read, to find out whether
+	// there is more.
+	if int64(len(b)) > lb.remaining+1 {
+		b = b[:lb.remaining+1]
+	}
+
+	n, err := lb.ReadCloser.Read(b)
+	if int64(n) > lb.remaining {
+		n = int(lb.remaining)
+		lb.remaining = 0
+		lb.exceeded = true
+		return n, errBodyTooLarge
+	}
+
+	lb.remaining -= int64(n)
+
+	return n, err
+}
+
+// bodySizeGas is an `air.Gas` that limits the size of the request bodies as
+// the `bodySizeLimit` says. The requests over the limit are answered with a
+// 413, whether that is known from their "Content-Length" or only found out
+// while their bodies are read. It must be a pregas.
+func bodySizeGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		hr := httpRequest(req)
+		limit := bodySizeLimit(hr.URL.Path)
+		req.Values["BodySizeLimit"] = limit
+		if hr.ContentLength > limit {
+			res.Status = 413
+			return errBodyTooLarge
+		}
+
+		lb := &limitedBody{
+			ReadCloser: hr.Body,
+			remaining:  limit,
+		}
+		hr.Body = lb
+
+		err := next(req, res)
+		if lb.exceeded && !res.Written {
+			res.Status = 413
+			return errBodyTooLarge
+		}
+
+		return err
+	}
+}
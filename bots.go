@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// humanBotClass is the name of the class of the requests that match no other
+// class.
+const humanBotClass = "human"
+
+// botClass is a class of clients told apart by their user agents, such as the
+// search bots, the feed readers and the AI crawlers.
+type botClass struct {
+	Name       string   `toml:"name"`
+	UserAgents []string `toml:"user_agents"`
+
+	// Policy is one of "allow", "rate-limit" and "block".
+	Policy string `toml:"policy"`
+
+	// Robots is sent as the "X-Robots-Tag" to the class.
+	Robots string `toml:"robots"`
+
+	// Rate and Burst limit all the requests of the class together when
+	// the Policy is "rate-limit".
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+var (
+	botClassBucketsMutex sync.Mutex
+	botClassBuckets      = map[string]*tokenBucket{}
+)
+
+// checkBotClasses reports whether the `config.BotClasses` make sense.
+func checkBotClasses() error {
+	names := map[string]bool{humanBotClass: true}
+	for _, bc := range config.BotClasses {
+		if bc.Name == "" || names[bc.Name] {
+			return fmt.Errorf("bot class name %q is taken", bc.Name)
+		}
+
+		names[bc.Name] = true
+
+		switch bc.Policy {
+		case "", "allow", "block":
+		case "rate-limit":
+			if bc.Rate <= 0 || bc.Burst < 1 {
+				return fmt.Errorf(
+					"bot class %s has no rate or burst",
+					bc.Name,
+				)
+			}
+		default:
+			return fmt.Errorf(
+				"bot class %s has unknown policy %q",
+				bc.Name,
+				bc.Policy,
+			)
+		}
+	}
+
+	return nil
+}
+
+// classifyUserAgent returns the class of the ua. The first class with a
+// matching user agent wins.
+func classifyUserAgent(ua string) *botClass {
+	ua = strings.ToLower(ua)
+	for i := range config.BotClasses {
+		bc := &config.BotClasses[i]
+		for _, s := range bc.UserAgents {
+			if strings.Contains(ua, strings.ToLower(s)) {
+				return bc
+			}
+		}
+	}
+
+	return nil
+}
+
+// takeBotClassToken reports whether the bc may send one more request, and if
+// not, how many seconds it has to wait.
+func takeBotClassToken(bc *botClass) (bool, float64) {
+	now := time.Now()
+	burst := float64(bc.Burst)
+
+	botClassBucketsMutex.Lock()
+	defer botClassBucketsMutex.Unlock()
+
+	tb, ok := botClassBuckets[bc.Name]
+	if !ok {
+		tb = &tokenBucket{
+			tokens: burst,
+			last:   now,
+		}
+		botClassBuckets[bc.Name] = tb
+	}
+
+	elapsed := now.Sub(tb.last).Seconds()
+	tb.tokens = math.Min(burst, tb.tokens+elapsed*bc.Rate)
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+
+	return false, (1 - tb.tokens) / bc.Rate
+}
+
+// botGas is an `air.Gas` that classifies the requests by their user agents
+// and applies the policies of their classes.
+func botGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		bc := classifyUserAgent(req.Header("user-agent").Value())
+		if bc == nil {
+			req.Values["BotClass"] = humanBotClass
+			metricsBotClassRequest(humanBotClass, "allowed")
+			return next(req, res)
+		}
+
+		req.Values["BotClass"] = bc.Name
+		if bc.Robots != "" {
+			res.SetHeader("x-robots-tag", bc.Robots)
+		}
+
+		switch bc.Policy {
+		case "block":
+			// The robots.txt is what tells them to go away.
+			if routePath(req) == "/robots.txt" {
+				break
+			}
+
+			metricsBotClassRequest(bc.Name, "blocked")
+			res.Status = 403
+			return errors.New("Forbidden")
+		case "rate-limit":
+			ok, wait := takeBotClassToken(bc)
+			if !ok {
+				metricsBotClassRequest(bc.Name, "limited")
+				res.Status = 429
+				res.SetHeader(
+					"retry-after",
+					strconv.Itoa(int(math.Ceil(wait))),
+				)
+
+				return res.WriteString("Too Many Requests")
+			}
+		}
+
+		metricsBotClassRequest(bc.Name, "allowed")
+
+		return next(req, res)
+	}
+}
+
+// robotsHandler serves the "robots.txt", followed by a group that disallows
+// everything for each user agent of the blocked classes and the sitemap.
+func robotsHandler(req *air.Request, res *air.Response) error {
+	b, err := readFileOrEmbedded("robots.txt")
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(b)
+	for _, bc := range config.BotClasses {
+		if bc.Policy != "block" || len(bc.UserAgents) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(buf, "\n# %s\n", bc.Name)
+		for _, ua := range bc.UserAgents {
+			fmt.Fprintf(buf, "User-Agent: %s\n", ua)
+		}
+
+		buf.WriteString("Disallow: /\n")
+	}
+
+	fmt.Fprintf(buf, "\nSitemap: %s/sitemap.xml\n", config.BaseURL)
+
+	res.SetHeader("content-type", "text/plain; charset=utf-8")
+
+	return res.WriteBlob(buf.Bytes())
+}
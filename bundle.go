@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"github.com/tdewolff/minify"
+	"github.com/tdewolff/minify/css"
+	"github.com/tdewolff/minify/js"
+)
+
+// bundleConfig is a configured bundle of the assets. The Name ends in either
+// ".css" or ".js", and the Files are the asset paths of the same kind to be
+// concatenated in order.
+type bundleConfig struct {
+	Name  string   `toml:"name"`
+	Files []string `toml:"files"`
+}
+
+// bundle is a bundle of the assets ready to be served.
+type bundle struct {
+	Name string
+	Type string
+	Data []byte
+	Hash string
+}
+
+// defaultBundles is the bundles used when the `config.Bundles` is empty.
+var defaultBundles = []bundleConfig{
+	{Name: "main.css", Files: []string{"/assets/css/main.css"}},
+	{Name: "main.js", Files: []string{"/assets/js/main.js"}},
+}
+
+// cssURLRE matches the "url()" in the CSS.
+var cssURLRE = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+var (
+	bundlesMutex sync.RWMutex
+	bundles      = map[string]*bundle{}
+)
+
+// buildBundles builds the bundles of the `config.Bundles` from the current
+// assets. A bundle that fails to build keeps its previous version.
+func buildBundles() {
+	bcs := config.Bundles
+	if len(bcs) == 0 {
+		bcs = defaultBundles
+	}
+
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+
+	nbs := map[string]*bundle{}
+	for _, bc := range bcs {
+		b, err := buildBundle(m, bc)
+		if err != nil {
+			air.ERROR(
+				"failed to build bundle",
+				map[string]interface{}{
+					"bundle": bc.Name,
+					"error":  err.Error(),
+				},
+			)
+
+			bundlesMutex.RLock()
+			b = bundles[bc.Name]
+			bundlesMutex.RUnlock()
+			if b == nil {
+				continue
+			}
+		}
+
+		nbs[bc.Name] = b
+	}
+
+	bundlesMutex.Lock()
+	bundles = nbs
+	bundlesMutex.Unlock()
+}
+
+// buildBundle concatenates and minifies the files of the bc with the m.
+func buildBundle(m *minify.M, bc bundleConfig) (*bundle, error) {
+	mediaType := ""
+	separator := ""
+	switch path.Ext(bc.Name) {
+	case ".css":
+		mediaType, separator = "text/css", "\n"
+	case ".js":
+		mediaType, separator = "application/javascript", ";\n"
+	default:
+		return nil, fmt.Errorf("unsupported bundle name %q", bc.Name)
+	}
+
+	buf := bytes.Buffer{}
+	for _, f := range bc.Files {
+		b, err := ioutil.ReadFile(assetFilename(f))
+		if err != nil {
+			return nil, err
+		}
+
+		if mediaType == "text/css" {
+			b = rebaseCSSURLs(b, f)
+		}
+
+		buf.Write(b)
+		buf.WriteString(separator)
+	}
+
+	mb, err := m.Bytes(mediaType, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundle{
+		Name: bc.Name,
+		Type: mime.TypeByExtension(path.Ext(bc.Name)),
+		Data: mb,
+		Hash: fmt.Sprintf("%x", md5.Sum(mb))[:8],
+	}, nil
+}
+
+// rebaseCSSURLs makes the relative "url()" in the CSS b of the asset at the p
+// absolute, so that they still work once the b is bundled. The ones to the
+// other assets are fingerprinted.
+func rebaseCSSURLs(b []byte, p string) []byte {
+	return cssURLRE.ReplaceAllFunc(b, func(m []byte) []byte {
+		sm := cssURLRE.FindSubmatch(m)
+		u := string(sm[2])
+		if strings.HasPrefix(u, "/") ||
+			strings.HasPrefix(u, "#") ||
+			strings.Contains(u, ":") {
+			return m
+		}
+
+		up := path.Join(path.Dir(p), u)
+		suffix := ""
+		if i := strings.IndexAny(up, "?#"); i >= 0 {
+			up, suffix = up[:i], up[i:]
+		}
+
+		return []byte(fmt.Sprintf(
+			"url(%s%s%s%s)",
+			sm[1],
+			assetURL(up),
+			suffix,
+			sm[3],
+		))
+	})
+}
+
+// bundleURL returns the fingerprinted URL of the bundle of the name, or an
+// empty string if there is no such bundle. The URL is under the `basePath`.
+func bundleURL(name string) string {
+	bundlesMutex.RLock()
+	b, ok := bundles[name]
+	bundlesMutex.RUnlock()
+	if !ok {
+		return ""
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	return sitePath("/bundles/" + base + "." + b.Hash + ext)
+}
+
+func bundleHandler(req *air.Request, res *air.Response) error {
+	name := paramValue(req, "Name")
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	hash := ""
+	if i := strings.LastIndexByte(base, '.'); i >= 0 {
+		hash = base[i+1:]
+	}
+
+	bundlesMutex.RLock()
+	b, ok := bundles[name]
+	if !ok && hash != "" {
+		b, ok = bundles[strings.TrimSuffix(base, "."+hash)+ext]
+	}
+	bundlesMutex.RUnlock()
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if hash == b.Hash {
+		res.SetHeader("cache-control", "max-age=31536000, immutable")
+	} else {
+		res.SetHeader("cache-control", "max-age=3600")
+	}
+
+	res.SetHeader("content-type", b.Type)
+	res.SetHeader("etag", `"`+b.Hash+`"`)
+
+	return res.WriteBlob(b.Data)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// trackingParamPrefix is the prefix of the tracking params of the campaigns,
+// such as the "utm_source".
+const trackingParamPrefix = "utm_"
+
+// trackingClickParams is the tracking params of the ad clicks, by the sources
+// they tell.
+var trackingClickParams = map[string]string{
+	"fbclid": "facebook",
+	"gclid":  "google",
+}
+
+// isTrackingParam reports whether the name is of a tracking param.
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	_, ok := trackingClickParams[name]
+
+	return ok || strings.HasPrefix(name, trackingParamPrefix)
+}
+
+// campaignKey returns the key of the campaign that the tracking params of the
+// q tell, which is its source, its medium and its name, or an empty string if
+// they tell none.
+func campaignKey(q url.Values) string {
+	source := q.Get("utm_source")
+	if source == "" {
+		for name, s := range trackingClickParams {
+			if _, ok := q[name]; ok {
+				source = s
+				break
+			}
+		}
+	}
+
+	if source == "" {
+		return ""
+	}
+
+	parts := []string{source, q.Get("utm_medium"), q.Get("utm_campaign")}
+	for i, p := range parts {
+		if p = strings.ToLower(strings.TrimSpace(p)); p == "" {
+			p = "-"
+		}
+
+		parts[i] = p
+	}
+
+	return strings.Join(parts, " / ")
+}
+
+// countCampaign counts a visit from the campaign of the key.
+func countCampaign(key string) {
+	viewsMutex.Lock()
+	defer viewsMutex.Unlock()
+
+	views.Campaigns[key]++
+	viewsDirty = true
+}
+
+// trackingParamsGas is an `air.Gas` that permanently redirects the GET and the
+// HEAD requests with the tracking params, such as the "utm_source" and the
+// "fbclid", to their URLs without them, so that the pages are cached and
+// indexed by one URL. The campaigns that the humans come from are counted
+// along with the views. It must be a pregas after the `botGas` and the
+// `normalizePathGas`.
+func trackingParamsGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !config.TrackingParamsStripped ||
+			req.Method != "GET" && req.Method != "HEAD" {
+			return next(req, res)
+		}
+
+		u := httpRequest(req).URL
+		if u.RawQuery == "" {
+			return next(req, res)
+		}
+
+		q := u.Query()
+		key := campaignKey(q)
+		n := len(q)
+		for name := range q {
+			if isTrackingParam(name) {
+				q.Del(name)
+			}
+		}
+
+		if len(q) == n {
+			return next(req, res)
+		}
+
+		if key != "" && config.ViewCounterEnabled &&
+			req.Values["BotClass"] == humanBotClass {
+			countCampaign(key)
+		}
+
+		location := sitePath(u.Path)
+		if len(q) > 0 {
+			location += "?" + q.Encode()
+		}
+
+		res.Status = 301
+
+		return res.Redirect(location)
+	}
+}
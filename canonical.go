@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// canonicalExemptPaths is the paths that are served on any host and scheme,
+// since they are asked for by machines that don't follow redirects.
+var canonicalExemptPaths = []string{
+	"/.well-known/acme-challenge/",
+	"/healthz",
+	"/readyz",
+	"/metrics",
+}
+
+// canonicalURL is the parsed `config.BaseURL`.
+var canonicalURL *url.URL
+
+// parseCanonicalURL parses the `config.BaseURL` into the `canonicalURL`.
+func parseCanonicalURL() error {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	u, err := url.Parse(config.BaseURL)
+	if err != nil {
+		return err
+	}
+
+	canonicalURL = u
+
+	return nil
+}
+
+// requestScheme returns the scheme that the client of the req used. The
+// "X-Forwarded-Proto" is only believed when sent by a trusted proxy.
+func requestScheme(req *air.Request) string {
+	host, _, err := net.SplitHostPort(httpRequest(req).RemoteAddr)
+	if err != nil {
+		host = httpRequest(req).RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && isTrustedProxy(ip) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(
+			req.Header("x-forwarded-proto").Value(),
+			",",
+		)[0]))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+
+	return req.Scheme
+}
+
+// canonicalHostGas is an `air.Gas` that permanently redirects the requests
+// made to any other host or scheme than the ones of the `config.BaseURL`
+// there.
+func canonicalHostGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		for _, p := range canonicalExemptPaths {
+			if strings.HasPrefix(req.Path, p) {
+				return next(req, res)
+			}
+		}
+
+		if strings.EqualFold(req.Authority, canonicalURL.Host) &&
+			requestScheme(req) == canonicalURL.Scheme {
+			return next(req, res)
+		}
+
+		res.Status = 301
+
+		return res.Redirect(fmt.Sprintf(
+			"%s://%s%s",
+			canonicalURL.Scheme,
+			canonicalURL.Host,
+			req.Path,
+		))
+	}
+}
+
+// checkCanonical checks that the canonical URL c of a post, if any, is an
+// absolute HTTP(S) URL.
+func checkCanonical(c string) error {
+	if c == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c)
+	if err != nil {
+		return fmt.Errorf("bad canonical url: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("canonical url %q is not absolute", c)
+	}
+
+	return nil
+}
+
+// postCanonicalURL returns the canonical URL of the p, which is its own
+// `Canonical` if it is republished from elsewhere.
+func postCanonicalURL(p post) string {
+	if p.Canonical != "" {
+		return p.Canonical
+	}
+
+	return config.BaseURL + p.Permalink
+}
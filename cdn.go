@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// Surrogate keys shared by many responses.
+const (
+	surrogateKeySite    = "site"
+	surrogateKeyListing = "listing"
+	surrogateKeyFeed    = "feed"
+	surrogateKeySitemap = "sitemap"
+)
+
+// cdnPurgeBatchSize is the maximum number of the surrogate keys purged by a
+// single request to the CDN.
+var cdnPurgeBatchSize = map[string]int{
+	"fastly":     256,
+	"cloudflare": 30,
+}
+
+// checkCDNProvider checks the `config.CDNProvider`.
+func checkCDNProvider() error {
+	if _, ok := cdnPurgeBatchSize[config.CDNProvider]; !ok &&
+		config.CDNProvider != "" {
+		return fmt.Errorf("unknown cdn provider %q", config.CDNProvider)
+	}
+
+	return nil
+}
+
+// postSurrogateKey returns the surrogate key of the post of the id.
+func postSurrogateKey(id string) string {
+	return "post-" + id
+}
+
+// pageSurrogateKey returns the surrogate key of the page of the slug.
+func pageSurrogateKey(slug string) string {
+	return "page-" + slug
+}
+
+// surrogateKeys returns the surrogate keys of the response to the req, by
+// which it is purged from the CDN. Every response has the `surrogateKeySite`.
+func surrogateKeys(req *air.Request) []string {
+	snap := loadedPosts()
+
+	keys := []string{surrogateKeySite}
+
+	p := routePath(req)
+	switch {
+	case strings.HasPrefix(p, "/posts/"):
+		id := strings.TrimPrefix(p, "/posts/")
+		switch ext := path.Ext(id); ext {
+		case ".md", ".txt", ".pdf":
+			id = strings.TrimSuffix(id, ext)
+		default:
+			id = strings.TrimSuffix(id, "/lite")
+		}
+
+		keys = append(keys, postSurrogateKey(id))
+	case p == "/", p == "/posts", p == "/search", p == "/today",
+		strings.HasPrefix(p, "/authors/"),
+		strings.HasPrefix(p, "/series/"):
+		keys = append(keys, surrogateKeyListing)
+	case p == "/feed", strings.HasPrefix(p, "/feeds/"):
+		keys = append(keys, surrogateKeyFeed)
+	case p == "/sitemap.xml", strings.HasPrefix(p, "/sitemaps/"):
+		keys = append(keys, surrogateKeySitemap)
+	case !strings.Contains(p[1:], "/"):
+		if _, ok := snap.pages[p[1:]]; ok {
+			keys = append(keys, pageSurrogateKey(p[1:]))
+		}
+	}
+
+	return keys
+}
+
+// surrogateKeyGas is an `air.Gas` that tags the responses with their
+// `surrogateKeys` in the "Surrogate-Key" of the Fastly and the "Cache-Tag" of
+// the Cloudflare. With the `config.CDNMaxAge`, it also lets the CDN keep the
+// public responses that long, since they are purged as soon as they change.
+func surrogateKeyGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if config.CDNProvider == "" {
+			return next(req, res)
+		}
+
+		keys := surrogateKeys(req)
+		res.SetHeader("surrogate-key", strings.Join(keys, " "))
+		res.SetHeader("cache-tag", strings.Join(keys, ","))
+
+		if config.CDNMaxAge > 0 &&
+			(req.Method == "GET" || req.Method == "HEAD") &&
+			req.Header("authorization").Value() == "" &&
+			!hasPostAccessCookies(req) {
+			setHTTPResponseWriter(req, res, &surrogateControlWriter{
+				ResponseWriter: httpResponseWriter(req, res),
+				maxAge:         config.CDNMaxAge,
+			})
+		}
+
+		return next(req, res)
+	}
+}
+
+// surrogateControlWriter is an `http.ResponseWriter` that tells the CDN how
+// long to keep the response, unless it turns out to be private.
+type surrogateControlWriter struct {
+	http.ResponseWriter
+
+	maxAge      int
+	wroteHeader bool
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (w *surrogateControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		cc := strings.ToLower(w.Header().Get("cache-control"))
+		if !strings.Contains(cc, "private") &&
+			!strings.Contains(cc, "no-store") &&
+			w.Header().Get("set-cookie") == "" {
+			v := fmt.Sprintf("max-age=%d", w.maxAge)
+			w.Header().Set("surrogate-control", v)
+			w.Header().Set("cdn-cache-control", v)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (w *surrogateControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// changedSurrogateKeys returns the surrogate keys of what changed from the
+// ops and the opgs to the nps and the npgs, the old and the new posts and
+// pages.
+func changedSurrogateKeys(
+	ops, nps map[string]post,
+	opgs, npgs map[string]page,
+) []string {
+	keys := []string{}
+	for id, np := range nps {
+		op, ok := ops[id]
+		if !ok || !bytes.Equal(op.Source, np.Source) ||
+			!op.Updated.Equal(np.Updated) {
+			keys = append(keys, postSurrogateKey(id))
+		}
+	}
+
+	for id := range ops {
+		if _, ok := nps[id]; !ok {
+			keys = append(keys, postSurrogateKey(id))
+		}
+	}
+
+	for slug, npg := range npgs {
+		if opg, ok := opgs[slug]; !ok || opg.Content != npg.Content {
+			keys = append(keys, pageSurrogateKey(slug))
+		}
+	}
+
+	for slug := range opgs {
+		if _, ok := npgs[slug]; !ok {
+			keys = append(keys, pageSurrogateKey(slug))
+		}
+	}
+
+	if len(keys) > 0 {
+		keys = append(
+			keys,
+			surrogateKeyListing,
+			surrogateKeyFeed,
+			surrogateKeySitemap,
+		)
+	}
+
+	return keys
+}
+
+// purgeCDN purges the responses tagged with any of the keys from the
+// `config.CDNProvider`.
+func purgeCDN(keys []string) error {
+	size, ok := cdnPurgeBatchSize[config.CDNProvider]
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+
+		keys = keys[len(batch):]
+
+		var err error
+		switch config.CDNProvider {
+		case "fastly":
+			err = purgeFastly(batch)
+		case "cloudflare":
+			err = purgeCloudflare(batch)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeCDNInBackground runs the `purgeCDN` with the keys in the background,
+// logging its failure.
+func purgeCDNInBackground(keys ...string) {
+	if config.CDNProvider == "" || len(keys) == 0 {
+		return
+	}
+
+	go func() {
+		if err := purgeCDN(keys); err != nil {
+			air.ERROR(
+				"failed to purge cdn",
+				map[string]interface{}{
+					"keys":  keys,
+					"error": err.Error(),
+				},
+			)
+		}
+	}()
+}
+
+// purgeFastly purges the keys from the `config.FastlyServiceID`.
+func purgeFastly(keys []string) error {
+	fr, err := fetch(
+		"POST",
+		"https://api.fastly.com/service/"+config.FastlyServiceID+
+			"/purge",
+		http.Header{
+			"Fastly-Key":    {config.CDNAPIToken},
+			"Surrogate-Key": {strings.Join(keys, " ")},
+			"Accept":        {"application/json"},
+		},
+		nil,
+	)
+	if err != nil {
+		return err
+	} else if fr.Status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	return nil
+}
+
+// purgeCloudflare purges the keys from the `config.CloudflareZoneID`.
+func purgeCloudflare(keys []string) error {
+	b, err := json.Marshal(map[string][]string{"tags": keys})
+	if err != nil {
+		return err
+	}
+
+	fr, err := fetch(
+		"POST",
+		"https://api.cloudflare.com/client/v4/zones/"+
+			config.CloudflareZoneID+"/purge_cache",
+		http.Header{
+			"Authorization": {"Bearer " + config.CDNAPIToken},
+			"Content-Type":  {"application/json"},
+		},
+		b,
+	)
+	if err != nil {
+		return err
+	} else if fr.Status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	return nil
+}
+
+func adminPurgeHandler(req *air.Request, res *air.Response) error {
+	if config.CDNProvider == "" {
+		return air.NotFoundHandler(req, res)
+	}
+
+	keys := strings.Fields(paramValue(req, "keys"))
+	if len(keys) == 0 {
+		keys = []string{surrogateKeySite}
+	}
+
+	if err := purgeCDN(keys); err != nil {
+		res.Status = 502
+		return err
+	}
+
+	return res.Redirect(sitePath("/admin/status"))
+}
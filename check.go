@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// check parses the posts, prints every problem found in them and returns the
+// exit code for the check command. Unlike the `parsePosts`, it tells nobody
+// about the posts it finds.
+func check() int {
+	snap, _, _, err := buildPostsSnapshot(lastPostsSnapshot())
+	if snap == nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	problems := 0
+	for _, pe := range snap.postErrors {
+		fmt.Printf("%s: %s\n", pe.File, pe.Error)
+		problems++
+	}
+
+	for _, pc := range snap.postCollisions {
+		fmt.Println(pc)
+		problems++
+	}
+
+	for _, p := range snap.orderedPosts {
+		for _, issue := range checkA11y([]byte(p.Content), true) {
+			fmt.Printf(
+				"%s: %s: %s\n",
+				p.File,
+				issue.Rule,
+				issue.Message,
+			)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+		return 1
+	}
+
+	return 0
+}
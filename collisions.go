@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The kinds of the `postCollision`s.
+const (
+	postCollisionID        = "id"
+	postCollisionPermalink = "permalink"
+)
+
+// postCollision is a post file that lost the ID or the permalink of the Key to
+// another one. The file of the ID that is Dropped is not served at all, while
+// the post of the permalink that is Dropped is still served at its
+// "/posts/:ID".
+type postCollision struct {
+	Kind    string
+	Key     string
+	Kept    string
+	Dropped string
+}
+
+// String returns the string of the pc.
+func (pc postCollision) String() string {
+	return fmt.Sprintf(
+		"%s: %s %q taken by %s",
+		pc.Dropped,
+		pc.Kind,
+		pc.Key,
+		pc.Kept,
+	)
+}
+
+// duplicatePostIDs returns the collisions of the IDs of the sps, such as of a
+// "foo.md" and an encrypted "foo.md.enc". Of the files with the same ID, the
+// one whose name sorts first keeps it, so the same one always wins no matter
+// the order of the sps.
+func duplicatePostIDs(sps []storedPost) []postCollision {
+	files := map[string][]string{}
+	for _, sp := range sps {
+		files[sp.ID] = append(files[sp.ID], sp.File)
+	}
+
+	pcs := []postCollision{}
+	for id, fns := range files {
+		if len(fns) < 2 {
+			continue
+		}
+
+		sort.Strings(fns)
+		for _, fn := range fns[1:] {
+			pcs = append(pcs, postCollision{
+				Kind:    postCollisionID,
+				Key:     id,
+				Kept:    fns[0],
+				Dropped: fn,
+			})
+		}
+	}
+
+	sortPostCollisions(pcs)
+
+	return pcs
+}
+
+// sortPostCollisions sorts the pcs by their kinds, their keys and the files
+// they dropped.
+func sortPostCollisions(pcs []postCollision) {
+	sort.Slice(pcs, func(i, j int) bool {
+		if pcs[i].Kind != pcs[j].Kind {
+			return pcs[i].Kind < pcs[j].Kind
+		} else if pcs[i].Key != pcs[j].Key {
+			return pcs[i].Key < pcs[j].Key
+		}
+
+		return pcs[i].Dropped < pcs[j].Dropped
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// colorSchemeCookieName is the name of the cookie of the color scheme chosen
+// by a reader.
+const colorSchemeCookieName = "theme"
+
+// colorSchemeCookieMaxAge is how long the choice of a color scheme is kept, in
+// seconds.
+const colorSchemeCookieMaxAge = 365 * 24 * 60 * 60
+
+// colorSchemeHint is the client hint of the color scheme that the browser
+// prefers.
+const colorSchemeHint = "Sec-CH-Prefers-Color-Scheme"
+
+// isColorScheme reports whether the s is a color scheme.
+func isColorScheme(s string) bool {
+	return s == "light" || s == "dark"
+}
+
+// colorScheme returns the color scheme of the req, which is the one chosen by
+// the reader or else the one their browser prefers. It returns an empty string
+// if neither is known, leaving it to the "prefers-color-scheme" of the CSS.
+func colorScheme(req *air.Request) string {
+	if c := req.Cookie(colorSchemeCookieName); c != nil &&
+		isColorScheme(c.Value) {
+		return c.Value
+	}
+
+	hint := strings.Trim(req.Header(colorSchemeHint).Value(), `" `)
+	if isColorScheme(hint) {
+		return hint
+	}
+
+	return ""
+}
+
+// colorSchemeGas is an `air.Gas` that sets the "ColorScheme" of the template
+// values. The HTML responses ask the browsers for the `colorSchemeHint`, so
+// that the pages are rendered in the right color scheme from the start, and
+// tell the caches that they vary by it.
+func colorSchemeGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		req.Values["ColorScheme"] = colorScheme(req)
+		setHTTPResponseWriter(req, res, &colorSchemeWriter{
+			ResponseWriter: httpResponseWriter(req, res),
+		})
+		return next(req, res)
+	}
+}
+
+// colorSchemeWriter is an `http.ResponseWriter` that adds the headers of the
+// `colorSchemeHint` to the HTML responses.
+type colorSchemeWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (w *colorSchemeWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		h := w.Header()
+		if strings.HasPrefix(h.Get("content-type"), "text/html") {
+			h.Set("accept-ch", colorSchemeHint)
+			h.Set("critical-ch", colorSchemeHint)
+			h.Add("vary", colorSchemeHint)
+			h.Add("vary", "cookie")
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (w *colorSchemeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func colorSchemeHandler(req *air.Request, res *air.Response) error {
+	scheme := paramValue(req, "set")
+	switch {
+	case isColorScheme(scheme):
+		setCookie(res, &http.Cookie{
+			Name:     colorSchemeCookieName,
+			Value:    scheme,
+			MaxAge:   colorSchemeCookieMaxAge,
+			Path:     sitePath("/"),
+			Secure:   requestScheme(req) == "https",
+			HttpOnly: true,
+		})
+	case scheme == "auto":
+		setCookie(res, &http.Cookie{
+			Name:     colorSchemeCookieName,
+			MaxAge:   -1,
+			Path:     sitePath("/"),
+			Secure:   requestScheme(req) == "https",
+			HttpOnly: true,
+		})
+	default:
+		return air.NotFoundHandler(req, res)
+	}
+
+	next := paramValue(req, "next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+
+	res.SetHeader("cache-control", "no-store")
+
+	return res.Redirect(sitePath(next))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+)
+
+// commentMaxLength is the maximum number of characters of a comment.
+const commentMaxLength = 5000
+
+// comment is a comment of a post.
+type comment struct {
+	ID        string    `json:"id"`
+	PostID    string    `json:"post_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email,omitempty"`
+	Website   string    `json:"website,omitempty"`
+	Content   string    `json:"content"`
+	ClientIP  string    `json:"client_ip"`
+	CreatedAt time.Time `json:"created_at"`
+	Approved  bool      `json:"approved"`
+	Spam      []string  `json:"spam,omitempty"`
+}
+
+var commentsMutex sync.RWMutex
+
+// loadComments returns all the comments of the post of the postID, oldest
+// first. It must be called with the `commentsMutex` held.
+func loadComments(postID string) ([]comment, error) {
+	return store.Comments(postID)
+}
+
+// saveComments saves the cs as all the comments of the post of the postID. It
+// must be called with the `commentsMutex` held.
+func saveComments(postID string, cs []comment) error {
+	return store.SaveComments(postID, cs)
+}
+
+// approvedComments returns the approved comments of the post of the postID.
+func approvedComments(postID string) []comment {
+	commentsMutex.RLock()
+	cs, err := loadComments(postID)
+	commentsMutex.RUnlock()
+	if err != nil {
+		air.ERROR(
+			"failed to load comments",
+			map[string]interface{}{
+				"post_id": postID,
+				"error":   err.Error(),
+			},
+		)
+		return nil
+	}
+
+	acs := []comment{}
+	for _, c := range cs {
+		if c.Approved {
+			acs = append(acs, c)
+		}
+	}
+
+	return acs
+}
+
+// allComments returns the comments of all the posts, oldest first.
+func allComments() ([]comment, error) {
+	commentsMutex.RLock()
+	defer commentsMutex.RUnlock()
+
+	return store.AllComments()
+}
+
+// pendingComments returns the comments of all the posts waiting for
+// moderation, oldest first.
+func pendingComments() ([]comment, error) {
+	acs, err := allComments()
+	if err != nil {
+		return nil, err
+	}
+
+	pcs := []comment{}
+	for _, c := range acs {
+		if !c.Approved {
+			pcs = append(pcs, c)
+		}
+	}
+
+	return pcs, nil
+}
+
+// addComment adds the c as a new comment waiting for moderation.
+func addComment(c comment) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	c.ID = fmt.Sprintf("%x", b)
+	c.CreatedAt = time.Now().UTC()
+	c.Approved = false
+
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+
+	cs, err := loadComments(c.PostID)
+	if err != nil {
+		return err
+	}
+
+	return saveComments(c.PostID, append(cs, c))
+}
+
+// moderateComment approves or deletes the comment of the id of the post of the
+// postID.
+func moderateComment(postID, id string, approve bool) error {
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+
+	cs, err := loadComments(postID)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range cs {
+		if c.ID != id {
+			continue
+		}
+
+		if approve {
+			cs[i].Approved = true
+		} else {
+			cs = append(cs[:i], cs[i+1:]...)
+		}
+
+		return saveComments(postID, cs)
+	}
+
+	return errors.New("comment not found")
+}
+
+func commentHandler(req *air.Request, res *air.Response) error {
+	path := paramValue(req, "*")
+	if !strings.HasSuffix(path, "/comments") {
+		return air.MethodNotAllowedHandler(req, res)
+	}
+
+	snap := loadedPosts()
+
+	postID := strings.TrimSuffix(path, "/comments")
+	p, ok := snap.posts[postID]
+	if !ok || !config.CommentsEnabled || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if honeypotFilled(req) {
+		return res.Redirect(sitePath(p.Permalink + "?comment=pending"))
+	}
+
+	c := comment{
+		PostID:   postID,
+		Name:     strings.TrimSpace(paramValue(req, "name")),
+		Email:    strings.TrimSpace(paramValue(req, "email")),
+		Website:  strings.TrimSpace(paramValue(req, "website")),
+		Content:  strings.TrimSpace(paramValue(req, "content")),
+		ClientIP: clientIP(req),
+	}
+	if c.Website != "" {
+		if u, err := url.Parse(c.Website); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			c.Website = ""
+		}
+	}
+
+	if c.Name == "" || c.Content == "" ||
+		utf8.RuneCountInString(c.Content) > commentMaxLength {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	if _, err := holdForModeration(
+		newSpamCandidate(c, req, p),
+		postID,
+		func(spam []string) (bool, error) {
+			c.Spam = spam
+			return true, addComment(c)
+		},
+		func() {
+			notify(fmt.Sprintf(
+				"New comment by %s on %s%s awaits moderation.",
+				c.Name,
+				config.BaseURL,
+				p.Permalink,
+			))
+			fireWebhooks(
+				webhookCommentReceived,
+				map[string]interface{}{
+					"post":    webhookPost(p),
+					"name":    c.Name,
+					"content": c.Content,
+				},
+			)
+		},
+	); err != nil {
+		return err
+	}
+
+	return res.Redirect(
+		sitePath(p.Permalink + "?comment=pending#comments"),
+	)
+}
+
+func adminCommentsHandler(req *air.Request, res *air.Response) error {
+	pcs, err := pendingComments()
+	if err != nil {
+		return err
+	}
+
+	req.Values["PageTitle"] = "Pending Comments"
+	req.Values["PendingComments"] = pcs
+
+	return res.Render(
+		req.Values,
+		"admin/comments.html",
+		"layouts/default.html",
+	)
+}
+
+func adminModerateCommentHandler(req *air.Request, res *air.Response) error {
+	if err := moderateComment(
+		paramValue(req, "post_id"),
+		paramValue(req, "id"),
+		paramValue(req, "action") == "approve",
+	); err != nil {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if paramValue(req, "action") == "approve" {
+		bumpContentVersion()
+		purgeCDNInBackground(
+			postSurrogateKey(paramValue(req, "post_id")),
+		)
+	}
+
+	return res.Redirect(sitePath("/admin/comments"))
+}
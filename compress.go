@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aofei/air"
+)
+
+// compressibleMIMETypes is the MIME types worth compressing.
+var compressibleMIMETypes = []string{
+	"text/",
+	"application/atom+xml",
+	"application/javascript",
+	"application/json",
+	"application/rss+xml",
+	"application/xml",
+	"image/svg+xml",
+	"image/x-icon",
+}
+
+// compressible reports whether the content type is worth compressing.
+func compressible(contentType string) bool {
+	for _, mt := range compressibleMIMETypes {
+		if strings.HasPrefix(contentType, mt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateEncoding returns the content coding to use for a request with the
+// Accept-Encoding header value ae. It returns "" when the content should be
+// sent as is.
+func negotiateEncoding(ae string) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(ae, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(
+					param[2:],
+					64,
+				); err == nil {
+					q = v
+				}
+			}
+		}
+
+		qs[coding] = q
+	}
+
+	encoding, best := "", 0.0
+	for _, coding := range []string{"br", "gzip"} {
+		q, ok := qs[coding]
+		if !ok {
+			q, ok = qs["*"]
+		}
+
+		if ok && q > best {
+			encoding, best = coding, q
+		}
+	}
+
+	return encoding
+}
+
+// newCompressor returns an `io.WriteCloser` compressing into the w with the
+// encoding.
+func newCompressor(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == "br" {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+
+	gw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	return gw
+}
+
+// precompress returns the b compressed with every supported encoding at the
+// best compression level, keyed by the encoding.
+func precompress(b []byte) map[string][]byte {
+	br := bytes.Buffer{}
+	bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+	bw.Write(b)
+	bw.Close()
+
+	gz := bytes.Buffer{}
+	gw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	gw.Write(b)
+	gw.Close()
+
+	return map[string][]byte{
+		"br":   br.Bytes(),
+		"gzip": gz.Bytes(),
+	}
+}
+
+// compressGas is an `air.Gas` that compresses the responses on the fly when
+// they are compressible, not already encoded and at least the configured
+// minimum size.
+func compressGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		encoding := negotiateEncoding(
+			req.Header("accept-encoding").Value(),
+		)
+		if encoding == "" {
+			return next(req, res)
+		}
+
+		rw := &compressResponseWriter{
+			ResponseWriter: httpResponseWriter(req, res),
+			encoding:       encoding,
+		}
+		setHTTPResponseWriter(req, res, rw)
+		defer rw.Close()
+
+		return next(req, res)
+	}
+}
+
+// compressResponseWriter is an `http.ResponseWriter` that holds back the
+// header and the first bytes of the body until it knows whether the body is
+// worth compressing.
+type compressResponseWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	cw       io.WriteCloser
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (rw *compressResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+// Write implements the `http.ResponseWriter`.
+func (rw *compressResponseWriter) Write(b []byte) (int, error) {
+	if rw.decided {
+		if rw.cw != nil {
+			return rw.cw.Write(b)
+		}
+
+		return rw.ResponseWriter.Write(b)
+	}
+
+	rw.buf = append(rw.buf, b...)
+	if len(rw.buf) < config.CompressionMinSize {
+		return len(b), nil
+	}
+
+	if err := rw.decide(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// decide decides whether to compress the body, writes the header and flushes
+// the held back bytes.
+func (rw *compressResponseWriter) decide() error {
+	rw.decided = true
+
+	h := rw.Header()
+	if len(rw.buf) >= config.CompressionMinSize &&
+		h.Get("content-encoding") == "" &&
+		compressible(h.Get("content-type")) {
+		h.Set("content-encoding", rw.encoding)
+		h.Del("content-length")
+		h.Add("vary", "accept-encoding")
+		rw.cw = newCompressor(rw.encoding, rw.ResponseWriter)
+	}
+
+	if rw.status == 0 {
+		rw.status = 200
+	}
+
+	rw.ResponseWriter.WriteHeader(rw.status)
+	if len(rw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if rw.cw != nil {
+		_, err = rw.cw.Write(rw.buf)
+	} else {
+		_, err = rw.ResponseWriter.Write(rw.buf)
+	}
+
+	rw.buf = nil
+
+	return err
+}
+
+// Close finishes the response.
+func (rw *compressResponseWriter) Close() error {
+	if !rw.decided && (rw.status != 0 || len(rw.buf) > 0) {
+		if err := rw.decide(); err != nil {
+			return err
+		}
+	}
+
+	if rw.cw != nil {
+		return rw.cw.Close()
+	}
+
+	return nil
+}
+
+// precompressedAsset is an asset compressed ahead of time.
+type precompressedAsset struct {
+	modTime  time.Time
+	encodeds map[string][]byte
+}
+
+var precompressedAssets *lruCache
+
+// precompressAssets compresses all the compressible files in the
+// `air.AssetRoot` ahead of time.
+func precompressAssets() {
+	filepath.Walk(
+		air.AssetRoot,
+		func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				precompressedAssetOf(path)
+			}
+
+			return nil
+		},
+	)
+}
+
+// precompressedAssetOf returns the precompressed asset of the filename. It
+// recompresses the file if it has changed since it was last compressed, and
+// returns nil if the file isn't compressible.
+func precompressedAssetOf(filename string) *precompressedAsset {
+	if !compressible(mime.TypeByExtension(filepath.Ext(filename))) {
+		return nil
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+
+	if v, ok := precompressedAssets.get(filename); ok {
+		pa := v.(*precompressedAsset)
+		if pa.modTime.Equal(fi.ModTime()) {
+			return pa
+		}
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	pa := &precompressedAsset{
+		modTime:  fi.ModTime(),
+		encodeds: precompress(b),
+	}
+
+	size := 0
+	for _, eb := range pa.encodeds {
+		size += len(eb)
+	}
+
+	precompressedAssets.set(filename, pa, size)
+
+	return pa
+}
+
+// precompressedAssetGas is an `air.Gas` that serves the precompressed assets
+// to the clients accepting them.
+func precompressedAssetGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !config.CompressionEnabled {
+			return next(req, res)
+		}
+
+		encoding := negotiateEncoding(
+			req.Header("accept-encoding").Value(),
+		)
+		if encoding == "" {
+			return next(req, res)
+		}
+
+		p, _ := assetPath(routePath(req))
+		filename := assetFilename(p)
+
+		pa := precompressedAssetOf(filename)
+		if pa == nil {
+			return next(req, res)
+		}
+
+		res.SetHeader(
+			"content-type",
+			mime.TypeByExtension(filepath.Ext(filename)),
+		)
+		res.SetHeader("content-encoding", encoding)
+		res.SetHeader("vary", "accept-encoding")
+		res.SetHeader(
+			"last-modified",
+			pa.modTime.UTC().Format(http.TimeFormat),
+		)
+
+		return res.WriteBlob(pa.encodeds[encoding])
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import "github.com/BurntSushi/toml"
+
+// config is the blog's own part of the configuration file. Air reads the same
+// file for its settings, so only the keys Air doesn't know about live here.
+var config struct {
+	BaseURL          string        `toml:"base_url"`
+	Title            string        `toml:"title"`
+	Theme            string        `toml:"theme"`
+	A11yCheckEnabled bool          `toml:"a11y_check_enabled"`
+	Render           renderOptions `toml:"render"`
+	Fonts            []fontConfig  `toml:"fonts"`
+
+	SanitizePolicy       string              `toml:"sanitize_policy"`
+	SanitizeAllowedAttrs map[string][]string `toml:"sanitize_allowed_attrs"`
+
+	CanonicalHostEnforced bool   `toml:"canonical_host_enforced"`
+	TrailingSlashPolicy   string `toml:"trailing_slash_policy"`
+	PathCasePolicy        string `toml:"path_case_policy"`
+	BasePath              string `toml:"base_path"`
+
+	TranslationBackend string `toml:"translation_backend"`
+	TranslationURL     string `toml:"translation_url"`
+	TranslationAPIKey  string `toml:"translation_api_key"`
+
+	RelatedFile  string `toml:"related_file"`
+	AuthorsFile  string `toml:"authors_file"`
+	BlogrollFile string `toml:"blogroll_file"`
+
+	Store      string `toml:"store"`
+	SQLitePath string `toml:"sqlite_path"`
+
+	S3Endpoint     string `toml:"s3_endpoint"`
+	S3Region       string `toml:"s3_region"`
+	S3Bucket       string `toml:"s3_bucket"`
+	S3Prefix       string `toml:"s3_prefix"`
+	S3AccessKey    string `toml:"s3_access_key"`
+	S3SecretKey    string `toml:"s3_secret_key"`
+	S3SyncInterval string `toml:"s3_sync_interval"`
+	S3SyncToken    string `toml:"s3_sync_token"`
+
+	ContentWebhookURL    string `toml:"content_webhook_url"`
+	ContentWebhookSecret string `toml:"content_webhook_secret"`
+	ContentSnapshotKey   string `toml:"content_snapshot_key"`
+
+	WatchdogAlertEnabled   bool `toml:"watchdog_alert_enabled"`
+	WatchdogRestartEnabled bool `toml:"watchdog_restart_enabled"`
+
+	CompressionEnabled bool `toml:"compression_enabled"`
+	CompressionMinSize int  `toml:"compression_min_size"`
+
+	PageCacheMaxBytes  int `toml:"page_cache_max_bytes"`
+	AssetCacheMaxBytes int `toml:"asset_cache_max_bytes"`
+
+	ACMEHTTPAddress string `toml:"acme_http_address"`
+
+	Listen         string `toml:"listen"`
+	UnixSocketMode string `toml:"unix_socket_mode"`
+
+	FeedEntries       int    `toml:"feed_entries"`
+	FeedMaxEntries    int    `toml:"feed_max_entries"`
+	FeedContent       string `toml:"feed_content"`
+	FeedEntriesFile   string `toml:"feed_entries_file"`
+	FeedCacheMaxBytes int    `toml:"feed_cache_max_bytes"`
+
+	VideoRoot           string `toml:"video_root"`
+	VideoPreviewEnabled bool   `toml:"video_preview_enabled"`
+	FFmpegPath          string `toml:"ffmpeg_path"`
+
+	PDFEnabled       bool   `toml:"pdf_enabled"`
+	PDFConverterPath string `toml:"pdf_converter_path"`
+	PDFCacheMaxBytes int    `toml:"pdf_cache_max_bytes"`
+
+	EPUBEnabled       bool `toml:"epub_enabled"`
+	EPUBCacheMaxBytes int  `toml:"epub_cache_max_bytes"`
+
+	OfflineEnabled bool `toml:"offline_enabled"`
+	OfflinePosts   int  `toml:"offline_posts"`
+
+	UploadRoot           string   `toml:"upload_root"`
+	ImageVariantsEnabled bool     `toml:"image_variants_enabled"`
+	ImageVariantRoot     string   `toml:"image_variant_root"`
+	ImageWidths          []int    `toml:"image_widths"`
+	ImageFormats         []string `toml:"image_formats"`
+	OGImagesEnabled      bool     `toml:"og_images_enabled"`
+
+	LogFile             string `toml:"log_file"`
+	LogStdout           bool   `toml:"log_stdout"`
+	LogMaxBytes         int64  `toml:"log_max_bytes"`
+	LogRotationInterval string `toml:"log_rotation_interval"`
+	LogMaxBackups       int    `toml:"log_max_backups"`
+
+	EncryptionKey string `toml:"encryption_key"`
+	SigningKey    string `toml:"signing_key"`
+	CookieSecret  string `toml:"cookie_secret"`
+
+	MaxPostErrors int    `toml:"max_post_errors"`
+	AdminUsername string `toml:"admin_username"`
+	AdminPassword string `toml:"admin_password"`
+
+	Admins            []adminAccount `toml:"admins"`
+	APITokens         []apiToken     `toml:"api_tokens"`
+	ApprovalEnabled   bool           `toml:"approval_enabled"`
+	ApprovalNotifyURL string         `toml:"approval_notify_url"`
+	PendingRoot       string         `toml:"pending_root"`
+
+	DataRoot           string `toml:"data_root"`
+	CommentsEnabled    bool   `toml:"comments_enabled"`
+	SuggestionsEnabled bool   `toml:"suggestions_enabled"`
+
+	SpamBlockedDomains  []string `toml:"spam_blocked_domains"`
+	SpamBlockedIPs      []string `toml:"spam_blocked_ips"`
+	SpamBlockedKeywords []string `toml:"spam_blocked_keywords"`
+	SpamMaxLinks        int      `toml:"spam_max_links"`
+	AkismetKey          string   `toml:"akismet_key"`
+	AkismetEndpoint     string   `toml:"akismet_endpoint"`
+
+	NewsletterEnabled bool   `toml:"newsletter_enabled"`
+	MembersEnabled    bool   `toml:"members_enabled"`
+	SMTPHost          string `toml:"smtp_host"`
+	SMTPPort          int    `toml:"smtp_port"`
+	SMTPUsername      string `toml:"smtp_username"`
+	SMTPPassword      string `toml:"smtp_password"`
+	SMTPFrom          string `toml:"smtp_from"`
+
+	ViewCounterEnabled     bool `toml:"view_counter_enabled"`
+	ReactionsEnabled       bool `toml:"reactions_enabled"`
+	TrackingParamsStripped bool `toml:"tracking_params_stripped"`
+
+	MatrixHomeserver  string `toml:"matrix_homeserver"`
+	MatrixAccessToken string `toml:"matrix_access_token"`
+	MatrixRoomID      string `toml:"matrix_room_id"`
+	XMPPJID           string `toml:"xmpp_jid"`
+	XMPPPassword      string `toml:"xmpp_password"`
+	XMPPTo            string `toml:"xmpp_to"`
+
+	FetchUserAgent     string `toml:"fetch_user_agent"`
+	FetchTimeout       string `toml:"fetch_timeout"`
+	FetchHostInterval  string `toml:"fetch_host_interval"`
+	FetchCacheMaxBytes int    `toml:"fetch_cache_max_bytes"`
+	LinkCheckInterval  string `toml:"link_check_interval"`
+
+	LinkArchiveInterval string `toml:"link_archive_interval"`
+
+	IndexNowKey      string   `toml:"indexnow_key"`
+	IndexNowEndpoint string   `toml:"indexnow_endpoint"`
+	SitemapPingURLs  []string `toml:"sitemap_ping_urls"`
+
+	MastodonInstance      string `toml:"mastodon_instance"`
+	MastodonAccessToken   string `toml:"mastodon_access_token"`
+	BlueskyPDS            string `toml:"bluesky_pds"`
+	BlueskyHandle         string `toml:"bluesky_handle"`
+	BlueskyAppPassword    string `toml:"bluesky_app_password"`
+	SyndicationWebhookURL string `toml:"syndication_webhook_url"`
+
+	CDNProvider      string `toml:"cdn_provider"`
+	CDNAPIToken      string `toml:"cdn_api_token"`
+	CDNMaxAge        int    `toml:"cdn_max_age"`
+	FastlyServiceID  string `toml:"fastly_service_id"`
+	CloudflareZoneID string `toml:"cloudflare_zone_id"`
+
+	IPRulesFile string `toml:"ip_rules_file"`
+
+	BodySizeLimits map[string]int64 `toml:"body_size_limits"`
+
+	RequestHeaderTimeout string            `toml:"request_header_timeout"`
+	RequestReadTimeout   string            `toml:"request_read_timeout"`
+	ResponseWriteTimeout string            `toml:"response_write_timeout"`
+	HandlerTimeouts      map[string]string `toml:"handler_timeouts"`
+
+	EarlyHintsEnabled bool                `toml:"early_hints_enabled"`
+	Preloads          map[string][]string `toml:"preloads"`
+
+	TrustedProxies   []string `toml:"trusted_proxies"`
+	RateLimitEnabled bool     `toml:"rate_limit_enabled"`
+	RateLimitRate    float64  `toml:"rate_limit_rate"`
+	RateLimitBurst   int      `toml:"rate_limit_burst"`
+
+	BotClasses []botClass `toml:"bot_classes"`
+
+	Permalinks map[string]string `toml:"permalinks"`
+
+	Menu []menuConfig `toml:"menu"`
+	Nav  []navConfig  `toml:"nav"`
+
+	Bundles []bundleConfig `toml:"bundles"`
+
+	WellKnown []wellKnownConfig `toml:"well_known"`
+
+	Webhooks []webhookConfig `toml:"webhooks"`
+
+	SearchBoosts map[string]float64 `toml:"search_boosts"`
+
+	Jobs map[string]string `toml:"jobs"`
+}
+
+// loadConfig loads the blog's configuration from the filename.
+func loadConfig(filename string) error {
+	// The files served from the roots must never be looked up from the
+	// root of the filesystem, so the roots left out stay directories.
+	config.VideoRoot = "videos"
+	config.UploadRoot = "uploads"
+	config.ImageVariantRoot = "image-variants"
+
+	_, err := toml.DecodeFile(filename, &config)
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// contentSnapshot is the full content of the blog, pushed as JSON to the
+// headless front ends.
+type contentSnapshot struct {
+	Title       string        `json:"title"`
+	BaseURL     string        `json:"base_url"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Posts       []contentPost `json:"posts"`
+	Tags        []contentTag  `json:"tags"`
+	Pages       []contentPage `json:"pages"`
+}
+
+// contentPost is a post in a `contentSnapshot`.
+type contentPost struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	URL       string    `json:"url"`
+	Permalink string    `json:"permalink"`
+	Published time.Time `json:"published"`
+	Updated   time.Time `json:"updated"`
+	Language  string    `json:"language,omitempty"`
+	Tags      []string  `json:"tags"`
+	Related   []string  `json:"related,omitempty"`
+	Summary   string    `json:"summary"`
+	Content   string    `json:"content"`
+}
+
+// contentTag is a tag in a `contentSnapshot` with the IDs of its posts, newest
+// first.
+type contentTag struct {
+	Name  string   `json:"name"`
+	Posts []string `json:"posts"`
+}
+
+// contentPage is a page other than the posts in a `contentSnapshot`.
+type contentPage struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+var (
+	contentPushMutex sync.Mutex
+	contentPushHash  string
+)
+
+// newContentPost returns the p as a `contentPost`.
+func newContentPost(p post) contentPost {
+	tags := p.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return contentPost{
+		ID:        p.ID,
+		Title:     p.Title,
+		URL:       config.BaseURL + p.Permalink,
+		Permalink: p.Permalink,
+		Published: p.Datetime,
+		Updated:   p.Updated,
+		Language:  p.Language,
+		Tags:      tags,
+		Related:   p.Related,
+		Summary:   postSummary(p),
+		Content:   string(p.Content),
+	}
+}
+
+// buildContentSnapshot returns the `contentSnapshot` of the ops, which are
+// ordered newest first. Its GeneratedAt is left for the caller.
+func buildContentSnapshot(ops []post) contentSnapshot {
+	cs := contentSnapshot{
+		Title:   config.Title,
+		BaseURL: config.BaseURL,
+		Posts:   make([]contentPost, 0, len(ops)),
+		Tags:    []contentTag{},
+		Pages:   []contentPage{},
+	}
+
+	tagPosts := map[string][]string{}
+	for _, p := range ops {
+		cs.Posts = append(cs.Posts, newContentPost(p))
+		for _, t := range p.Tags {
+			tagPosts[t] = append(tagPosts[t], p.ID)
+		}
+	}
+
+	for t, ids := range tagPosts {
+		cs.Tags = append(cs.Tags, contentTag{
+			Name:  t,
+			Posts: ids,
+		})
+	}
+
+	sort.Slice(cs.Tags, func(i, j int) bool {
+		return cs.Tags[i].Name < cs.Tags[j].Name
+	})
+
+	for _, mc := range menuConfigs() {
+		u, err := url.Parse(mc.Path)
+		if err != nil || u.Host != "" || mc.External {
+			continue
+		}
+
+		cs.Pages = append(cs.Pages, contentPage{
+			Name: mc.Label,
+			URL:  config.BaseURL + mc.Path,
+		})
+	}
+
+	return cs
+}
+
+// pushContentSnapshot pushes the `contentSnapshot` of the ops to the
+// `config.ContentWebhookURL` and the `config.ContentSnapshotKey` of the
+// configured bucket, unless nothing has changed since the last successful
+// push. It is meant to be run in the background after the posts are parsed.
+func pushContentSnapshot(ops []post) {
+	if config.ContentWebhookURL == "" && config.ContentSnapshotKey == "" {
+		return
+	}
+
+	contentPushMutex.Lock()
+	defer contentPushMutex.Unlock()
+
+	cs := buildContentSnapshot(ops)
+	b, err := json.Marshal(cs)
+	if err != nil {
+		air.ERROR(
+			"failed to marshal content snapshot",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	if hash == contentPushHash {
+		return
+	}
+
+	cs.GeneratedAt = time.Now().UTC()
+	if b, err = json.MarshalIndent(cs, "", "\t"); err != nil {
+		return
+	}
+
+	failed := false
+	if config.ContentWebhookURL != "" {
+		if err := postContentSnapshot(b); err != nil {
+			air.ERROR(
+				"failed to post content snapshot",
+				map[string]interface{}{
+					"url":   config.ContentWebhookURL,
+					"error": err.Error(),
+				},
+			)
+			failed = true
+		}
+	}
+
+	if config.ContentSnapshotKey != "" {
+		if err := putContentSnapshot(b); err != nil {
+			air.ERROR(
+				"failed to put content snapshot",
+				map[string]interface{}{
+					"key":   config.ContentSnapshotKey,
+					"error": err.Error(),
+				},
+			)
+			failed = true
+		}
+	}
+
+	// A failed push is retried with the next change.
+	if !failed {
+		contentPushHash = hash
+	}
+}
+
+// postContentSnapshot posts the b to the `config.ContentWebhookURL`, signed
+// with the `config.ContentWebhookSecret` in the "x-blog-signature" if set.
+func postContentSnapshot(b []byte) error {
+	header := http.Header{
+		"Content-Type": {"application/json"},
+	}
+	if config.ContentWebhookSecret != "" {
+		mac := hmacSHA256(
+			[]byte(config.ContentWebhookSecret),
+			string(b),
+		)
+		header.Set(
+			"X-Blog-Signature",
+			"sha256="+hex.EncodeToString(mac),
+		)
+	}
+
+	fr, err := fetch("POST", config.ContentWebhookURL, header, b)
+	if err != nil {
+		return err
+	} else if fr.Status < 200 || fr.Status >= 300 {
+		return fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	return nil
+}
+
+// putContentSnapshot puts the b as the `config.ContentSnapshotKey` of the
+// configured bucket.
+func putContentSnapshot(b []byte) error {
+	c, err := newS3Client()
+	if err != nil {
+		return err
+	}
+
+	return c.put(s3Key(config.ContentSnapshotKey), b)
+}
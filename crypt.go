@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// encryptedPostExt is the extension of the encrypted post files.
+const encryptedPostExt = ".enc"
+
+// encryptedPostMagic is the header of the encrypted post files.
+var encryptedPostMagic = []byte("BLOGENC1")
+
+// postKey returns the key to encrypt and decrypt the posts with. It comes from
+// the "BLOG_ENCRYPTION_KEY" environment variable, or the
+// `config.EncryptionKey` if the variable is not set, as 32 bytes encoded in
+// base64.
+func postKey() (*[32]byte, error) {
+	s := os.Getenv("BLOG_ENCRYPTION_KEY")
+	if s == "" {
+		s = config.EncryptionKey
+	}
+
+	if s == "" {
+		return nil, errors.New("no encryption key is configured")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encryption key: %v", err)
+	} else if len(b) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes long")
+	}
+
+	key := &[32]byte{}
+	copy(key[:], b)
+
+	return key, nil
+}
+
+// encryptPost encrypts the b with the `postKey`.
+func encryptPost(b []byte) ([]byte, error) {
+	key, err := postKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := &[24]byte{}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, encryptedPostMagic...)
+	out = append(out, nonce[:]...)
+
+	return secretbox.Seal(out, b, nonce, key), nil
+}
+
+// decryptPost decrypts the b encrypted by the `encryptPost`.
+func decryptPost(b []byte) ([]byte, error) {
+	key, err := postKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(b, encryptedPostMagic) ||
+		len(b) < len(encryptedPostMagic)+24 {
+		return nil, errors.New("not an encrypted post")
+	}
+
+	b = b[len(encryptedPostMagic):]
+
+	nonce := &[24]byte{}
+	copy(nonce[:], b)
+
+	out, ok := secretbox.Open(nil, b[24:], nonce, key)
+	if !ok {
+		return nil, errors.New("failed to decrypt post")
+	}
+
+	return out, nil
+}
+
+// readPostFile reads the post file named filename, decrypting it in memory if
+// it is encrypted.
+func readPostFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(filename, encryptedPostExt) {
+		return decryptPost(b)
+	}
+
+	return b, nil
+}
+
+// encryptPostFile encrypts the post file named filename into a new file with
+// the `encryptedPostExt` appended to its name, and removes the original.
+func encryptPostFile(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	eb, err := encryptPost(b)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(
+		filename+encryptedPostExt,
+		eb,
+		0600,
+	); err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
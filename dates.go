@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// dateLayouts is the layouts of the date styles. They are the keys of the
+// locale files, so that each locale lays the dates out its own way, and the
+// month and weekday names in them are localized as well.
+var dateLayouts = map[string]string{
+	"date":     "January 2, 2006",
+	"datetime": "January 2, 2006 15:04",
+	"month":    "January 2006",
+}
+
+// localizedDate returns the t formatted in the style of the `dateLayouts` for
+// the locale of the req.
+func localizedDate(req *air.Request, t time.Time, style string) string {
+	layout, ok := dateLayouts[style]
+	if !ok {
+		layout = dateLayouts["date"]
+	}
+
+	layout = req.LocalizedString(layout)
+
+	// The names are put in after the formatting, since they may contain
+	// what the layouts take for their elements.
+	const monthMark, weekdayMark = "\x00", "\x01"
+
+	layout = strings.NewReplacer(
+		"January", monthMark,
+		"Monday", weekdayMark,
+	).Replace(layout)
+
+	return strings.NewReplacer(
+		monthMark, req.LocalizedString(t.Month().String()),
+		weekdayMark, req.LocalizedString(t.Weekday().String()),
+	).Replace(t.Format(layout))
+}
+
+// dateFormatter returns the `localizedDate` for the req, which the templates
+// call as the "FormatDate" of their values, such as
+// `{{call $.FormatDate .Datetime "date"}}`.
+func dateFormatter(req *air.Request) func(time.Time, string) string {
+	return func(t time.Time, style string) string {
+		return localizedDate(req, t, style)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// preloadFonts is the entry of the `config.Preloads` that stands for the
+// preloaded web fonts and their stylesheet.
+const preloadFonts = "fonts"
+
+// checkPreloads checks the `config.Preloads`.
+func checkPreloads() error {
+	for prefix, entries := range config.Preloads {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("bad preload prefix %q", prefix)
+		}
+
+		for _, e := range entries {
+			if e == preloadFonts ||
+				strings.HasPrefix(e, "/assets/") ||
+				!strings.Contains(e, "/") {
+				continue
+			}
+
+			return fmt.Errorf("bad preload %q of %s", e, prefix)
+		}
+	}
+
+	return nil
+}
+
+// preloadEntries returns the entries of the `config.Preloads` of the path,
+// which are those of the longest of its path prefixes that the path has.
+func preloadEntries(path string) []string {
+	longest, ok := "", false
+	for prefix := range config.Preloads {
+		if strings.HasPrefix(path, prefix) &&
+			(!ok || len(prefix) > len(longest)) {
+			longest, ok = prefix, true
+		}
+	}
+
+	return config.Preloads[longest]
+}
+
+// preloadAs returns the "as" of a preload of the URL u, by its extension.
+func preloadAs(u string) string {
+	switch strings.ToLower(path.Ext(u)) {
+	case ".css":
+		return "style"
+	case ".js", ".mjs":
+		return "script"
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return "font"
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".avif":
+		return "image"
+	}
+
+	return "fetch"
+}
+
+// preloadLinks returns the "Link" header values that preload the critical
+// assets of the path. An entry of the `config.Preloads` is the name of a
+// bundle, the path of an asset, or the `preloadFonts`.
+func preloadLinks(path string) []string {
+	snap := loadedPosts()
+
+	links := []string{}
+	for _, e := range preloadEntries(path) {
+		switch {
+		case e == preloadFonts:
+			if snap.webFontsCSSURL != "" {
+				links = append(links, fmt.Sprintf(
+					"<%s>; rel=preload; as=style",
+					sitePath(snap.webFontsCSSURL),
+				))
+			}
+
+			for _, wf := range snap.webFonts {
+				if wf.Preload {
+					links = append(links, fmt.Sprintf(
+						"<%s>; rel=preload; as=font; "+
+							"type=%q; crossorigin",
+						sitePath(wf.URL),
+						wf.Type,
+					))
+				}
+			}
+		case strings.HasPrefix(e, "/"):
+			u := assetURL(e)
+			links = append(links, fmt.Sprintf(
+				"<%s>; rel=preload; as=%s",
+				u,
+				preloadAs(u),
+			))
+		default:
+			if u := bundleURL(e); u != "" {
+				links = append(links, fmt.Sprintf(
+					"<%s>; rel=preload; as=%s",
+					u,
+					preloadAs(u),
+				))
+			}
+		}
+	}
+
+	return links
+}
+
+// earlyHintsGas is an `air.Gas` that sends the `preloadLinks` of the pages in
+// their "Link" header, so that the browsers fetch the critical assets before
+// they see them in the HTML. Over HTTP/2 and later, the links are also sent
+// ahead in a 103 Early Hints while the page is still being rendered. It must
+// be a pregas before any that buffers the response.
+func earlyHintsGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !config.EarlyHintsEnabled || req.Method != "GET" ||
+			acceptQuality(
+				req.Header("accept").Value(),
+				"text/html",
+			) <= 0 {
+			return next(req, res)
+		}
+
+		links := preloadLinks(routePath(req))
+		if len(links) == 0 {
+			return next(req, res)
+		}
+
+		hrw := httpResponseWriter(req, res)
+		for _, l := range links {
+			hrw.Header().Add("link", l)
+		}
+
+		if httpRequest(req).ProtoMajor >= 2 {
+			hrw.WriteHeader(http.StatusEarlyHints)
+		}
+
+		return next(req, res)
+	}
+}
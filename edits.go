@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// postEdit is a change to a post worth telling its readers about, listed in
+// the changelog under the post.
+type postEdit struct {
+	Date time.Time `toml:"date"`
+	Note string    `toml:"note"`
+}
+
+// prepareEdits checks the es and sorts them from the newest.
+func prepareEdits(es []postEdit) error {
+	for i := range es {
+		if es[i].Date.IsZero() {
+			return errors.New("edit without date")
+		} else if es[i].Note == "" {
+			return errors.New("edit without note")
+		}
+
+		es[i].Date = es[i].Date.UTC()
+	}
+
+	sort.SliceStable(es, func(i, j int) bool {
+		return es[i].Date.After(es[j].Date)
+	})
+
+	return nil
+}
+
+// Modified reports whether the p has been said to be updated, by its front
+// matter, on a later day than it was published, which is when its update
+// time is shown. The modification times of the files don't count, since
+// they change with every copy.
+func (p post) Modified() bool {
+	if !p.Revised {
+		return false
+	}
+
+	py, pm, pd := p.Datetime.Date()
+	uy, um, ud := p.Updated.Date()
+	return uy != py || um != pm || ud != pd
+}
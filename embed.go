@@ -0,0 +1,152 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aofei/air"
+)
+
+// embeddedFiles is the default templates, locales, assets and "robots.txt"
+// built into the binary, so that it runs without them on the disk.
+//
+//go:embed templates locales assets robots.txt
+var embeddedFiles embed.FS
+
+// setupEmbedded fills in the files of the `air.TemplateRoot`, the
+// `air.LocaleRoot` and the `air.AssetRoot` that are missing on the disk from
+// the `embeddedFiles`. The files on the disk are never overwritten, so any of
+// them overrides its embedded default.
+func setupEmbedded() error {
+	for _, r := range []struct {
+		dir  string
+		root *string
+	}{
+		{"templates", &air.TemplateRoot},
+		{"locales", &air.LocaleRoot},
+		{"assets", &air.AssetRoot},
+	} {
+		if err := unpackEmbedded(r.dir, r.root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpackEmbedded writes the files of the embedded dir that are missing under
+// the root. If the root can't be written, such as on a read-only disk, the
+// root is moved to a temporary directory holding the embedded files with the
+// ones of the old root on top.
+func unpackEmbedded(dir string, root *string) error {
+	err := copyEmbedded(dir, *root, false)
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "blog-"+dir+"-")
+	if err != nil {
+		return err
+	}
+
+	if err := copyEmbedded(dir, tmp, true); err != nil {
+		return err
+	}
+
+	if err := copyDir(*root, tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	air.WARN(
+		"using temporary directory for embedded files",
+		map[string]interface{}{
+			"root":      *root,
+			"directory": tmp,
+		},
+	)
+
+	*root = tmp
+
+	return nil
+}
+
+// copyEmbedded writes the files of the embedded dir under the root, skipping
+// the ones that exist unless the overwrite is true.
+func copyEmbedded(dir, root string, overwrite bool) error {
+	return fs.WalkDir(
+		embeddedFiles,
+		dir,
+		func(name string, de fs.DirEntry, err error) error {
+			if err != nil || de.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, filepath.FromSlash(name))
+			if err != nil {
+				return err
+			}
+
+			filename := filepath.Join(root, rel)
+			_, err = os.Stat(filename)
+			if err == nil && !overwrite {
+				return nil
+			}
+
+			b, err := embeddedFiles.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			err = os.MkdirAll(filepath.Dir(filename), 0755)
+			if err != nil {
+				return err
+			}
+
+			return ioutil.WriteFile(filename, b, 0644)
+		},
+	)
+}
+
+// copyDir copies the files under the src to the same places under the dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(
+		src,
+		func(filename string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(src, filename)
+			if err != nil {
+				return err
+			}
+
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+
+			target := filepath.Join(dst, rel)
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return err
+			}
+
+			return ioutil.WriteFile(target, b, 0644)
+		},
+	)
+}
+
+// readFileOrEmbedded returns the content of the file named filename, or of its
+// embedded default if there is no such file on the disk.
+func readFileOrEmbedded(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return embeddedFiles.ReadFile(filepath.ToSlash(filename))
+	}
+
+	return b, err
+}
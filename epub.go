@@ -0,0 +1,697 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// epubMaxPosts is the most posts that an archive EPUB may have.
+	epubMaxPosts = 50
+
+	// epubMaxImageBytes is the largest image that is embedded into an
+	// EPUB. The larger ones are left out for their alt texts.
+	epubMaxImageBytes = 10 << 20
+)
+
+// epubImageExts is the extensions of the images that may be embedded into an
+// EPUB by their media types, which are the image types that all the EPUB
+// readers support.
+var epubImageExts = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// epubVoidElements is the elements that never have anything inside them, and
+// so are closed right away in the XHTML of an EPUB.
+var epubVoidElements = map[string]bool{
+	"area":  true,
+	"base":  true,
+	"br":    true,
+	"col":   true,
+	"embed": true,
+	"hr":    true,
+	"img":   true,
+	"input": true,
+	"link":  true,
+	"meta":  true,
+	"track": true,
+	"wbr":   true,
+}
+
+// epubAttrPattern is the pattern of the names of the attributes that are kept
+// in the XHTML of an EPUB.
+var epubAttrPattern = regexp.MustCompile(`^[a-z_][-a-z0-9_.]*$`)
+
+var (
+	// epubCache is the cache of the EPUBs, by the hashes of the posts
+	// they are made of.
+	epubCache *lruCache
+
+	// epubBuilds makes the concurrent requests for an EPUB that isn't
+	// cached share a single build.
+	epubBuilds singleflight.Group
+)
+
+// EPUBPath returns the path of the EPUB of the p.
+func (p post) EPUBPath() string {
+	return "/posts/" + p.ID + ".epub"
+}
+
+// epubImage is an image embedded into an EPUB.
+type epubImage struct {
+	ID        string
+	Href      string
+	MediaType string
+	data      []byte
+}
+
+// epubChapter is a post in an EPUB.
+type epubChapter struct {
+	ID      string
+	Href    string
+	Title   string
+	Content string
+	Post    post
+}
+
+// epubBook is an EPUB being built.
+type epubBook struct {
+	Identifier string
+	Title      string
+	Language   string
+	Creator    string
+	Modified   string
+	Chapters   []epubChapter
+	Images     []*epubImage
+
+	// imageHrefs is the hrefs of the Images by the URLs they are from, or
+	// an empty string for those that could not be embedded.
+	imageHrefs map[string]string
+}
+
+// embedImage embeds the image of the src, an absolute URL, into the eb and
+// returns its href in the eb, or an empty string if it can't be embedded. The
+// uploads and the image variants are read right from the disk.
+func (eb *epubBook) embedImage(src string) string {
+	if href, ok := eb.imageHrefs[src]; ok {
+		return href
+	}
+
+	eb.imageHrefs[src] = ""
+
+	var (
+		b   []byte
+		err error
+	)
+	rel := strings.TrimPrefix(src, config.BaseURL)
+	switch {
+	case rel != src && strings.HasPrefix(rel, "/uploads/"):
+		b, err = readRootedFile(uploadFilename(rel))
+	case rel != src && strings.HasPrefix(rel, "/images/"):
+		b, err = readRootedFile(imageVariantFilename(rel))
+	default:
+		var fr *fetchedResponse
+		if fr, err = fetch("GET", src, nil, nil); err == nil {
+			if fr.Status != http.StatusOK {
+				err = fmt.Errorf(
+					"unexpected status %d",
+					fr.Status,
+				)
+			}
+
+			b = fr.Body
+		}
+	}
+
+	if err != nil {
+		air.WARN(
+			"failed to embed image into epub",
+			map[string]interface{}{
+				"src":   src,
+				"error": err.Error(),
+			},
+		)
+		return ""
+	} else if len(b) > epubMaxImageBytes {
+		return ""
+	}
+
+	mt := http.DetectContentType(b)
+	ext, ok := epubImageExts[mt]
+	if !ok {
+		return ""
+	}
+
+	id := fmt.Sprintf("image-%d", len(eb.Images)+1)
+	href := "images/" + id + ext
+	eb.Images = append(eb.Images, &epubImage{
+		ID:        id,
+		Href:      href,
+		MediaType: mt,
+		data:      b,
+	})
+	eb.imageHrefs[src] = href
+
+	return href
+}
+
+// epubXHTML returns the content of the p as the XHTML of a chapter of the eb,
+// with its images embedded into the eb.
+func epubXHTML(eb *epubBook, p post) (string, error) {
+	body := &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	}
+
+	ns, err := html.ParseFragment(
+		strings.NewReader(liteHTML(p.AbsoluteContent())),
+		body,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	self := config.BaseURL + p.Permalink
+	buf := bytes.Buffer{}
+	var write func(n *html.Node)
+	write = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			buf.WriteString(html.EscapeString(n.Data))
+			return
+		case html.ElementNode:
+		default:
+			return
+		}
+
+		if n.Namespace != "" || n.Data == "source" {
+			return
+		} else if n.Data == "picture" {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				write(c)
+			}
+
+			return
+		}
+
+		attrs := map[string]string{}
+		for _, a := range n.Attr {
+			attrs[a.Key] = a.Val
+		}
+
+		if n.Data == "img" {
+			href := eb.embedImage(attrs["src"])
+			if href == "" {
+				buf.WriteString(html.EscapeString(attrs["alt"]))
+				return
+			}
+
+			fmt.Fprintf(
+				&buf,
+				`<img src="%s" alt="%s"/>`,
+				href,
+				html.EscapeString(attrs["alt"]),
+			)
+
+			return
+		}
+
+		buf.WriteString("<" + n.Data)
+		for _, a := range n.Attr {
+			if a.Namespace != "" || a.Key == "xmlns" ||
+				!epubAttrPattern.MatchString(a.Key) {
+				continue
+			}
+
+			v := a.Val
+			if a.Key == "href" && strings.HasPrefix(v, self+"#") {
+				v = strings.TrimPrefix(v, self)
+			}
+
+			fmt.Fprintf(
+				&buf,
+				` %s="%s"`,
+				a.Key,
+				html.EscapeString(v),
+			)
+		}
+
+		if epubVoidElements[n.Data] {
+			buf.WriteString("/>")
+			return
+		}
+
+		buf.WriteString(">")
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			write(c)
+		}
+
+		buf.WriteString("</" + n.Data + ">")
+	}
+
+	for _, n := range ns {
+		write(n)
+	}
+
+	return buf.String(), nil
+}
+
+// epubContainer is the "META-INF/container.xml" of an EPUB, which tells where
+// its package document is.
+type epubContainer struct {
+	XMLName   xml.Name       `xml:"container"`
+	Xmlns     string         `xml:"xmlns,attr"`
+	Version   string         `xml:"version,attr"`
+	Rootfiles []epubRootfile `xml:"rootfiles>rootfile"`
+}
+
+// epubRootfile is a rootfile of an `epubContainer`.
+type epubRootfile struct {
+	FullPath  string `xml:"full-path,attr"`
+	MediaType string `xml:"media-type,attr"`
+}
+
+// epubPackage is the package document of an EPUB, which lists its metadata
+// and its files.
+type epubPackage struct {
+	XMLName          xml.Name       `xml:"package"`
+	Xmlns            string         `xml:"xmlns,attr"`
+	XmlnsDC          string         `xml:"xmlns:dc,attr"`
+	Version          string         `xml:"version,attr"`
+	UniqueIdentifier string         `xml:"unique-identifier,attr"`
+	Identifier       epubIdentifier `xml:"metadata>dc:identifier"`
+	Title            string         `xml:"metadata>dc:title"`
+	Language         string         `xml:"metadata>dc:language"`
+	Creator          string         `xml:"metadata>dc:creator"`
+	Modified         epubMeta       `xml:"metadata>meta"`
+	Items            []epubItem     `xml:"manifest>item"`
+	Itemrefs         []epubItemref  `xml:"spine>itemref"`
+}
+
+// epubIdentifier is the identifier of an `epubPackage`.
+type epubIdentifier struct {
+	ID    string `xml:"id,attr"`
+	Value string `xml:",chardata"`
+}
+
+// epubMeta is a meta of an `epubPackage`.
+type epubMeta struct {
+	Property string `xml:"property,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// epubItem is a file in the manifest of an `epubPackage`.
+type epubItem struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr,omitempty"`
+}
+
+// epubItemref is a file in the spine of an `epubPackage`.
+type epubItemref struct {
+	IDRef string `xml:"idref,attr"`
+}
+
+// opf returns the package document of the eb.
+func (eb *epubBook) opf() epubPackage {
+	ep := epubPackage{
+		Xmlns:            "http://www.idpf.org/2007/opf",
+		XmlnsDC:          "http://purl.org/dc/elements/1.1/",
+		Version:          "3.0",
+		UniqueIdentifier: "identifier",
+		Identifier: epubIdentifier{
+			ID:    "identifier",
+			Value: eb.Identifier,
+		},
+		Title:    eb.Title,
+		Language: eb.Language,
+		Creator:  eb.Creator,
+		Modified: epubMeta{
+			Property: "dcterms:modified",
+			Value:    eb.Modified,
+		},
+		Items: []epubItem{{
+			ID:         "nav",
+			Href:       "nav.xhtml",
+			MediaType:  "application/xhtml+xml",
+			Properties: "nav",
+		}},
+	}
+
+	for _, c := range eb.Chapters {
+		ep.Items = append(ep.Items, epubItem{
+			ID:        c.ID,
+			Href:      c.Href,
+			MediaType: "application/xhtml+xml",
+		})
+		ep.Itemrefs = append(ep.Itemrefs, epubItemref{IDRef: c.ID})
+	}
+
+	for _, img := range eb.Images {
+		ep.Items = append(ep.Items, epubItem{
+			ID:        img.ID,
+			Href:      img.Href,
+			MediaType: img.MediaType,
+		})
+	}
+
+	return ep
+}
+
+// epubXML returns the v marshaled as an XML document.
+func epubXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+// xhtmlDocument returns the XHTML document of the title and the body in the
+// language.
+func xhtmlDocument(language, title, body string) []byte {
+	return []byte(fmt.Sprintf(
+		"%s<!DOCTYPE html>\n"+
+			`<html xmlns="http://www.w3.org/1999/xhtml" `+
+			`xmlns:epub="http://www.idpf.org/2007/ops" `+
+			`xml:lang="%s">`+
+			"<head><title>%s</title></head>"+
+			"<body>%s</body></html>\n",
+		xml.Header,
+		html.EscapeString(language),
+		html.EscapeString(title),
+		body,
+	))
+}
+
+// navXHTML returns the navigation document of the eb, its table of contents.
+func (eb *epubBook) navXHTML() []byte {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(
+		&buf,
+		`<nav epub:type="toc"><h1>%s</h1><ol>`,
+		html.EscapeString(eb.Title),
+	)
+	for _, c := range eb.Chapters {
+		fmt.Fprintf(
+			&buf,
+			`<li><a href="%s">%s</a></li>`,
+			c.Href,
+			html.EscapeString(c.Title),
+		)
+	}
+
+	buf.WriteString("</ol></nav>")
+
+	return xhtmlDocument(eb.Language, eb.Title, buf.String())
+}
+
+// chapterXHTML returns the XHTML document of the c of the eb.
+func (eb *epubBook) chapterXHTML(c epubChapter) []byte {
+	return xhtmlDocument(eb.Language, c.Title, fmt.Sprintf(
+		`<h1>%s</h1><p><a href="%s">%s</a></p>%s`,
+		html.EscapeString(c.Title),
+		html.EscapeString(config.BaseURL+c.Post.Permalink),
+		c.Post.Datetime.Format("2006-01-02"),
+		c.Content,
+	))
+}
+
+// epubHash returns the hash of the EPUB of the title made of the ps, which
+// changes whenever any of them does.
+func epubHash(title string, ps []post) string {
+	h := md5.New()
+	fmt.Fprintf(h, "%s\x00", title)
+	for _, p := range ps {
+		fmt.Fprintf(
+			h,
+			"%s\x00%s\x00%s\x00%s\x00",
+			p.ID,
+			p.Title,
+			p.Updated.Format(time.RFC3339Nano),
+			p.Content,
+		)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// buildEPUB builds the EPUB 3 of the title made of the ps, one chapter each,
+// in the language of the first of them.
+func buildEPUB(identifier, title string, ps []post) ([]byte, error) {
+	eb := &epubBook{
+		Identifier: identifier,
+		Title:      title,
+		Language:   postLanguage(ps[0]),
+		Creator:    config.Title,
+		Modified:   time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		imageHrefs: map[string]string{},
+	}
+
+	if len(ps) == 1 {
+		if a := ps[0].AuthorProfile(); a != nil {
+			eb.Creator = a.Name
+		}
+	}
+
+	for i, p := range ps {
+		content, err := epubXHTML(eb, p)
+		if err != nil {
+			return nil, err
+		}
+
+		id := fmt.Sprintf("chapter-%d", i+1)
+		eb.Chapters = append(eb.Chapters, epubChapter{
+			ID:      id,
+			Href:    id + ".xhtml",
+			Title:   p.Title,
+			Content: content,
+			Post:    p,
+		})
+	}
+
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+
+	// The "mimetype" must come first and be stored as it is.
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   "mimetype",
+		Method: zip.Store,
+	})
+	if err != nil {
+		return nil, err
+	} else if _, err := w.Write(
+		[]byte("application/epub+zip"),
+	); err != nil {
+		return nil, err
+	}
+
+	container, err := epubXML(epubContainer{
+		Xmlns: "urn:oasis:names:tc:opendocument:xmlns:container",
+		Rootfiles: []epubRootfile{{
+			FullPath:  "OEBPS/content.opf",
+			MediaType: "application/oebps-package+xml",
+		}},
+		Version: "1.0",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opf, err := epubXML(eb.opf())
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/container.xml", container},
+		{"OEBPS/content.opf", opf},
+		{"OEBPS/nav.xhtml", eb.navXHTML()},
+	}
+	for _, c := range eb.Chapters {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{"OEBPS/" + c.Href, eb.chapterXHTML(c)})
+	}
+
+	for _, img := range eb.Images {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{"OEBPS/" + img.Href, img.data})
+	}
+
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		} else if _, err := w.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// serveEPUB serves the EPUB of the title made of the ps as the filename. The
+// EPUBs are cached by the `epubHash`es of the ps, so a post is only built into
+// one again once it changes.
+func serveEPUB(
+	req *air.Request,
+	res *air.Response,
+	identifier string,
+	title string,
+	filename string,
+	ps []post,
+) error {
+	hash := epubHash(title, ps)
+	v, err, _ := epubBuilds.Do(hash, func() (interface{}, error) {
+		if b, ok := epubCache.get(hash); ok {
+			return b, nil
+		}
+
+		b, err := buildEPUB(identifier, title, ps)
+		if err != nil {
+			return nil, err
+		}
+
+		epubCache.set(hash, b, len(b))
+
+		return b, nil
+	})
+	if err != nil {
+		air.ERROR("failed to build epub", map[string]interface{}{
+			"filename": filename,
+			"error":    err.Error(),
+		})
+		return err
+	}
+
+	res.SetHeader("content-type", "application/epub+zip")
+	res.SetHeader(
+		"content-disposition",
+		fmt.Sprintf("attachment; filename=%q", filename),
+	)
+	res.SetHeader("etag", `"`+hash+`"`)
+
+	return res.WriteBlob(v.([]byte))
+}
+
+// epubPostHandler serves the EPUB of the post of the id in the snap.
+func epubPostHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+) error {
+	p, ok := snap.posts[id]
+	if !config.EPUBEnabled || !ok || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if p.Protected() || p.MembersOnly {
+		res.SetHeader("cache-control", "private, no-cache")
+	}
+
+	res.SetHeader(
+		"link",
+		"<"+config.BaseURL+p.Permalink+`>; rel="canonical"`,
+	)
+
+	return serveEPUB(req, res, p.EntryID, p.Title, p.ID+".epub", []post{p})
+}
+
+// archiveEPUBHandler serves the EPUB of a selection of the listed posts,
+// oldest first: the parts of the "series" param, the posts tagged with the
+// "tag" param, the posts of the comma-separated "ids" param or else the
+// latest ones, `epubMaxPosts` at most. The password-protected and the
+// members-only posts are left out.
+func archiveEPUBHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+	if !config.EPUBEnabled {
+		return air.NotFoundHandler(req, res)
+	}
+
+	title := config.Title
+	var ps []post
+	if name := paramValue(req, "series"); name != "" {
+		title = name
+		ps = append(ps, snap.series[name]...)
+	} else {
+		tag := paramValue(req, "tag")
+		ids := map[string]bool{}
+		for _, id := range strings.Split(paramValue(req, "ids"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids[id] = true
+			}
+		}
+
+		if tag != "" {
+			title = config.Title + ": " + tag
+		}
+
+		for _, p := range snap.orderedPosts {
+			if tag != "" && !stringSliceContains(p.Tags, tag) ||
+				len(ids) > 0 && !ids[p.ID] {
+				continue
+			}
+
+			ps = append(ps, p)
+		}
+
+		sort.SliceStable(ps, func(i, j int) bool {
+			return ps[i].Datetime.Before(ps[j].Datetime)
+		})
+	}
+
+	sps := ps[:0:0]
+	for _, p := range ps {
+		if !p.Protected() && !p.MembersOnly {
+			sps = append(sps, p)
+		}
+	}
+
+	if len(sps) > epubMaxPosts {
+		sps = sps[len(sps)-epubMaxPosts:]
+	}
+
+	if len(sps) == 0 {
+		return air.NotFoundHandler(req, res)
+	}
+
+	return serveEPUB(
+		req,
+		res,
+		config.BaseURL+"/archive.epub#"+epubHash(title, sps),
+		title,
+		"archive.epub",
+		sps,
+	)
+}
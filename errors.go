@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// errorTemplate returns the template of the error pages of the status, which
+// is the "errors/<status>.html" if there is one, or the "error.html".
+func errorTemplate(status int) string {
+	name := "errors/" + strconv.Itoa(status) + ".html"
+	filename := filepath.Join(air.TemplateRoot, filepath.FromSlash(name))
+	if _, err := os.Stat(filename); err == nil {
+		return name
+	}
+
+	return "error.html"
+}
+
+// acceptQuality returns the quality that the accept, the value of an "Accept"
+// header, gives to the media type mt, which is 0 if it is not acceptable.
+func acceptQuality(accept, mt string) float64 {
+	best, bestSpecificity := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		rmt := strings.ToLower(strings.TrimSpace(params[0]))
+
+		specificity := 0
+		switch {
+		case rmt == mt:
+			specificity = 2
+		case strings.HasSuffix(rmt, "/*") &&
+			strings.HasPrefix(mt, strings.TrimSuffix(rmt, "*")):
+			specificity = 1
+		case rmt == "*/*":
+		default:
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+
+			if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+				q = v
+			}
+		}
+
+		// The most specific media range that matches wins.
+		if specificity > bestSpecificity {
+			best, bestSpecificity = q, specificity
+		}
+	}
+
+	return best
+}
+
+// prefersJSON reports whether the req prefers a JSON response to an HTML one.
+func prefersJSON(req *air.Request) bool {
+	accept := req.Header("accept").Value()
+	if accept == "" {
+		return false
+	}
+
+	return acceptQuality(accept, "application/json") >
+		acceptQuality(accept, "text/html")
+}
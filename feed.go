@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tdewolff/minify"
+	mxml "github.com/tdewolff/minify/xml"
+)
+
+const (
+	// feedContentFull is the `config.FeedContent` of the feeds that carry
+	// the whole content of the posts.
+	feedContentFull = "full"
+
+	// feedContentSummary is the `config.FeedContent` of the feeds that
+	// carry the summaries of the posts only.
+	feedContentSummary = "summary"
+
+	// defaultFeedEntries is the `config.FeedEntries` unless set.
+	defaultFeedEntries = 10
+)
+
+// feedVariant is the feed rendered with a number of the entries other than
+// the `config.FeedEntries`, as asked for by the "limit" param.
+type feedVariant struct {
+	body         []byte
+	encodeds     map[string][]byte
+	etag         string
+	lastModified string
+}
+
+var (
+	// feedCache is the cache of the rendered entries and the rendered
+	// documents of the feeds, by the hashes of what goes into them.
+	feedCache *lruCache
+
+	// feedBufferPool is the pool of the buffers that the feeds are
+	// rendered into.
+	feedBufferPool = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+)
+
+// feedEntry is what the "entry" template of the `feedTemplate` renders an
+// entry of a feed from.
+type feedEntry struct {
+	BaseURL     string
+	Locale      string
+	Summary     string
+	SummaryOnly bool
+	Post        post
+}
+
+// key returns the hash of everything that the fe renders from.
+func (fe feedEntry) key() string {
+	h := md5.New()
+	p := fe.Post
+	fmt.Fprintf(
+		h,
+		"%s\x00%s\x00%s\x00%t\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00",
+		fe.BaseURL,
+		fe.Locale,
+		fe.Summary,
+		fe.SummaryOnly,
+		p.ID,
+		p.EntryID,
+		p.Permalink,
+		p.ShortCode,
+		p.Datetime.Format(time.RFC3339Nano),
+		p.Updated.Format(time.RFC3339Nano),
+	)
+	if a := p.AuthorProfile(); a != nil {
+		fmt.Fprintf(h, "%s\x00%s\x00", a.Name, a.Path())
+	}
+
+	h.Write(p.Source)
+	h.Write([]byte(p.Content))
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// checkFeedOptions checks the `config.FeedEntries`, the
+// `config.FeedMaxEntries` and the `config.FeedContent`. Those left unset
+// default to the `defaultFeedEntries`, as many and the `feedContentFull`.
+func checkFeedOptions() error {
+	if config.FeedEntries == 0 {
+		config.FeedEntries = defaultFeedEntries
+	}
+
+	if config.FeedMaxEntries == 0 {
+		config.FeedMaxEntries = config.FeedEntries
+	}
+
+	if config.FeedContent == "" {
+		config.FeedContent = feedContentFull
+	}
+
+	if config.FeedEntries < 1 {
+		return errors.New("feed entries must be at least 1")
+	} else if config.FeedMaxEntries < config.FeedEntries {
+		return errors.New(
+			"feed max entries must be at least the feed entries",
+		)
+	}
+
+	switch config.FeedContent {
+	case feedContentFull, feedContentSummary:
+	default:
+		return fmt.Errorf("unknown feed content %q", config.FeedContent)
+	}
+
+	return nil
+}
+
+// renderFeed returns the minified feed that the `feedTemplate` renders from
+// the data, which is told whether the `config.FeedContent` leaves out the
+// content of the posts.
+//
+// If the `feedTemplate` defines an "entry" template, as the default one does,
+// each of the "Posts" of the data is rendered with it on its own and given to
+// the feed in the "Entries". Both the entries and the feed are cached by the
+// hashes of what they are rendered from, so the cost of rendering a feed grows
+// with the posts that have changed rather than with all of them. Without such
+// a template, the feed renders the "Posts" itself, uncached.
+func renderFeed(data map[string]interface{}) ([]byte, error) {
+	summaryOnly := config.FeedContent == feedContentSummary
+	data["SummaryOnly"] = summaryOnly
+	if _, ok := data["Summaries"]; !ok {
+		data["Summaries"] = map[string]string{}
+	}
+
+	if feedTemplate.Lookup("entry") == nil {
+		return minifyFeed(data)
+	}
+
+	locale, _ := data["Locale"].(string)
+	summaries, _ := data["Summaries"].(map[string]string)
+	ops, _ := data["Posts"].([]post)
+
+	fes := make([]feedEntry, 0, len(ops))
+	h := md5.New()
+	fmt.Fprintf(
+		h,
+		"%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00",
+		data["Title"],
+		data["FeedPath"],
+		data["Links"],
+		data["Archive"],
+		data["Tombstones"],
+		data["Updated"],
+	)
+	for _, p := range ops {
+		fe := feedEntry{
+			BaseURL:     config.BaseURL,
+			Locale:      locale,
+			Summary:     summaries[p.ID],
+			SummaryOnly: summaryOnly,
+			Post:        p,
+		}
+		fes = append(fes, fe)
+		io.WriteString(h, fe.key())
+	}
+
+	key := fmt.Sprintf("feed:%x", h.Sum(nil))
+	if v, ok := feedCache.get(key); ok {
+		return v.([]byte), nil
+	}
+
+	entries := make([]string, 0, len(fes))
+	for _, fe := range fes {
+		e, err := renderFeedEntry(fe)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	data["Entries"] = entries
+
+	b, err := minifyFeed(data)
+	if err != nil {
+		return nil, err
+	}
+
+	feedCache.set(key, b, len(b))
+
+	return b, nil
+}
+
+// renderFeedEntry returns the fe rendered with the "entry" template of the
+// `feedTemplate`.
+func renderFeedEntry(fe feedEntry) (string, error) {
+	key := "entry:" + fe.key()
+	if v, ok := feedCache.get(key); ok {
+		return v.(string), nil
+	}
+
+	buf := feedBufferPool.Get().(*bytes.Buffer)
+	defer feedBufferPool.Put(buf)
+	buf.Reset()
+
+	if err := feedTemplate.ExecuteTemplate(buf, "entry", fe); err != nil {
+		return "", err
+	}
+
+	e := buf.String()
+	feedCache.set(key, e, len(e))
+
+	return e, nil
+}
+
+// minifyFeed returns the `feedTemplate` executed with the data and minified.
+// The template is executed straight into the minifier through a pipe, so the
+// feed is never held unminified in a buffer of its own.
+func minifyFeed(data map[string]interface{}) ([]byte, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(feedTemplate.Execute(pw, data))
+	}()
+
+	buf := feedBufferPool.Get().(*bytes.Buffer)
+	defer feedBufferPool.Put(buf)
+	buf.Reset()
+
+	err := mxml.DefaultMinifier.Minify(minify.New(), buf, pr, nil)
+	pr.CloseWithError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// renderLatestFeed returns the minified feed of the limit latest of the listed
+// posts of the snap and its tombstones, which is served at the path.
+func renderLatestFeed(
+	snap *postsSnapshot,
+	limit int,
+	path string,
+) ([]byte, error) {
+	latestPosts := snap.orderedPosts
+	if len(latestPosts) > limit {
+		latestPosts = latestPosts[:limit]
+	}
+
+	tombstones := snap.feedTombstones
+	updated := lastUpdated(latestPosts)
+	if len(tombstones) > 0 && tombstones[0].When.After(updated) {
+		updated = tombstones[0].When
+	}
+
+	archivePages := feedArchivePages(len(snap.orderedPosts))
+	return renderFeed(map[string]interface{}{
+		"BaseURL":    config.BaseURL,
+		"Title":      config.Title,
+		"FeedPath":   path,
+		"Links":      feedLinks(0, archivePages),
+		"Posts":      latestPosts,
+		"Tombstones": tombstones,
+		"Updated":    updated,
+	})
+}
+
+// feedLimit returns the number of the entries asked for by the s, the "limit"
+// param, within the 1 to the `config.FeedMaxEntries`. An empty s asks for the
+// `config.FeedEntries`.
+func feedLimit(s string) (int, error) {
+	if s == "" {
+		return config.FeedEntries, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad feed limit %q", s)
+	} else if limit < 1 {
+		limit = 1
+	} else if limit > config.FeedMaxEntries {
+		limit = config.FeedMaxEntries
+	}
+
+	return limit, nil
+}
+
+// latestFeedVariant returns the `feedVariant` of the limit of the snap,
+// rendering it if it is not in its feedVariants yet.
+func latestFeedVariant(snap *postsSnapshot, limit int) (*feedVariant, error) {
+	if fv, ok := snap.feedVariants.Load(limit); ok {
+		return fv.(*feedVariant), nil
+	}
+
+	b, err := renderLatestFeed(
+		snap,
+		limit,
+		"/feed?limit="+strconv.Itoa(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	fv := &feedVariant{
+		body:         b,
+		encodeds:     precompress(b),
+		etag:         fmt.Sprintf(`"%x"`, md5.Sum(b)),
+		lastModified: time.Now().UTC().Format(http.TimeFormat),
+	}
+
+	actual, _ := snap.feedVariants.LoadOrStore(limit, fv)
+
+	return actual.(*feedVariant), nil
+}
+
+// Summary returns the summary of the p for the feeds whose
+// `config.FeedContent` is the `feedContentSummary`.
+func (p post) Summary() string {
+	return postSummary(p)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// benchmarkFeedPosts returns the n posts of a made-up archive, newest first.
+func benchmarkFeedPosts(n int) []post {
+	content := ""
+	for i := 0; i < 10; i++ {
+		content += `<p>Lorem ipsum dolor sit amet, <a href="/posts/` +
+			`other">consectetur</a> adipiscing elit, sed do ` +
+			`eiusmod tempor incididunt ut labore et dolore ` +
+			`magna aliqua.</p>`
+	}
+
+	start := time.Date(2018, 2, 23, 8, 36, 24, 0, time.UTC)
+	ps := make([]post, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		id := fmt.Sprintf("post-%d", i)
+		d := start.Add(time.Duration(i) * time.Hour)
+		ps = append(ps, post{
+			ID:        id,
+			Title:     fmt.Sprintf("Post %d", i),
+			Datetime:  d,
+			Updated:   d,
+			Content:   htemplate.HTML(content),
+			Permalink: "/posts/" + id,
+			EntryID:   "tag:example.com,2018:" + id,
+			Source:    []byte(id + "\n\n" + content),
+		})
+	}
+
+	return ps
+}
+
+// benchmarkRenderFeed benchmarks the `renderFeed` of the entries latest of
+// the posts of an archive. The entries stay cached between the runs if warm,
+// while the feed itself is always rendered anew.
+func benchmarkRenderFeed(b *testing.B, entries int, warm bool) {
+	baseURL, feedContent := config.BaseURL, config.FeedContent
+	ft, fc := feedTemplate, feedCache
+	defer func() {
+		config.BaseURL, config.FeedContent = baseURL, feedContent
+		feedTemplate, feedCache = ft, fc
+	}()
+
+	config.BaseURL = "https://example.com"
+	config.FeedContent = feedContentFull
+
+	tb, err := ioutil.ReadFile(filepath.Join("templates", "feed.xml"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	feedTemplate = template.Must(
+		template.New("feed").Funcs(templateFuncs()).Parse(string(tb)),
+	)
+	feedCache = newLRUCache("benchmark_feed", 1<<30)
+
+	ps := benchmarkFeedPosts(10000)[:entries]
+	// The "Updated" differs in every run, so that the feed itself is never
+	// found in the `feedCache`.
+	render := func(i int) {
+		if _, err := renderFeed(map[string]interface{}{
+			"BaseURL":  config.BaseURL,
+			"Title":    "Benchmark",
+			"FeedPath": "/feed",
+			"Posts":    ps,
+			"Updated":  ps[0].Updated.Add(time.Duration(i)),
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if warm {
+		render(-1)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !warm {
+			b.StopTimer()
+			feedCache.purge()
+			b.StartTimer()
+		}
+
+		render(i)
+	}
+}
+
+func BenchmarkRenderFeed(b *testing.B) {
+	for _, entries := range []int{10, 100, 1000} {
+		for _, warm := range []bool{false, true} {
+			cache := "cold"
+			if warm {
+				cache = "warm"
+			}
+
+			name := fmt.Sprintf("entries=%d/%s", entries, cache)
+			b.Run(name, func(b *testing.B) {
+				benchmarkRenderFeed(b, entries, warm)
+			})
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/aofei/air"
+)
+
+// feedPageSize returns the number of the entries of each of the archive pages
+// of the feed, which is that of the feed itself.
+func feedPageSize() int {
+	return config.FeedEntries
+}
+
+// feedLink is a link of the feed to another feed document.
+type feedLink struct {
+	Rel  string
+	Href string
+}
+
+// feedArchivePages returns the number of the archive pages of the feed for
+// the n posts. The archive pages are numbered from the oldest posts, so that
+// a page never changes once full (RFC 5005, section 4). Only the full ones
+// are served, the newer posts are all in the feed itself.
+func feedArchivePages(n int) int {
+	if n <= feedPageSize() {
+		return 0
+	}
+
+	return n / feedPageSize()
+}
+
+// feedArchivePath returns the path of the archive page.
+func feedArchivePath(page int) string {
+	return "/feed?page=" + strconv.Itoa(page)
+}
+
+// feedLinks returns the links of the page of the feed to the other documents
+// of the feed when there are the pages archive pages. The page 0 is the feed
+// itself. Both the archive relations and the paging ones (RFC 5005, sections 3
+// and 4) are given, so that the clients of either can walk the history.
+func feedLinks(page, pages int) []feedLink {
+	if pages == 0 {
+		return nil
+	} else if page == 0 {
+		return []feedLink{
+			{Rel: "next", Href: feedArchivePath(pages)},
+			{Rel: "prev-archive", Href: feedArchivePath(pages)},
+		}
+	}
+
+	fls := []feedLink{
+		{Rel: "current", Href: "/feed"},
+		{Rel: "first", Href: "/feed"},
+		{Rel: "last", Href: feedArchivePath(1)},
+	}
+
+	if page > 1 {
+		fls = append(
+			fls,
+			feedLink{Rel: "next", Href: feedArchivePath(page - 1)},
+			feedLink{
+				Rel:  "prev-archive",
+				Href: feedArchivePath(page - 1),
+			},
+		)
+	}
+
+	newer := "/feed"
+	if page < pages {
+		newer = feedArchivePath(page + 1)
+	}
+
+	return append(
+		fls,
+		feedLink{Rel: "previous", Href: newer},
+		feedLink{Rel: "next-archive", Href: newer},
+	)
+}
+
+// feedArchiveHandler serves the archive page of the feed in the "page" param.
+func feedArchiveHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	ops := snap.orderedPosts
+	pages := feedArchivePages(len(ops))
+	page, err := strconv.Atoi(paramValue(req, "page"))
+	if err != nil || page < 1 || page > pages {
+		return air.NotFoundHandler(req, res)
+	}
+
+	size := feedPageSize()
+	pps := ops[len(ops)-page*size : len(ops)-(page-1)*size]
+
+	b, err := renderFeed(map[string]interface{}{
+		"BaseURL":  config.BaseURL,
+		"Title":    config.Title,
+		"FeedPath": feedArchivePath(page),
+		"Links":    feedLinks(page, pages),
+		"Archive":  true,
+		"Posts":    pps,
+		"Updated":  lastUpdated(pps),
+	})
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/atom+xml; charset=utf-8")
+	res.SetHeader("cache-control", "max-age=86400")
+
+	return res.WriteBlob(b)
+}
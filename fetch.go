@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchMaxBodyBytes is the maximum size of the body of a fetched response.
+const fetchMaxBodyBytes = 10 << 20
+
+// fetchedResponse is a response fetched by the `fetch`.
+type fetchedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	expires time.Time
+}
+
+// size returns the approximate number of bytes the fr takes in memory.
+func (fr *fetchedResponse) size() int {
+	size := len(fr.Body)
+	for k, vs := range fr.Header {
+		size += len(k)
+		for _, v := range vs {
+			size += len(v)
+		}
+	}
+
+	return size
+}
+
+// fetchHost is the state of the requests to a host.
+type fetchHost struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+var (
+	fetchClient       *http.Client
+	fetchHostInterval time.Duration
+	fetchCache        *lruCache
+
+	fetchHostsMutex sync.Mutex
+	fetchHosts      = map[string]*fetchHost{}
+)
+
+// setupFetch prepares the `fetch` from the configuration.
+func setupFetch() error {
+	timeout, err := time.ParseDuration(config.FetchTimeout)
+	if err != nil {
+		return err
+	}
+
+	fetchHostInterval, err = time.ParseDuration(config.FetchHostInterval)
+	if err != nil {
+		return err
+	}
+
+	fetchClient = &http.Client{
+		Timeout: timeout,
+	}
+	fetchCache = newLRUCache("fetch", config.FetchCacheMaxBytes)
+
+	return nil
+}
+
+// fetch sends a request of the method with the header and the body (if any)
+// to the rawURL. It is the only way out to third parties: the requests to
+// the same host are spaced at least the `config.FetchHostInterval` apart, and
+// the cacheable GET responses are answered from the cache, revalidated with
+// the origin once they get stale.
+func fetch(
+	method string,
+	rawURL string,
+	header http.Header,
+	body []byte,
+) (*fetchedResponse, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported url scheme")
+	}
+
+	var cached *fetchedResponse
+	if method == "GET" {
+		if v, ok := fetchCache.get(rawURL); ok {
+			cached = v.(*fetchedResponse)
+			if time.Now().Before(cached.expires) {
+				return cached, nil
+			}
+		}
+	}
+
+	var br io.Reader
+	if body != nil {
+		br = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, rawURL, br)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	req.Header.Set("user-agent", config.FetchUserAgent)
+
+	if cached != nil {
+		if etag := cached.Header.Get("etag"); etag != "" {
+			req.Header.Set("if-none-match", etag)
+		}
+
+		if lm := cached.Header.Get("last-modified"); lm != "" {
+			req.Header.Set("if-modified-since", lm)
+		}
+	}
+
+	waitForFetchHost(u.Host)
+
+	res, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if cached != nil && res.StatusCode == http.StatusNotModified {
+		fr := *cached
+		fr.expires = fetchExpires(res.Header)
+		fetchCache.set(rawURL, &fr, fr.size())
+		return &fr, nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, fetchMaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &fetchedResponse{
+		Status:  res.StatusCode,
+		Header:  res.Header,
+		Body:    b,
+		expires: fetchExpires(res.Header),
+	}
+	if method == "GET" && res.StatusCode == http.StatusOK &&
+		!strings.Contains(res.Header.Get("cache-control"), "no-store") {
+		fetchCache.set(rawURL, fr, fr.size())
+	}
+
+	return fr, nil
+}
+
+// waitForFetchHost blocks until a request can be sent to the host.
+func waitForFetchHost(host string) {
+	fetchHostsMutex.Lock()
+	fh, ok := fetchHosts[host]
+	if !ok {
+		fh = &fetchHost{}
+		fetchHosts[host] = fh
+	}
+	fetchHostsMutex.Unlock()
+
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+
+	if d := time.Until(fh.next); d > 0 {
+		time.Sleep(d)
+	}
+
+	fh.next = time.Now().Add(fetchHostInterval)
+}
+
+// fetchExpires returns the time that a response with the header becomes
+// stale, according to its "Cache-Control" or "Expires".
+func fetchExpires(header http.Header) time.Time {
+	for _, d := range strings.Split(header.Get("cache-control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "no-cache" {
+			return time.Time{}
+		} else if !strings.HasPrefix(d, "max-age=") {
+			continue
+		}
+
+		s, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+		if err == nil {
+			return time.Now().Add(time.Duration(s) * time.Second)
+		}
+	}
+
+	if t, err := http.ParseTime(header.Get("expires")); err == nil {
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// fontConfig is a web font served first-party.
+type fontConfig struct {
+	Family  string `toml:"family"`
+	File    string `toml:"file"`
+	Weight  string `toml:"weight"`
+	Style   string `toml:"style"`
+	Preload bool   `toml:"preload"`
+}
+
+// webFont is a web font ready to be served.
+type webFont struct {
+	Family  string
+	Weight  string
+	Style   string
+	Preload bool
+	URL     string
+	Type    string
+
+	data []byte
+}
+
+// buildWebFonts subsets the configured fonts to the runes used by the site
+// and builds the stylesheet declaring them. It returns the fonts, the URL of
+// the stylesheet and the bodies of both by their paths.
+func buildWebFonts(ops []post) ([]*webFont, string, map[string][]byte) {
+	if len(config.Fonts) == 0 {
+		return nil, "", nil
+	}
+
+	runes := siteRunes(ops)
+
+	wfs := make([]*webFont, 0, len(config.Fonts))
+	bps := map[string][]byte{}
+	css := bytes.Buffer{}
+	for _, fc := range config.Fonts {
+		b, err := ioutil.ReadFile(fc.File)
+		if err != nil {
+			air.ERROR(
+				"failed to read font file",
+				map[string]interface{}{
+					"file":  fc.File,
+					"error": err.Error(),
+				},
+			)
+			continue
+		}
+
+		if sb, err := subsetFont(b, runes); err != nil {
+			air.WARN(
+				"failed to subset font, serving it as is",
+				map[string]interface{}{
+					"file":  fc.File,
+					"error": err.Error(),
+				},
+			)
+		} else {
+			b = sb
+		}
+
+		ext := strings.ToLower(filepath.Ext(fc.File))
+		name := strings.TrimSuffix(filepath.Base(fc.File), ext)
+		wf := &webFont{
+			Family:  fc.Family,
+			Weight:  fc.Weight,
+			Style:   fc.Style,
+			Preload: fc.Preload,
+			URL: fmt.Sprintf(
+				"/fonts/%s.%x%s",
+				name,
+				md5.Sum(b),
+				ext,
+			),
+			Type: "font/ttf",
+			data: b,
+		}
+		if ext == ".otf" {
+			wf.Type = "font/otf"
+		}
+
+		if wf.Weight == "" {
+			wf.Weight = "normal"
+		}
+
+		if wf.Style == "" {
+			wf.Style = "normal"
+		}
+
+		fmt.Fprintf(
+			&css,
+			"@font-face{font-family:%q;src:url(%q);"+
+				"font-weight:%s;font-style:%s;"+
+				"font-display:swap}\n",
+			wf.Family,
+			sitePath(wf.URL),
+			wf.Weight,
+			wf.Style,
+		)
+
+		wfs = append(wfs, wf)
+		bps[wf.URL] = wf.data
+	}
+
+	cssURL := fmt.Sprintf("/fonts/fonts.%x.css", md5.Sum(css.Bytes()))
+	bps[cssURL] = css.Bytes()
+
+	return wfs, cssURL, bps
+}
+
+// siteRunes returns all the runes that may appear on the site, which are the
+// printable ASCII, the ones in the locales, the templates and the ops.
+func siteRunes(ops []post) map[rune]bool {
+	runes := map[rune]bool{}
+	addString := func(s string) {
+		for _, r := range s {
+			runes[r] = true
+		}
+	}
+
+	for r := rune(0x20); r < 0x7f; r++ {
+		runes[r] = true
+	}
+
+	lfs, _ := filepath.Glob(filepath.Join(air.LocaleRoot, "*.toml"))
+	for _, lf := range lfs {
+		l := map[string]string{}
+		if _, err := toml.DecodeFile(lf, &l); err != nil {
+			continue
+		}
+
+		for _, v := range l {
+			addString(v)
+		}
+	}
+
+	filepath.Walk(
+		air.TemplateRoot,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+
+			if b, err := ioutil.ReadFile(path); err == nil &&
+				utf8.Valid(b) {
+				addString(string(b))
+			}
+
+			return nil
+		},
+	)
+
+	for _, p := range ops {
+		addString(p.Title)
+		addString(string(p.Content))
+	}
+
+	return runes
+}
+
+// subsetFont returns a copy of the TrueType font b with the outlines of all
+// the glyphs not needed to render the runes removed. The glyph IDs are kept
+// so that all the other tables stay valid.
+func subsetFont(b []byte, runes map[rune]bool) ([]byte, error) {
+	if len(b) < 12 {
+		return nil, errors.New("font file is too short")
+	}
+
+	if v := binary.BigEndian.Uint32(b); v != 0x00010000 && v != 0x74727565 {
+		return nil, errors.New("not a TrueType font")
+	}
+
+	tables := map[string][]byte{}
+	numTables := int(binary.BigEndian.Uint16(b[4:]))
+	for i := 0; i < numTables; i++ {
+		r := 12 + i*16
+		if r+16 > len(b) {
+			return nil, errors.New("malformed table directory")
+		}
+
+		offset := int(binary.BigEndian.Uint32(b[r+8:]))
+		length := int(binary.BigEndian.Uint32(b[r+12:]))
+		if offset+length > len(b) {
+			return nil, errors.New("malformed table directory")
+		}
+
+		tables[string(b[r:r+4])] = b[offset : offset+length]
+	}
+
+	head, maxp := tables["head"], tables["maxp"]
+	loca, glyf, cmap := tables["loca"], tables["glyf"], tables["cmap"]
+	if len(head) < 54 || len(maxp) < 6 || loca == nil || glyf == nil ||
+		cmap == nil {
+		return nil, errors.New("missing required tables")
+	}
+
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	longLoca := binary.BigEndian.Uint16(head[50:]) != 0
+
+	offsets := make([]int, numGlyphs+1)
+	for i := range offsets {
+		if longLoca {
+			if 4*i+4 > len(loca) {
+				return nil, errors.New("malformed loca table")
+			}
+
+			offsets[i] = int(binary.BigEndian.Uint32(loca[4*i:]))
+		} else {
+			if 2*i+2 > len(loca) {
+				return nil, errors.New("malformed loca table")
+			}
+
+			o := binary.BigEndian.Uint16(loca[2*i:])
+			offsets[i] = int(o) * 2
+		}
+
+		if offsets[i] > len(glyf) {
+			return nil, errors.New("malformed loca table")
+		}
+	}
+
+	glyphs, err := cmapGlyphs(cmap, runes)
+	if err != nil {
+		return nil, err
+	}
+
+	glyphs[0] = true
+
+	// Composite glyphs need their components.
+	queue := make([]int, 0, len(glyphs))
+	for g := range glyphs {
+		queue = append(queue, g)
+	}
+
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if g >= numGlyphs || offsets[g] >= offsets[g+1] {
+			continue
+		}
+
+		for _, c := range compositeComponents(
+			glyf[offsets[g]:offsets[g+1]],
+		) {
+			if !glyphs[c] {
+				glyphs[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	newGlyf := bytes.Buffer{}
+	newLoca := make([]byte, 4*(numGlyphs+1))
+	for g := 0; g < numGlyphs; g++ {
+		binary.BigEndian.PutUint32(newLoca[4*g:], uint32(newGlyf.Len()))
+		if glyphs[g] && offsets[g] < offsets[g+1] {
+			newGlyf.Write(glyf[offsets[g]:offsets[g+1]])
+			for newGlyf.Len()%4 != 0 {
+				newGlyf.WriteByte(0)
+			}
+		}
+	}
+
+	binary.BigEndian.PutUint32(
+		newLoca[4*numGlyphs:],
+		uint32(newGlyf.Len()),
+	)
+
+	newHead := append([]byte{}, head...)
+	binary.BigEndian.PutUint32(newHead[8:], 0)
+	binary.BigEndian.PutUint16(newHead[50:], 1)
+
+	tables["head"] = newHead
+	tables["loca"] = newLoca
+	tables["glyf"] = newGlyf.Bytes()
+	delete(tables, "DSIG")
+
+	return writeFont(binary.BigEndian.Uint32(b), tables), nil
+}
+
+// cmapGlyphs returns the IDs of the glyphs the cmap table maps the runes to.
+// Only the format 4 and the format 12 subtables are supported.
+func cmapGlyphs(cmap []byte, runes map[rune]bool) (map[int]bool, error) {
+	if len(cmap) < 4 {
+		return nil, errors.New("malformed cmap table")
+	}
+
+	var sub4, sub12 []byte
+	numTables := int(binary.BigEndian.Uint16(cmap[2:]))
+	for i := 0; i < numTables; i++ {
+		r := 4 + i*8
+		if r+8 > len(cmap) {
+			return nil, errors.New("malformed cmap table")
+		}
+
+		offset := int(binary.BigEndian.Uint32(cmap[r+4:]))
+		if offset+4 > len(cmap) {
+			return nil, errors.New("malformed cmap table")
+		}
+
+		switch binary.BigEndian.Uint16(cmap[offset:]) {
+		case 4:
+			sub4 = cmap[offset:]
+		case 12:
+			sub12 = cmap[offset:]
+		}
+	}
+
+	glyphs := map[int]bool{}
+	switch {
+	case len(sub12) >= 16:
+		n := int(binary.BigEndian.Uint32(sub12[12:]))
+		if 16+n*12 > len(sub12) {
+			return nil, errors.New("malformed cmap subtable")
+		}
+
+		for r := range runes {
+			for i := 0; i < n; i++ {
+				g := sub12[16+i*12:]
+				start := rune(binary.BigEndian.Uint32(g))
+				end := rune(binary.BigEndian.Uint32(g[4:]))
+				if r >= start && r <= end {
+					gid := binary.BigEndian.Uint32(g[8:])
+					glyphs[int(gid)+int(r-start)] = true
+					break
+				}
+			}
+		}
+	case len(sub4) >= 14:
+		u16 := func(i int) int {
+			return int(binary.BigEndian.Uint16(sub4[i:]))
+		}
+
+		segCount := u16(6) / 2
+		if 16+segCount*8 > len(sub4) {
+			return nil, errors.New("malformed cmap subtable")
+		}
+
+		ends := 14
+		starts := 16 + segCount*2
+		deltas := 16 + segCount*4
+		rangeOffsets := 16 + segCount*6
+		for r := range runes {
+			if r > 0xffff {
+				continue
+			}
+
+			for i := 0; i < segCount; i++ {
+				start, end := u16(starts+2*i), u16(ends+2*i)
+				if int(r) > end {
+					continue
+				} else if int(r) < start {
+					break
+				}
+
+				delta := u16(deltas + 2*i)
+				ro := u16(rangeOffsets + 2*i)
+				if ro == 0 {
+					glyphs[(int(r)+delta)&0xffff] = true
+					break
+				}
+
+				gi := rangeOffsets + 2*i + ro + 2*(int(r)-start)
+				if gi+2 > len(sub4) {
+					break
+				}
+
+				if g := u16(gi); g != 0 {
+					glyphs[(g+delta)&0xffff] = true
+				}
+
+				break
+			}
+		}
+	default:
+		return nil, errors.New("no supported cmap subtable")
+	}
+
+	return glyphs, nil
+}
+
+// compositeComponents returns the glyph IDs of the components of the glyph
+// data g if it is a composite glyph.
+func compositeComponents(g []byte) []int {
+	if len(g) < 10 || int16(binary.BigEndian.Uint16(g)) >= 0 {
+		return nil
+	}
+
+	components := []int{}
+	for i := 10; i+4 <= len(g); {
+		flags := binary.BigEndian.Uint16(g[i:])
+		components = append(
+			components,
+			int(binary.BigEndian.Uint16(g[i+2:])),
+		)
+
+		i += 4
+		if flags&0x0001 != 0 {
+			i += 4
+		} else {
+			i += 2
+		}
+
+		switch {
+		case flags&0x0008 != 0:
+			i += 2
+		case flags&0x0040 != 0:
+			i += 4
+		case flags&0x0080 != 0:
+			i += 8
+		}
+
+		if flags&0x0020 == 0 {
+			break
+		}
+	}
+
+	return components
+}
+
+// writeFont assembles the tables into a font file with the sfnt version.
+func writeFont(version uint32, tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+
+	searchRange, entrySelector := 1, 0
+	for searchRange*2 <= len(tags) {
+		searchRange *= 2
+		entrySelector++
+	}
+
+	header := make([]byte, 12+16*len(tags))
+	binary.BigEndian.PutUint32(header, version)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(tags)))
+	binary.BigEndian.PutUint16(header[6:], uint16(searchRange*16))
+	binary.BigEndian.PutUint16(header[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(
+		header[10:],
+		uint16(len(tags)*16-searchRange*16),
+	)
+
+	body := bytes.Buffer{}
+	headOffset := 0
+	for i, tag := range tags {
+		t := tables[tag]
+		offset := len(header) + body.Len()
+		if tag == "head" {
+			headOffset = offset
+		}
+
+		r := header[12+16*i:]
+		copy(r, tag)
+		binary.BigEndian.PutUint32(r[4:], fontChecksum(t))
+		binary.BigEndian.PutUint32(r[8:], uint32(offset))
+		binary.BigEndian.PutUint32(r[12:], uint32(len(t)))
+
+		body.Write(t)
+		for body.Len()%4 != 0 {
+			body.WriteByte(0)
+		}
+	}
+
+	font := append(header, body.Bytes()...)
+	if headOffset > 0 {
+		binary.BigEndian.PutUint32(
+			font[headOffset+8:],
+			0xb1b0afba-fontChecksum(font),
+		)
+	}
+
+	return font
+}
+
+// fontChecksum returns the checksum of the font table b.
+func fontChecksum(b []byte) uint32 {
+	sum := uint32(0)
+	for i := 0; i < len(b); i += 4 {
+		w := [4]byte{}
+		copy(w[:], b[i:])
+		sum += binary.BigEndian.Uint32(w[:])
+	}
+
+	return sum
+}
+
+func fontHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	b, ok := snap.webFontsByPaths[routePath(req)]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	switch filepath.Ext(routePath(req)) {
+	case ".css":
+		res.SetHeader("content-type", "text/css; charset=utf-8")
+	case ".otf":
+		res.SetHeader("content-type", "font/otf")
+	default:
+		res.SetHeader("content-type", "font/ttf")
+	}
+
+	res.SetHeader("cache-control", "max-age=31536000, immutable")
+
+	return res.WriteBlob(b)
+}
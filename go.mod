@@ -1,15 +1,24 @@
 module github.com/air-examples/blog
 
+go 1.16
+
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/air-gases/defibrillator v0.0.0-20181106103120-3595f7858d87
-	github.com/air-gases/limiter v0.0.0-20181106103602-b397777c2022
-	github.com/air-gases/logger v0.0.0-20181106103036-f5820cc359fd
 	github.com/air-gases/redirector v0.0.0-20181106103526-54a7d1048bcc
+	github.com/andybalholm/brotli v1.0.4
 	github.com/aofei/air v0.0.0-20181109102355-f855b9e6d334
 	github.com/fsnotify/fsnotify v1.4.7
+	github.com/go-git/go-git/v5 v5.4.2
+	github.com/microcosm-cc/bluemonday v1.0.16
 	github.com/russross/blackfriday/v2 v2.0.1
 	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
 	github.com/tdewolff/minify v2.3.6+incompatible
 	github.com/tdewolff/parse v2.3.4+incompatible // indirect
+	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sync v0.7.0
+	golang.org/x/text v0.16.0
+	modernc.org/sqlite v1.7.4
 )
@@ -0,0 +1,1807 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// graphQLSchema is the schema of the `/api/graphql`, served as it is at the
+// `/api/graphql/schema`. The introspection queries are not supported, so this
+// is where the clients learn what they may ask for.
+const graphQLSchema = `type Query {
+  site: Site!
+  posts(
+    tag: String
+    since: String
+    until: String
+    search: String
+    first: Int = 10
+    after: String
+  ): PostConnection!
+  post(id: ID!): Post
+  tags: [Tag!]!
+  tag(name: String!): Tag
+  authors: [Author!]!
+  author(id: ID!): Author
+}
+
+type Site {
+  title: String!
+  baseURL: String!
+  feedURL: String!
+  postCount: Int!
+}
+
+type Post {
+  id: ID!
+  title: String!
+  url: String!
+  permalink: String!
+  published: String!
+  updated: String!
+  language: String
+  summary: String!
+  content: String!
+  protected: Boolean!
+  membersOnly: Boolean!
+  series: String
+  seriesPart: Int
+  tags: [Tag!]!
+  author: Author
+  related: [Post!]!
+  reactions: [Reaction!]!
+}
+
+type Reaction {
+  kind: String!
+  emoji: String!
+  count: Int!
+}
+
+type Tag {
+  name: String!
+  postCount: Int!
+  posts(first: Int = 10, after: String): PostConnection!
+}
+
+type Author {
+  id: ID!
+  name: String!
+  bio: String
+  avatarURL: String
+  url: String!
+  links: [AuthorLink!]!
+  posts(first: Int = 10, after: String): PostConnection!
+}
+
+type AuthorLink {
+  name: String!
+  url: String!
+}
+
+type PostConnection {
+  totalCount: Int!
+  edges: [PostEdge!]!
+  nodes: [Post!]!
+  pageInfo: PageInfo!
+}
+
+type PostEdge {
+  cursor: String!
+  node: Post!
+}
+
+type PageInfo {
+  hasNextPage: Boolean!
+  hasPreviousPage: Boolean!
+  startCursor: String
+  endCursor: String
+}
+`
+
+const (
+	// graphQLDefaultFirst is how many posts a page of a `PostConnection`
+	// has if the query doesn't say.
+	graphQLDefaultFirst = 10
+
+	// graphQLMaxFirst is the most posts a page of a `PostConnection` may
+	// have.
+	graphQLMaxFirst = 100
+
+	// graphQLMaxDepth is how deep the selections of a query may nest.
+	graphQLMaxDepth = 12
+
+	// graphQLMaxObjects is the most objects a query may resolve, so that
+	// the nested connections can't multiply into too much work.
+	graphQLMaxObjects = 10000
+
+	// graphQLMaxFields is the most fields a query may select, counting
+	// those of a fragment once for each time it is spread, so that the
+	// fragments spreading each other can't multiply into too much work.
+	graphQLMaxFields = 10000
+
+	// graphQLMaxNesting is how deep the selection sets, the lists and the
+	// objects may nest in the text of a query, so that parsing it can't
+	// recurse without end. It is above the `graphQLMaxDepth`, since the
+	// inline fragments nest too.
+	graphQLMaxNesting = 32
+)
+
+// graphQLRequest is a request to the `/api/graphql`.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLSelection is a field, a fragment spread or an inline fragment of a
+// selection set of a query.
+type graphQLSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Directives []graphQLDirective
+
+	// Spread is the name of the fragment of a fragment spread.
+	Spread string
+
+	// Inline reports whether it is an inline fragment, and On is the type
+	// condition of it, if any.
+	Inline bool
+	On     string
+
+	Selections []graphQLSelection
+}
+
+// graphQLDirective is a directive of a `graphQLSelection`.
+type graphQLDirective struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// graphQLVariable is a variable used as a value in a query.
+type graphQLVariable string
+
+// graphQLOperation is an operation of a query document.
+type graphQLOperation struct {
+	Type       string
+	Name       string
+	Defaults   map[string]interface{}
+	Selections []graphQLSelection
+}
+
+// graphQLFragment is a fragment definition of a query document.
+type graphQLFragment struct {
+	On         string
+	Selections []graphQLSelection
+}
+
+// graphQLDocument is a parsed query document.
+type graphQLDocument struct {
+	Operations []graphQLOperation
+	Fragments  map[string]graphQLFragment
+}
+
+// graphQLParser parses the query documents, which are made of the operations
+// and the fragments. The type system definitions are not accepted.
+type graphQLParser struct {
+	s     string
+	i     int
+	depth int
+}
+
+// parseGraphQL parses the query document s.
+func parseGraphQL(s string) (*graphQLDocument, error) {
+	p := &graphQLParser{s: s}
+	d := &graphQLDocument{
+		Fragments: map[string]graphQLFragment{},
+	}
+
+	for p.skip(); p.i < len(p.s); p.skip() {
+		if p.peek() == '{' {
+			ss, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+
+			d.Operations = append(d.Operations, graphQLOperation{
+				Type:       "query",
+				Selections: ss,
+			})
+
+			continue
+		}
+
+		keyword, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+
+		switch keyword {
+		case "query", "mutation", "subscription":
+			op, err := p.operation(keyword)
+			if err != nil {
+				return nil, err
+			}
+
+			d.Operations = append(d.Operations, op)
+		case "fragment":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+
+			d.Fragments[name] = f
+		default:
+			return nil, p.errorf("unexpected %q", keyword)
+		}
+	}
+
+	if len(d.Operations) == 0 {
+		return nil, errors.New("document has no operation")
+	}
+
+	return d, nil
+}
+
+// errorf returns an error at the current position of the p.
+func (p *graphQLParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.s[:p.i], "\n")
+	column := p.i - strings.LastIndexByte(p.s[:p.i], '\n')
+	return fmt.Errorf(
+		"syntax error at %d:%d: %s",
+		line,
+		column,
+		fmt.Sprintf(format, args...),
+	)
+}
+
+// skip skips the white spaces, the commas and the comments.
+func (p *graphQLParser) skip() {
+	for p.i < len(p.s) {
+		switch c := p.s[p.i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' ||
+			c == ',':
+			p.i++
+		case c == '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+		case strings.HasPrefix(p.s[p.i:], "\ufeff"):
+			p.i += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next byte, or zero if there is none.
+func (p *graphQLParser) peek() byte {
+	p.skip()
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+
+	return 0
+}
+
+// nest enters a nested selection set, list or object, which must be left by
+// calling the `unnest` once done with it.
+func (p *graphQLParser) nest() error {
+	p.depth++
+	if p.depth > graphQLMaxNesting {
+		return p.errorf("query is nested too deeply")
+	}
+
+	return nil
+}
+
+// unnest leaves what the `nest` entered.
+func (p *graphQLParser) unnest() {
+	p.depth--
+}
+
+// expect consumes the punctuator s.
+func (p *graphQLParser) expect(s string) error {
+	p.skip()
+	if !strings.HasPrefix(p.s[p.i:], s) {
+		return p.errorf("expected %q", s)
+	}
+
+	p.i += len(s)
+
+	return nil
+}
+
+// isNameByte reports whether the c may be in a name, or start one if first.
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		!first && c >= '0' && c <= '9'
+}
+
+// name consumes a name.
+func (p *graphQLParser) name() (string, error) {
+	p.skip()
+	start := p.i
+	for p.i < len(p.s) && isNameByte(p.s[p.i], p.i == start) {
+		p.i++
+	}
+
+	if p.i == start {
+		return "", p.errorf("expected name")
+	}
+
+	return p.s[start:p.i], nil
+}
+
+// operation consumes the rest of an operation of the type typ.
+func (p *graphQLParser) operation(typ string) (graphQLOperation, error) {
+	op := graphQLOperation{
+		Type:     typ,
+		Defaults: map[string]interface{}{},
+	}
+
+	if c := p.peek(); isNameByte(c, true) {
+		name, err := p.name()
+		if err != nil {
+			return op, err
+		}
+
+		op.Name = name
+	}
+
+	if p.peek() == '(' {
+		p.i++
+		for p.peek() != ')' {
+			if err := p.expect("$"); err != nil {
+				return op, err
+			}
+
+			name, err := p.name()
+			if err != nil {
+				return op, err
+			}
+
+			if err := p.expect(":"); err != nil {
+				return op, err
+			}
+
+			if err := p.varType(); err != nil {
+				return op, err
+			}
+
+			if p.peek() == '=' {
+				p.i++
+				v, err := p.value(true)
+				if err != nil {
+					return op, err
+				}
+
+				op.Defaults[name] = v
+			}
+		}
+
+		p.i++
+	}
+
+	if _, err := p.directives(); err != nil {
+		return op, err
+	}
+
+	ss, err := p.selectionSet()
+	if err != nil {
+		return op, err
+	}
+
+	op.Selections = ss
+
+	return op, nil
+}
+
+// varType consumes the type of a variable definition. The types are not
+// checked, the resolvers check the values they get instead.
+func (p *graphQLParser) varType() error {
+	if p.peek() == '[' {
+		p.i++
+		if err := p.nest(); err != nil {
+			return err
+		}
+
+		defer p.unnest()
+		if err := p.varType(); err != nil {
+			return err
+		}
+
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+
+	if p.peek() == '!' {
+		p.i++
+	}
+
+	return nil
+}
+
+// fragment consumes the rest of a fragment definition.
+func (p *graphQLParser) fragment() (graphQLFragment, error) {
+	f := graphQLFragment{}
+	if on, err := p.name(); err != nil {
+		return f, err
+	} else if on != "on" {
+		return f, p.errorf("expected \"on\"")
+	}
+
+	on, err := p.name()
+	if err != nil {
+		return f, err
+	}
+
+	f.On = on
+	if _, err := p.directives(); err != nil {
+		return f, err
+	}
+
+	f.Selections, err = p.selectionSet()
+
+	return f, err
+}
+
+// selectionSet consumes a selection set.
+func (p *graphQLParser) selectionSet() ([]graphQLSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+
+	defer p.unnest()
+
+	ss := []graphQLSelection{}
+	for p.peek() != '}' {
+		if p.i >= len(p.s) {
+			return nil, p.errorf("expected \"}\"")
+		}
+
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+
+		ss = append(ss, s)
+	}
+
+	p.i++
+
+	return ss, nil
+}
+
+// selection consumes a selection.
+func (p *graphQLParser) selection() (graphQLSelection, error) {
+	s := graphQLSelection{}
+	if strings.HasPrefix(p.s[p.i:], "...") {
+		p.i += len("...")
+		if c := p.peek(); isNameByte(c, true) {
+			name, err := p.name()
+			if err != nil {
+				return s, err
+			}
+
+			if name != "on" {
+				s.Spread = name
+				s.Directives, err = p.directives()
+				return s, err
+			}
+
+			if s.On, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+
+		s.Inline = true
+
+		var err error
+		if s.Directives, err = p.directives(); err != nil {
+			return s, err
+		}
+
+		s.Selections, err = p.selectionSet()
+
+		return s, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return s, err
+	}
+
+	s.Alias, s.Name = name, name
+	if p.peek() == ':' {
+		p.i++
+		if s.Name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+
+	if s.Args, err = p.arguments(); err != nil {
+		return s, err
+	}
+
+	if s.Directives, err = p.directives(); err != nil {
+		return s, err
+	}
+
+	if p.peek() == '{' {
+		s.Selections, err = p.selectionSet()
+	}
+
+	return s, err
+}
+
+// arguments consumes the arguments of a field or a directive, if any.
+func (p *graphQLParser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if p.peek() != '(' {
+		return args, nil
+	}
+
+	p.i++
+	for p.peek() != ')' {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+
+	p.i++
+
+	return args, nil
+}
+
+// directives consumes the directives, if any.
+func (p *graphQLParser) directives() ([]graphQLDirective, error) {
+	var ds []graphQLDirective
+	for p.peek() == '@' {
+		p.i++
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+
+		ds = append(ds, graphQLDirective{
+			Name: name,
+			Args: args,
+		})
+	}
+
+	return ds, nil
+}
+
+// value consumes a value. The enum values are taken as strings, and the
+// variables are not allowed if constant.
+func (p *graphQLParser) value(constant bool) (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '$' && !constant:
+		p.i++
+		name, err := p.name()
+		return graphQLVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.i
+		p.i++
+		for p.i < len(p.s) &&
+			strings.IndexByte("0123456789.eE+-", p.s[p.i]) >= 0 {
+			p.i++
+		}
+
+		n := p.s[start:p.i]
+		if i, err := strconv.Atoi(n); err == nil {
+			return i, nil
+		}
+
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return nil, p.errorf("malformed number %q", n)
+		}
+
+		return f, nil
+	case c == '[':
+		p.i++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+
+		defer p.unnest()
+
+		vs := []interface{}{}
+		for p.peek() != ']' {
+			if p.i >= len(p.s) {
+				return nil, p.errorf("expected \"]\"")
+			}
+
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+
+			vs = append(vs, v)
+		}
+
+		p.i++
+
+		return vs, nil
+	case c == '{':
+		p.i++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+
+		defer p.unnest()
+
+		m := map[string]interface{}{}
+		for p.peek() != '}' {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+
+			if m[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+
+		p.i++
+
+		return m, nil
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, p.errorf("expected value")
+	}
+
+	switch name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	return name, nil
+}
+
+// stringValue consumes a string value, quoted or in a block.
+func (p *graphQLParser) stringValue() (string, error) {
+	if strings.HasPrefix(p.s[p.i:], `"""`) {
+		p.i += len(`"""`)
+		end := strings.Index(p.s[p.i:], `"""`)
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+
+		s := p.s[p.i : p.i+end]
+		p.i += end + len(`"""`)
+
+		return strings.TrimSpace(s), nil
+	}
+
+	start := p.i
+	for p.i++; p.i < len(p.s) && p.s[p.i] != '"'; p.i++ {
+		if p.s[p.i] == '\\' {
+			p.i++
+		} else if p.s[p.i] == '\n' {
+			break
+		}
+	}
+
+	if p.i >= len(p.s) || p.s[p.i] != '"' {
+		return "", p.errorf("unterminated string")
+	}
+
+	p.i++
+
+	// The escapes of the GraphQL are those of the JSON.
+	s := ""
+	if err := json.Unmarshal([]byte(p.s[start:p.i]), &s); err != nil {
+		return "", p.errorf("malformed string")
+	}
+
+	return s, nil
+}
+
+// graphQLObject is an object of the schema, which resolves its fields with
+// their arguments. A resolver returns a nil for a null.
+type graphQLObject struct {
+	Type    string
+	Resolve func(field string, args graphQLArgs) (interface{}, error)
+}
+
+// graphQLArgs is the arguments of a field, with the variables put in.
+type graphQLArgs map[string]interface{}
+
+// string returns the string argument of the name, or an empty string if it
+// is not given.
+func (args graphQLArgs) string(name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+// int returns the integer argument of the name, or the def if it is not
+// given.
+func (args graphQLArgs) int(name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64: // From the JSON of the variables
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+// graphQLResult is the result of a selection set, which keeps its fields in
+// the order they were asked for.
+type graphQLResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// MarshalJSON implements the `json.Marshaler`.
+func (r *graphQLResult) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		vb, err := json.Marshal(r.values[k])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// graphQLExecution is the execution of an operation.
+type graphQLExecution struct {
+	fragments map[string]graphQLFragment
+	variables map[string]interface{}
+	objects   int
+	fields    int
+}
+
+// value returns the v with its variables put in.
+func (e *graphQLExecution) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case graphQLVariable:
+		return e.variables[string(v)]
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i := range v {
+			vs[i] = e.value(v[i])
+		}
+
+		return vs
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k := range v {
+			m[k] = e.value(v[k])
+		}
+
+		return m
+	}
+
+	return v
+}
+
+// args returns the arguments of the s with their variables put in.
+func (e *graphQLExecution) args(s graphQLSelection) graphQLArgs {
+	args := graphQLArgs{}
+	for k, v := range s.Args {
+		if v = e.value(v); v != nil {
+			args[k] = v
+		}
+	}
+
+	return args
+}
+
+// included reports whether the s is included by its "@include" and "@skip"
+// directives.
+func (e *graphQLExecution) included(s graphQLSelection) (bool, error) {
+	for _, d := range s.Directives {
+		if d.Name != "include" && d.Name != "skip" {
+			return false, fmt.Errorf("unknown directive %q", d.Name)
+		}
+
+		b, ok := e.value(d.Args["if"]).(bool)
+		if !ok {
+			return false, fmt.Errorf(
+				"directive %q needs a boolean \"if\"",
+				d.Name,
+			)
+		}
+
+		if b != (d.Name == "include") {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// collect returns the fields of the ss for an object of the typ, with the
+// fragments spread and the fields of the same key merged, as they appear.
+func (e *graphQLExecution) collect(
+	typ string,
+	ss []graphQLSelection,
+	visited map[string]bool,
+) ([]graphQLSelection, error) {
+	fields := []graphQLSelection{}
+	indexes := map[string]int{}
+	for _, s := range ss {
+		if ok, err := e.included(s); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		var fss []graphQLSelection
+		switch {
+		case s.Spread != "":
+			f, ok := e.fragments[s.Spread]
+			if !ok {
+				return nil, fmt.Errorf(
+					"unknown fragment %q",
+					s.Spread,
+				)
+			} else if visited[s.Spread] {
+				return nil, fmt.Errorf(
+					"fragment %q spreads itself",
+					s.Spread,
+				)
+			} else if f.On != typ {
+				continue
+			}
+
+			visited[s.Spread] = true
+			fs, err := e.collect(typ, f.Selections, visited)
+			delete(visited, s.Spread)
+			if err != nil {
+				return nil, err
+			}
+
+			fss = fs
+		case s.Inline:
+			if s.On != "" && s.On != typ {
+				continue
+			}
+
+			fs, err := e.collect(typ, s.Selections, visited)
+			if err != nil {
+				return nil, err
+			}
+
+			fss = fs
+		default:
+			e.fields++
+			if e.fields > graphQLMaxFields {
+				return nil, errors.New(
+					"query selects too many fields",
+				)
+			}
+
+			fss = []graphQLSelection{s}
+		}
+
+		for _, f := range fss {
+			if i, ok := indexes[f.Alias]; ok {
+				if fields[i].Name != f.Name {
+					return nil, fmt.Errorf(
+						"fields named %q conflict",
+						f.Alias,
+					)
+				}
+
+				ss := make(
+					[]graphQLSelection,
+					0,
+					len(fields[i].Selections)+
+						len(f.Selections),
+				)
+				ss = append(ss, fields[i].Selections...)
+				fields[i].Selections = append(
+					ss,
+					f.Selections...,
+				)
+
+				continue
+			}
+
+			indexes[f.Alias] = len(fields)
+			fields = append(fields, f)
+		}
+	}
+
+	return fields, nil
+}
+
+// execute returns the result of the ss on the o, which is at the depth.
+func (e *graphQLExecution) execute(
+	o graphQLObject,
+	ss []graphQLSelection,
+	depth int,
+) (*graphQLResult, error) {
+	if depth > graphQLMaxDepth {
+		return nil, errors.New("query is too deep")
+	}
+
+	e.objects++
+	if e.objects > graphQLMaxObjects {
+		return nil, errors.New("query asks for too many objects")
+	}
+
+	fields, err := e.collect(o.Type, ss, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &graphQLResult{
+		values: make(map[string]interface{}, len(fields)),
+	}
+
+	for _, f := range fields {
+		var v interface{}
+		if f.Name == "__typename" {
+			v = o.Type
+		} else if v, err = o.Resolve(f.Name, e.args(f)); err != nil {
+			return nil, err
+		}
+
+		if v, err = e.complete(o.Type, f, v, depth); err != nil {
+			return nil, err
+		}
+
+		r.keys = append(r.keys, f.Alias)
+		r.values[f.Alias] = v
+	}
+
+	return r, nil
+}
+
+// complete returns the v of the field f of an object of the typ, with the
+// selections of the f executed on it if it is an object or a list of them.
+func (e *graphQLExecution) complete(
+	typ string,
+	f graphQLSelection,
+	v interface{},
+	depth int,
+) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case graphQLObject:
+		if len(f.Selections) == 0 {
+			return nil, fmt.Errorf(
+				"field %q of type %q must have subfields",
+				f.Name,
+				v.Type,
+			)
+		}
+
+		return e.execute(v, f.Selections, depth+1)
+	case []graphQLObject:
+		rs := make([]*graphQLResult, 0, len(v))
+		for _, o := range v {
+			r, err := e.complete(typ, f, o, depth)
+			if err != nil {
+				return nil, err
+			}
+
+			rs = append(rs, r.(*graphQLResult))
+		}
+
+		return rs, nil
+	}
+
+	if len(f.Selections) > 0 {
+		return nil, fmt.Errorf(
+			"field %q of type %q must not have subfields",
+			f.Name,
+			typ,
+		)
+	}
+
+	return v, nil
+}
+
+// unknownGraphQLField returns the error of the unknown field of the typ.
+func unknownGraphQLField(typ, field string) error {
+	return fmt.Errorf("type %q has no field %q", typ, field)
+}
+
+// executeGraphQL executes the gr on the listed posts of the snap.
+func executeGraphQL(
+	gr graphQLRequest,
+	snap *postsSnapshot,
+) (interface{}, error) {
+	d, err := parseGraphQL(gr.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	var op *graphQLOperation
+	for i := range d.Operations {
+		if gr.OperationName == "" && len(d.Operations) > 1 {
+			return nil, errors.New("operation name is required")
+		} else if d.Operations[i].Name == gr.OperationName ||
+			gr.OperationName == "" {
+			op = &d.Operations[i]
+			break
+		}
+	}
+
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", gr.OperationName)
+	} else if op.Type != "query" {
+		return nil, errors.New("only queries are supported")
+	}
+
+	e := &graphQLExecution{
+		fragments: d.Fragments,
+		variables: map[string]interface{}{},
+	}
+
+	for k, v := range op.Defaults {
+		e.variables[k] = v
+	}
+
+	for k, v := range gr.Variables {
+		e.variables[k] = v
+	}
+
+	return e.execute(newGraphQLSchema(snap).query(), op.Selections, 0)
+}
+
+// graphQLSchemaData is the data that a query is executed on, which is taken
+// all at once, so that a reload of the posts doesn't change it halfway.
+type graphQLSchemaData struct {
+	snap    *postsSnapshot
+	posts   []post
+	postIDs map[string]int
+	authors map[string]*author
+}
+
+// newGraphQLSchema returns the `graphQLSchemaData` of the snap.
+func newGraphQLSchema(snap *postsSnapshot) *graphQLSchemaData {
+	lps := snap.orderedPosts
+	gs := &graphQLSchemaData{
+		snap:    snap,
+		posts:   lps,
+		postIDs: make(map[string]int, len(lps)),
+		authors: snap.authors,
+	}
+
+	for i, p := range lps {
+		gs.postIDs[p.ID] = i
+	}
+
+	return gs
+}
+
+// query returns the root object of the gs.
+func (gs *graphQLSchemaData) query() graphQLObject {
+	return graphQLObject{
+		Type: "Query",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "site":
+				return gs.site(), nil
+			case "posts":
+				return gs.filteredPosts(args)
+			case "post":
+				id, err := args.string("id")
+				if err != nil {
+					return nil, err
+				}
+
+				if i, ok := gs.postIDs[id]; ok {
+					return gs.post(gs.posts[i]), nil
+				}
+
+				return nil, nil
+			case "tags":
+				return gs.tags(), nil
+			case "tag":
+				name, err := args.string("name")
+				if err != nil {
+					return nil, err
+				}
+
+				for _, t := range gs.tagNames() {
+					if strings.EqualFold(t, name) {
+						return gs.tag(t), nil
+					}
+				}
+
+				return nil, nil
+			case "authors":
+				ids := make([]string, 0, len(gs.authors))
+				for id := range gs.authors {
+					ids = append(ids, id)
+				}
+
+				sort.Strings(ids)
+
+				objs := make([]graphQLObject, 0, len(ids))
+				for _, id := range ids {
+					objs = append(
+						objs,
+						gs.author(gs.authors[id]),
+					)
+				}
+
+				return objs, nil
+			case "author":
+				id, err := args.string("id")
+				if err != nil {
+					return nil, err
+				}
+
+				if a, ok := gs.authors[id]; ok {
+					return gs.author(a), nil
+				}
+
+				return nil, nil
+			}
+
+			return nil, unknownGraphQLField("Query", field)
+		},
+	}
+}
+
+// site returns the object of the site.
+func (gs *graphQLSchemaData) site() graphQLObject {
+	return graphQLObject{
+		Type: "Site",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "title":
+				return config.Title, nil
+			case "baseURL":
+				return config.BaseURL, nil
+			case "feedURL":
+				return config.BaseURL + "/feed", nil
+			case "postCount":
+				return len(gs.posts), nil
+			}
+
+			return nil, unknownGraphQLField("Site", field)
+		},
+	}
+}
+
+// filteredPosts returns the connection of the posts that match the filters
+// of the args. The posts are ordered newest first, or best first if searched.
+func (gs *graphQLSchemaData) filteredPosts(
+	args graphQLArgs,
+) (interface{}, error) {
+	tag, err := args.string("tag")
+	if err != nil {
+		return nil, err
+	}
+
+	var since, until time.Time
+	for _, a := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"since", &since},
+		{"until", &until},
+	} {
+		s, err := args.string(a.name)
+		if err != nil {
+			return nil, err
+		} else if s == "" {
+			continue
+		}
+
+		start, end, ok := parseSearchDate(s)
+		if !ok {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"argument %q must be a date",
+					a.name,
+				)
+			}
+
+			start, end = t, t
+		}
+
+		if a.name == "since" {
+			*a.t = start
+		} else {
+			*a.t = end
+		}
+	}
+
+	search, err := args.string("search")
+	if err != nil {
+		return nil, err
+	}
+
+	ps := gs.posts
+	if strings.TrimSpace(search) != "" {
+		ps = []post{}
+		for _, sr := range searchPosts(gs.snap, search) {
+			if i, ok := gs.postIDs[sr.Post.ID]; ok {
+				ps = append(ps, gs.posts[i])
+			}
+		}
+	}
+
+	fps := []post{}
+	for _, p := range ps {
+		if tag != "" && !hasTag(p, tag) ||
+			!since.IsZero() && p.Datetime.Before(since) ||
+			!until.IsZero() && !p.Datetime.Before(until) {
+			continue
+		}
+
+		fps = append(fps, p)
+	}
+
+	return gs.connection(fps, args)
+}
+
+// hasTag reports whether the p is tagged with the tag, in any case.
+func hasTag(p post, tag string) bool {
+	for _, t := range p.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// graphQLCursor returns the cursor of the p in a `PostConnection`.
+func graphQLCursor(p post) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(p.ID))
+}
+
+// connection returns the page of the ps that the "first" and the "after" of
+// the args ask for.
+func (gs *graphQLSchemaData) connection(
+	ps []post,
+	args graphQLArgs,
+) (interface{}, error) {
+	first, err := args.int("first", graphQLDefaultFirst)
+	if err != nil {
+		return nil, err
+	} else if first < 0 || first > graphQLMaxFirst {
+		return nil, fmt.Errorf(
+			"argument \"first\" must be between 0 and %d",
+			graphQLMaxFirst,
+		)
+	}
+
+	after, err := args.string("after")
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if after != "" {
+		id, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil {
+			return nil, errors.New("malformed cursor")
+		}
+
+		start = -1
+		for i, p := range ps {
+			if p.ID == string(id) {
+				start = i + 1
+				break
+			}
+		}
+
+		if start < 0 {
+			return nil, errors.New("unknown cursor")
+		}
+	}
+
+	end := start + first
+	if end > len(ps) {
+		end = len(ps)
+	}
+
+	page := ps[start:end]
+
+	return graphQLObject{
+		Type: "PostConnection",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "totalCount":
+				return len(ps), nil
+			case "edges":
+				objs := make([]graphQLObject, 0, len(page))
+				for _, p := range page {
+					objs = append(objs, gs.edge(p))
+				}
+
+				return objs, nil
+			case "nodes":
+				objs := make([]graphQLObject, 0, len(page))
+				for _, p := range page {
+					objs = append(objs, gs.post(p))
+				}
+
+				return objs, nil
+			case "pageInfo":
+				return graphQLPageInfo(
+					page,
+					start > 0,
+					end < len(ps),
+				), nil
+			}
+
+			return nil, unknownGraphQLField("PostConnection", field)
+		},
+	}, nil
+}
+
+// edge returns the object of the edge of the p in a `PostConnection`.
+func (gs *graphQLSchemaData) edge(p post) graphQLObject {
+	return graphQLObject{
+		Type: "PostEdge",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "cursor":
+				return graphQLCursor(p), nil
+			case "node":
+				return gs.post(p), nil
+			}
+
+			return nil, unknownGraphQLField("PostEdge", field)
+		},
+	}
+}
+
+// graphQLPageInfo returns the object of the information about the page of a
+// `PostConnection`.
+func graphQLPageInfo(page []post, hasPrevious, hasNext bool) graphQLObject {
+	return graphQLObject{
+		Type: "PageInfo",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "hasNextPage":
+				return hasNext, nil
+			case "hasPreviousPage":
+				return hasPrevious, nil
+			case "startCursor":
+				if len(page) == 0 {
+					return nil, nil
+				}
+
+				return graphQLCursor(page[0]), nil
+			case "endCursor":
+				if len(page) == 0 {
+					return nil, nil
+				}
+
+				return graphQLCursor(page[len(page)-1]), nil
+			}
+
+			return nil, unknownGraphQLField("PageInfo", field)
+		},
+	}
+}
+
+// graphQLString returns the s, or nil if it is empty.
+func graphQLString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// post returns the object of the p.
+func (gs *graphQLSchemaData) post(p post) graphQLObject {
+	return graphQLObject{
+		Type: "Post",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "id":
+				return p.ID, nil
+			case "title":
+				return p.Title, nil
+			case "url":
+				return config.BaseURL + p.Permalink, nil
+			case "permalink":
+				return p.Permalink, nil
+			case "published":
+				return p.Datetime.Format(time.RFC3339), nil
+			case "updated":
+				return p.Updated.Format(time.RFC3339), nil
+			case "language":
+				return graphQLString(p.Language), nil
+			case "summary":
+				return postSummary(p), nil
+			case "content":
+				return string(p.Content), nil
+			case "protected":
+				return p.Protected(), nil
+			case "membersOnly":
+				return p.MembersOnly, nil
+			case "series":
+				return graphQLString(p.Series), nil
+			case "seriesPart":
+				if p.Series == "" {
+					return nil, nil
+				}
+
+				return p.SeriesPart, nil
+			case "tags":
+				objs := make([]graphQLObject, 0, len(p.Tags))
+				for _, t := range p.Tags {
+					objs = append(objs, gs.tag(t))
+				}
+
+				return objs, nil
+			case "author":
+				if a, ok := gs.authors[p.Author]; ok {
+					return gs.author(a), nil
+				}
+
+				return nil, nil
+			case "related":
+				objs := []graphQLObject{}
+				for _, id := range p.Related {
+					if i, ok := gs.postIDs[id]; ok {
+						objs = append(
+							objs,
+							gs.post(gs.posts[i]),
+						)
+					}
+				}
+
+				return objs, nil
+			case "reactions":
+				if !config.ReactionsEnabled {
+					return []graphQLObject{}, nil
+				}
+
+				prs := postReactions(p.ID)
+				objs := make([]graphQLObject, 0, len(prs))
+				for _, pr := range prs {
+					objs = append(objs, graphQLReaction(pr))
+				}
+
+				return objs, nil
+			}
+
+			return nil, unknownGraphQLField("Post", field)
+		},
+	}
+}
+
+// graphQLReaction returns the object of the pr.
+func graphQLReaction(pr postReaction) graphQLObject {
+	return graphQLObject{
+		Type: "Reaction",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "kind":
+				return pr.Name, nil
+			case "emoji":
+				return pr.Emoji, nil
+			case "count":
+				return pr.Count, nil
+			}
+
+			return nil, unknownGraphQLField("Reaction", field)
+		},
+	}
+}
+
+// tagNames returns the names of the tags of the posts, ordered. The tags are
+// told apart regardless of case, as the first post of each has it.
+func (gs *graphQLSchemaData) tagNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, p := range gs.posts {
+		for _, t := range p.Tags {
+			if lt := strings.ToLower(t); !seen[lt] {
+				seen[lt] = true
+				names = append(names, t)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// tags returns the objects of the tags of the posts, ordered by name.
+func (gs *graphQLSchemaData) tags() []graphQLObject {
+	names := gs.tagNames()
+	objs := make([]graphQLObject, 0, len(names))
+	for _, t := range names {
+		objs = append(objs, gs.tag(t))
+	}
+
+	return objs
+}
+
+// tag returns the object of the tag of the name.
+func (gs *graphQLSchemaData) tag(name string) graphQLObject {
+	return graphQLObject{
+		Type: "Tag",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "name":
+				return name, nil
+			case "postCount", "posts":
+				ps := []post{}
+				for _, p := range gs.posts {
+					if hasTag(p, name) {
+						ps = append(ps, p)
+					}
+				}
+
+				if field == "postCount" {
+					return len(ps), nil
+				}
+
+				return gs.connection(ps, args)
+			}
+
+			return nil, unknownGraphQLField("Tag", field)
+		},
+	}
+}
+
+// author returns the object of the a.
+func (gs *graphQLSchemaData) author(a *author) graphQLObject {
+	return graphQLObject{
+		Type: "Author",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "id":
+				return a.ID, nil
+			case "name":
+				return a.Name, nil
+			case "bio":
+				return graphQLString(a.Bio), nil
+			case "avatarURL":
+				return graphQLString(a.AvatarURL()), nil
+			case "url":
+				return config.BaseURL + a.Path(), nil
+			case "links":
+				objs := []graphQLObject{}
+				for _, l := range a.Links {
+					objs = append(
+						objs,
+						graphQLAuthorLink(l),
+					)
+				}
+
+				return objs, nil
+			case "posts":
+				ps := []post{}
+				for _, p := range gs.posts {
+					if p.Author == a.ID {
+						ps = append(ps, p)
+					}
+				}
+
+				return gs.connection(ps, args)
+			}
+
+			return nil, unknownGraphQLField("Author", field)
+		},
+	}
+}
+
+// graphQLAuthorLink returns the object of the l.
+func graphQLAuthorLink(l authorLink) graphQLObject {
+	return graphQLObject{
+		Type: "AuthorLink",
+		Resolve: func(
+			field string,
+			args graphQLArgs,
+		) (interface{}, error) {
+			switch field {
+			case "name":
+				return l.Name, nil
+			case "url":
+				return l.URL, nil
+			}
+
+			return nil, unknownGraphQLField("AuthorLink", field)
+		},
+	}
+}
+
+// graphQLError is an error in a response of the `/api/graphql`.
+type graphQLError struct {
+	Message string `json:"message"`
+}
+
+// setGraphQLCORSHeaders sets the headers that let the front ends of the other
+// origins query the `/api/graphql`.
+func setGraphQLCORSHeaders(res *air.Response) {
+	res.SetHeader("access-control-allow-origin", "*")
+	res.SetHeader("access-control-allow-methods", "GET, POST")
+	res.SetHeader("access-control-allow-headers", "content-type")
+	res.SetHeader("access-control-max-age", "86400")
+}
+
+// writeGraphQLError responds to the client with the err, prefixed with the
+// context if any, as the errors of a GraphQL response.
+func writeGraphQLError(res *air.Response, context string, err error) error {
+	msg := err.Error()
+	if context != "" {
+		msg = context + ": " + msg
+	}
+
+	return res.WriteJSON(map[string]interface{}{
+		"errors": []graphQLError{{
+			Message: msg,
+		}},
+	})
+}
+
+func graphQLHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	setGraphQLCORSHeaders(res)
+	res.SetHeader("cache-control", "no-cache")
+
+	gr := graphQLRequest{}
+	if req.Method == "POST" {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+
+		ct := req.Header("content-type").Value()
+		if strings.HasPrefix(ct, "application/graphql") {
+			gr.Query = string(b)
+		} else if err := json.Unmarshal(b, &gr); err != nil {
+			res.Status = 400
+			return writeGraphQLError(res, "malformed request", err)
+		}
+	} else {
+		gr.Query = paramValue(req, "query")
+		gr.OperationName = paramValue(req, "operationName")
+		if vs := paramValue(req, "variables"); vs != "" {
+			if err := json.Unmarshal(
+				[]byte(vs),
+				&gr.Variables,
+			); err != nil {
+				res.Status = 400
+				return writeGraphQLError(
+					res,
+					"malformed variables",
+					err,
+				)
+			}
+		}
+	}
+
+	data, err := executeGraphQL(gr, snap)
+	if err != nil {
+		return writeGraphQLError(res, "", err)
+	}
+
+	return res.WriteJSON(map[string]interface{}{
+		"data": data,
+	})
+}
+
+func graphQLPreflightHandler(req *air.Request, res *air.Response) error {
+	setGraphQLCORSHeaders(res)
+	res.Status = 204
+	return res.Write(nil)
+}
+
+func graphQLSchemaHandler(req *air.Request, res *air.Response) error {
+	setGraphQLCORSHeaders(res)
+	res.SetHeader("content-type", "text/plain; charset=utf-8")
+	return res.WriteString(graphQLSchema)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+)
+
+func healthzHandler(req *air.Request, res *air.Response) error {
+	res.SetHeader("cache-control", "no-cache")
+	return res.WriteString("ok")
+}
+
+// readyzHandler reports whether the blog is ready to serve. The problems that
+// keep it from being so are logged rather than given out, since they may tell
+// about the files and the configuration behind it.
+func readyzHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	problems := []string{}
+	if snap.err != nil {
+		problems = append(problems, snap.err.Error())
+	}
+
+	if feedTemplate == nil {
+		problems = append(problems, "feed template is not loaded")
+	}
+
+	if _, err := os.Stat(air.TemplateRoot); err != nil {
+		problems = append(problems, "templates are not available")
+	}
+
+	if atomic.LoadInt32(&postsWatcherRunning) == 0 {
+		problems = append(problems, "post watcher is not running")
+	}
+
+	for _, hb := range heartbeatSnapshot() {
+		if hb.Stale() {
+			problems = append(problems, hb.Name+" is stale")
+		}
+	}
+
+	res.SetHeader("cache-control", "no-cache")
+
+	if len(problems) > 0 {
+		air.WARN(
+			"not ready",
+			map[string]interface{}{
+				"problems": problems,
+			},
+		)
+
+		res.Status = 503
+		return res.WriteString("not ready")
+	}
+
+	return res.WriteString("ok")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// heartbeatStaleFactor is how many of its intervals a subsystem may miss
+// before it is considered stale.
+const heartbeatStaleFactor = 3
+
+// heartbeat is the liveness of a background subsystem.
+type heartbeat struct {
+	Name     string
+	Interval time.Duration
+	Last     time.Time
+	Restarts int
+
+	generation uint64
+	alerted    bool
+	run        func()
+}
+
+// Stale reports whether the hb has missed too many beats.
+func (hb heartbeat) Stale() bool {
+	return time.Since(hb.Last) > heartbeatStaleFactor*hb.Interval
+}
+
+var (
+	heartbeatsMutex sync.Mutex
+	heartbeats      = map[string]*heartbeat{}
+)
+
+// runWithHeartbeat runs the run in the background as the subsystem of the
+// name, which promises to `beat` at least every interval. The run is run again
+// by the `watchdog` if it stops beating and the `config.WatchdogRestartEnabled`
+// is on, so it must give up once its `beat` reports that it has been replaced.
+func runWithHeartbeat(name string, interval time.Duration, run func()) {
+	heartbeatsMutex.Lock()
+	heartbeats[name] = &heartbeat{
+		Name:     name,
+		Interval: interval,
+		Last:     time.Now(),
+		run:      run,
+	}
+	heartbeatsMutex.Unlock()
+
+	go run()
+}
+
+// heartbeatGeneration returns the current generation of the subsystem of the
+// name, which its run passes to the `beat`.
+func heartbeatGeneration(name string) uint64 {
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+
+	if hb, ok := heartbeats[name]; ok {
+		return hb.generation
+	}
+
+	return 0
+}
+
+// beat records a heartbeat of the generation of the subsystem of the name. It
+// reports false if the generation has been replaced by the `watchdog`, in
+// which case the caller should stop.
+func beat(name string, generation uint64) bool {
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+
+	hb, ok := heartbeats[name]
+	if !ok {
+		return true
+	} else if hb.generation != generation {
+		return false
+	}
+
+	hb.Last = time.Now()
+	if hb.alerted {
+		hb.alerted = false
+		air.INFO(
+			"subsystem recovered",
+			map[string]interface{}{
+				"subsystem": name,
+			},
+		)
+	}
+
+	return true
+}
+
+// heartbeatSnapshot returns a copy of all the heartbeats ordered by name.
+func heartbeatSnapshot() []heartbeat {
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+
+	hbs := make([]heartbeat, 0, len(heartbeats))
+	for _, hb := range heartbeats {
+		hbs = append(hbs, *hb)
+	}
+
+	sort.Slice(hbs, func(i, j int) bool {
+		return hbs[i].Name < hbs[j].Name
+	})
+
+	return hbs
+}
+
+// watchdog checks the heartbeats every interval. A stale subsystem is logged
+// and, as configured, alerted about through the `notify` and restarted.
+func watchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		heartbeatsMutex.Lock()
+		for _, hb := range heartbeats {
+			if !hb.Stale() {
+				continue
+			}
+
+			last := hb.Last.Format(time.RFC3339)
+			air.ERROR(
+				"subsystem is stale",
+				map[string]interface{}{
+					"subsystem": hb.Name,
+					"last_beat": last,
+				},
+			)
+
+			if config.WatchdogAlertEnabled && !hb.alerted {
+				notify(fmt.Sprintf(
+					"%s: %s has stopped since %s",
+					config.Title,
+					hb.Name,
+					last,
+				))
+			}
+
+			hb.alerted = true
+
+			if config.WatchdogRestartEnabled {
+				hb.generation++
+				hb.Restarts++
+				hb.Last = time.Now()
+				go hb.run()
+			}
+		}
+		heartbeatsMutex.Unlock()
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// postHistoryMaxRevisions is the most revisions the history of a post
+	// lists.
+	postHistoryMaxRevisions = 100
+
+	// postDiffContext is how many unchanged lines a diff shows around each
+	// change.
+	postDiffContext = 3
+)
+
+// postRevPattern is the pattern of the revisions in the "/posts/:ID/diff/:Rev",
+// which are (abbreviated) commit hashes only.
+var postRevPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// postRevision is a commit that touched the file of a post.
+type postRevision struct {
+	Hash      string
+	ShortHash string
+	Author    string
+	Date      time.Time
+	Subject   string
+}
+
+// postDiffLine is a line of the diff of a post. Its Kind is "add", "del",
+// "ctx" or, for the unchanged lines left out, "gap".
+type postDiffLine struct {
+	Kind string
+	Text string
+}
+
+var (
+	// postsRepo is the git repository that the posts are in, or nil if
+	// they are not in one.
+	postsRepo *git.Repository
+
+	// postsRepoRoot is the root of the work tree of the `postsRepo`.
+	postsRepoRoot string
+
+	// postRevisions is the cache of the histories of the posts, by the
+	// names of their files, for the postRevisionsHead only.
+	postRevisions      map[string][]postRevision
+	postRevisionsHead  plumbing.Hash
+	postRevisionsMutex sync.Mutex
+)
+
+// setupPostHistory opens the `postsRepo` if the posts of the `fsPostStore`
+// are in a git repository.
+func setupPostHistory() error {
+	fs, ok := store.(fsPostStore)
+	if !ok {
+		return nil
+	}
+
+	root, err := filepath.Abs(fs.root)
+	if err != nil {
+		return err
+	}
+
+	r, err := git.PlainOpenWithOptions(root, &git.PlainOpenOptions{
+		DetectDotGit: true,
+	})
+	if err == git.ErrRepositoryNotExists {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	postsRepo = r
+	postsRepoRoot = wt.Filesystem.Root()
+
+	return nil
+}
+
+// postRepoPath returns the path of the file of the p in the `postsRepo`, or
+// an empty string if the history of the p is not given out. The encrypted,
+// password-protected and members-only posts keep theirs.
+func postRepoPath(p post) string {
+	if postsRepo == nil || p.Protected() || p.MembersOnly ||
+		strings.HasSuffix(p.File, encryptedPostExt) {
+		return ""
+	}
+
+	fn, err := filepath.Abs(p.File)
+	if err != nil {
+		return ""
+	}
+
+	rel, err := filepath.Rel(postsRepoRoot, fn)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// HistoryPath returns the path of the history of the p, or an empty string if
+// the p has none.
+func (p post) HistoryPath() string {
+	if postRepoPath(p) == "" {
+		return ""
+	}
+
+	return "/posts/" + p.ID + "/history"
+}
+
+// postHistory returns the revisions of the file of the name in the
+// `postsRepo`, newest first.
+func postHistory(name string) ([]postRevision, error) {
+	head, err := postsRepo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	postRevisionsMutex.Lock()
+	defer postRevisionsMutex.Unlock()
+
+	if head.Hash() != postRevisionsHead {
+		postRevisions = map[string][]postRevision{}
+		postRevisionsHead = head.Hash()
+	}
+
+	if prs, ok := postRevisions[name]; ok {
+		return prs, nil
+	}
+
+	ci, err := postsRepo.Log(&git.LogOptions{
+		From:     head.Hash(),
+		FileName: &name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ci.Close()
+
+	errEnough := errors.New("enough revisions")
+	prs := []postRevision{}
+	if err := ci.ForEach(func(c *object.Commit) error {
+		if len(prs) == postHistoryMaxRevisions {
+			return errEnough
+		}
+
+		h := c.Hash.String()
+		prs = append(prs, postRevision{
+			Hash:      h,
+			ShortHash: h[:7],
+			Author:    c.Author.Name,
+			Date:      c.Author.When.UTC(),
+			Subject:   strings.SplitN(c.Message, "\n", 2)[0],
+		})
+
+		return nil
+	}); err != nil && err != errEnough {
+		return nil, err
+	}
+
+	postRevisions[name] = prs
+
+	return prs, nil
+}
+
+// postDiff returns the diff that the commit of the rev made to the file of the
+// name in the `postsRepo`, or nil if it did not touch the file.
+func postDiff(name, rev string) (*postRevision, []postDiffLine, error) {
+	h, err := postsRepo.ResolveRevision(plumbing.Revision(rev))
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := postsRepo.CommitObject(*h)
+	if err == plumbing.ErrObjectNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	to, err := fileContents(c, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pc *object.Commit
+	from := ""
+	if c.NumParents() > 0 {
+		if pc, err = c.Parent(0); err != nil {
+			return nil, nil, err
+		}
+
+		if from, err = fileContents(pc, name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if from == to {
+		return nil, nil, nil
+	}
+
+	chunks := []fdiff.Chunk{}
+	if from == "" {
+		chunks = append(chunks, fileChunk{to, fdiff.Add})
+	} else {
+		patch, err := pc.Patch(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, fp := range patch.FilePatches() {
+			if f, t := fp.Files(); f != nil && f.Path() == name ||
+				t != nil && t.Path() == name {
+				chunks = fp.Chunks()
+				break
+			}
+		}
+	}
+
+	hs := c.Hash.String()
+	pr := &postRevision{
+		Hash:      hs,
+		ShortHash: hs[:7],
+		Author:    c.Author.Name,
+		Date:      c.Author.When.UTC(),
+		Subject:   strings.SplitN(c.Message, "\n", 2)[0],
+	}
+
+	return pr, postDiffLines(chunks), nil
+}
+
+// fileContents returns the contents of the file of the name in the commit c,
+// or an empty string if there is no such file.
+func fileContents(c *object.Commit, name string) (string, error) {
+	f, err := c.File(name)
+	if err == object.ErrFileNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return f.Contents()
+}
+
+// fileChunk is an `fdiff.Chunk` of a whole file.
+type fileChunk struct {
+	content string
+	typ     fdiff.Operation
+}
+
+// Content implements the `fdiff.Chunk`.
+func (fc fileChunk) Content() string {
+	return fc.content
+}
+
+// Type implements the `fdiff.Chunk`.
+func (fc fileChunk) Type() fdiff.Operation {
+	return fc.typ
+}
+
+// postDiffLines returns the lines of the chunks, with the unchanged lines
+// farther than the `postDiffContext` from any change left out.
+func postDiffLines(chunks []fdiff.Chunk) []postDiffLine {
+	pdls := []postDiffLine{}
+	for i, c := range chunks {
+		content := strings.TrimSuffix(c.Content(), "\n")
+		lines := strings.Split(content, "\n")
+		kind, gap := "ctx", -1
+		switch c.Type() {
+		case fdiff.Add:
+			kind = "add"
+		case fdiff.Delete:
+			kind = "del"
+		default:
+			head, tail := postDiffContext, postDiffContext
+			if i == 0 {
+				head = 0
+			}
+
+			if i == len(chunks)-1 {
+				tail = 0
+			}
+
+			if len(lines) > head+tail {
+				gap = head
+				lines = append(
+					lines[:head:head],
+					lines[len(lines)-tail:]...,
+				)
+			}
+		}
+
+		for j, l := range lines {
+			if j == gap {
+				pdls = append(pdls, postDiffLine{Kind: "gap"})
+			}
+
+			pdls = append(pdls, postDiffLine{Kind: kind, Text: l})
+		}
+
+		if gap == len(lines) {
+			pdls = append(pdls, postDiffLine{Kind: "gap"})
+		}
+	}
+
+	return pdls
+}
+
+// postHistoryHandler serves the history of the post of the id in the snap, the
+// commits of the `postsRepo` that touched its file.
+func postHistoryHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+) error {
+	p, ok := snap.posts[id]
+	if !ok || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	name := postRepoPath(p)
+	if name == "" {
+		return air.NotFoundHandler(req, res)
+	}
+
+	prs, err := postHistory(name)
+	if err != nil {
+		return err
+	}
+
+	req.Values["PageTitle"] = p.Title
+	req.Values["CanonicalPath"] = p.HistoryPath()
+	req.Values["NoIndex"] = true
+	req.Values["Post"] = p
+	req.Values["Revisions"] = prs
+
+	return res.Render(req.Values, "history.html", "layouts/default.html")
+}
+
+// postDiffHandler serves the diff that the commit of the rev made to the file
+// of the post of the id in the snap.
+func postDiffHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+	rev string,
+) error {
+	p, ok := snap.posts[id]
+	if !ok || !hasPostAccess(req, p) || !postRevPattern.MatchString(rev) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	name := postRepoPath(p)
+	if name == "" {
+		return air.NotFoundHandler(req, res)
+	}
+
+	pr, pdls, err := postDiff(name, rev)
+	if err != nil {
+		return err
+	} else if pr == nil {
+		return air.NotFoundHandler(req, res)
+	}
+
+	req.Values["PageTitle"] = p.Title
+	req.Values["CanonicalPath"] = "/posts/" + p.ID + "/diff/" + pr.Hash
+	req.Values["NoIndex"] = true
+	req.Values["Post"] = p
+	req.Values["Revision"] = pr
+	req.Values["DiffLines"] = pdls
+
+	return res.Render(req.Values, "diff.html", "layouts/default.html")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/aofei/air"
+)
+
+// The air only hands the `http.Request` and the `http.ResponseWriter` under
+// its requests and responses out to the HTTP middleware, so these borrow them
+// through the `air.WrapHTTPMiddleware`.
+
+// httpRequest returns the `http.Request` under the req.
+func httpRequest(req *air.Request) *http.Request {
+	var hr *http.Request
+	air.WrapHTTPMiddleware(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			_ http.ResponseWriter,
+			r *http.Request,
+		) {
+			hr = r
+		})
+	})(nil)(req, &air.Response{})
+
+	return hr
+}
+
+// httpResponseWriter returns the `http.ResponseWriter` that the res writes to.
+func httpResponseWriter(
+	req *air.Request,
+	res *air.Response,
+) http.ResponseWriter {
+	var hrw http.ResponseWriter
+	air.WrapHTTPMiddleware(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			rw http.ResponseWriter,
+			_ *http.Request,
+		) {
+			hrw = rw
+		})
+	})(nil)(req, res)
+
+	return hrw
+}
+
+// setHTTPResponseWriter makes the res write to the hrw from now on.
+func setHTTPResponseWriter(
+	req *air.Request,
+	res *air.Response,
+	hrw http.ResponseWriter,
+) {
+	air.WrapHTTPMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(
+			_ http.ResponseWriter,
+			r *http.Request,
+		) {
+			next.ServeHTTP(hrw, r)
+		})
+	})(func(*air.Request, *air.Response) error {
+		return nil
+	})(req, res)
+}
+
+// setCookie adds the c to the "set-cookie" of the res. Unlike the
+// `air.Cookie`, the c may have a SameSite.
+func setCookie(res *air.Response, c *http.Cookie) {
+	vs := []string{}
+	if h := res.Header("set-cookie"); h != nil {
+		vs = append(vs, h.Values...)
+	}
+
+	res.SetHeader("set-cookie", append(vs, c.String())...)
+}
+
+// addHeader adds the value to the header of the name of the res.
+func addHeader(res *air.Response, name, value string) {
+	vs := []string{}
+	if h := res.Header(name); h != nil {
+		vs = append(vs, h.Values...)
+	}
+
+	res.SetHeader(name, append(vs, value)...)
+}
+
+// copyResponse returns a copy of the res for the req, with headers and a Body
+// of its own, so that nothing written to the copy reaches the res. A plain copy
+// shares the headers of the res, and its Body writes to the res.
+//
+// The air has no way to give a response new headers, so headers without
+// values, which are never sent, are added to the copy until they no longer fit
+// in the array it shares with the res, and those copied along are then
+// replaced with copies of their own.
+func copyResponse(req *air.Request, res *air.Response) *air.Response {
+	c := *res
+	hs := res.Headers()
+	for i := 0; len(hs) > 0 && &c.Headers()[0] == &hs[0]; i++ {
+		name := "x-air-copy-" + strconv.Itoa(i)
+		c.SetHeader(name, "")
+		c.SetHeader(name)
+	}
+
+	chs := c.Headers()
+	for i, h := range hs {
+		chs[i] = &air.Header{
+			Name:   h.Name,
+			Values: append([]string{}, h.Values...),
+		}
+	}
+
+	c.Body = &responseCopyBody{
+		req: req,
+		res: &c,
+	}
+
+	return &c
+}
+
+// responseCopyBody is the Body of a response made by the `copyResponse`. Like
+// that of the air, it writes the headers on the first write.
+type responseCopyBody struct {
+	req *air.Request
+	res *air.Response
+}
+
+// Write implements the `io.Writer`.
+func (rcb *responseCopyBody) Write(b []byte) (int, error) {
+	if !rcb.res.Written {
+		rcb.res.ContentLength = -1
+		if err := rcb.res.Write(nil); err != nil {
+			return 0, err
+		}
+
+		rcb.res.ContentLength = 0
+	}
+
+	n, err := httpResponseWriter(rcb.req, rcb.res).Write(b)
+	rcb.res.ContentLength += int64(n)
+
+	return n, err
+}
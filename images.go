@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	htemplate "html/template"
+	"image"
+	_ "image/gif"  // For the `image.DecodeConfig`.
+	_ "image/jpeg" // For the `image.DecodeConfig`.
+	_ "image/png"  // For the `image.DecodeConfig`.
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// imageSizes is the "sizes" of the responsive images, matching the width of
+// the content column.
+const imageSizes = "(max-width: 700px) 100vw, 700px"
+
+// imageFormats is the formats that the variants may be encoded in, from the
+// most preferred, with their MIME types.
+var imageFormats = []struct {
+	Name string
+	Type string
+}{
+	{"avif", "image/avif"},
+	{"webp", "image/webp"},
+}
+
+// imageVariant is a resized and re-encoded copy of an image.
+type imageVariant struct {
+	Path   string
+	Format string
+	Width  int
+}
+
+var (
+	imageVariantsGenerating sync.Map
+	imageVariantsFailed     sync.Map
+)
+
+// uploadFilename returns the name of the file that the upload path p refers
+// to. It reports false if the p refers to nothing under the
+// `config.UploadRoot`.
+func uploadFilename(p string) (string, bool) {
+	return rootedFilename(config.UploadRoot, "/uploads", p)
+}
+
+// imageVariantFilename returns the name of the file that the image variant
+// path p refers to. It reports false if the p refers to nothing under the
+// `config.ImageVariantRoot`.
+func imageVariantFilename(p string) (string, bool) {
+	return rootedFilename(config.ImageVariantRoot, "/images", p)
+}
+
+// readRootedFile reads the file of the filename that one of the
+// `uploadFilename` and the `imageVariantFilename` returned with the ok.
+func readRootedFile(filename string, ok bool) ([]byte, error) {
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.ReadFile(filename)
+}
+
+// imageSource returns the path and the name of the file of the image at the
+// src, which must be under the "/assets/" or the "/uploads/". It reports false
+// otherwise.
+func imageSource(src string) (string, string, bool) {
+	p := strings.TrimPrefix(src, basePath)
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(p, "/assets/"):
+		p, _ = assetPath(p)
+		return p, assetFilename(p), true
+	case strings.HasPrefix(p, "/uploads/"):
+		filename, ok := uploadFilename(p)
+		return p, filename, ok
+	}
+
+	return "", "", false
+}
+
+// imageVariants returns the variants of the image of the b at the p, which is
+// width pixels wide. They are as wide as each of the `config.ImageWidths`
+// narrower than the image and as the image itself, in each of the known
+// `config.ImageFormats`.
+func imageVariants(p string, b []byte, width int) []imageVariant {
+	widths := []int{width}
+	for _, w := range config.ImageWidths {
+		if w > 0 && w < width {
+			widths = append(widths, w)
+		}
+	}
+
+	sort.Ints(widths)
+
+	base := strings.TrimSuffix(p, path.Ext(p))
+	hash := fmt.Sprintf("%x", md5.Sum(b))[:8]
+
+	formats := map[string]bool{}
+	for _, f := range config.ImageFormats {
+		formats[f] = true
+	}
+
+	ivs := []imageVariant{}
+	for _, f := range imageFormats {
+		if !formats[f.Name] {
+			continue
+		}
+
+		for _, w := range widths {
+			ivs = append(ivs, imageVariant{
+				Path: fmt.Sprintf(
+					"/images%s.%s.%dw.%s",
+					base,
+					hash,
+					w,
+					f.Name,
+				),
+				Format: f.Name,
+				Width:  w,
+			})
+		}
+	}
+
+	return ivs
+}
+
+// responsiveImages rewrites the "<img>" of the images under the "/assets/" or
+// the "/uploads/" in the HTML h into "<picture>" with the variants of the
+// images that are ready, and gives them their dimensions. The variants that
+// aren't ready are generated in the background, and the posts are reparsed
+// once they are.
+func responsiveImages(h []byte) []byte {
+	if !config.ImageVariantsEnabled || !bytes.Contains(h, []byte("<img")) {
+		return h
+	}
+
+	buf := bytes.Buffer{}
+	z := html.NewTokenizer(bytes.NewReader(h))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		// The `z.Token` may change what the `z.Raw` returns.
+		raw := append([]byte(nil), z.Raw()...)
+		t := z.Token()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken ||
+			t.Data != "img" {
+			buf.Write(raw)
+			continue
+		}
+
+		if p, ok := responsiveImage(t); ok {
+			buf.WriteString(p)
+		} else {
+			buf.Write(raw)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// responsiveImage returns the "<picture>" of the "<img>" t, or false if the t
+// can't be made responsive.
+func responsiveImage(t html.Token) (string, bool) {
+	attrs := map[string]string{}
+	for _, a := range t.Attr {
+		attrs[a.Key] = a.Val
+	}
+
+	p, filename, ok := imageSource(attrs["src"])
+	if !ok || attrs["srcset"] != "" {
+		return "", false
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", false
+	}
+
+	ic, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return "", false
+	}
+
+	srcsets := map[string][]string{}
+	missing := []imageVariant{}
+	for _, iv := range imageVariants(p, b, ic.Width) {
+		filename, ok := imageVariantFilename(iv.Path)
+		if !ok {
+			continue
+		}
+
+		_, err := os.Stat(filename)
+		if _, failed := imageVariantsFailed.Load(iv.Path); failed {
+			continue
+		} else if err != nil {
+			missing = append(missing, iv)
+			continue
+		}
+
+		srcsets[iv.Format] = append(
+			srcsets[iv.Format],
+			sitePath(iv.Path)+" "+strconv.Itoa(iv.Width)+"w",
+		)
+	}
+
+	if len(missing) > 0 {
+		if _, loaded := imageVariantsGenerating.LoadOrStore(
+			filename,
+			true,
+		); !loaded {
+			go generateImageVariants(filename, missing)
+		}
+	}
+
+	if _, ok := attrs["width"]; !ok {
+		attrs["width"] = strconv.Itoa(ic.Width)
+		attrs["height"] = strconv.Itoa(ic.Height)
+	}
+
+	if _, ok := attrs["loading"]; !ok {
+		attrs["loading"] = "lazy"
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	buf := bytes.Buffer{}
+	buf.WriteString("<picture>")
+	for _, f := range imageFormats {
+		if len(srcsets[f.Name]) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(
+			&buf,
+			`<source type="%s" srcset="%s" sizes="%s">`,
+			f.Type,
+			htemplate.HTMLEscapeString(
+				strings.Join(srcsets[f.Name], ", "),
+			),
+			imageSizes,
+		)
+	}
+
+	buf.WriteString("<img")
+	for _, k := range keys {
+		fmt.Fprintf(
+			&buf,
+			` %s="%s"`,
+			k,
+			htemplate.HTMLEscapeString(attrs[k]),
+		)
+	}
+
+	buf.WriteString("></picture>")
+
+	return buf.String(), true
+}
+
+// generateImageVariants generates the ivs of the image of the filename using
+// the FFmpeg. The posts are reparsed afterwards to pick the variants up.
+func generateImageVariants(filename string, ivs []imageVariant) {
+	defer imageVariantsGenerating.Delete(filename)
+
+	generated := 0
+	for _, iv := range ivs {
+		out, ok := imageVariantFilename(iv.Path)
+		if !ok {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			continue
+		}
+
+		scale := fmt.Sprintf("scale=%d:-2:flags=lanczos", iv.Width)
+		if b, err := exec.Command(
+			config.FFmpegPath,
+			"-y",
+			"-loglevel", "error",
+			"-i", filename,
+			"-vf", scale,
+			out,
+		).CombinedOutput(); err != nil {
+			air.ERROR(
+				"failed to generate image variant",
+				map[string]interface{}{
+					"image":   filename,
+					"variant": iv.Path,
+					"error":   err.Error(),
+					"output":  string(b),
+				},
+			)
+			os.Remove(out)
+
+			// Most likely the FFmpeg can't encode the format, so it
+			// isn't tried again until the next start.
+			imageVariantsFailed.Store(iv.Path, true)
+			continue
+		}
+
+		generated++
+	}
+
+	if generated > 0 {
+		requestPostsReload()
+	}
+}
+
+func imageVariantHandler(req *air.Request, res *air.Response) error {
+	filename, ok := imageVariantFilename(routePath(req))
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("cache-control", "max-age=31536000, immutable")
+	return serveFile(req, res, filename)
+}
+
+func uploadHandler(req *air.Request, res *air.Response) error {
+	filename, ok := uploadFilename(routePath(req))
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("cache-control", "max-age=86400")
+	return serveFile(req, res, filename)
+}
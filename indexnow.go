@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// indexNowMaxURLs is the maximum number of URLs a single IndexNow submission
+// can hold.
+const indexNowMaxURLs = 10000
+
+// indexNowKeyRE matches the keys that the IndexNow accepts.
+var indexNowKeyRE = regexp.MustCompile(`^[a-zA-Z0-9-]{8,128}$`)
+
+// indexNowMutex serializes the `pingSearchEngines`, so that the changes are
+// worked out against the state left by the previous run.
+var indexNowMutex sync.Mutex
+
+// checkIndexNowKey checks the `config.IndexNowKey`, if any.
+func checkIndexNowKey() error {
+	if config.IndexNowKey != "" &&
+		!indexNowKeyRE.MatchString(config.IndexNowKey) {
+		return errors.New("indexnow key must be 8 to 128 letters, " +
+			"digits or dashes")
+	}
+
+	return nil
+}
+
+// indexedURLsFilename returns the name of the file of the URLs last told to
+// the search engines.
+func indexedURLsFilename() string {
+	return filepath.Join(config.DataRoot, "indexed-urls.json")
+}
+
+// indexedURLs returns the absolute URLs in the sitemaps of the ops and the
+// pgs, with the times they last changed.
+func indexedURLs(ops []post, pgs map[string]page) map[string]time.Time {
+	ius := map[string]time.Time{}
+	for _, p := range ops {
+		if p.Canonical == "" {
+			ius[config.BaseURL+p.Permalink] = p.Updated
+		}
+	}
+
+	for _, pg := range pgs {
+		if pg.InSitemap() {
+			ius[config.BaseURL+pg.Path()] = pg.Updated
+		}
+	}
+
+	return ius
+}
+
+// pingSearchEngines tells the search engines about the URLs of the ius that
+// have been added, changed or removed since the last time, through the
+// IndexNow with the `config.IndexNowKey` and the `config.SitemapPingURLs`. The
+// first time, when there is nothing to compare with, they are only recorded.
+// A failed submission is retried with the next change, or by the
+// "search_engine_ping" job.
+func pingSearchEngines(ius map[string]time.Time) {
+	if config.IndexNowKey == "" && len(config.SitemapPingURLs) == 0 {
+		return
+	}
+
+	indexNowMutex.Lock()
+	defer indexNowMutex.Unlock()
+
+	logError := func(msg string, err error) {
+		air.ERROR(msg, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	filename := indexedURLsFilename()
+	previous := map[string]time.Time{}
+	b, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(b, &previous)
+	}
+
+	first := os.IsNotExist(err)
+	if err != nil && !first {
+		logError("failed to load indexed urls", err)
+		return
+	}
+
+	changed := []string{}
+	for u, t := range ius {
+		if pt, ok := previous[u]; !ok || !pt.Equal(t) {
+			changed = append(changed, u)
+		}
+	}
+
+	for u := range previous {
+		if _, ok := ius[u]; !ok {
+			changed = append(changed, u)
+		}
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	sort.Strings(changed)
+
+	if !first {
+		if err := submitIndexNow(changed); err != nil {
+			logError("failed to submit to indexnow", err)
+			return
+		}
+
+		pingSitemaps()
+	}
+
+	if b, err := json.Marshal(ius); err != nil {
+		logError("failed to save indexed urls", err)
+	} else if err := writeFileAtomically(filename, b); err != nil {
+		logError("failed to save indexed urls", err)
+	}
+}
+
+// submitIndexNow submits the urls to the `config.IndexNowEndpoint`.
+func submitIndexNow(urls []string) error {
+	if config.IndexNowKey == "" {
+		return nil
+	}
+
+	for len(urls) > 0 {
+		chunk := urls
+		if len(chunk) > indexNowMaxURLs {
+			chunk = chunk[:indexNowMaxURLs]
+		}
+
+		urls = urls[len(chunk):]
+
+		b, err := json.Marshal(map[string]interface{}{
+			"host":        canonicalURL.Hostname(),
+			"key":         config.IndexNowKey,
+			"keyLocation": config.BaseURL + indexNowKeyPath(),
+			"urlList":     chunk,
+		})
+		if err != nil {
+			return err
+		}
+
+		fr, err := fetch(
+			"POST",
+			config.IndexNowEndpoint,
+			http.Header{"Content-Type": {"application/json"}},
+			b,
+		)
+		if err != nil {
+			return err
+		} else if fr.Status != http.StatusOK &&
+			fr.Status != http.StatusAccepted {
+			return fmt.Errorf("unexpected status %d", fr.Status)
+		}
+	}
+
+	return nil
+}
+
+// pingSitemaps pings each of the `config.SitemapPingURLs`, in which the "%s"
+// is replaced with the URL of the sitemap.
+func pingSitemaps() {
+	sitemapURL := url.QueryEscape(config.BaseURL + "/sitemap.xml")
+	for _, pu := range config.SitemapPingURLs {
+		u := strings.Replace(pu, "%s", sitemapURL, -1)
+		fr, err := fetch("GET", u, nil, nil)
+		if err == nil && fr.Status >= 400 {
+			err = fmt.Errorf("unexpected status %d", fr.Status)
+		}
+
+		if err != nil {
+			air.ERROR(
+				"failed to ping sitemap",
+				map[string]interface{}{
+					"url":   u,
+					"error": err.Error(),
+				},
+			)
+		}
+	}
+}
+
+// indexNowKeyPath returns the path of the key file of the IndexNow.
+func indexNowKeyPath() string {
+	return "/" + config.IndexNowKey + ".txt"
+}
+
+func indexNowKeyHandler(req *air.Request, res *air.Response) error {
+	res.SetHeader("content-type", "text/plain; charset=utf-8")
+	return res.WriteString(config.IndexNowKey)
+}
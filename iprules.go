@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+	"github.com/fsnotify/fsnotify"
+)
+
+// ipRule is a set of allowed and denied IP networks. An empty allowlist allows
+// everyone who is not denied.
+type ipRule struct {
+	Prefix string   `toml:"prefix"`
+	Allow  []string `toml:"allow"`
+	Deny   []string `toml:"deny"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// permits reports whether the ir lets the ip through.
+func (ir *ipRule) permits(ip net.IP) bool {
+	if containsIP(ir.deny, ip) {
+		return false
+	}
+
+	return len(ir.allow) == 0 || containsIP(ir.allow, ip)
+}
+
+// ipRules is the content of the `config.IPRulesFile`. The global rule applies
+// to every request, and each group applies to the requests whose paths start
+// with its prefix.
+type ipRules struct {
+	Global ipRule            `toml:"global"`
+	Groups map[string]ipRule `toml:"groups"`
+
+	groups []ipRule
+}
+
+var (
+	currentIPRulesMutex sync.RWMutex
+	currentIPRules      *ipRules
+)
+
+// loadIPRules loads the `config.IPRulesFile` into the `currentIPRules`. The
+// current rules are kept if the file is malformed.
+func loadIPRules() error {
+	irs := &ipRules{}
+	if _, err := toml.DecodeFile(config.IPRulesFile, irs); err != nil {
+		return err
+	}
+
+	rules := []*ipRule{&irs.Global}
+	for name, g := range irs.Groups {
+		if !strings.HasPrefix(g.Prefix, "/") {
+			return fmt.Errorf("group %s has no prefix", name)
+		}
+
+		irs.groups = append(irs.groups, g)
+	}
+
+	for i := range irs.groups {
+		rules = append(rules, &irs.groups[i])
+	}
+
+	for _, ir := range rules {
+		var err error
+		if ir.allow, err = parseCIDRs(ir.Allow); err != nil {
+			return err
+		}
+
+		if ir.deny, err = parseCIDRs(ir.Deny); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(irs.groups, func(i, j int) bool {
+		return irs.groups[i].Prefix < irs.groups[j].Prefix
+	})
+
+	currentIPRulesMutex.Lock()
+	currentIPRules = irs
+	currentIPRulesMutex.Unlock()
+
+	return nil
+}
+
+// watchIPRules reloads the `config.IPRulesFile` whenever it changes. The
+// directory of the file is watched instead of the file itself, since editors
+// tend to replace files rather than write to them.
+func watchIPRules() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := w.Add(filepath.Dir(config.IPRulesFile)); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(e.Name) !=
+					filepath.Clean(config.IPRulesFile) {
+					continue
+				}
+
+				if err := loadIPRules(); err != nil {
+					air.ERROR(
+						"failed to reload ip rules",
+						map[string]interface{}{
+							"error": err.Error(),
+						},
+					)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+
+				air.ERROR(
+					"ip rule watcher error",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ipRulesGas is an `air.Gas` that turns away the clients that the
+// `currentIPRules` don't let through.
+func ipRulesGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		currentIPRulesMutex.RLock()
+		irs := currentIPRules
+		currentIPRulesMutex.RUnlock()
+		if irs == nil {
+			return next(req, res)
+		}
+
+		ip := net.ParseIP(clientIP(req))
+		permitted := ip != nil && irs.Global.permits(ip)
+		for i := range irs.groups {
+			g := &irs.groups[i]
+			if permitted && strings.HasPrefix(req.Path, g.Prefix) {
+				permitted = g.permits(ip)
+			}
+		}
+
+		if !permitted {
+			res.Status = 403
+			return errors.New("Forbidden")
+		}
+
+		return next(req, res)
+	}
+}
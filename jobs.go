@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// jobScheduleOff is the schedule of the `config.Jobs` that turns a job off.
+const jobScheduleOff = "off"
+
+// jobSchedule is when a job runs.
+type jobSchedule interface {
+	// next returns the first time of the schedule after the t.
+	next(t time.Time) time.Time
+}
+
+// everySchedule is a `jobSchedule` of a fixed interval.
+type everySchedule time.Duration
+
+// next implements the `jobSchedule`.
+func (es everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(es))
+}
+
+// cronSchedule is a `jobSchedule` of the minutes, the hours, the days of the
+// month, the months and the days of the week as in a crontab. Each field is a
+// set of bits, one for each value.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+
+	// anyDay and anyWeekday tell apart an unrestricted day of the month or
+	// of the week, since either matches when the other one is restricted.
+	anyDay, anyWeekday bool
+}
+
+// cronScheduleAliases is the predefined schedules of the crontabs.
+var cronScheduleAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// parseJobSchedule parses the s, which is "@every" followed by a duration, a
+// predefined schedule such as "@daily" or five fields of a crontab.
+func parseJobSchedule(s string) (jobSchedule, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "@every ") {
+		d, err := time.ParseDuration(strings.TrimPrefix(s, "@every "))
+		if err != nil {
+			return nil, err
+		} else if d < time.Second {
+			return nil, errors.New("interval must be at least 1s")
+		}
+
+		return everySchedule(d), nil
+	}
+
+	if a, ok := cronScheduleAliases[s]; ok {
+		s = a
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("malformed schedule %q", s)
+	}
+
+	cs := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&cs.minutes, 0, 59},
+		{&cs.hours, 0, 23},
+		{&cs.days, 1, 31},
+		{&cs.months, 1, 12},
+		{&cs.weekdays, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"malformed schedule %q: %v",
+				s,
+				err,
+			)
+		}
+
+		*f.bits = bits
+	}
+
+	// Both 0 and 7 are Sunday.
+	if cs.weekdays&(1<<7) != 0 {
+		cs.weekdays |= 1
+	}
+
+	return cs, nil
+}
+
+// parseCronField parses the f, a field of a crontab of the values from the
+// min to the max, into a set of bits. The f is a list of "*", values and
+// ranges, each of which may be followed by a step such as "/5".
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("bad step %q", part[i+1:])
+			}
+
+			step, part = s, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", bounds[0])
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf(
+						"bad value %q",
+						bounds[1],
+					)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// next implements the `jobSchedule`. It gives up with the zero time if the
+// schedule matches nothing for five years, as a "0 0 30 2 *" would.
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case cs.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(
+				t.Year(),
+				t.Month()+1,
+				1,
+				0,
+				0,
+				0,
+				0,
+				t.Location(),
+			)
+		case !cs.matchesDay(t):
+			t = time.Date(
+				t.Year(),
+				t.Month(),
+				t.Day()+1,
+				0,
+				0,
+				0,
+				0,
+				t.Location(),
+			)
+		case cs.hours&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case cs.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matchesDay reports whether the day of the t matches the cs. As in the
+// crontabs, a day matches either of the day of the month and the day of the
+// week if both are restricted.
+func (cs *cronSchedule) matchesDay(t time.Time) bool {
+	day := cs.days&(1<<uint(t.Day())) != 0
+	weekday := cs.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case cs.anyDay && cs.anyWeekday:
+		return true
+	case cs.anyDay:
+		return weekday
+	case cs.anyWeekday:
+		return day
+	}
+
+	return day || weekday
+}
+
+// job is a periodic piece of work of a feature, run by the `runScheduler`.
+type job struct {
+	Name         string
+	Schedule     string
+	Next         time.Time
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	Runs         int
+	Failures     int
+	Running      bool
+
+	schedule jobSchedule
+	run      func() error
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      = map[string]*job{}
+)
+
+// registerJob registers the run as the job of the name, which runs on the
+// schedule unless the `config.Jobs` says otherwise. It must be called before
+// the `startJobs`.
+func registerJob(name, schedule string, run func() error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	jobs[name] = &job{
+		Name:     name,
+		Schedule: schedule,
+		run:      run,
+	}
+}
+
+// startJobs schedules the registered jobs and starts the `runScheduler`.
+func startJobs() error {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for name := range config.Jobs {
+		if _, ok := jobs[name]; !ok {
+			return fmt.Errorf("unknown job %q", name)
+		}
+	}
+
+	now := time.Now()
+	for _, j := range jobs {
+		if s, ok := config.Jobs[j.Name]; ok {
+			j.Schedule = s
+		}
+
+		if j.Schedule == jobScheduleOff {
+			continue
+		}
+
+		s, err := parseJobSchedule(j.Schedule)
+		if err != nil {
+			return fmt.Errorf("job %q: %v", j.Name, err)
+		}
+
+		j.schedule = s
+		if j.Next = s.next(now); j.Next.IsZero() {
+			return fmt.Errorf("job %q would never run", j.Name)
+		}
+	}
+
+	runWithHeartbeat("scheduler", time.Minute, runScheduler)
+
+	return nil
+}
+
+// runScheduler runs the jobs as they become due. A job that is still running
+// when it is due again is not run twice, but waits for its next time.
+func runScheduler() {
+	generation := heartbeatGeneration("scheduler")
+	for {
+		if !beat("scheduler", generation) {
+			return
+		}
+
+		now := time.Now()
+		wait := time.Minute
+
+		jobsMutex.Lock()
+		for _, j := range jobs {
+			if j.schedule == nil || j.Next.IsZero() {
+				continue
+			}
+
+			if !now.Before(j.Next) {
+				j.Next = j.schedule.next(now)
+				if !j.Running {
+					j.Running = true
+					go runJob(j)
+				}
+			}
+
+			if d := j.Next.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		jobsMutex.Unlock()
+
+		time.Sleep(wait)
+	}
+}
+
+// runJob runs the j, which has been marked as running, and records how it
+// went.
+func runJob(j *job) {
+	started := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		return j.run()
+	}()
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	j.Running = false
+	j.LastRun = started.UTC()
+	j.LastDuration = time.Since(started).Round(time.Millisecond)
+	j.LastError = ""
+	j.Runs++
+	if err != nil {
+		j.LastError = err.Error()
+		j.Failures++
+		air.ERROR("job failed", map[string]interface{}{
+			"job":   j.Name,
+			"error": err.Error(),
+		})
+	}
+}
+
+// runJobNow runs the job of the name right away, unless it is running. It
+// reports whether the job is known.
+func runJobNow(name string) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	j, ok := jobs[name]
+	if !ok {
+		return false
+	}
+
+	if !j.Running {
+		j.Running = true
+		go runJob(j)
+	}
+
+	return true
+}
+
+// jobSnapshot returns a copy of all the jobs ordered by name.
+func jobSnapshot() []job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	js := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		js = append(js, *j)
+	}
+
+	sort.Slice(js, func(i, k int) bool {
+		return js[i].Name < js[k].Name
+	})
+
+	return js
+}
+
+func adminRunJobHandler(req *air.Request, res *air.Response) error {
+	if !runJobNow(paramValue(req, "name")) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	return res.Redirect(sitePath("/admin/status"))
+}
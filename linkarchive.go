@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// The endpoints of the Wayback Machine of the Internet Archive.
+const (
+	waybackSaveEndpoint      = "https://web.archive.org/save/"
+	waybackAvailableEndpoint = "https://archive.org/wayback/available"
+)
+
+// linkArchive is an archived copy of an outbound link.
+type linkArchive struct {
+	URL         string    `json:"url"`
+	ArchivedURL string    `json:"archived_url"`
+	ArchivedAt  time.Time `json:"archived_at"`
+}
+
+var (
+	linkArchivesMutex sync.Mutex
+	linkArchives      = map[string]linkArchive{}
+
+	// linkArchiveInterval is how long the submissions to the Wayback
+	// Machine are spaced apart, and linkArchivingMutex makes sure that
+	// only one post has its links archived at a time.
+	linkArchiveInterval time.Duration
+	linkArchivingMutex  sync.Mutex
+)
+
+// linkArchivesFilename returns the name of the file of the `linkArchives`.
+func linkArchivesFilename() string {
+	return filepath.Join(config.DataRoot, "link-archives.json")
+}
+
+// setupLinkArchives parses the `config.LinkArchiveInterval` and loads the
+// `linkArchives` from the disk.
+func setupLinkArchives() error {
+	d, err := time.ParseDuration(config.LinkArchiveInterval)
+	if err != nil {
+		return fmt.Errorf("bad link archive interval: %v", err)
+	}
+
+	linkArchiveInterval = d
+
+	b, err := ioutil.ReadFile(linkArchivesFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	linkArchivesMutex.Lock()
+	defer linkArchivesMutex.Unlock()
+
+	return json.Unmarshal(b, &linkArchives)
+}
+
+// saveLinkArchives saves the `linkArchives`. It must be called with the
+// `linkArchivesMutex` held.
+func saveLinkArchives() error {
+	b, err := json.MarshalIndent(linkArchives, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(linkArchivesFilename(), b)
+}
+
+// archiveLink submits the u to the Wayback Machine and returns the URL of the
+// copy it made, or of the closest copy it had if it made none.
+func archiveLink(u string) (string, error) {
+	fr, err := fetch("GET", waybackSaveEndpoint+u, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if cl := fr.Header.Get("content-location"); fr.Status < 400 &&
+		strings.HasPrefix(cl, "/web/") {
+		return "https://web.archive.org" + cl, nil
+	}
+
+	fr, err = fetch(
+		"GET",
+		waybackAvailableEndpoint+"?url="+url.QueryEscape(u),
+		nil,
+		nil,
+	)
+	if err != nil {
+		return "", err
+	} else if fr.Status != 200 {
+		return "", fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	var available struct {
+		ArchivedSnapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.Unmarshal(fr.Body, &available); err != nil {
+		return "", err
+	}
+
+	closest := available.ArchivedSnapshots.Closest
+	if !closest.Available || closest.URL == "" {
+		return "", fmt.Errorf("no archived copy of %s", u)
+	}
+
+	return closest.URL, nil
+}
+
+// archiveOutboundLinks archives the outbound links of the p that have no
+// archived copies yet, one by one and the `linkArchiveInterval` apart. The
+// posts are archived one at a time, so it is fine to call it for many of them
+// at once in the background.
+func archiveOutboundLinks(p post) {
+	if p.Protected() || p.MembersOnly {
+		return
+	}
+
+	linkArchivingMutex.Lock()
+	defer linkArchivingMutex.Unlock()
+
+	for _, u := range outboundLinks(p) {
+		if strings.HasPrefix(u, "https://web.archive.org/") {
+			continue
+		}
+
+		linkArchivesMutex.Lock()
+		_, ok := linkArchives[u]
+		linkArchivesMutex.Unlock()
+		if ok {
+			continue
+		}
+
+		au, err := archiveLink(u)
+		if err != nil {
+			air.WARN(
+				"failed to archive link",
+				map[string]interface{}{
+					"post_id": p.ID,
+					"url":     u,
+					"error":   err.Error(),
+				},
+			)
+		} else {
+			linkArchivesMutex.Lock()
+			linkArchives[u] = linkArchive{
+				URL:         u,
+				ArchivedURL: au,
+				ArchivedAt:  time.Now().UTC(),
+			}
+			err := saveLinkArchives()
+			linkArchivesMutex.Unlock()
+			if err != nil {
+				air.ERROR(
+					"failed to save link archives",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}
+
+		time.Sleep(linkArchiveInterval)
+	}
+}
+
+// archivedURL returns the URL of the archived copy of the u, or an empty
+// string if there is none.
+func archivedURL(u string) string {
+	linkArchivesMutex.Lock()
+	defer linkArchivesMutex.Unlock()
+	return linkArchives[u].ArchivedURL
+}
+
+// postLinkArchives returns the archived copies of the outbound links of the p,
+// in the order the links appear.
+func postLinkArchives(p post) []linkArchive {
+	linkArchivesMutex.Lock()
+	defer linkArchivesMutex.Unlock()
+
+	las := []linkArchive{}
+	for _, u := range outboundLinks(p) {
+		if la, ok := linkArchives[u]; ok {
+			las = append(las, la)
+		}
+	}
+
+	return las
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// linkCheck is the result of the last check of an outbound link.
+type linkCheck struct {
+	URL       string    `json:"url"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Dead      bool      `json:"dead"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// deadLink is a dead link of a post, as the `/admin/links` shows it.
+type deadLink struct {
+	PostID    string
+	PostTitle string
+	linkCheck
+}
+
+var (
+	linkChecksMutex sync.Mutex
+	linkChecks      = map[string]linkCheck{}
+)
+
+// linkChecksFilename returns the name of the file of the `linkChecks`.
+func linkChecksFilename() string {
+	return filepath.Join(config.DataRoot, "link-checks.json")
+}
+
+// loadLinkChecks loads the `linkChecks` from the disk.
+func loadLinkChecks() error {
+	b, err := ioutil.ReadFile(linkChecksFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	linkChecksMutex.Lock()
+	defer linkChecksMutex.Unlock()
+
+	return json.Unmarshal(b, &linkChecks)
+}
+
+// saveLinkChecks saves the `linkChecks`. It must be called with the
+// `linkChecksMutex` held.
+func saveLinkChecks() error {
+	b, err := json.MarshalIndent(linkChecks, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(linkChecksFilename(), b)
+}
+
+// outboundLinks returns the URLs of the links of the p to the other sites, in
+// the order they appear.
+func outboundLinks(p post) []string {
+	urls := []string{}
+	seen := map[string]bool{}
+	z := html.NewTokenizer(bytes.NewReader([]byte(p.Content)))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		} else if tt != html.StartTagToken {
+			continue
+		}
+
+		t := z.Token()
+		if t.Data != "a" {
+			continue
+		}
+
+		href := attr(t, "href")
+		if i := strings.IndexByte(href, '#'); i >= 0 {
+			href = href[:i]
+		}
+
+		if !isExternalURL(href) || seen[href] ||
+			!strings.HasPrefix(href, "http://") &&
+				!strings.HasPrefix(href, "https://") {
+			continue
+		}
+
+		seen[href] = true
+		urls = append(urls, href)
+	}
+
+	return urls
+}
+
+// checkLink checks the link of the u with a HEAD, falling back to a GET for
+// the sites that don't answer the HEAD properly.
+func checkLink(u string) linkCheck {
+	lc := linkCheck{
+		URL:       u,
+		CheckedAt: time.Now().UTC(),
+	}
+
+	fr, err := fetch("HEAD", u, nil, nil)
+	if err != nil || fr.Status >= 400 {
+		fr, err = fetch("GET", u, nil, nil)
+	}
+
+	if err != nil {
+		lc.Error = err.Error()
+		lc.Dead = true
+		return lc
+	}
+
+	lc.Status = fr.Status
+
+	// The sites that are merely busy or fend off the bots are not dead.
+	lc.Dead = fr.Status >= 400 &&
+		fr.Status != http.StatusTooManyRequests &&
+		fr.Status != http.StatusForbidden &&
+		fr.Status != http.StatusServiceUnavailable
+
+	return lc
+}
+
+// checkLinks checks the outbound links of the posts that have not been
+// checked within the maxAge, and forgets the results of the links that are
+// gone from the posts. The checks are spaced by the `fetch`, so a run may take
+// a while.
+func checkLinks(maxAge time.Duration) error {
+	snap := loadedPosts()
+
+	needed := map[string]bool{}
+	checked := 0
+	for _, p := range snap.posts {
+		for _, u := range outboundLinks(p) {
+			needed[u] = true
+
+			linkChecksMutex.Lock()
+			lc, ok := linkChecks[u]
+			linkChecksMutex.Unlock()
+			if ok && time.Since(lc.CheckedAt) < maxAge {
+				continue
+			}
+
+			lc = checkLink(u)
+			linkChecksMutex.Lock()
+			linkChecks[u] = lc
+			linkChecksMutex.Unlock()
+			checked++
+		}
+	}
+
+	linkChecksMutex.Lock()
+	defer linkChecksMutex.Unlock()
+
+	forgotten := 0
+	for u := range linkChecks {
+		if !needed[u] {
+			delete(linkChecks, u)
+			forgotten++
+		}
+	}
+
+	if checked > 0 || forgotten > 0 {
+		if err := saveLinkChecks(); err != nil {
+			return fmt.Errorf("failed to save link checks: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// deadLinks returns the dead links of the posts of the snap, by the posts from
+// the newest.
+func deadLinks(snap *postsSnapshot) []deadLink {
+	linkChecksMutex.Lock()
+	defer linkChecksMutex.Unlock()
+
+	dls := []deadLink{}
+	for _, p := range snap.posts {
+		for _, u := range outboundLinks(p) {
+			if lc, ok := linkChecks[u]; ok && lc.Dead {
+				dls = append(dls, deadLink{
+					PostID:    p.ID,
+					PostTitle: p.Title,
+					linkCheck: lc,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(dls, func(i, j int) bool {
+		pi, pj := snap.posts[dls[i].PostID], snap.posts[dls[j].PostID]
+		if !pi.Datetime.Equal(pj.Datetime) {
+			return pi.Datetime.After(pj.Datetime)
+		}
+
+		return dls[i].PostID < dls[j].PostID
+	})
+
+	return dls
+}
+
+func adminLinksHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	req.Values["PageTitle"] = "Dead Links"
+	req.Values["DeadLinks"] = deadLinks(snap)
+	req.Values["LinkCheckEnabled"] = config.LinkCheckInterval != ""
+
+	return res.Render(
+		req.Values,
+		"admin/links.html",
+		"layouts/default.html",
+	)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by the systemd
+// socket activation.
+const systemdListenFDsStart = 3
+
+// checkListen checks the `config.Listen` and the `config.UnixSocketMode`.
+func checkListen() error {
+	switch {
+	case config.Listen == "", config.Listen == "systemd":
+	case strings.HasPrefix(config.Listen, "unix:"):
+		if strings.TrimPrefix(config.Listen, "unix:") == "" {
+			return errors.New("missing unix socket path")
+		}
+
+		if _, err := strconv.ParseUint(
+			config.UnixSocketMode,
+			8,
+			32,
+		); err != nil {
+			return fmt.Errorf(
+				"bad unix socket mode %q",
+				config.UnixSocketMode,
+			)
+		}
+	default:
+		return fmt.Errorf("bad listen %q", config.Listen)
+	}
+
+	return nil
+}
+
+// listenSocket returns the listener of the `config.Listen`, which is either a
+// unix socket at the path after its "unix:", or the first socket passed by the
+// systemd if it is "systemd".
+func listenSocket() (net.Listener, error) {
+	if config.Listen == "systemd" {
+		return systemdListener()
+	}
+
+	name := strings.TrimPrefix(config.Listen, "unix:")
+
+	// A socket left behind by a previous run that didn't close it would
+	// fail the listen.
+	if fi, err := os.Lstat(name); err == nil &&
+		fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, _ := strconv.ParseUint(config.UnixSocketMode, 8, 32)
+	if err := os.Chmod(name, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// systemdListener returns the listener of the first socket passed by the
+// systemd, as its socket activation describes with the "LISTEN_PID" and the
+// "LISTEN_FDS".
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if pid != os.Getpid() {
+		return nil, errors.New("no socket passed by systemd")
+	}
+
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if n < 1 {
+		return nil, errors.New("no socket passed by systemd")
+	}
+
+	// They must not be passed on to any child process.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// airAddress returns the address that the Air listens on. The `air.Address`
+// is only read from the `air.ConfigFile` once the Air starts serving, so it is
+// read here ahead of that.
+func airAddress() (string, error) {
+	ac := struct {
+		Address string `toml:"address"`
+	}{
+		Address: air.Address,
+	}
+	if air.ConfigFile != "" {
+		if _, err := toml.DecodeFile(air.ConfigFile, &ac); err != nil {
+			return "", err
+		}
+	}
+
+	return ac.Address, nil
+}
+
+// serveSocket relays the connections accepted by the l to the `airAddress`,
+// where the Air serves them. The Air can only listen on a TCP address, so it
+// is expected to be a loopback one. The relaying starts once the Air is up, so
+// that the connections queued by the systemd during a restart are not lost.
+func serveSocket(l net.Listener) error {
+	address, err := airAddress()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" &&
+		(ip == nil || !ip.IsLoopback()) {
+		air.WARN(
+			"address is not a loopback one, so it is reachable "+
+				"besides the socket",
+			map[string]interface{}{
+				"address": address,
+			},
+		)
+	}
+
+	for {
+		c, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			c.Close()
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go relaySocketConn(c, address)
+	}
+}
+
+// relaySocketConn relays the c to the address until either side closes.
+func relaySocketConn(c net.Conn, address string) {
+	defer c.Close()
+
+	ac, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		air.ERROR(
+			"failed to relay socket connection",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+		return
+	}
+	defer ac.Close()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ac, c)
+		if tc, ok := ac.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(c, ac)
+		if uc, ok := c.(interface{ CloseWrite() error }); ok {
+			uc.CloseWrite()
+		}
+	}()
+
+	wg.Wait()
+}
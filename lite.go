@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	htemplate "html/template"
+	"strings"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// liteStrippedTags is the tags left out of the lite posts, along with what is
+// inside them.
+var liteStrippedTags = map[string]bool{
+	"iframe":   true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+}
+
+// liteHTML returns the h without the scripts, the styles, the embeds and the
+// event handlers, so that it needs nothing but itself to be read.
+func liteHTML(h string) string {
+	buf := bytes.Buffer{}
+	skip := 0
+	z := html.NewTokenizer(strings.NewReader(h))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if liteStrippedTags[t.Data] {
+				if tt == html.StartTagToken {
+					skip++
+				}
+
+				continue
+			} else if t.Data == "link" || t.Data == "embed" {
+				continue
+			}
+
+			attrs := t.Attr[:0]
+			for _, a := range t.Attr {
+				if !strings.HasPrefix(a.Key, "on") {
+					attrs = append(attrs, a)
+				}
+			}
+
+			t.Attr = attrs
+		case html.EndTagToken:
+			if liteStrippedTags[t.Data] {
+				if skip > 0 {
+					skip--
+				}
+
+				continue
+			}
+		}
+
+		if skip == 0 {
+			buf.WriteString(t.String())
+		}
+	}
+
+	return buf.String()
+}
+
+// LitePath returns the path of the lite version of the p.
+func (p post) LitePath() string {
+	return "/posts/" + p.ID + "/lite"
+}
+
+// litePostHandler serves the lite version of the post of the id in the snap, a
+// page with its styles inlined and no scripts, for the slow connections and the
+// reader services.
+func litePostHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+) error {
+	p, ok := snap.posts[id]
+	if !ok || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if p.Protected() || p.MembersOnly {
+		res.SetHeader("cache-control", "private, no-cache")
+	}
+
+	req.Values["PageTitle"] = p.Title
+	req.Values["CanonicalPath"] = p.Permalink
+	req.Values["CanonicalURL"] = p.Canonical
+	req.Values["Post"] = p
+	req.Values["Content"] = htemplate.HTML(liteHTML(string(p.Content)))
+	return res.Render(req.Values, "lite.html")
+}
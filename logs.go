@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// rotatingFile is an `io.Writer` that writes to a file and moves it aside
+// whenever it grows over its size limit or gets older than its rotation
+// interval.
+type rotatingFile struct {
+	name       string
+	maxBytes   int64
+	interval   time.Duration
+	maxBackups int
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// openRotatingFile opens the name as a `rotatingFile`. A zero maxBytes or
+// interval disables the respective rotation, and a zero maxBackups keeps all
+// the rotated files.
+func openRotatingFile(
+	name string,
+	maxBytes int64,
+	interval time.Duration,
+	maxBackups int,
+) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		name:       name,
+		maxBytes:   maxBytes,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// open opens the file of the rf for appending.
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.name), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(
+		rf.name,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file = f
+	rf.size = fi.Size()
+	rf.openedAt = fi.ModTime()
+	if rf.size == 0 {
+		rf.openedAt = time.Now()
+	}
+
+	return nil
+}
+
+// Write implements the `io.Writer`.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	tooBig := rf.maxBytes > 0 && rf.size+int64(len(b)) > rf.maxBytes
+	tooOld := rf.interval > 0 && time.Since(rf.openedAt) > rf.interval
+	if rf.size > 0 && (tooBig || tooOld) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// rotate moves the current file of the rf aside, opens a new one and removes
+// the rotated files beyond the limit.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(
+		rf.name,
+		rf.name+"."+time.Now().UTC().Format("20060102T150405"),
+	); err != nil {
+		return err
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	if rf.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(rf.name + ".*")
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(backups)
+	for len(backups) > rf.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// setupLogging directs the logs to the `config.LogFile` (if any), and to the
+// standard output as well if the `config.LogStdout` is set.
+func setupLogging() error {
+	if config.LogFile == "" {
+		return nil
+	}
+
+	interval := time.Duration(0)
+	if config.LogRotationInterval != "" {
+		d, err := time.ParseDuration(config.LogRotationInterval)
+		if err != nil {
+			return err
+		}
+
+		interval = d
+	}
+
+	rf, err := openRotatingFile(
+		config.LogFile,
+		config.LogMaxBytes,
+		interval,
+		config.LogMaxBackups,
+	)
+	if err != nil {
+		return err
+	}
+
+	if config.LogStdout {
+		air.LoggerOutput = io.MultiWriter(rf, os.Stdout)
+	} else {
+		air.LoggerOutput = rf
+	}
+
+	return nil
+}
+
+// requestIDRE matches the request IDs that are taken from the proxies.
+var requestIDRE = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// newRequestID returns a new random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// requestID returns the ID of the req, which is the "X-Request-Id" that a
+// trusted proxy has given it, or a new one.
+func requestID(req *air.Request) string {
+	host := httpRequest(req).RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if ip := net.ParseIP(host); ip != nil && isTrustedProxy(ip) {
+		rid := req.Header("x-request-id").Value()
+		if requestIDRE.MatchString(rid) {
+			return rid
+		}
+	}
+
+	return newRequestID()
+}
+
+// accessLogGas is an `air.Gas` that logs every request it serves, by its ID
+// that it also returns in the "X-Request-Id".
+func accessLogGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		start := time.Now()
+
+		requestID := requestID(req)
+		req.Values["RequestID"] = requestID
+		res.SetHeader("x-request-id", requestID)
+
+		cw := &countingResponseWriter{
+			ResponseWriter: httpResponseWriter(req, res),
+		}
+		setHTTPResponseWriter(req, res, cw)
+
+		err := next(req, res)
+
+		status := res.Status
+		if err != nil && status < 400 {
+			status = 500
+		}
+
+		fields := map[string]interface{}{
+			"request_id": requestID,
+			"client_ip":  clientIP(req),
+			"method":     req.Method,
+			"path":       req.Path,
+			"status":     status,
+			"bytes":      cw.bytes,
+			"latency":    time.Since(start).String(),
+			"user_agent": req.Header("user-agent").Value(),
+			"bot_class":  req.Values["BotClass"],
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+
+		if status >= 500 {
+			air.ERROR("request served", fields)
+		} else {
+			air.INFO("request served", fields)
+		}
+
+		return err
+	}
+}
+
+// countingResponseWriter is an `http.ResponseWriter` that counts the bytes of
+// the body written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+
+	bytes int
+}
+
+// Write implements the `http.ResponseWriter`.
+func (rw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
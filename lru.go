@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a size-aware least recently used cache. It evicts the least
+// recently used entries whenever the total size of its entries exceeds its
+// budget. A budget of zero means unlimited.
+type lruCache struct {
+	name     string
+	maxBytes int
+
+	mutex     sync.Mutex
+	bytes     int
+	ll        *list.List
+	elements  map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// lruEntry is an entry of the `lruCache`.
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int
+}
+
+var lruCaches []*lruCache
+
+// newLRUCache returns a new `lruCache` with the name and the budget of the
+// maxBytes. The name is used to tell the caches apart in the metrics.
+func newLRUCache(name string, maxBytes int) *lruCache {
+	c := &lruCache{
+		name:     name,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		elements: map[string]*list.Element{},
+	}
+
+	lruCaches = append(lruCaches, c)
+
+	return c
+}
+
+// get returns the value of the key.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.elements[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.ll.MoveToFront(e)
+
+	return e.Value.(*lruEntry).value, true
+}
+
+// set sets the value of the key, which takes the size bytes of memory.
+func (c *lruCache) set(key string, value interface{}, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	if e, ok := c.elements[key]; ok {
+		c.remove(e)
+	}
+
+	c.elements[key] = c.ll.PushFront(&lruEntry{
+		key:   key,
+		value: value,
+		size:  size,
+	})
+	c.bytes += size
+
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// remove removes the e from the c.
+func (c *lruCache) remove(e *list.Element) {
+	le := c.ll.Remove(e).(*lruEntry)
+	delete(c.elements, le.key)
+	c.bytes -= le.size
+}
+
+// purge removes all the entries from the c.
+func (c *lruCache) purge() {
+	c.mutex.Lock()
+	c.ll.Init()
+	c.elements = map[string]*list.Element{}
+	c.bytes = 0
+	c.mutex.Unlock()
+}
+
+// lruCacheStats is the statistics of an `lruCache`.
+type lruCacheStats struct {
+	Name      string
+	Entries   int
+	Bytes     int
+	MaxBytes  int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// HitRatio returns the share of the lookups of the cs that were hits, in
+// percent.
+func (cs lruCacheStats) HitRatio() float64 {
+	if cs.Hits+cs.Misses == 0 {
+		return 0
+	}
+
+	return 100 * float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+}
+
+// stats returns the statistics of the c.
+func (c *lruCache) stats() lruCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return lruCacheStats{
+		Name:      c.name,
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
@@ -3,69 +3,287 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
-	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	htemplate "html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/air-gases/defibrillator"
-	"github.com/air-gases/limiter"
-	"github.com/air-gases/logger"
 	"github.com/air-gases/redirector"
 	"github.com/aofei/air"
 	"github.com/fsnotify/fsnotify"
-	"github.com/russross/blackfriday/v2"
-	"github.com/tdewolff/minify"
-	mxml "github.com/tdewolff/minify/xml"
 )
 
 type post struct {
-	ID       string
-	Title    string
-	Datetime time.Time
-	Content  htemplate.HTML
+	ID          string
+	Title       string
+	Datetime    time.Time
+	Content     htemplate.HTML
+	Render      renderOptions
+	Tags        []string   `toml:"tags"`
+	Slug        string     `toml:"slug"`
+	Description string     `toml:"description"`
+	Keywords    []string   `toml:"keywords"`
+	Language    string     `toml:"language"`
+	Related     []string   `toml:"related"`
+	Syndication []string   `toml:"syndication"`
+	Image       string     `toml:"image"`
+	Author      string     `toml:"author"`
+	Canonical   string     `toml:"canonical"`
+	Visibility  string     `toml:"visibility"`
+	Password    string     `toml:"password"`
+	MembersOnly bool       `toml:"members_only"`
+	Series      string     `toml:"series"`
+	SeriesPart  int        `toml:"series_part"`
+	Updated     time.Time  `toml:"updated"`
+	Edits       []postEdit `toml:"edits"`
+	Revised     bool       `toml:"-"`
+	Permalink   string     `toml:"-"`
+	Source      []byte     `toml:"-"`
+	File        string     `toml:"-"`
+	ModTime     time.Time  `toml:"-"`
+	ShortCode   string     `toml:"-"`
+	EntryID     string     `toml:"entry_id"`
+	Video       *postVideo `toml:"video"`
+	Template    string     `toml:"template"`
+	Layout      string     `toml:"layout"`
+	Pinned      bool       `toml:"pinned"`
+	Featured    bool       `toml:"featured"`
+
+	authorProfile *author
 }
 
 var (
-	postsOnce    sync.Once
-	posts        map[string]post
-	orderedPosts []post
+	checkMode   *bool
+	encryptFile *string
+	migrateMode *bool
+	sitesFile   *string
+	siteMode    *bool
+
+	postsWatcherRunning int32
 
-	feed             []byte
-	feedTemplate     *template.Template
-	feedETag         string
-	feedLastModified string
+	postsOnce    sync.Once
+	feedTemplate *template.Template
 )
 
-func init() {
+// setup parses the flags and sets the blog up by its configuration file. The
+// `main` calls it first, rather than it being an `init`, so that the tests
+// don't parse the flags of the `go test` nor need a configuration file.
+func setup() {
 	cf := flag.String("config", "config.toml", "configuration file")
+	checkMode = flag.Bool("check", false, "check the posts and exit")
+	encryptFile = flag.String(
+		"encrypt",
+		"",
+		"encrypt the post file and exit",
+	)
+	migrateMode = flag.Bool(
+		"migrate-to-sqlite",
+		false,
+		"copy the posts and their data into the sqlite store and exit",
+	)
+	sitesFile = flag.String(
+		"sites",
+		"",
+		"serve the blogs of the sites file by their hosts",
+	)
+	siteMode = flag.Bool(
+		"site",
+		false,
+		"serve a blog of a sites file behind the proxy of its parent",
+	)
 	flag.Parse()
 
+	// The blogs of the sites file are set up by their own processes.
+	if *sitesFile != "" {
+		return
+	}
+
 	air.ConfigFile = *cf
+	if err := loadConfig(*cf); err != nil {
+		panic(fmt.Errorf("failed to load configuration file: %v", err))
+	}
+
+	if err := setupSanitizer(); err != nil {
+		panic(fmt.Errorf("failed to set up sanitizer: %v", err))
+	}
+
+	if err := setupEmbedded(); err != nil {
+		panic(fmt.Errorf("failed to set up embedded files: %v", err))
+	}
+
+	if err := setupTheme(); err != nil {
+		panic(fmt.Errorf("failed to set up theme: %v", err))
+	}
+
+	if err := setupStore(); err != nil {
+		panic(fmt.Errorf("failed to set up store: %v", err))
+	}
+
+	if err := setupSigning(); err != nil {
+		panic(fmt.Errorf("failed to set up signing: %v", err))
+	}
+
+	if err := setupPostHistory(); err != nil {
+		panic(fmt.Errorf("failed to open posts repository: %v", err))
+	}
+
+	if err := parseCanonicalURL(); err != nil {
+		panic(fmt.Errorf("failed to parse base url: %v", err))
+	}
+
+	setupBasePath()
+
+	if err := checkBodySizeLimits(); err != nil {
+		panic(fmt.Errorf("failed to check body size limits: %v", err))
+	}
+
+	if err := setupTimeouts(); err != nil {
+		panic(fmt.Errorf("failed to set up timeouts: %v", err))
+	}
+
+	if err := checkFeedOptions(); err != nil {
+		panic(fmt.Errorf("failed to check feed options: %v", err))
+	}
+
+	if err := setupWellKnown(); err != nil {
+		panic(fmt.Errorf("failed to set up well-known files: %v", err))
+	}
+
+	if err := checkWebhooks(); err != nil {
+		panic(fmt.Errorf("failed to check webhooks: %v", err))
+	}
+
+	if err := checkMenu(); err != nil {
+		panic(fmt.Errorf("failed to check menu: %v", err))
+	}
+
+	if err := checkAPITokens(); err != nil {
+		panic(fmt.Errorf("failed to check api tokens: %v", err))
+	}
+
+	if err := checkPreloads(); err != nil {
+		panic(fmt.Errorf("failed to check preloads: %v", err))
+	}
+
+	if err := checkPathPolicies(); err != nil {
+		panic(fmt.Errorf("failed to check path policies: %v", err))
+	}
+
+	if err := checkListen(); err != nil {
+		panic(fmt.Errorf("failed to check listen: %v", err))
+	}
+
+	if err := checkCDNProvider(); err != nil {
+		panic(fmt.Errorf("failed to check cdn provider: %v", err))
+	}
+
+	if err := checkIndexNowKey(); err != nil {
+		panic(fmt.Errorf("failed to check indexnow key: %v", err))
+	}
+
+	if err := setupTranslation(); err != nil {
+		panic(fmt.Errorf("failed to set up translation: %v", err))
+	}
+
+	if *siteMode {
+		trustSiteProxy()
+	}
+
+	if err := parseTrustedProxies(); err != nil {
+		panic(fmt.Errorf("failed to parse trusted proxies: %v", err))
+	}
+
+	if err := parseSpamBlockedIPs(); err != nil {
+		panic(fmt.Errorf("failed to parse spam blocked ips: %v", err))
+	}
+
+	if config.RateLimitEnabled &&
+		(config.RateLimitRate <= 0 || config.RateLimitBurst < 1) {
+		panic(errors.New("rate limit rate and burst must be positive"))
+	}
+
+	if err := checkBotClasses(); err != nil {
+		panic(fmt.Errorf("failed to check bot classes: %v", err))
+	}
+
+	if err := checkPermalinks(); err != nil {
+		panic(fmt.Errorf("failed to check permalinks: %v", err))
+	}
+
+	if err := setupFetch(); err != nil {
+		panic(fmt.Errorf("failed to set up fetch: %v", err))
+	}
+
+	pageCache = newLRUCache("page", config.PageCacheMaxBytes)
+	pdfCache = newLRUCache("pdf", config.PDFCacheMaxBytes)
+	epubCache = newLRUCache("epub", config.EPUBCacheMaxBytes)
+	feedCache = newLRUCache("feed", config.FeedCacheMaxBytes)
+	precompressedAssets = newLRUCache(
+		"precompressed_asset",
+		config.AssetCacheMaxBytes,
+	)
 
 	postsWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		panic(fmt.Errorf("failed to build post watcher: %v", err))
-	} else if err := postsWatcher.Add("posts"); err != nil {
+	} else if err := watchDirs(postsWatcher, "posts"); err != nil {
 		panic(fmt.Errorf("failed to watch post directory: %v", err))
+	} else if err := watchDirs(
+		postsWatcher,
+		pageRoot,
+	); err != nil && !os.IsNotExist(err) {
+		panic(fmt.Errorf("failed to watch page directory: %v", err))
 	}
 
-	go func() {
+	watchPostFiles(postsWatcher)
+
+	runWithHeartbeat("posts_watcher", time.Minute, func() {
+		generation := heartbeatGeneration("posts_watcher")
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		atomic.StoreInt32(&postsWatcherRunning, 1)
+		defer func() {
+			g := heartbeatGeneration("posts_watcher")
+			if g == generation {
+				atomic.StoreInt32(&postsWatcherRunning, 0)
+			}
+		}()
+
+		// debounce fires once the events have stopped for the
+		// `postsWatcherDebounce`. It is nil while there are none.
+		var debounce <-chan time.Time
 		for {
 			select {
-			case e := <-postsWatcher.Events:
+			case <-ticker.C:
+				if !beat("posts_watcher", generation) {
+					return
+				}
+			case <-debounce:
+				debounce = nil
+				requestPostsReload()
+			case e, ok := <-postsWatcher.Events:
+				if !ok {
+					return
+				} else if isTempFile(e.Name) {
+					continue
+				}
+
 				air.DEBUG(
 					"post file event occurs",
 					map[string]interface{}{
@@ -73,8 +291,21 @@ func init() {
 						"event": e.Op.String(),
 					},
 				)
-				postsOnce = sync.Once{}
-			case err := <-postsWatcher.Errors:
+				gone := fsnotify.Remove | fsnotify.Rename
+				if e.Op&fsnotify.Create != 0 {
+					watchDirs(postsWatcher, e.Name)
+				} else if e.Op&gone != 0 {
+					// The files replaced by the editors
+					// are watched again.
+					watchPostFiles(postsWatcher)
+				}
+
+				debounce = time.After(postsWatcherDebounce)
+			case err, ok := <-postsWatcher.Errors:
+				if !ok {
+					return
+				}
+
 				air.ERROR(
 					"post watcher error",
 					map[string]interface{}{
@@ -83,7 +314,90 @@ func init() {
 				)
 			}
 		}
-	}()
+	})
+
+	templatesWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		panic(fmt.Errorf("failed to build template watcher: %v", err))
+	}
+
+	for _, root := range append(themeSourceRoots(), air.LocaleRoot) {
+		filepath.Walk(
+			root,
+			func(path string, fi os.FileInfo, err error) error {
+				if err == nil && fi.IsDir() {
+					templatesWatcher.Add(path)
+				}
+
+				return nil
+			},
+		)
+	}
+
+	runWithHeartbeat("templates_watcher", time.Minute, func() {
+		generation := heartbeatGeneration("templates_watcher")
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if !beat("templates_watcher", generation) {
+					return
+				}
+			case e, ok := <-templatesWatcher.Events:
+				if !ok {
+					return
+				}
+
+				air.DEBUG(
+					"template file event occurs",
+					map[string]interface{}{
+						"file":  e.Name,
+						"event": e.Op.String(),
+					},
+				)
+				if err := buildTheme(); err != nil {
+					air.ERROR(
+						"failed to build theme",
+						map[string]interface{}{
+							"error": err.Error(),
+						},
+					)
+				}
+
+				if isAssetSource(e.Name) {
+					hashAssets()
+				}
+
+				bumpContentVersion()
+				purgeCDNInBackground(surrogateKeySite)
+			case err, ok := <-templatesWatcher.Errors:
+				if !ok {
+					return
+				}
+
+				air.ERROR(
+					"template watcher error",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}
+	})
+
+	hashAssets()
+	for name, f := range templateFuncs() {
+		air.TemplateFuncMap[name] = f
+	}
+
+	air.TemplateFuncMap["asset"] = assetURL
+	air.TemplateFuncMap["url"] = sitePath
+	air.TemplateFuncMap["bundle"] = bundleURL
+	air.TemplateFuncMap["views"] = func(postID string) string {
+		return humanizeCount(postViews(postID))
+	}
 
 	b, err := ioutil.ReadFile(filepath.Join(air.TemplateRoot, "feed.xml"))
 	if err != nil {
@@ -91,62 +405,410 @@ func init() {
 	}
 
 	feedTemplate = template.Must(
-		template.New("feed").
-			Funcs(map[string]interface{}{
-				"xmlescape": func(s string) string {
-					buf := bytes.Buffer{}
-					xml.EscapeText(&buf, []byte(s))
-					return buf.String()
-				},
-				"now": func() time.Time {
-					return time.Now().UTC()
-				},
-				"timefmt": air.TemplateFuncMap["timefmt"],
-			}).
-			Parse(string(b)),
+		template.New("feed").Funcs(templateFuncs()).Parse(string(b)),
 	)
 }
 
 func main() {
+	setup()
+
+	if *sitesFile != "" {
+		if err := serveSites(*sitesFile); err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"failed to serve sites: %v\n",
+				err,
+			)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *checkMode {
+		os.Exit(check())
+	}
+
+	if *encryptFile != "" {
+		if err := encryptPostFile(*encryptFile); err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"failed to encrypt post: %v\n",
+				err,
+			)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *migrateMode {
+		s, ok := store.(*sqliteStore)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "store is not sqlite")
+			os.Exit(1)
+		}
+
+		fs := fsPostStore{root: "posts"}
+		if err := migrateToSQLite(fs, s); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if err := setupLogging(); err != nil {
+		panic(fmt.Errorf("failed to set up logging: %v", err))
+	}
+
 	air.ErrorHandler = errorHandler
+
+	canonicalGas := canonicalHostGas
+	if !config.CanonicalHostEnforced {
+		canonicalGas = redirector.WWW2NonWWWGas(
+			redirector.WWW2NonWWWGasConfig{},
+		)
+	}
+
 	air.Pregases = []air.Gas{
-		logger.Gas(logger.GasConfig{}),
+		accessLogGas,
+		metricsGas,
+		ipRulesGas,
+		botGas,
+		basePathGas,
+		normalizePathGas,
+		trackingParamsGas,
+		permalinkGas,
 		defibrillator.Gas(defibrillator.GasConfig{}),
-		redirector.WWW2NonWWWGas(redirector.WWW2NonWWWGasConfig{}),
-		limiter.BodySizeGas(limiter.BodySizeGasConfig{
-			MaxBytes: 1 << 20,
-			Error413: errors.New("Request Entity Too Large"),
-		}),
+		canonicalGas,
+		bodySizeGas,
+		earlyHintsGas,
+		handlerTimeoutGas,
+	}
+
+	if config.CompressionEnabled {
+		air.Pregases = append(air.Pregases, compressGas)
+		precompressAssets()
+	}
+
+	if config.RateLimitEnabled {
+		registerJob(
+			"rate_limit_sweep",
+			"@every 1m",
+			sweepRateLimitBuckets,
+		)
+	}
+
+	if config.ViewCounterEnabled {
+		if err := loadViews(); err != nil {
+			panic(fmt.Errorf("failed to load views: %v", err))
+		}
+
+		registerJob("views_save", "@every 1m", saveViews)
+	}
+
+	if config.ReactionsEnabled {
+		if err := loadReactions(); err != nil {
+			panic(fmt.Errorf("failed to load reactions: %v", err))
+		}
+
+		registerJob("reactions_save", "@every 1m", saveReactions)
+	}
+
+	registerJob("post_widgets", "*/10 * * * *", refreshPostWidgets)
+	registerJob("scheduled_posts", "* * * * *", promoteScheduledPosts)
+
+	if s, ok := store.(*s3Store); ok {
+		registerJob(
+			"s3_sync",
+			"@every "+config.S3SyncInterval,
+			s.syncAndReload,
+		)
+	}
+
+	if config.IndexNowKey != "" || len(config.SitemapPingURLs) > 0 {
+		registerJob("search_engine_ping", "@hourly", func() error {
+			snap := loadedPosts()
+			pingSearchEngines(indexedURLs(
+				snap.orderedPosts,
+				snap.pages,
+			))
+			return nil
+		})
+	}
+
+	go watchdog(time.Minute)
+
+	if err := loadRelatedLinks(); err != nil {
+		panic(fmt.Errorf("failed to load related links: %v", err))
+	}
+
+	if err := loadSyndications(); err != nil {
+		panic(fmt.Errorf("failed to load syndications: %v", err))
+	}
+
+	if config.LinkCheckInterval != "" {
+		interval, err := time.ParseDuration(config.LinkCheckInterval)
+		if err != nil {
+			panic(fmt.Errorf(
+				"failed to parse link check interval: %v",
+				err,
+			))
+		} else if err := loadLinkChecks(); err != nil {
+			panic(fmt.Errorf("failed to load link checks: %v", err))
+		}
+
+		registerJob(
+			"link_check",
+			"@every "+config.LinkCheckInterval,
+			func() error {
+				return checkLinks(interval)
+			},
+		)
+	}
+
+	if config.LinkArchiveInterval != "" {
+		if err := setupLinkArchives(); err != nil {
+			panic(fmt.Errorf(
+				"failed to set up link archives: %v",
+				err,
+			))
+		}
+	}
+
+	if err := startJobs(); err != nil {
+		panic(fmt.Errorf("failed to start jobs: %v", err))
+	}
+
+	if config.IPRulesFile != "" {
+		if err := loadIPRules(); err != nil {
+			panic(fmt.Errorf("failed to load ip rules: %v", err))
+		} else if err := watchIPRules(); err != nil {
+			panic(fmt.Errorf("failed to watch ip rules: %v", err))
+		}
+	}
+
+	if config.MembersEnabled {
+		if err := reloadMembers(); err != nil {
+			panic(fmt.Errorf("failed to load members: %v", err))
+		} else if err := watchMembers(); err != nil {
+			panic(fmt.Errorf("failed to watch members: %v", err))
+		}
+	}
+
+	air.Gases = []air.Gas{
+		metricsRoutedGas,
+		valuesGas,
+		contentVersionGas,
+		surrogateKeyGas,
+		colorSchemeGas,
+	}
+	if config.A11yCheckEnabled {
+		air.Gases = append(air.Gases, a11yGas)
 	}
 
 	air.NotFoundHandler = notFoundHandler
 	air.MethodNotAllowedHandler = methodNotAllowedHandler
 
-	air.FILE("/robots.txt", "robots.txt")
-	air.STATIC(
-		"/assets",
-		air.AssetRoot,
-		func(next air.Handler) air.Handler {
-			return func(req *air.Request, res *air.Response) error {
-				res.SetHeader("cache-control", "max-age=3600")
-				return next(req, res)
-			}
-		},
+	air.GET("/robots.txt", robotsHandler)
+	air.HEAD("/robots.txt", robotsHandler)
+	air.GET("/assets/*", assetHandler, assetGases...)
+	air.HEAD("/assets/*", assetHandler, assetGases...)
+	air.GET(signingKeyPath, signingKeyHandler)
+	air.HEAD(signingKeyPath, signingKeyHandler)
+	air.GET(
+		"/.well-known/signatures/:ID",
+		postSignatureHandler,
+		rateLimitGas,
+	)
+	air.GET("/bundles/:Name", bundleHandler)
+	air.HEAD("/bundles/:Name", bundleHandler)
+	air.GET("/", homeHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/", homeHandler, rateLimitGas)
+	air.GET("/posts", postsHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/posts", postsHandler, rateLimitGas)
+	air.GET(
+		"/posts/*",
+		postHandler,
+		rateLimitGas,
+		viewCountGas,
+		pageCacheGas,
 	)
-	air.GET("/", homeHandler)
-	air.HEAD("/", homeHandler)
-	air.GET("/posts", postsHandler)
-	air.HEAD("/posts", postsHandler)
-	air.GET("/posts/:ID", postHandler)
-	air.HEAD("/posts/:ID", postHandler)
-	air.GET("/bio", bioHandler)
-	air.HEAD("/bio", bioHandler)
-	air.GET("/feed", feedHandler)
-	air.HEAD("/feed", feedHandler)
+	air.HEAD("/posts/*", postHandler, rateLimitGas)
+	air.POST("/posts/*", postFormHandler, rateLimitGas)
+	air.GET("/p/:Code", shortURLHandler, rateLimitGas)
+	air.HEAD("/p/:Code", shortURLHandler, rateLimitGas)
+	air.GET("/authors/:ID", authorHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/authors/:ID", authorHandler, rateLimitGas)
+	air.GET("/series/:Name", seriesHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/series/:Name", seriesHandler, rateLimitGas)
+	air.GET("/archive.epub", archiveEPUBHandler, rateLimitGas)
+	air.HEAD("/archive.epub", archiveEPUBHandler, rateLimitGas)
+	air.GET("/bio", bioHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/bio", bioHandler, rateLimitGas)
+	if config.IndexNowKey != "" {
+		air.GET(indexNowKeyPath(), indexNowKeyHandler, rateLimitGas)
+		air.HEAD(indexNowKeyPath(), indexNowKeyHandler, rateLimitGas)
+	}
+
+	for p := range wellKnownFiles {
+		air.GET(p, wellKnownHandler)
+		air.HEAD(p, wellKnownHandler)
+	}
+
+	air.GET("/:Slug", pageHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/:Slug", pageHandler, rateLimitGas)
+	air.GET("/theme", colorSchemeHandler, rateLimitGas)
+	air.GET("/random", randomHandler, rateLimitGas)
+	air.HEAD("/random", randomHandler, rateLimitGas)
+	air.GET("/today", todayHandler, rateLimitGas)
+	air.HEAD("/today", todayHandler, rateLimitGas)
+	air.GET("/search", searchHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/search", searchHandler, rateLimitGas)
+	air.GET("/search/suggest", searchSuggestHandler, rateLimitGas)
+	air.GET("/blogroll", blogrollHandler, rateLimitGas, pageCacheGas)
+	air.HEAD("/blogroll", blogrollHandler, rateLimitGas)
+	air.GET("/blogroll.opml", blogrollOPMLHandler, rateLimitGas)
+	air.HEAD("/blogroll.opml", blogrollOPMLHandler, rateLimitGas)
+	air.GET("/opensearch.xml", openSearchHandler)
+	air.HEAD("/opensearch.xml", openSearchHandler)
+	if config.OfflineEnabled {
+		air.GET(manifestPath, manifestHandler)
+		air.HEAD(manifestPath, manifestHandler)
+		air.GET(serviceWorkerPath, serviceWorkerHandler)
+		air.HEAD(serviceWorkerPath, serviceWorkerHandler)
+	}
+
+	air.GET("/api/graphql", graphQLHandler, rateLimitGas)
+	air.HEAD("/api/graphql", graphQLHandler, rateLimitGas)
+	air.POST("/api/graphql", graphQLHandler, rateLimitGas)
+	air.OPTIONS("/api/graphql", graphQLPreflightHandler)
+	air.GET("/api/graphql/schema", graphQLSchemaHandler)
+	air.GET("/feed", feedHandler, rateLimitGas)
+	air.HEAD("/feed", feedHandler, rateLimitGas)
+	air.GET(
+		"/feeds/:Locale",
+		localizedFeedHandler,
+		rateLimitGas,
+		pageCacheGas,
+	)
+	air.HEAD("/feeds/:Locale", localizedFeedHandler, rateLimitGas)
+	air.GET("/sitemap.xml", sitemapHandler, rateLimitGas)
+	air.HEAD("/sitemap.xml", sitemapHandler, rateLimitGas)
+	air.GET("/sitemaps/:Name", sitemapHandler, rateLimitGas)
+	air.HEAD("/sitemaps/:Name", sitemapHandler, rateLimitGas)
+	air.GET("/login", loginHandler, rateLimitGas)
+	air.POST("/login", loginHandler, rateLimitGas)
+	air.GET("/login/confirm", confirmLoginHandler, rateLimitGas)
+	air.POST("/logout", logoutHandler, rateLimitGas)
+	air.POST("/subscribe", subscribeHandler, rateLimitGas)
+	air.GET("/subscribe/confirm", confirmSubscriptionHandler, rateLimitGas)
+	air.GET("/unsubscribe", unsubscribeHandler, rateLimitGas)
+	air.POST("/unsubscribe", unsubscribeHandler, rateLimitGas)
+	if config.VideoRoot != "" {
+		air.GET("/videos/*", videoHandler)
+		air.HEAD("/videos/*", videoHandler)
+	}
+
+	if config.ImageVariantRoot != "" {
+		air.GET("/images/*", imageVariantHandler)
+		air.HEAD("/images/*", imageVariantHandler)
+	}
+
+	if config.UploadRoot != "" {
+		air.GET("/uploads/*", uploadHandler)
+		air.HEAD("/uploads/*", uploadHandler)
+	}
+
+	air.GET("/fonts/:Name", fontHandler)
+	air.HEAD("/fonts/:Name", fontHandler)
+	air.GET("/metrics", metricsHandler)
+	air.GET("/healthz", healthzHandler)
+	air.HEAD("/healthz", healthzHandler)
+	air.GET("/readyz", readyzHandler)
+	air.HEAD("/readyz", readyzHandler)
+	air.GET("/status", statusHandler)
+	adminReadGas := authGas(scopeAdminRead)
+	adminWriteGas := authGas(scopeAdminWrite)
+	air.GET("/admin/login", adminLoginHandler, rateLimitGas)
+	air.POST("/admin/login", adminLoginHandler, rateLimitGas)
+	air.POST("/admin/logout", adminLogoutHandler, adminReadGas)
+	air.GET("/admin/status", adminStatusHandler, adminReadGas)
+	air.GET("/admin/posts/new", adminNewPostHandler, adminReadGas)
+	air.POST(
+		"/admin/posts",
+		adminCreatePostHandler,
+		authGas(scopePostsWrite),
+	)
+	air.GET("/admin/pending", adminPendingHandler, adminReadGas)
+	air.POST(
+		"/admin/pending",
+		adminReviewPendingHandler,
+		authGas(scopePostsWrite),
+	)
+	air.GET("/admin/comments", adminCommentsHandler, adminReadGas)
+	air.POST(
+		"/admin/comments",
+		adminModerateCommentHandler,
+		authGas(scopeCommentsWrite),
+	)
+	air.GET("/admin/suggestions", adminSuggestionsHandler, adminReadGas)
+	air.POST(
+		"/admin/suggestions",
+		adminReviewSuggestionHandler,
+		authGas(scopePostsWrite),
+	)
+	air.GET("/admin/stats", adminStatsHandler, adminReadGas)
+	air.GET("/admin/members", adminMembersHandler, adminReadGas)
+	air.GET("/admin/links", adminLinksHandler, adminReadGas)
+	air.GET("/admin/seo", adminSEOHandler, adminReadGas)
+	air.GET("/admin/audit", adminAuditHandler, adminReadGas)
+	air.GET("/admin/export", adminExportHandler, adminWriteGas)
+	air.POST("/admin/import", adminImportHandler, adminWriteGas)
+	air.POST(
+		"/admin/members",
+		adminUpdateMembersHandler,
+		authGas(scopeMembersWrite),
+	)
+	air.POST("/admin/purge", adminPurgeHandler, adminWriteGas)
+	air.POST("/admin/jobs", adminRunJobHandler, adminWriteGas)
+	air.GET("/activity.atom", activityHandler, adminReadGas)
+	air.POST("/hooks/s3-sync", s3SyncHandler, rateLimitGas)
+
+	// The posts are parsed before the first request, so that nobody waits
+	// for it.
+	postsOnce.Do(reloadPosts)
+	runWithHeartbeat("posts_reloader", time.Minute, runPostsReloader)
 
 	shutdownChan := make(chan os.Signal, 1)
 	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 
+	if air.ACMEEnabled && config.ACMEHTTPAddress != "" {
+		go serveACMEHTTP()
+	}
+
+	var socket net.Listener
+	if config.Listen != "" {
+		l, err := listenSocket()
+		if err != nil {
+			panic(fmt.Errorf("failed to listen: %v", err))
+		}
+
+		socket = l
+		go func() {
+			if err := serveSocket(l); err != nil {
+				air.ERROR(
+					"socket server error",
+					map[string]interface{}{
+						"listen": config.Listen,
+						"error":  err.Error(),
+					},
+				)
+			}
+		}()
+	}
+
 	go func() {
 		if err := air.Serve(); err != nil {
 			air.ERROR(
@@ -159,109 +821,589 @@ func main() {
 	}()
 
 	<-shutdownChan
+	if socket != nil {
+		socket.Close()
+	}
+
 	air.Shutdown(time.Minute)
 }
 
+// parsePosts parses the posts into a new `postsSnapshot` and swaps it in. If
+// that fails, the previous posts are kept, along with the error.
 func parsePosts() {
-	fns, _ := filepath.Glob("posts/*.md")
-	nps := make(map[string]post, len(fns))
-	nops := make([]post, 0, len(fns))
-	for _, fn := range fns {
-		b, _ := ioutil.ReadFile(fn)
-		if bytes.Count(b, []byte{'+', '+', '+'}) < 2 {
+	postsReloadMutex.Lock()
+	defer postsReloadMutex.Unlock()
+
+	prev := lastPostsSnapshot()
+	next, nops, nsp, err := buildPostsSnapshot(prev)
+	if err != nil {
+		air.ERROR(
+			"failed to parse posts",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+
+		kept := *prev
+		kept.err = err
+		if next != nil {
+			kept.postErrors = next.postErrors
+		}
+
+		postsSnapshotValue.Store(&kept)
+		return
+	}
+
+	var purgeKeys []string
+	if prev.posts != nil {
+		purgeKeys = changedSurrogateKeys(
+			prev.posts,
+			next.posts,
+			prev.pages,
+			next.pages,
+		)
+	}
+
+	postsSnapshotValue.Store(next)
+	nextScheduledPost.Store(nsp)
+
+	if prev.posts != nil {
+		for _, p := range next.orderedPosts {
+			op, ok := prev.posts[p.ID]
+			if !ok {
+				notify(fmt.Sprintf(
+					"New post published: %s %s%s",
+					p.Title,
+					config.BaseURL,
+					p.Permalink,
+				))
+				mailNewPost(p)
+				go syndicate(p)
+				fireWebhooks(
+					webhookPostPublished,
+					webhookPost(p),
+				)
+				if config.LinkArchiveInterval != "" {
+					go archiveOutboundLinks(p)
+				}
+			} else if op.Title != p.Title ||
+				op.Content != p.Content ||
+				!op.Updated.Equal(p.Updated) {
+				fireWebhooks(webhookPostUpdated, webhookPost(p))
+				if config.LinkArchiveInterval != "" &&
+					op.Content != p.Content {
+					go archiveOutboundLinks(p)
+				}
+			}
+		}
+	}
+
+	go translateSummaries(next.orderedPosts)
+	go resolveRelatedLinks(nops)
+	go pushContentSnapshot(next.orderedPosts)
+	go generateOGImages(nops)
+	updatePostWidgets(next)
+	go pingSearchEngines(indexedURLs(next.orderedPosts, next.pages))
+
+	metricsPostsParsed(len(nops))
+	bumpContentVersion()
+	purgeCDNInBackground(purgeKeys...)
+}
+
+// buildPostsSnapshot parses the posts into a new `postsSnapshot`, building
+// upon the prev. It also returns all the posts parsed, unlisted ones included,
+// and when the next scheduled post is due. The returned snapshot, if any,
+// carries the errors of the post files even when it fails.
+func buildPostsSnapshot(
+	prev *postsSnapshot,
+) (*postsSnapshot, []post, time.Time, error) {
+	sps, err := store.Posts()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf(
+			"failed to load posts: %v",
+			err,
+		)
+	}
+
+	cru, err := curatedRelatedURLs()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf(
+			"failed to read related file: %v",
+			err,
+		)
+	}
+
+	nas, err := loadAuthors()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf(
+			"failed to read authors file: %v",
+			err,
+		)
+	}
+
+	nbr, err := loadBlogroll()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf(
+			"failed to read blogroll file: %v",
+			err,
+		)
+	}
+
+	npcs := duplicatePostIDs(sps)
+	dropped := make(map[string]bool, len(npcs))
+	for _, pc := range npcs {
+		dropped[pc.Dropped] = true
+	}
+
+	nps := make(map[string]post, len(sps))
+	nops := make([]post, 0, len(sps))
+	npes := []postError{}
+	now := time.Now()
+	nsp := time.Time{}
+	for _, sp := range sps {
+		fn, b := sp.File, sp.Source
+		if dropped[fn] {
+			continue
+		} else if sp.Err != nil {
+			npes = append(npes, newPostError(fn, sp.Err))
 			continue
 		}
 
-		i := bytes.Index(b, []byte{'+', '+', '+'})
-		j := bytes.Index(b[i+3:], []byte{'+', '+', '+'}) + 3
+		fm, md, err := splitFrontMatter(b)
+		if err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		}
 
 		p := post{
-			ID:      fn[6 : len(fn)-3],
-			Content: htemplate.HTML(blackfriday.Run(b[j+3:])),
+			ID:     sp.ID,
+			File:   fn,
+			Source: b,
 		}
-		if err := toml.Unmarshal(b[i+3:j], &p); err != nil {
+		if err := toml.Unmarshal(fm, &p); err != nil {
+			npes = append(npes, newPostError(fn, err))
 			continue
 		}
 
+		if err := checkVisibility(p.Visibility); err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		}
+
+		if err := checkCanonical(p.Canonical); err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		}
+
+		if err := prepareEdits(p.Edits); err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		}
+
+		if err := checkPostTemplates(p); err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		}
+
+		if p.Author != "" {
+			a, ok := nas[p.Author]
+			if !ok {
+				err := fmt.Errorf("unknown author %q", p.Author)
+				npes = append(npes, newPostError(fn, err))
+				continue
+			}
+
+			p.authorProfile = a
+		}
+
+		ro := config.Render.merge(p.Render)
+		p.Content = htemplate.HTML(responsiveImages(postProcessHTML(
+			renderMarkdown(md, ro),
+			ro,
+		)))
+
 		p.Datetime = p.Datetime.UTC()
+		p.ModTime = sp.ModTime.UTC()
+
+		p.Revised = !p.Updated.IsZero() || len(p.Edits) > 0
+		if p.Updated.IsZero() && len(p.Edits) > 0 {
+			p.Updated = p.Edits[0].Date
+		} else if p.Updated.IsZero() {
+			p.Updated = p.ModTime
+		}
+
+		if p.Updated.Before(p.Datetime) {
+			p.Updated = p.Datetime
+		}
+
+		p.Updated = p.Updated.UTC()
+
+		p.Related = append(p.Related, cru[p.ID]...)
+		p.EntryID = feedEntryID(p)
+		p.Permalink = postPermalink(p)
+		if p.Video != nil {
+			prepareVideo(p.Video)
+		}
+
+		if holdScheduledPost(p, now, &nsp) {
+			continue
+		}
 
 		nps[p.ID] = p
 		nops = append(nops, p)
 	}
 
+	npgs, pges := parsePages()
+	npes = append(npes, pges...)
+
+	for _, pc := range npcs {
+		air.ERROR("duplicate post id", map[string]interface{}{
+			"id":       pc.Key,
+			"file":     pc.Dropped,
+			"taken_by": pc.Kept,
+		})
+	}
+
+	next := &postsSnapshot{
+		authors:         nas,
+		blogroll:        nbr,
+		blogrollUpdated: time.Now().UTC(),
+		pages:           npgs,
+		postErrors:      npes,
+		feedVariants:    &sync.Map{},
+	}
+
+	for _, pe := range npes {
+		air.ERROR(
+			"failed to parse post file",
+			map[string]interface{}{
+				"file":  pe.File,
+				"error": pe.Error,
+			},
+		)
+	}
+
+	if config.MaxPostErrors > 0 && len(npes) > config.MaxPostErrors {
+		return next, nil, time.Time{}, fmt.Errorf(
+			"%d post files failed to parse, previous posts kept",
+			len(npes),
+		)
+	}
+
 	sort.Slice(nops, func(i, j int) bool {
-		return nops[i].Datetime.After(nops[j].Datetime)
+		if !nops[i].Datetime.Equal(nops[j].Datetime) {
+			return nops[i].Datetime.After(nops[j].Datetime)
+		}
+
+		return nops[i].ID > nops[j].ID
 	})
 
-	posts = nps
-	orderedPosts = nops
+	nscps, err := assignShortCodes(nops)
+	if err != nil {
+		air.ERROR(
+			"failed to assign short codes",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+		nscps = prev.shortCodePosts
+	}
 
-	latestPosts := orderedPosts
-	if len(latestPosts) > 10 {
-		latestPosts = latestPosts[:10]
+	npps, ppcs := buildPermalinkPosts(nops)
+	npcs = append(npcs, ppcs...)
+	sortPostCollisions(npcs)
+	for _, p := range nops {
+		nps[p.ID] = p
 	}
 
-	buf := bytes.Buffer{}
-	feedTemplate.Execute(&buf, map[string]interface{}{
-		"Posts": latestPosts,
-	})
+	nlps := listedPosts(nops)
+
+	next.posts = nps
+	next.orderedPosts = nlps
+	next.pinnedPosts = pinnedPostsFirst(nlps)
+	next.featuredPosts = featuredPostsOf(nlps)
+	next.series = buildSeries(nlps)
+	next.permalinkPosts = npps
+	next.postCollisions = npcs
+	next.shortCodePosts = nscps
+	next.seoIssues = auditSEO(nops)
+	next.searchDocs = buildSearchDocs(nlps)
+
+	next.sitemaps, err = buildSitemaps(nlps, npgs)
+	if err != nil {
+		return next, nil, time.Time{}, fmt.Errorf(
+			"failed to build sitemaps: %v",
+			err,
+		)
+	}
 
-	buf2 := bytes.Buffer{}
-	mxml.DefaultMinifier.Minify(minify.New(), &buf2, &buf, nil)
+	next.webFonts, next.webFontsCSSURL, next.webFontsByPaths =
+		buildWebFonts(nops)
 
-	if b := buf2.Bytes(); !bytes.Equal(b, feed) {
-		feed = b
-		feedETag = fmt.Sprintf(`"%x"`, md5.Sum(feed))
-		feedLastModified = time.Now().UTC().Format(http.TimeFormat)
+	next.feedTombstones = updateFeedTombstones(nlps)
+
+	b, err := renderLatestFeed(next, config.FeedEntries, "/feed")
+	if err != nil {
+		return next, nil, time.Time{}, fmt.Errorf(
+			"failed to execute feed template: %v",
+			err,
+		)
+	}
+
+	next.feed = prev.feed
+	next.feedEncodeds = prev.feedEncodeds
+	next.feedETag = prev.feedETag
+	next.feedLastModified = prev.feedLastModified
+	if !bytes.Equal(b, prev.feed) {
+		next.feed = b
+		next.feedEncodeds = precompress(b)
+		next.feedETag = fmt.Sprintf(`"%x"`, md5.Sum(b))
+		next.feedLastModified = time.Now().UTC().Format(
+			http.TimeFormat,
+		)
+		metricsFeedRegenerated()
+	}
+
+	return next, nops, nsp, nil
+}
+
+// lastUpdated returns the latest `Updated` of the ops.
+func lastUpdated(ops []post) time.Time {
+	updated := time.Time{}
+	for _, p := range ops {
+		if p.Updated.After(updated) {
+			updated = p.Updated
+		}
+	}
+
+	return updated
+}
+
+// valuesGas is an `air.Gas` that sets the values shared by all templates.
+func valuesGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		snap := loadedPosts()
+		req.Values["WebFonts"] = snap.webFonts
+		req.Values["WebFontsCSSURL"] = sitePath(snap.webFontsCSSURL)
+		req.Values["NewsletterEnabled"] = config.NewsletterEnabled
+		req.Values["ViewCounterEnabled"] = config.ViewCounterEnabled
+		req.Values["BaseURL"] = config.BaseURL
+		req.Values["Theme"] = config.Theme
+		req.Values["FormatDate"] = dateFormatter(req)
+		req.Values["Menu"] = buildMenu(req, snap)
+		req.Values["OpenSearchURL"] = sitePath("/opensearch.xml")
+		if config.OfflineEnabled {
+			req.Values["ManifestURL"] = sitePath(manifestPath)
+			req.Values["ServiceWorkerURL"] = sitePath(
+				serviceWorkerPath,
+			)
+		}
+
+		if translationBackend != nil {
+			req.Values["LocalizedFeedURL"] = sitePath(
+				"/feeds/" + requestLocale(req),
+			)
+		}
+
+		pps, rups := postWidgets()
+		req.Values["PopularPosts"] = pps
+		req.Values["RecentlyUpdated"] = rups
+		return next(req, res)
 	}
 }
 
 func homeHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
 	req.Values["CanonicalPath"] = ""
+	req.Values["FeaturedPosts"] = snap.featuredPosts
 	return res.Render(req.Values, "index.html")
 }
 
 func postsHandler(req *air.Request, res *air.Response) error {
-	postsOnce.Do(parsePosts)
+	snap := loadedPosts()
 	req.Values["PageTitle"] = req.LocalizedString("Posts")
 	req.Values["CanonicalPath"] = "/posts"
-	req.Values["IsPosts"] = true
-	req.Values["Posts"] = orderedPosts
+	req.Values["Posts"] = snap.pinnedPosts
+	req.Values["Summaries"] = translatedSummaries(
+		snap.orderedPosts,
+		requestLocale(req),
+	)
 	return res.Render(req.Values, "posts.html", "layouts/default.html")
 }
 
 func postHandler(req *air.Request, res *air.Response) error {
-	postsOnce.Do(parsePosts)
+	snap := loadedPosts()
+
+	id := paramValue(req, "*")
+	if ext := filepath.Ext(id); ext == ".md" || ext == ".txt" {
+		id = strings.TrimSuffix(id, ext)
+		return rawPostHandler(req, res, snap, id, ext)
+	} else if ext == ".pdf" {
+		id = strings.TrimSuffix(id, ext)
+		return pdfPostHandler(req, res, snap, id)
+	} else if ext == ".epub" {
+		id = strings.TrimSuffix(id, ext)
+		return epubPostHandler(req, res, snap, id)
+	} else if lid := strings.TrimSuffix(id, "/lite"); lid != id {
+		return litePostHandler(req, res, snap, lid)
+	} else if hid := strings.TrimSuffix(id, "/history"); hid != id {
+		return postHistoryHandler(req, res, snap, hid)
+	} else if i := strings.LastIndex(id, "/diff/"); i >= 0 {
+		rev := id[i+len("/diff/"):]
+		return postDiffHandler(req, res, snap, id[:i], rev)
+	}
 
-	p, ok := posts[req.Param("ID").Value().String()]
+	p, ok := snap.posts[id]
 	if !ok {
+		if p, ok := misspelledPost(snap, id); ok {
+			res.Status = 301
+			return res.Redirect(sitePath(p.Permalink))
+		}
+
+		req.Values["Suggestions"] = postSuggestions(snap, id)
 		return air.NotFoundHandler(req, res)
 	}
 
+	if p.Protected() || p.MembersOnly {
+		res.SetHeader("cache-control", "private, no-cache")
+	}
+
+	addHeader(res, "vary", "accept")
+	switch negotiatePostFormat(req) {
+	case postFormatJSON:
+		return jsonPostHandler(req, res, p)
+	case postFormatMarkdown:
+		return rawPostHandler(req, res, snap, p.ID, ".md")
+	}
+
+	if p.Protected() {
+		req.Values["Locked"] = !hasPostPassword(req, p)
+		req.Values["UnlockFailed"] = paramValue(req, "unlock") ==
+			"failed"
+	}
+
+	if p.MembersOnly {
+		req.Values["Member"] = requestMember(req)
+		req.Values["MembersOnlyLocked"] = req.Values["Member"] == ""
+	}
+
 	req.Values["PageTitle"] = p.Title
-	req.Values["CanonicalPath"] = "/posts/" + p.ID
-	req.Values["IsPosts"] = true
+	req.Values["Description"] = p.MetaDescription()
+	req.Values["Keywords"] = p.MetaKeywords()
+	req.Values["CanonicalPath"] = p.Permalink
+	req.Values["NoIndex"] = !p.Listed()
+	req.Values["CanonicalURL"] = p.Canonical
+	req.Values["ShortURL"] = p.ShortURL()
+	req.Values["LiteURL"] = sitePath(p.LitePath())
 	req.Values["Post"] = p
+	req.Values["Related"] = postRelatedLinks(p)
+	req.Values["Syndications"] = postSyndications(p)
+	req.Values["LinkArchives"] = postLinkArchives(p)
+	req.Values["Image"] = postImageURL(p)
+	req.Values["JSONLD"] = postJSONLD(p)
+	req.Values["Series"] = postSeriesOf(snap, p)
+	if config.PDFEnabled {
+		req.Values["PDFURL"] = sitePath(p.PDFPath())
+	}
 
-	return res.Render(req.Values, "post.html", "layouts/default.html")
+	if config.EPUBEnabled {
+		req.Values["EPUBURL"] = sitePath(p.EPUBPath())
+	}
+
+	req.Values["ReactionsEnabled"] = config.ReactionsEnabled
+	if config.ReactionsEnabled {
+		req.Values["Reactions"] = postReactions(p.ID)
+		req.Values["Reacted"] = paramValue(req, "reacted")
+	}
+
+	req.Values["SuggestionsEnabled"] = config.SuggestionsEnabled
+	req.Values["SuggestionPending"] = paramValue(req, "suggestion") ==
+		"pending"
+
+	req.Values["CommentsEnabled"] = config.CommentsEnabled
+	if config.CommentsEnabled {
+		req.Values["Comments"] = approvedComments(p.ID)
+		req.Values["CommentPending"] = paramValue(req, "comment") ==
+			"pending"
+	}
+
+	return res.Render(req.Values, postTemplate(p), postLayout(p))
+}
+
+func postFormHandler(req *air.Request, res *air.Response) error {
+	if strings.HasSuffix(paramValue(req, "*"), "/unlock") {
+		return unlockPostHandler(req, res)
+	} else if strings.HasSuffix(paramValue(req, "*"), "/react") {
+		return reactHandler(req, res)
+	} else if strings.HasSuffix(paramValue(req, "*"), "/suggest") {
+		return suggestHandler(req, res)
+	}
+
+	return commentHandler(req, res)
 }
 
 func bioHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+	if pg, ok := snap.pages["bio"]; ok {
+		return servePage(req, res, pg)
+	}
+
 	req.Values["PageTitle"] = req.LocalizedString("Bio")
 	req.Values["CanonicalPath"] = "/bio"
-	req.Values["IsBio"] = true
 	return res.Render(req.Values, "bio.html", "layouts/default.html")
 }
 
 func feedHandler(req *air.Request, res *air.Response) error {
-	postsOnce.Do(parsePosts)
+	snap := loadedPosts()
+
+	if paramValue(req, "page") != "" {
+		return feedArchiveHandler(req, res)
+	}
+
+	limit, err := feedLimit(paramValue(req, "limit"))
+	if err != nil {
+		res.Status = 400
+		return err
+	}
+
+	body, encodeds := snap.feed, snap.feedEncodeds
+	etag, lastModified := snap.feedETag, snap.feedLastModified
+	if limit != config.FeedEntries {
+		fv, err := latestFeedVariant(snap, limit)
+		if err != nil {
+			return err
+		}
+
+		body, encodeds = fv.body, fv.encodeds
+		etag, lastModified = fv.etag, fv.lastModified
+	}
 
 	res.SetHeader("content-type", "application/atom+xml; charset=utf-8")
 	res.SetHeader("cache-control", "max-age=3600")
-	res.SetHeader("etag", feedETag)
-	res.SetHeader("last-modified", feedLastModified)
+	res.SetHeader("last-modified", lastModified)
+
+	if !config.CompressionEnabled {
+		res.SetHeader("etag", etag)
+		return res.WriteBlob(body)
+	}
+
+	res.SetHeader("vary", "accept-encoding")
+
+	encoding := negotiateEncoding(req.Header("accept-encoding").Value())
+	b, ok := encodeds[encoding]
+	if !ok {
+		res.SetHeader("etag", etag)
+		return res.WriteBlob(body)
+	}
 
-	return res.WriteBlob(feed)
+	res.SetHeader("content-encoding", encoding)
+	res.SetHeader(
+		"etag",
+		fmt.Sprintf(`%s-%s"`, etag[:len(etag)-1], encoding),
+	)
+
+	return res.WriteBlob(b)
 }
 
 func errorHandler(err error, req *air.Request, res *air.Response) {
@@ -284,13 +1426,32 @@ func errorHandler(err error, req *air.Request, res *air.Response) {
 		res.SetHeader("last-modified")
 	}
 
+	if prefersJSON(req) {
+		res.SetHeader("vary", "accept")
+		res.WriteJSON(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":       res.Status,
+				"message":    message,
+				"request_id": req.Values["RequestID"],
+			},
+		})
+		return
+	}
+
+	// The error may have stopped the request before the `colorSchemeGas`.
+	req.Values["ColorScheme"] = colorScheme(req)
 	req.Values["PageTitle"] = res.Status
 	req.Values["Error"] = map[string]interface{}{
-		"Code":    res.Status,
-		"Message": message,
+		"Code":      res.Status,
+		"Message":   message,
+		"RequestID": req.Values["RequestID"],
 	}
 
-	res.Render(req.Values, "error.html", "layouts/default.html")
+	res.Render(
+		req.Values,
+		errorTemplate(res.Status),
+		"layouts/default.html",
+	)
 }
 
 var notFoundHandler = func(req *air.Request, res *air.Response) error {
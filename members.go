@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// memberSessionCookieName is the name of the cookie of the sessions of
+	// the members. It shares the prefix of the cookies that grant the
+	// access to the protected posts, so that it keeps the requests out of
+	// the shared caches as well.
+	memberSessionCookieName = postAccessCookiePrefix + "member"
+
+	// memberLoginTTL is how long a login link stays valid.
+	memberLoginTTL = 15 * time.Minute
+
+	// memberSessionTTL is how long a member stays logged in.
+	memberSessionTTL = 30 * 24 * time.Hour
+)
+
+// member is a member who may read the members-only posts.
+type member struct {
+	Email   string    `json:"email"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+var (
+	membersMutex sync.Mutex
+
+	// currentMembers is the members as last loaded or saved. It must be
+	// used with the `membersMutex` held.
+	currentMembers []member
+)
+
+// membersFilename returns the name of the file of the members.
+func membersFilename() string {
+	return filepath.Join(config.DataRoot, "members.json")
+}
+
+// loadMembers returns all the members. It must be called with the
+// `membersMutex` held.
+func loadMembers() ([]member, error) {
+	b, err := ioutil.ReadFile(membersFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ms := []member{}
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+// saveMembers saves the ms as all the members. It must be called with the
+// `membersMutex` held.
+func saveMembers(ms []member) error {
+	b, err := json.MarshalIndent(ms, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	filename := membersFilename()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	currentMembers = ms
+
+	return nil
+}
+
+// reloadMembers loads the members into the `currentMembers`. The current
+// members are kept if the file is malformed.
+func reloadMembers() error {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+
+	ms, err := loadMembers()
+	if err != nil {
+		return err
+	}
+
+	currentMembers = ms
+
+	return nil
+}
+
+// watchMembers reloads the members whenever their file changes, so that the
+// requests don't read it every time. The directory of the file is watched
+// instead of the file itself, since it is replaced rather than written to.
+func watchMembers() error {
+	filename := membersFilename()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := w.Add(filepath.Dir(filename)); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(e.Name) != filename {
+					continue
+				}
+
+				if err := reloadMembers(); err != nil {
+					air.ERROR(
+						"failed to reload members",
+						map[string]interface{}{
+							"error": err.Error(),
+						},
+					)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+
+				air.ERROR(
+					"member watcher error",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// updateMembers loads the members, lets the f change them and saves them.
+func updateMembers(f func([]member) ([]member, error)) error {
+	membersMutex.Lock()
+	defer membersMutex.Unlock()
+
+	ms, err := loadMembers()
+	if err != nil {
+		return err
+	}
+
+	if ms, err = f(ms); err != nil {
+		return err
+	}
+
+	return saveMembers(ms)
+}
+
+// isMemberEmail reports whether the email is of a member.
+func isMemberEmail(email string) bool {
+	membersMutex.Lock()
+	ms := currentMembers
+	membersMutex.Unlock()
+
+	for _, m := range ms {
+		if strings.EqualFold(m.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// memberToken returns a token of the kind for the email that expires at the
+// expiry, signed with the `getCookieSecret`.
+func memberToken(kind, email string, expiry time.Time) string {
+	e := base64.RawURLEncoding.EncodeToString([]byte(email))
+	x := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, getCookieSecret())
+	mac.Write([]byte(kind + "\x00" + e + "\x00" + x))
+	return e + "." + x + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMemberToken returns the email of the token of the kind, or false if
+// the token is forged or expired.
+func verifyMemberToken(kind, token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	x, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(x, 0)) {
+		return "", false
+	}
+
+	email, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	expected := memberToken(kind, string(email), time.Unix(x, 0))
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return "", false
+	}
+
+	return string(email), true
+}
+
+// requestMember returns the email of the member who sent the req, or an empty
+// string if the req is not from a logged-in member. A removed member is
+// logged out at once.
+func requestMember(req *air.Request) string {
+	if !config.MembersEnabled {
+		return ""
+	}
+
+	c := req.Cookie(memberSessionCookieName)
+	if c == nil {
+		return ""
+	}
+
+	email, ok := verifyMemberToken("session", c.Value)
+	if !ok || !isMemberEmail(email) {
+		return ""
+	}
+
+	return email
+}
+
+// Teaser returns the beginning of the content of the p, up to the end of its
+// first paragraph, which is what those who may not read the p see of it.
+func (p post) Teaser() htemplate.HTML {
+	c := string(p.Content)
+	if i := strings.Index(c, "</p>"); i >= 0 {
+		return htemplate.HTML(c[:i+len("</p>")])
+	}
+
+	return ""
+}
+
+// isLocalPath reports whether the p is a path on this site, and not one that
+// the browsers take as another host, such as the "//example.com".
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") &&
+		!strings.HasPrefix(p, "/\\")
+}
+
+// renderMemberMessage renders the message as the response of the res.
+func renderMemberMessage(
+	req *air.Request,
+	res *air.Response,
+	message string,
+) error {
+	req.Values["PageTitle"] = req.LocalizedString("Log in")
+	req.Values["Message"] = message
+	return res.Render(req.Values, "message.html", "layouts/default.html")
+}
+
+func loginHandler(req *air.Request, res *air.Response) error {
+	if !config.MembersEnabled {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if req.Method != "POST" {
+		req.Values["PageTitle"] = req.LocalizedString("Log in")
+		req.Values["CanonicalPath"] = "/login"
+		req.Values["NoIndex"] = true
+		req.Values["Next"] = paramValue(req, "next")
+		return res.Render(
+			req.Values,
+			"login.html",
+			"layouts/default.html",
+		)
+	}
+
+	// The same message is shown whether or not the email is of a member,
+	// so that the members can't be found out by trying.
+	message := req.LocalizedString("Please check your email to log in.")
+
+	a, err := mail.ParseAddress(strings.TrimSpace(paramValue(req, "email")))
+	if err != nil || !isMemberEmail(a.Address) {
+		return renderMemberMessage(req, res, message)
+	}
+
+	link := config.BaseURL + "/login/confirm?token=" + url.QueryEscape(
+		memberToken("login", a.Address, time.Now().Add(memberLoginTTL)),
+	)
+	if next := paramValue(req, "next"); isLocalPath(next) {
+		link += "&next=" + url.QueryEscape(next)
+	}
+
+	subject := req.LocalizedString("Log in")
+	sendMailInBackground(
+		a.Address,
+		subject,
+		fmt.Sprintf(
+			"<p><a href=\"%s\">%s</a></p>\n",
+			htemplate.HTMLEscapeString(link),
+			subject,
+		),
+		"",
+	)
+
+	return renderMemberMessage(req, res, message)
+}
+
+func confirmLoginHandler(req *air.Request, res *air.Response) error {
+	if !config.MembersEnabled {
+		return air.NotFoundHandler(req, res)
+	}
+
+	email, ok := verifyMemberToken("login", paramValue(req, "token"))
+	if !ok || !isMemberEmail(email) {
+		return renderMemberMessage(
+			req,
+			res,
+			req.LocalizedString("The link is invalid or expired."),
+		)
+	}
+
+	setCookie(res, &http.Cookie{
+		Name: memberSessionCookieName,
+		Value: memberToken(
+			"session",
+			email,
+			time.Now().Add(memberSessionTTL),
+		),
+		MaxAge:   int(memberSessionTTL / time.Second),
+		Path:     sitePath("/"),
+		Secure:   requestScheme(req) == "https",
+		HttpOnly: true,
+	})
+
+	next := paramValue(req, "next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+
+	return res.Redirect(sitePath(next))
+}
+
+func logoutHandler(req *air.Request, res *air.Response) error {
+	setCookie(res, &http.Cookie{
+		Name:     memberSessionCookieName,
+		MaxAge:   -1,
+		Path:     sitePath("/"),
+		Secure:   requestScheme(req) == "https",
+		HttpOnly: true,
+	})
+
+	return res.Redirect(sitePath("/"))
+}
+
+func adminMembersHandler(req *air.Request, res *air.Response) error {
+	membersMutex.Lock()
+	ms, err := loadMembers()
+	membersMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Email < ms[j].Email
+	})
+
+	req.Values["PageTitle"] = "Members"
+	req.Values["Members"] = ms
+
+	return res.Render(
+		req.Values,
+		"admin/members.html",
+		"layouts/default.html",
+	)
+}
+
+func adminUpdateMembersHandler(req *air.Request, res *air.Response) error {
+	a, err := mail.ParseAddress(strings.TrimSpace(paramValue(req, "email")))
+	if err != nil {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	add := paramValue(req, "action") == "add"
+	if err := updateMembers(func(ms []member) ([]member, error) {
+		nms := ms[:0]
+		for _, m := range ms {
+			if !strings.EqualFold(m.Email, a.Address) {
+				nms = append(nms, m)
+			} else if add {
+				return ms, nil
+			}
+		}
+
+		if add {
+			nms = append(nms, member{
+				Email:   a.Address,
+				AddedAt: time.Now().UTC(),
+			})
+		}
+
+		return nms, nil
+	}); err != nil {
+		return err
+	}
+
+	return res.Redirect(sitePath("/admin/members"))
+}
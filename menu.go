@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// menuConfig is a configured item of the menu. The Label is localized. The
+// items are ordered by their Weights, the lightest first, and those of the
+// same weight as they are configured. An item is external if its Path is on
+// another host or if it says so, and is then linked to as it is.
+type menuConfig struct {
+	Label    string `toml:"label"`
+	Path     string `toml:"path"`
+	Weight   int    `toml:"weight"`
+	External bool   `toml:"external"`
+}
+
+// navConfig is an item of the `[[nav]]` of the older configuration files,
+// which is the `[[menu]]` without the weights.
+type navConfig struct {
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+}
+
+// menuItem is an item of the menu as the templates see it.
+type menuItem struct {
+	Label    string
+	URL      string
+	External bool
+	Active   bool
+}
+
+// defaultMenu is the menu used when neither the `config.Menu` nor the
+// `config.Nav` is set.
+var defaultMenu = []menuConfig{
+	{Label: "Index", Path: "/"},
+	{Label: "Posts", Path: "/posts"},
+	{Label: "Bio", Path: "/bio"},
+	{Label: "Search", Path: "/search"},
+	{Label: "GitHub", Path: "https://github.com/air-examples"},
+}
+
+// checkMenu checks the `config.Menu`.
+func checkMenu() error {
+	for _, mc := range config.Menu {
+		if mc.Label == "" {
+			return errors.New("menu item without a label")
+		}
+
+		u, err := url.Parse(mc.Path)
+		if err != nil ||
+			u.Host == "" && !mc.External &&
+				!strings.HasPrefix(mc.Path, "/") {
+			return fmt.Errorf("bad path %q of menu item", mc.Path)
+		}
+	}
+
+	return nil
+}
+
+// menuConfigs returns the configured items of the menu in their order: the
+// `config.Menu`, or else the `config.Nav`, or else the `defaultMenu`.
+func menuConfigs() []menuConfig {
+	mcs := config.Menu
+	if len(mcs) == 0 {
+		for _, nc := range config.Nav {
+			mcs = append(mcs, menuConfig{
+				Label: nc.Name,
+				Path:  nc.URL,
+			})
+		}
+	}
+
+	if len(mcs) == 0 {
+		return defaultMenu
+	}
+
+	mcs = append([]menuConfig{}, mcs...)
+	sort.SliceStable(mcs, func(i, j int) bool {
+		return mcs[i].Weight < mcs[j].Weight
+	})
+
+	return mcs
+}
+
+// buildMenu returns the menu for the req, the `menuConfigs` followed by the
+// pages of the snap that ask to be in it. An item is active if the path of the
+// req is its path or under it. The path is taken after the `basePathGas` and
+// the `permalinkGas`, so the posts at their permalinks are still under the
+// "/posts". The URLs of the internal items are put under the `basePath`.
+func buildMenu(req *air.Request, snap *postsSnapshot) []menuItem {
+	mcs := menuConfigs()
+
+	listed := make(map[string]bool, len(mcs))
+	for _, mc := range mcs {
+		listed[mc.Path] = true
+	}
+
+	pmcs := []menuConfig{}
+	for _, mc := range menuPages(snap) {
+		if !listed[mc.Path] {
+			pmcs = append(pmcs, mc)
+		}
+	}
+
+	if len(pmcs) > 0 {
+		mcs = append(append([]menuConfig{}, mcs...), pmcs...)
+	}
+
+	path := routePath(req)
+	mis := make([]menuItem, 0, len(mcs))
+	for _, mc := range mcs {
+		u, err := url.Parse(mc.Path)
+		if err != nil {
+			continue
+		}
+
+		mi := menuItem{
+			Label:    mc.Label,
+			URL:      mc.Path,
+			External: mc.External || u.Host != "",
+		}
+		if !mi.External {
+			mi.URL = sitePath(mc.Path)
+			p := strings.TrimSuffix(u.Path, "/")
+			mi.Active = path == u.Path ||
+				p != "" && strings.HasPrefix(path, p+"/")
+		}
+
+		mis = append(mis, mi)
+	}
+
+	return mis
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// metricsLatencyBuckets is the upper bounds (in seconds) of the response
+// latency histogram buckets.
+var metricsLatencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// metricsHistogram is a cumulative histogram of observed values.
+type metricsHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe records the v into the h.
+func (h *metricsHistogram) observe(v float64) {
+	for i, b := range metricsLatencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+var metrics = struct {
+	sync.Mutex
+
+	requests          map[[2]string]uint64
+	latencies         map[string]*metricsHistogram
+	botClassRequests  map[[2]string]uint64
+	posts             int
+	lastParse         time.Time
+	feedRegenerations uint64
+}{
+	requests:         map[[2]string]uint64{},
+	latencies:        map[string]*metricsHistogram{},
+	botClassRequests: map[[2]string]uint64{},
+}
+
+// metricsGas is an `air.Gas` that counts the requests and observes their
+// latencies by route and status.
+func metricsGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		start := time.Now()
+		err := next(req, res)
+
+		status := res.Status
+		if err != nil && status < 400 {
+			status = 500
+		}
+
+		route := metricsRoute(req, status)
+
+		metrics.Lock()
+		metrics.requests[[2]string{route, fmt.Sprint(status)}]++
+		h := metrics.latencies[route]
+		if h == nil {
+			h = &metricsHistogram{
+				counts: make(
+					[]uint64,
+					len(metricsLatencyBuckets),
+				),
+			}
+			metrics.latencies[route] = h
+		}
+
+		h.observe(time.Since(start).Seconds())
+		metrics.Unlock()
+
+		return err
+	}
+}
+
+// metricsRoutedGas is an `air.Gas` that marks the requests that reached the
+// router, for the `metricsRoute`.
+func metricsRoutedGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		req.Values["MetricsRouted"] = true
+		return next(req, res)
+	}
+}
+
+// metricsRoute returns the route that the req belongs to, so that dynamic
+// paths don't blow up the cardinality of the metrics. The requests answered
+// before reaching the router and those matching no route are all folded into
+// one.
+func metricsRoute(req *air.Request, status int) string {
+	// The path may have been rewritten by the `permalinkGas`.
+	path := httpRequest(req).URL.Path
+
+	switch {
+	case status == 404:
+		return "(not found)"
+	case strings.HasPrefix(path, "/assets/"):
+		return "/assets/*"
+	case strings.HasPrefix(path, "/posts/"):
+		return "/posts/*"
+	case strings.HasPrefix(path, "/videos/"):
+		return "/videos/*"
+	case strings.HasPrefix(path, "/fonts/"):
+		return "/fonts/:Name"
+	case strings.HasPrefix(path, "/sitemaps/"):
+		return "/sitemaps/:Name"
+	case strings.HasPrefix(path, "/feeds/"):
+		return "/feeds/:Locale"
+	case strings.HasPrefix(path, "/authors/"):
+		return "/authors/:ID"
+	case strings.HasPrefix(path, "/series/"):
+		return "/series/:Name"
+	case strings.HasPrefix(path, "/p/"):
+		return "/p/:Code"
+	case strings.HasPrefix(path, "/.well-known/signatures/"):
+		return "/.well-known/signatures/:ID"
+	case req.Values["MetricsRouted"] != true, status == 405:
+		return "(unmatched)"
+	case paramValue(req, "Slug") != "":
+		return "/:Slug"
+	}
+
+	return path
+}
+
+// metricsBotClassRequest records a request of the class that was allowed,
+// limited or blocked as the action says.
+func metricsBotClassRequest(class, action string) {
+	metrics.Lock()
+	metrics.botClassRequests[[2]string{class, action}]++
+	metrics.Unlock()
+}
+
+// metricsPostsParsed records a successful parse of the n posts.
+func metricsPostsParsed(n int) {
+	metrics.Lock()
+	metrics.posts = n
+	metrics.lastParse = time.Now()
+	metrics.Unlock()
+}
+
+// metricsFeedRegenerated records a regeneration of the feed.
+func metricsFeedRegenerated() {
+	metrics.Lock()
+	metrics.feedRegenerations++
+	metrics.Unlock()
+}
+
+func metricsHandler(req *air.Request, res *air.Response) error {
+	buf := bytes.Buffer{}
+
+	metrics.Lock()
+
+	keys := make([][2]string, 0, len(metrics.requests))
+	for k := range metrics.requests {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+
+		return keys[i][1] < keys[j][1]
+	})
+
+	buf.WriteString("# HELP blog_http_requests_total " +
+		"Total number of HTTP requests.\n")
+	buf.WriteString("# TYPE blog_http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(
+			&buf,
+			"blog_http_requests_total{route=%q,status=%q} %d\n",
+			k[0],
+			k[1],
+			metrics.requests[k],
+		)
+	}
+
+	routes := make([]string, 0, len(metrics.latencies))
+	for r := range metrics.latencies {
+		routes = append(routes, r)
+	}
+
+	sort.Strings(routes)
+
+	buf.WriteString("# HELP blog_http_request_duration_seconds " +
+		"HTTP response latencies.\n")
+	buf.WriteString("# TYPE blog_http_request_duration_seconds " +
+		"histogram\n")
+	for _, r := range routes {
+		h := metrics.latencies[r]
+		for i, b := range metricsLatencyBuckets {
+			fmt.Fprintf(
+				&buf,
+				"blog_http_request_duration_seconds_bucket"+
+					"{route=%q,le=\"%g\"} %d\n",
+				r,
+				b,
+				h.counts[i],
+			)
+		}
+
+		fmt.Fprintf(
+			&buf,
+			"blog_http_request_duration_seconds_bucket"+
+				"{route=%q,le=\"+Inf\"} %d\n",
+			r,
+			h.count,
+		)
+		fmt.Fprintf(
+			&buf,
+			"blog_http_request_duration_seconds_sum"+
+				"{route=%q} %g\n",
+			r,
+			h.sum,
+		)
+		fmt.Fprintf(
+			&buf,
+			"blog_http_request_duration_seconds_count"+
+				"{route=%q} %d\n",
+			r,
+			h.count,
+		)
+	}
+
+	keys = keys[:0]
+	for k := range metrics.botClassRequests {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+
+		return keys[i][1] < keys[j][1]
+	})
+
+	buf.WriteString("# HELP blog_bot_class_requests_total " +
+		"Total number of requests by bot class.\n")
+	buf.WriteString("# TYPE blog_bot_class_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(
+			&buf,
+			"blog_bot_class_requests_total"+
+				"{class=%q,action=%q} %d\n",
+			k[0],
+			k[1],
+			metrics.botClassRequests[k],
+		)
+	}
+
+	buf.WriteString("# HELP blog_posts Number of posts.\n")
+	buf.WriteString("# TYPE blog_posts gauge\n")
+	fmt.Fprintf(&buf, "blog_posts %d\n", metrics.posts)
+
+	buf.WriteString("# HELP blog_posts_last_parse_timestamp_seconds " +
+		"Time of the last successful post parse.\n")
+	buf.WriteString("# TYPE blog_posts_last_parse_timestamp_seconds " +
+		"gauge\n")
+	lastParse := int64(0)
+	if !metrics.lastParse.IsZero() {
+		lastParse = metrics.lastParse.Unix()
+	}
+
+	fmt.Fprintf(
+		&buf,
+		"blog_posts_last_parse_timestamp_seconds %d\n",
+		lastParse,
+	)
+
+	buf.WriteString("# HELP blog_feed_regenerations_total " +
+		"Total number of feed regenerations.\n")
+	buf.WriteString("# TYPE blog_feed_regenerations_total counter\n")
+	fmt.Fprintf(
+		&buf,
+		"blog_feed_regenerations_total %d\n",
+		metrics.feedRegenerations,
+	)
+
+	metrics.Unlock()
+
+	buf.WriteString("# HELP blog_content_version " +
+		"Version of the content being served.\n")
+	buf.WriteString("# TYPE blog_content_version gauge\n")
+	fmt.Fprintf(&buf, "blog_content_version %d\n", currentContentVersion())
+
+	hbs := heartbeatSnapshot()
+	buf.WriteString("# HELP blog_heartbeat_age_seconds " +
+		"Seconds since the last heartbeat of a subsystem.\n")
+	buf.WriteString("# TYPE blog_heartbeat_age_seconds gauge\n")
+	for _, hb := range hbs {
+		fmt.Fprintf(
+			&buf,
+			"blog_heartbeat_age_seconds{subsystem=%q} %g\n",
+			hb.Name,
+			time.Since(hb.Last).Seconds(),
+		)
+	}
+
+	buf.WriteString("# HELP blog_heartbeat_stale " +
+		"Whether a subsystem has stopped making progress.\n")
+	buf.WriteString("# TYPE blog_heartbeat_stale gauge\n")
+	for _, hb := range hbs {
+		stale := 0
+		if hb.Stale() {
+			stale = 1
+		}
+
+		fmt.Fprintf(
+			&buf,
+			"blog_heartbeat_stale{subsystem=%q} %d\n",
+			hb.Name,
+			stale,
+		)
+	}
+
+	buf.WriteString("# HELP blog_subsystem_restarts_total " +
+		"Total number of restarts of a subsystem by the watchdog.\n")
+	buf.WriteString("# TYPE blog_subsystem_restarts_total counter\n")
+	for _, hb := range hbs {
+		fmt.Fprintf(
+			&buf,
+			"blog_subsystem_restarts_total{subsystem=%q} %d\n",
+			hb.Name,
+			hb.Restarts,
+		)
+	}
+
+	for _, m := range []struct {
+		name string
+		help string
+		typ  string
+		v    func(lruCacheStats) interface{}
+	}{
+		{
+			"blog_cache_hits_total",
+			"Total number of cache hits.",
+			"counter",
+			func(s lruCacheStats) interface{} { return s.Hits },
+		},
+		{
+			"blog_cache_misses_total",
+			"Total number of cache misses.",
+			"counter",
+			func(s lruCacheStats) interface{} { return s.Misses },
+		},
+		{
+			"blog_cache_evictions_total",
+			"Total number of cache evictions.",
+			"counter",
+			func(s lruCacheStats) interface{} {
+				return s.Evictions
+			},
+		},
+		{
+			"blog_cache_entries",
+			"Number of cache entries.",
+			"gauge",
+			func(s lruCacheStats) interface{} { return s.Entries },
+		},
+		{
+			"blog_cache_bytes",
+			"Size of cache entries in bytes.",
+			"gauge",
+			func(s lruCacheStats) interface{} { return s.Bytes },
+		},
+		{
+			"blog_cache_max_bytes",
+			"Memory budget of cache in bytes.",
+			"gauge",
+			func(s lruCacheStats) interface{} { return s.MaxBytes },
+		},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.typ)
+		for _, c := range lruCaches {
+			s := c.stats()
+			fmt.Fprintf(
+				&buf,
+				"%s{cache=%q} %v\n",
+				m.name,
+				s.Name,
+				m.v(s),
+			)
+		}
+	}
+
+	res.SetHeader("content-type", "text/plain; version=0.0.4")
+	res.SetHeader("cache-control", "no-cache")
+
+	return res.WriteBlob(buf.Bytes())
+}
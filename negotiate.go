@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/aofei/air"
+)
+
+// The representations of a post at its URL.
+const (
+	postFormatHTML     = "html"
+	postFormatJSON     = "json"
+	postFormatMarkdown = "markdown"
+)
+
+// postFormats is the media types of the representations of a post. The
+// earlier ones win the ties.
+var postFormats = []struct {
+	format    string
+	mediaType string
+}{
+	{postFormatHTML, "text/html"},
+	{postFormatJSON, "application/json"},
+	{postFormatMarkdown, "text/markdown"},
+}
+
+// negotiatePostFormat returns the representation of a post that the "Accept"
+// of the req prefers, which is the HTML if it has none or accepts none.
+func negotiatePostFormat(req *air.Request) string {
+	accept := req.Header("accept").Value()
+	if accept == "" {
+		return postFormatHTML
+	}
+
+	format, best := postFormatHTML, 0.0
+	for _, pf := range postFormats {
+		if q := acceptQuality(accept, pf.mediaType); q > best {
+			format, best = pf.format, q
+		}
+	}
+
+	return format
+}
+
+// jsonPostHandler serves the p as JSON, the same as in the headless content.
+func jsonPostHandler(req *air.Request, res *air.Response, p post) error {
+	if !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader(
+		"link",
+		"<"+config.BaseURL+p.Permalink+`>; rel="canonical"`,
+	)
+
+	return res.WriteJSON(newContentPost(p))
+}
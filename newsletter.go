@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// subscriber is a subscriber of the newsletter.
+type subscriber struct {
+	Email     string    `json:"email"`
+	Token     string    `json:"token"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var subscribersMutex sync.Mutex
+
+// subscribersFilename returns the name of the file of the subscribers.
+func subscribersFilename() string {
+	return filepath.Join(config.DataRoot, "subscribers.json")
+}
+
+// loadSubscribers returns all the subscribers. It must be called with the
+// `subscribersMutex` held.
+func loadSubscribers() ([]subscriber, error) {
+	b, err := ioutil.ReadFile(subscribersFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ss := []subscriber{}
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// saveSubscribers saves the ss as all the subscribers. It must be called with
+// the `subscribersMutex` held.
+func saveSubscribers(ss []subscriber) error {
+	b, err := json.MarshalIndent(ss, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	filename := subscribersFilename()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// updateSubscribers loads the subscribers, lets the f change them and saves
+// them.
+func updateSubscribers(f func([]subscriber) ([]subscriber, error)) error {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	ss, err := loadSubscribers()
+	if err != nil {
+		return err
+	}
+
+	if ss, err = f(ss); err != nil {
+		return err
+	}
+
+	return saveSubscribers(ss)
+}
+
+// sendMail sends the HTML body with the subject to the to through the
+// `config.SMTPHost`. The unsubscribeURL (if any) is offered to the mail
+// clients as a one-click unsubscription (RFC 8058).
+func sendMail(to, subject, body, unsubscribeURL string) error {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(
+		&buf,
+		"Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", subject),
+	)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	if unsubscribeURL != "" {
+		fmt.Fprintf(&buf, "List-Unsubscribe: <%s>\r\n", unsubscribeURL)
+		buf.WriteString(
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+		)
+	}
+
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	from := config.SMTPFrom
+	if a, err := mail.ParseAddress(config.SMTPFrom); err == nil {
+		from = a.Address
+	}
+
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth(
+			"",
+			config.SMTPUsername,
+			config.SMTPPassword,
+			config.SMTPHost,
+		)
+	}
+
+	return smtp.SendMail(
+		net.JoinHostPort(
+			config.SMTPHost,
+			strconv.Itoa(config.SMTPPort),
+		),
+		auth,
+		from,
+		[]string{to},
+		buf.Bytes(),
+	)
+}
+
+// sendMailInBackground runs the `sendMail` in the background and logs its
+// failure.
+func sendMailInBackground(to, subject, body, unsubscribeURL string) {
+	go func() {
+		err := sendMail(to, subject, body, unsubscribeURL)
+		if err != nil {
+			air.ERROR(
+				"failed to send mail",
+				map[string]interface{}{
+					"subject": subject,
+					"error":   err.Error(),
+				},
+			)
+		}
+	}()
+}
+
+// unsubscribeURL returns the URL that unsubscribes the owner of the token.
+func unsubscribeURL(token string) string {
+	return config.BaseURL + "/unsubscribe?token=" + url.QueryEscape(token)
+}
+
+// mailNewPost sends the p to all the confirmed subscribers.
+func mailNewPost(p post) {
+	if !config.NewsletterEnabled {
+		return
+	}
+
+	subscribersMutex.Lock()
+	ss, err := loadSubscribers()
+	subscribersMutex.Unlock()
+	if err != nil {
+		air.ERROR(
+			"failed to load subscribers",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+		return
+	}
+
+	link := config.BaseURL + p.Permalink
+	for _, s := range ss {
+		if !s.Confirmed {
+			continue
+		}
+
+		uu := unsubscribeURL(s.Token)
+		body := fmt.Sprintf(
+			"<h1><a href=\"%s\">%s</a></h1>\n%s\n<hr>\n"+
+				"<p><a href=\"%s\">Unsubscribe</a></p>\n",
+			link,
+			htemplate.HTMLEscapeString(p.Title),
+			p.AbsoluteContent(),
+			uu,
+		)
+		sendMailInBackground(s.Email, p.Title, body, uu)
+	}
+}
+
+// renderNewsletterMessage renders the message as the response of the res.
+func renderNewsletterMessage(
+	req *air.Request,
+	res *air.Response,
+	message string,
+) error {
+	req.Values["PageTitle"] = req.LocalizedString("Subscribe")
+	req.Values["Message"] = message
+	return res.Render(req.Values, "message.html", "layouts/default.html")
+}
+
+func subscribeHandler(req *air.Request, res *air.Response) error {
+	if !config.NewsletterEnabled {
+		return air.NotFoundHandler(req, res)
+	}
+
+	a, err := mail.ParseAddress(strings.TrimSpace(paramValue(req, "email")))
+	if err != nil {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	token := fmt.Sprintf("%x", b)
+	confirmed := false
+	if err := updateSubscribers(func(
+		ss []subscriber,
+	) ([]subscriber, error) {
+		for i, s := range ss {
+			if strings.EqualFold(s.Email, a.Address) {
+				if s.Confirmed {
+					confirmed = true
+				} else {
+					ss[i].Token = token
+				}
+
+				return ss, nil
+			}
+		}
+
+		return append(ss, subscriber{
+			Email:     a.Address,
+			Token:     token,
+			CreatedAt: time.Now().UTC(),
+		}), nil
+	}); err != nil {
+		return err
+	}
+
+	if !confirmed {
+		subject := req.LocalizedString("Confirm your subscription")
+		sendMailInBackground(
+			a.Address,
+			subject,
+			fmt.Sprintf(
+				"<p><a href=\"%s/subscribe/confirm?token=%s\">"+
+					"%s</a></p>\n",
+				config.BaseURL,
+				token,
+				subject,
+			),
+			"",
+		)
+	}
+
+	return renderNewsletterMessage(
+		req,
+		res,
+		req.LocalizedString("Please check your email to confirm."),
+	)
+}
+
+func confirmSubscriptionHandler(req *air.Request, res *air.Response) error {
+	token := paramValue(req, "token")
+	found := false
+	if err := updateSubscribers(func(
+		ss []subscriber,
+	) ([]subscriber, error) {
+		for i, s := range ss {
+			if token != "" && s.Token == token {
+				ss[i].Confirmed = true
+				found = true
+			}
+		}
+
+		return ss, nil
+	}); err != nil {
+		return err
+	}
+
+	if !found {
+		return air.NotFoundHandler(req, res)
+	}
+
+	return renderNewsletterMessage(
+		req,
+		res,
+		req.LocalizedString("You have subscribed."),
+	)
+}
+
+// unsubscribeHandler unsubscribes the owner of the token on POST, which is
+// also what the one-click unsubscription of the mail clients sends. A GET only
+// asks for a confirmation, since mail scanners follow links on their own.
+func unsubscribeHandler(req *air.Request, res *air.Response) error {
+	token := paramValue(req, "token")
+	if req.Method != "POST" {
+		req.Values["UnsubscribeToken"] = token
+		return renderNewsletterMessage(
+			req,
+			res,
+			req.LocalizedString("Unsubscribe from new posts?"),
+		)
+	}
+
+	if err := updateSubscribers(func(
+		ss []subscriber,
+	) ([]subscriber, error) {
+		nss := ss[:0]
+		for _, s := range ss {
+			if token == "" || s.Token != token {
+				nss = append(nss, s)
+			}
+		}
+
+		return nss, nil
+	}); err != nil {
+		return err
+	}
+
+	return renderNewsletterMessage(
+		req,
+		res,
+		req.LocalizedString("You have unsubscribed."),
+	)
+}
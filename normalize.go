@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// caseSensitivePathPrefixes is the prefixes of the paths that are taken as
+// they are, such as those of the files, the locales and the names.
+var caseSensitivePathPrefixes = []string{
+	"/assets/",
+	"/authors/",
+	"/bundles/",
+	"/feeds/",
+	"/fonts/",
+	"/images/",
+	"/p/",
+	"/series/",
+	"/uploads/",
+	"/videos/",
+}
+
+// isNormalPathExempt reports whether the p is left alone by the
+// `normalizePathGas`.
+func isNormalPathExempt(p string) bool {
+	if p == "/" ||
+		config.IndexNowKey != "" && p == indexNowKeyPath() {
+		return true
+	}
+
+	for _, prefix := range canonicalExemptPaths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	for _, prefix := range caseSensitivePathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPathPolicies checks the `config.TrailingSlashPolicy` and the
+// `config.PathCasePolicy`.
+func checkPathPolicies() error {
+	switch config.TrailingSlashPolicy {
+	case "", "keep", "remove":
+	default:
+		return fmt.Errorf(
+			"unknown trailing slash policy %q",
+			config.TrailingSlashPolicy,
+		)
+	}
+
+	switch config.PathCasePolicy {
+	case "", "keep", "lower":
+	default:
+		return fmt.Errorf(
+			"unknown path case policy %q",
+			config.PathCasePolicy,
+		)
+	}
+
+	return nil
+}
+
+// foldPathCase returns the p with its case folded as the
+// `config.PathCasePolicy` "lower" says: a post or a page keeps the case of
+// its ID or its slug, and everything else is lowercased.
+func foldPathCase(p string) string {
+	if p == strings.ToLower(p) {
+		return p
+	}
+
+	snap := loadedPosts()
+	if _, ok := snap.permalinkPosts[p]; ok {
+		return p
+	}
+
+	lp := strings.ToLower(p)
+	if strings.HasPrefix(lp, "/posts/") {
+		id := p[len("/posts/"):]
+		ext := path.Ext(id)
+		if strings.HasSuffix(strings.ToLower(id), "/lite") {
+			ext = "/lite"
+		} else if ext != ".md" && ext != ".txt" && ext != ".pdf" &&
+			ext != ".epub" {
+			ext = ""
+		}
+
+		id = id[:len(id)-len(ext)]
+		if _, ok := snap.posts[id]; ok {
+			return "/posts/" + id + ext
+		}
+
+		for _, op := range snap.posts {
+			if strings.EqualFold(op.ID, id) {
+				return "/posts/" + op.ID + ext
+			}
+		}
+	} else if !strings.Contains(p[1:], "/") {
+		for _, pg := range snap.pages {
+			if strings.EqualFold(pg.Path(), p) {
+				return pg.Path()
+			}
+		}
+	}
+
+	return lp
+}
+
+// normalizePathGas is an `air.Gas` that permanently redirects the GET and the
+// HEAD requests to the paths that are not normal as the
+// `config.TrailingSlashPolicy` and the `config.PathCasePolicy` say, such as
+// the "/Posts/foo/" to the "/posts/foo", so that every page is known by one
+// URL. It must be a pregas after the `basePathGas`.
+func normalizePathGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return next(req, res)
+		}
+
+		u := httpRequest(req).URL
+		if isNormalPathExempt(u.Path) {
+			return next(req, res)
+		}
+
+		np := u.Path
+		if config.TrailingSlashPolicy == "remove" {
+			np = strings.TrimRight(np, "/")
+			if np == "" {
+				np = "/"
+			}
+		}
+
+		if config.PathCasePolicy == "lower" {
+			np = foldPathCase(np)
+		}
+
+		if np == u.Path {
+			return next(req, res)
+		}
+
+		location := sitePath(np)
+		if u.RawQuery != "" {
+			location += "?" + u.RawQuery
+		}
+
+		res.Status = 301
+
+		return res.Redirect(location)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPostSuggestions is the maximum number of the posts suggested on the 404
+// pages of the mistyped post URLs.
+const maxPostSuggestions = 5
+
+// looseID returns the id as it is compared when looking for the post that a
+// mistyped URL meant: lowercased, and without the punctuation that tends to
+// stick to the URLs pasted from a sentence.
+func looseID(id string) string {
+	return strings.ToLower(strings.TrimRight(id, "/.,;:!?)]}'\"”’"))
+}
+
+// editDistance returns the Levenshtein distance between the a and the b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(
+				prev[j]+1,
+				minInt(cur[j-1]+1, prev[j-1]+cost),
+			)
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// minInt returns the smaller of the a and the b.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// misspelledPost returns the only listed post of the snap whose ID the id
+// differs from by no more than the case and the trailing punctuation, if there
+// is exactly one.
+func misspelledPost(snap *postsSnapshot, id string) (post, bool) {
+	lid := looseID(id)
+	if lid == "" {
+		return post{}, false
+	}
+
+	var found []post
+	for _, p := range snap.orderedPosts {
+		if looseID(p.ID) == lid {
+			found = append(found, p)
+		}
+	}
+
+	if len(found) != 1 {
+		return post{}, false
+	}
+
+	return found[0], true
+}
+
+// postSuggestions returns the listed posts of the snap whose IDs are close to
+// the id, the closest and then the newest first, for the 404 pages of the
+// mistyped post URLs.
+func postSuggestions(snap *postsSnapshot, id string) []post {
+	lid := looseID(id)
+	if utf8.RuneCountInString(lid) < 3 {
+		return nil
+	}
+
+	maxDistance := utf8.RuneCountInString(lid) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	type candidate struct {
+		post     post
+		distance int
+	}
+
+	cs := []candidate{}
+	for _, p := range snap.orderedPosts {
+		pid := looseID(p.ID)
+		d := editDistance(lid, pid)
+		if strings.HasPrefix(pid, lid) || strings.HasPrefix(lid, pid) {
+			// A truncated URL is as good as a typo.
+			d = minInt(d, 1)
+		}
+
+		if d <= maxDistance {
+			cs = append(cs, candidate{post: p, distance: d})
+		}
+	}
+
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].distance < cs[j].distance
+	})
+
+	if len(cs) > maxPostSuggestions {
+		cs = cs[:maxPostSuggestions]
+	}
+
+	ps := make([]post, 0, len(cs))
+	for _, c := range cs {
+		ps = append(ps, c.post)
+	}
+
+	return ps
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// notify sends the message to all the configured notifiers in the background.
+func notify(message string) {
+	if config.MatrixRoomID != "" {
+		go func() {
+			if err := notifyMatrix(message); err != nil {
+				air.ERROR(
+					"failed to notify matrix",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}()
+	}
+
+	if config.XMPPTo != "" {
+		go func() {
+			if err := notifyXMPP(message); err != nil {
+				air.ERROR(
+					"failed to notify xmpp",
+					map[string]interface{}{
+						"error": err.Error(),
+					},
+				)
+			}
+		}()
+	}
+}
+
+// notifyMatrix sends the message to the `config.MatrixRoomID`.
+func notifyMatrix(message string) error {
+	b, err := json.Marshal(map[string]string{
+		"msgtype": "m.notice",
+		"body":    message,
+	})
+	if err != nil {
+		return err
+	}
+
+	fr, err := fetch(
+		"PUT",
+		fmt.Sprintf(
+			"%s/_matrix/client/r0/rooms/%s/send/m.room.message/%s",
+			strings.TrimSuffix(config.MatrixHomeserver, "/"),
+			url.PathEscape(config.MatrixRoomID),
+			newRequestID(),
+		),
+		http.Header{
+			"Authorization": {"Bearer " + config.MatrixAccessToken},
+			"Content-Type":  {"application/json"},
+		},
+		b,
+	)
+	if err != nil {
+		return err
+	} else if fr.Status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	return nil
+}
+
+// notifyXMPP sends the message to the `config.XMPPTo` as the `config.XMPPJID`.
+func notifyXMPP(message string) error {
+	i := strings.IndexByte(config.XMPPJID, '@')
+	if i < 0 {
+		return errors.New("malformed jid")
+	}
+
+	user, domain := config.XMPPJID[:i], config.XMPPJID[i+1:]
+	if j := strings.IndexByte(domain, '/'); j >= 0 {
+		domain = domain[:j]
+	}
+
+	address := net.JoinHostPort(domain, "5222")
+	if _, srvs, err := net.LookupSRV(
+		"xmpp-client",
+		"tcp",
+		domain,
+	); err == nil && len(srvs) > 0 {
+		address = net.JoinHostPort(
+			strings.TrimSuffix(srvs[0].Target, "."),
+			fmt.Sprint(srvs[0].Port),
+		)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	x := &xmppConn{
+		conn:   conn,
+		domain: domain,
+	}
+
+	features, err := x.open()
+	if err != nil {
+		return err
+	} else if !bytes.Contains(features, []byte("<starttls")) {
+		return errors.New("server does not support starttls")
+	}
+
+	if err := x.send(
+		"<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>",
+	); err != nil {
+		return err
+	} else if se, _, err := x.next(); err != nil {
+		return err
+	} else if se.Name.Local != "proceed" {
+		return errors.New("starttls refused")
+	}
+
+	tc := tls.Client(conn, &tls.Config{
+		ServerName: domain,
+	})
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+
+	x.conn = tc
+	if _, err := x.open(); err != nil {
+		return err
+	}
+
+	if err := x.send(fmt.Sprintf(
+		"<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' "+
+			"mechanism='PLAIN'>%s</auth>",
+		base64.StdEncoding.EncodeToString(
+			[]byte("\x00"+user+"\x00"+config.XMPPPassword),
+		),
+	)); err != nil {
+		return err
+	} else if se, _, err := x.next(); err != nil {
+		return err
+	} else if se.Name.Local != "success" {
+		return errors.New("authentication failed")
+	}
+
+	if _, err := x.open(); err != nil {
+		return err
+	}
+
+	if err := x.send(
+		"<iq type='set' id='bind'>" +
+			"<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></iq>",
+	); err != nil {
+		return err
+	} else if se, _, err := x.next(); err != nil {
+		return err
+	} else if xmlAttr(se, "type") != "result" {
+		return errors.New("resource binding failed")
+	}
+
+	to := bytes.Buffer{}
+	xml.EscapeText(&to, []byte(config.XMPPTo))
+	body := bytes.Buffer{}
+	xml.EscapeText(&body, []byte(message))
+
+	return x.send(fmt.Sprintf(
+		"<message to='%s' type='chat'><body>%s</body></message>"+
+			"</stream:stream>",
+		to.String(),
+		body.String(),
+	))
+}
+
+// xmppConn is a minimal XMPP client connection, just enough to send a
+// message.
+type xmppConn struct {
+	conn    net.Conn
+	domain  string
+	decoder *xml.Decoder
+}
+
+// send sends the s.
+func (x *xmppConn) send(s string) error {
+	_, err := x.conn.Write([]byte(s))
+	return err
+}
+
+// open opens a new stream and returns the features offered by the server.
+func (x *xmppConn) open() ([]byte, error) {
+	if err := x.send(fmt.Sprintf(
+		"<?xml version='1.0'?><stream:stream to='%s' "+
+			"xmlns='jabber:client' "+
+			"xmlns:stream='http://etherx.jabber.org/streams' "+
+			"version='1.0'>",
+		x.domain,
+	)); err != nil {
+		return nil, err
+	}
+
+	x.decoder = xml.NewDecoder(x.conn)
+	for {
+		t, err := x.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if ok && se.Name.Local == "stream" {
+			break
+		}
+	}
+
+	se, features, err := x.next()
+	if err != nil {
+		return nil, err
+	} else if se.Name.Local != "features" {
+		return nil, fmt.Errorf("unexpected <%s>", se.Name.Local)
+	}
+
+	return features, nil
+}
+
+// next reads the next top-level element of the stream and returns its start
+// and its inner XML.
+func (x *xmppConn) next() (xml.StartElement, []byte, error) {
+	for {
+		t, err := x.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, nil, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		e := struct {
+			Inner []byte `xml:",innerxml"`
+		}{}
+		if err := x.decoder.DecodeElement(&e, &se); err != nil {
+			return xml.StartElement{}, nil, err
+		}
+
+		return se, e.Inner, nil
+	}
+}
+
+// xmlAttr returns the value of the attribute named name of the se.
+func xmlAttr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
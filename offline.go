@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// Where the web manifest and the service worker are served. The service
+// worker has to be at the root of the blog to control all of its pages.
+const (
+	manifestPath      = "/manifest.webmanifest"
+	serviceWorkerPath = "/sw.js"
+)
+
+// serviceWorkerCachePrefix is the prefix of the names of the caches of the
+// service worker. The caches with it but of another version are deleted once
+// a new version of the service worker activates.
+const serviceWorkerCachePrefix = "blog-"
+
+// serviceWorkerScript is the script of the service worker, which is given the
+// name of its cache and the URLs to precache. The pages are served from the
+// network first and fall back to the cache, or to the home page when offline,
+// while everything else precached is served from the cache first.
+const serviceWorkerScript = `"use strict";
+
+var CACHE = %s;
+var URLS = %s;
+var HOME = URLS[0];
+
+self.addEventListener("install", function(event) {
+	event.waitUntil(caches.open(CACHE).then(function(cache) {
+		return cache.addAll(URLS);
+	}).then(function() {
+		return self.skipWaiting();
+	}));
+});
+
+self.addEventListener("activate", function(event) {
+	event.waitUntil(caches.keys().then(function(names) {
+		return Promise.all(names.filter(function(name) {
+			return name.indexOf(%s) === 0 && name !== CACHE;
+		}).map(function(name) {
+			return caches.delete(name);
+		}));
+	}).then(function() {
+		return self.clients.claim();
+	}));
+});
+
+self.addEventListener("fetch", function(event) {
+	var req = event.request;
+	if (req.method !== "GET" ||
+		new URL(req.url).origin !== self.location.origin) {
+		return;
+	}
+
+	if (req.mode === "navigate") {
+		event.respondWith(fetch(req).catch(function() {
+			return caches.match(req).then(function(res) {
+				return res || caches.match(HOME);
+			});
+		}));
+		return;
+	}
+
+	event.respondWith(caches.match(req).then(function(res) {
+		return res || fetch(req);
+	}));
+});
+`
+
+// webManifest is a web app manifest of the blog.
+type webManifest struct {
+	Name        string            `json:"name"`
+	ShortName   string            `json:"short_name"`
+	Description string            `json:"description"`
+	StartURL    string            `json:"start_url"`
+	Scope       string            `json:"scope"`
+	Display     string            `json:"display"`
+	Icons       []webManifestIcon `json:"icons"`
+}
+
+// webManifestIcon is an icon of a `webManifest`.
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// offlineURLs returns the URLs that the service worker precaches, which are of
+// the home page, the bundles, the icons and the ops, the latest
+// `config.OfflinePosts` listed posts of the snap that anyone can read. The home
+// page always comes first.
+func offlineURLs(snap *postsSnapshot) (urls []string, ops []post) {
+	urls = []string{sitePath("/")}
+
+	bundlesMutex.RLock()
+	names := make([]string, 0, len(bundles))
+	for name := range bundles {
+		names = append(names, name)
+	}
+	bundlesMutex.RUnlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if u := bundleURL(name); u != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	urls = append(
+		urls,
+		assetURL("/assets/images/favicon.ico"),
+		assetURL("/assets/images/apple-touch-icon.png"),
+	)
+
+	for _, p := range snap.orderedPosts {
+		if len(ops) >= config.OfflinePosts {
+			break
+		}
+
+		if p.Protected() || p.MembersOnly {
+			continue
+		}
+
+		urls = append(urls, sitePath(p.Permalink))
+		ops = append(ops, p)
+	}
+
+	return urls, ops
+}
+
+// serviceWorkerCacheName returns the name of the cache of the service worker
+// precaching the urls with the ops among them. It is derived from the urls,
+// which carry the hashes of the assets, and from when each of the ops was last
+// updated, so a new one is only made when what is precached changes.
+func serviceWorkerCacheName(urls []string, ops []post) string {
+	h := md5.New()
+	for _, u := range urls {
+		io.WriteString(h, u+"\n")
+	}
+
+	for _, p := range ops {
+		io.WriteString(h, p.Updated.Format(time.RFC3339Nano)+"\n")
+	}
+
+	return fmt.Sprintf("%s%x", serviceWorkerCachePrefix, h.Sum(nil)[:8])
+}
+
+func serviceWorkerHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	urls, ops := offlineURLs(snap)
+	cache, err := json.Marshal(serviceWorkerCacheName(urls, ops))
+	if err != nil {
+		return err
+	}
+
+	ub, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := json.Marshal(serviceWorkerCachePrefix)
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/javascript; charset=utf-8")
+	res.SetHeader("cache-control", "no-cache")
+
+	return res.WriteString(fmt.Sprintf(
+		serviceWorkerScript,
+		cache,
+		ub,
+		prefix,
+	))
+}
+
+func manifestHandler(req *air.Request, res *air.Response) error {
+	b, err := json.Marshal(webManifest{
+		Name:        config.Title,
+		ShortName:   config.Title,
+		Description: req.LocalizedString("Jon Snow's blog."),
+		StartURL:    sitePath("/"),
+		Scope:       sitePath("/"),
+		Display:     "standalone",
+		Icons: []webManifestIcon{
+			{
+				Src: assetURL(
+					"/assets/images/apple-touch-icon.png",
+				),
+				Sizes: "256x256",
+				Type:  "image/png",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/manifest+json")
+	res.SetHeader("cache-control", "max-age=86400")
+
+	return res.WriteBlob(b)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// ogImageWidth and ogImageHeight are the size of the Open Graph
+	// images, which is what most of the sites unfurl the links with.
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+
+	// ogImageMargin is the margin around the text of the Open Graph
+	// images.
+	ogImageMargin = 80
+
+	// ogImageTitleLines is the maximum number of lines of the title.
+	ogImageTitleLines = 3
+)
+
+var (
+	ogImageBackground = color.RGBA{0xfd, 0xfd, 0xfd, 0xff}
+	ogImageAccent     = color.RGBA{0x2a, 0x7a, 0xe2, 0xff}
+	ogImageText       = color.RGBA{0x11, 0x11, 0x11, 0xff}
+	ogImageMuted      = color.RGBA{0x82, 0x82, 0x82, 0xff}
+
+	ogImagesBusy int32
+)
+
+// ogImagePath returns the asset path of the generated Open Graph image of the
+// p.
+func ogImagePath(p post) string {
+	return "/assets/og/" + p.ID + ".png"
+}
+
+// postImageURL returns the absolute URL of the image of the p to be shared
+// with, which is its own `Image` or, failing that, its generated Open Graph
+// image. It returns an empty string if there is neither.
+func postImageURL(p post) string {
+	img := p.Image
+	if img == "" {
+		if !config.OGImagesEnabled {
+			return ""
+		}
+
+		img = ogImagePath(p)
+	}
+
+	if strings.Contains(img, "://") {
+		return img
+	} else if strings.HasPrefix(img, "/assets/") {
+		img = strings.TrimPrefix(assetURL(img), basePath)
+	}
+
+	return config.BaseURL + img
+}
+
+// generateOGImages generates the Open Graph images of the ops that have no
+// `Image` of their own and whose images are missing or older than them. It
+// is meant to be run in the background after the posts are parsed, and only
+// one run happens at a time.
+func generateOGImages(ops []post) {
+	if !config.OGImagesEnabled ||
+		!atomic.CompareAndSwapInt32(&ogImagesBusy, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ogImagesBusy, 0)
+
+	titleFace, textFace, err := ogImageFaces()
+	if err != nil {
+		air.ERROR(
+			"failed to load open graph image fonts",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+		return
+	}
+
+	generated := 0
+	for _, p := range ops {
+		if p.Image != "" {
+			continue
+		}
+
+		filename := filepath.Join(
+			defaultAssetRoot,
+			filepath.FromSlash(strings.TrimPrefix(
+				ogImagePath(p),
+				"/assets",
+			)),
+		)
+		if fi, err := os.Stat(filename); err == nil &&
+			!fi.ModTime().Before(p.Updated) &&
+			!fi.ModTime().Before(p.ModTime) {
+			continue
+		}
+
+		b, err := renderOGImage(p, titleFace, textFace)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(filename), 0755)
+		}
+
+		if err == nil {
+			err = ioutil.WriteFile(filename, b, 0644)
+		}
+
+		if err != nil {
+			air.ERROR(
+				"failed to generate open graph image",
+				map[string]interface{}{
+					"post_id": p.ID,
+					"error":   err.Error(),
+				},
+			)
+			continue
+		}
+
+		generated++
+	}
+
+	if generated == 0 {
+		return
+	}
+
+	if err := buildTheme(); err != nil {
+		air.ERROR(
+			"failed to build theme",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+	}
+
+	hashAssets()
+	bumpContentVersion()
+}
+
+// ogImageFaces returns the faces of the titles and the other text of the Open
+// Graph images. They are of the first TrueType or OpenType font of the
+// `config.Fonts`, so that the titles in any of the languages it covers are
+// drawn, or of the Go fonts if there is none.
+func ogImageFaces() (font.Face, font.Face, error) {
+	titleFont, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	textFont, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, fc := range config.Fonts {
+		b, err := ioutil.ReadFile(fc.File)
+		if err != nil {
+			continue
+		}
+
+		if f, err := opentype.Parse(b); err == nil {
+			titleFont, textFont = f, f
+			break
+		}
+	}
+
+	titleFace, err := opentype.NewFace(titleFont, &opentype.FaceOptions{
+		Size:    64,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	textFace, err := opentype.NewFace(textFont, &opentype.FaceOptions{
+		Size:    32,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return titleFace, textFace, nil
+}
+
+// renderOGImage returns the Open Graph image of the p as a PNG, with the site
+// title above the title of the p and its date below.
+func renderOGImage(p post, titleFace, textFace font.Face) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, ogImageWidth, ogImageHeight))
+	draw.Draw(
+		img,
+		img.Bounds(),
+		image.NewUniform(ogImageBackground),
+		image.Point{},
+		draw.Src,
+	)
+	draw.Draw(
+		img,
+		image.Rect(0, 0, ogImageWidth, 16),
+		image.NewUniform(ogImageAccent),
+		image.Point{},
+		draw.Src,
+	)
+
+	width := ogImageWidth - 2*ogImageMargin
+	drawOGText(img, textFace, ogImageAccent, config.Title, ogImageMargin+32)
+
+	lines := wrapOGText(titleFace, p.Title, width)
+	lh := titleFace.Metrics().Height.Ceil() * 5 / 4
+	y := (ogImageHeight - lh*len(lines)) / 2
+	for _, l := range lines {
+		y += lh
+		drawOGText(img, titleFace, ogImageText, l, y)
+	}
+
+	drawOGText(
+		img,
+		textFace,
+		ogImageMuted,
+		p.Datetime.Format("2006-01-02"),
+		ogImageHeight-ogImageMargin,
+	)
+
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// drawOGText draws the s onto the img in the face and the c with its baseline
+// at the y.
+func drawOGText(
+	img draw.Image,
+	face font.Face,
+	c color.Color,
+	s string,
+	y int,
+) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(ogImageMargin, y),
+	}
+	d.DrawString(s)
+}
+
+// wrapOGText wraps the s into lines no wider than the width in the face, at
+// most `ogImageTitleLines` of them. The words too wide for a line, such as
+// the runs of the CJK characters, are broken between any runes.
+func wrapOGText(face font.Face, s string, width int) []string {
+	fits := func(s string) bool {
+		return font.MeasureString(face, s).Ceil() <= width
+	}
+
+	lines := []string{}
+	line := ""
+	for _, w := range strings.Fields(s) {
+		candidate := w
+		if line != "" {
+			candidate = line + " " + w
+		}
+
+		if fits(candidate) {
+			line = candidate
+			continue
+		} else if line != "" {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		for _, r := range w {
+			if line != "" && !fits(line+string(r)) {
+				lines = append(lines, line)
+				line = ""
+			}
+
+			line += string(r)
+		}
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	if len(lines) > ogImageTitleLines {
+		lines = lines[:ogImageTitleLines]
+		last := []rune(lines[len(lines)-1])
+		for len(last) > 0 && !fits(string(last)+"…") {
+			last = last[:len(last)-1]
+		}
+
+		lines[len(lines)-1] = string(last) + "…"
+	}
+
+	return lines
+}
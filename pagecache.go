@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	renders singleflight.Group
+
+	pageCache *lruCache
+)
+
+// renderedPage is a page rendered into memory.
+type renderedPage struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// size returns the approximate number of bytes the rp takes in memory.
+func (rp *renderedPage) size() int {
+	size := len(rp.body)
+	for k, vs := range rp.header {
+		size += len(k)
+		for _, v := range vs {
+			size += len(v)
+		}
+	}
+
+	return size
+}
+
+// renderKey returns the key identifying the page the req asks for in the
+// version of the content. Requests with the same key are answered with the
+// same page. Of the "Accept", only the representation of the posts that it
+// negotiates matters, so the browsers all share the same pages.
+func renderKey(version uint64, req *air.Request) string {
+	return strconv.FormatUint(version, 10) + "|" + req.Path + "?" +
+		httpRequest(req).URL.RawQuery + "|" +
+		req.Header("accept-language").Value() + "|" +
+		colorScheme(req) + "|" +
+		negotiatePostFormat(req)
+}
+
+// pageCacheGas is an `air.Gas` that answers GET requests from the cache of the
+// rendered pages. Concurrent requests for a page that isn't cached share a
+// single render instead of each executing the templates. The requests that
+// may see the protected posts are never answered from the cache.
+func pageCacheGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if req.Method != "GET" || hasPostAccessCookies(req) {
+			return next(req, res)
+		}
+
+		version := currentContentVersion()
+		key := renderKey(version, req)
+		if v, ok := pageCache.get(key); ok {
+			return writeRenderedPage(res, v.(*renderedPage))
+		}
+
+		hrw := httpResponseWriter(req, res)
+		leader := false
+		v, err, _ := renders.Do(key, func() (interface{}, error) {
+			leader = true
+
+			rp, err := renderPage(req, res, next)
+			if err != nil {
+				return nil, err
+			}
+
+			if rp.status == 200 &&
+				currentContentVersion() == version {
+				pageCache.set(key, rp, rp.size())
+			}
+
+			return rp, nil
+		})
+		if leader {
+			setHTTPResponseWriter(req, res, hrw)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rp := v.(*renderedPage)
+		if leader {
+			for k, vs := range rp.header {
+				hrw.Header()[k] = vs
+			}
+
+			hrw.WriteHeader(rp.status)
+			_, err := hrw.Write(rp.body)
+
+			return err
+		}
+
+		return writeRenderedPage(res, rp)
+	}
+}
+
+// writeRenderedPage writes the rp as the response of the res.
+func writeRenderedPage(res *air.Response, rp *renderedPage) error {
+	for k, vs := range rp.header {
+		res.SetHeader(k, vs...)
+	}
+
+	res.Status = rp.status
+
+	return res.WriteBlob(rp.body)
+}
+
+// renderPage runs the next with the req and the res and returns what it wrote
+// instead of sending it.
+func renderPage(
+	req *air.Request,
+	res *air.Response,
+	next air.Handler,
+) (*renderedPage, error) {
+	rec := &pageRecorder{
+		header: http.Header{},
+	}
+	for k, vs := range httpResponseWriter(req, res).Header() {
+		rec.header[k] = append([]string{}, vs...)
+	}
+
+	// The ID of the request that happens to render the page is not to be
+	// served to the others.
+	rec.header.Del("x-request-id")
+
+	setHTTPResponseWriter(req, res, rec)
+	if err := next(req, res); err != nil {
+		return nil, err
+	}
+
+	if rec.status == 0 {
+		rec.status = 200
+	}
+
+	if rec.header.Get("etag") == "" {
+		rec.header.Set(
+			"etag",
+			fmt.Sprintf(`"%x"`, md5.Sum(rec.body.Bytes())),
+		)
+	}
+
+	if rec.header.Get("last-modified") == "" {
+		rec.header.Set(
+			"last-modified",
+			time.Now().UTC().Format(http.TimeFormat),
+		)
+	}
+
+	return &renderedPage{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+	}, nil
+}
+
+// pageRecorder is an `http.ResponseWriter` that records the response written
+// through it.
+type pageRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header implements the `http.ResponseWriter`.
+func (pr *pageRecorder) Header() http.Header {
+	return pr.header
+}
+
+// WriteHeader implements the `http.ResponseWriter`. The informational
+// statuses, such as the 103 of the `earlyHintsGas`, are not the status of the
+// response and so are left out.
+func (pr *pageRecorder) WriteHeader(status int) {
+	if pr.status == 0 && status >= 200 {
+		pr.status = status
+	}
+}
+
+// Write implements the `http.ResponseWriter`.
+func (pr *pageRecorder) Write(b []byte) (int, error) {
+	if pr.status == 0 {
+		pr.status = 200
+	}
+
+	return pr.body.Write(b)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// pageRoot is the directory of the page files.
+const pageRoot = "pages"
+
+// page is a standalone page, such as the "/about", served at its slug.
+type page struct {
+	ID      string
+	Title   string
+	Slug    string         `toml:"slug"`
+	Updated time.Time      `toml:"updated"`
+	Render  renderOptions  `toml:"render"`
+	Nav     bool           `toml:"nav"`
+	Sitemap *bool          `toml:"sitemap"`
+	Content htemplate.HTML `toml:"-"`
+	File    string         `toml:"-"`
+	ModTime time.Time      `toml:"-"`
+}
+
+// Path returns the path of the pg.
+func (pg page) Path() string {
+	return "/" + pg.Slug
+}
+
+// InSitemap reports whether the pg is listed in the sitemap, which it is
+// unless its front matter says otherwise.
+func (pg page) InSitemap() bool {
+	return pg.Sitemap == nil || *pg.Sitemap
+}
+
+// splitFrontMatter splits the b into its front matter, between the first two
+// "+++", and the Markdown after it.
+func splitFrontMatter(b []byte) ([]byte, []byte, error) {
+	if bytes.Count(b, []byte{'+', '+', '+'}) < 2 {
+		return nil, nil, errors.New("missing front matter")
+	}
+
+	i := bytes.Index(b, []byte{'+', '+', '+'})
+	j := i + 3 + bytes.Index(b[i+3:], []byte{'+', '+', '+'})
+
+	return b[i+3 : j], b[j+3:], nil
+}
+
+// parsePages parses the page files under the `pageRoot`, returning the pages
+// by their slugs and the errors of the files that fail to parse. A missing
+// `pageRoot` has no page.
+func parsePages() (map[string]page, []postError) {
+	npgs := map[string]page{}
+	npes := []postError{}
+
+	fns, err := postFiles(pageRoot)
+	if os.IsNotExist(err) {
+		return npgs, npes
+	} else if err != nil {
+		return npgs, append(npes, newPostError(pageRoot, err))
+	}
+
+	for _, fn := range fns {
+		if filepath.Ext(fn) != ".md" {
+			continue
+		}
+
+		pg, err := parsePage(fn)
+		if err != nil {
+			npes = append(npes, newPostError(fn, err))
+			continue
+		} else if opg, ok := npgs[pg.Slug]; ok {
+			npes = append(npes, newPostError(fn, fmt.Errorf(
+				"slug %q already used by %s",
+				pg.Slug,
+				opg.File,
+			)))
+			continue
+		}
+
+		npgs[pg.Slug] = pg
+	}
+
+	return npgs, npes
+}
+
+// parsePage parses the page file of the fn.
+func parsePage(fn string) (page, error) {
+	pg := page{
+		ID:   postID(pageRoot, fn),
+		File: fn,
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return pg, err
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return pg, err
+	}
+
+	fm, md, err := splitFrontMatter(b)
+	if err != nil {
+		return pg, err
+	}
+
+	if err := toml.Unmarshal(fm, &pg); err != nil {
+		return pg, err
+	}
+
+	if pg.Slug == "" {
+		pg.Slug = pg.ID
+	}
+
+	if strings.Contains(pg.Slug, "/") {
+		return pg, fmt.Errorf("slug %q contains slashes", pg.Slug)
+	}
+
+	ro := config.Render.merge(pg.Render)
+	pg.Content = htemplate.HTML(responsiveImages(postProcessHTML(
+		renderMarkdown(md, ro),
+		ro,
+	)))
+
+	pg.ModTime = fi.ModTime().UTC()
+	if pg.Updated.IsZero() {
+		pg.Updated = pg.ModTime
+	}
+
+	pg.Updated = pg.Updated.UTC()
+
+	return pg, nil
+}
+
+// menuPages returns the menu items of the pages of the snap that ask to be in
+// the menu, ordered by their slugs.
+func menuPages(snap *postsSnapshot) []menuConfig {
+	mcs := []menuConfig{}
+	for _, pg := range snap.pages {
+		if pg.Nav {
+			mcs = append(mcs, menuConfig{
+				Label: pg.Title,
+				Path:  pg.Path(),
+			})
+		}
+	}
+
+	sort.Slice(mcs, func(i, j int) bool {
+		return mcs[i].Path < mcs[j].Path
+	})
+
+	return mcs
+}
+
+func pageHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	pg, ok := snap.pages[paramValue(req, "Slug")]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	return servePage(req, res, pg)
+}
+
+// servePage responds the req with the pg.
+func servePage(req *air.Request, res *air.Response, pg page) error {
+	req.Values["PageTitle"] = pg.Title
+	req.Values["CanonicalPath"] = pg.Path()
+	req.Values["Page"] = pg
+	return res.Render(req.Values, "page.html", "layouts/default.html")
+}
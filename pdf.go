@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	htemplate "html/template"
+	"os/exec"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/sync/singleflight"
+)
+
+// pdfTimeout is how long a post may take to be converted into a PDF.
+const pdfTimeout = time.Minute
+
+var (
+	// pdfCache is the cache of the PDFs of the posts, by the hashes of
+	// the HTML they are converted from.
+	pdfCache *lruCache
+
+	// pdfConversions makes the concurrent requests for a PDF that isn't
+	// cached share a single conversion.
+	pdfConversions singleflight.Group
+)
+
+// PDFPath returns the path of the PDF of the p.
+func (p post) PDFPath() string {
+	return "/posts/" + p.ID + ".pdf"
+}
+
+// convertToPDF converts the h, a self-contained HTML document, into a PDF with
+// the `config.PDFConverterPath`, which is expected to take the HTML on its
+// standard input and write the PDF on its standard output as the wkhtmltopdf
+// does.
+func convertToPDF(h []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+
+	stderr := bytes.Buffer{}
+	cmd := exec.CommandContext(
+		ctx,
+		config.PDFConverterPath,
+		"--quiet",
+		"--print-media-type",
+		"--disable-javascript",
+		"--disable-local-file-access",
+		"--encoding", "utf-8",
+		"-",
+		"-",
+	)
+	cmd.Stdin = bytes.NewReader(h)
+	cmd.Stderr = &stderr
+
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, stderr.String())
+	}
+
+	return b, nil
+}
+
+// pdfPostHandler serves the PDF of the post of the id in the snap, converted
+// from its rendering with the `templates/print.html`. The PDFs are cached by
+// the hashes of those renderings, so a post is only converted again once it or
+// the template changes.
+func pdfPostHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+) error {
+	p, ok := snap.posts[id]
+	if !config.PDFEnabled || !ok || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	req.Values["PageTitle"] = p.Title
+	req.Values["CanonicalPath"] = p.Permalink
+	req.Values["Post"] = p
+	req.Values["Content"] = htemplate.HTML(liteHTML(string(p.Content)))
+
+	hrw := httpResponseWriter(req, res)
+	rp, err := renderPage(req, res, func(
+		req *air.Request,
+		res *air.Response,
+	) error {
+		return res.Render(req.Values, "print.html")
+	})
+	setHTTPResponseWriter(req, res, hrw)
+
+	// The rendering was only recorded, so nothing has been written yet.
+	res.Written = false
+	if err != nil {
+		return err
+	}
+
+	hash := fmt.Sprintf("%x", md5.Sum(rp.body))
+	v, err, _ := pdfConversions.Do(hash, func() (interface{}, error) {
+		if b, ok := pdfCache.get(hash); ok {
+			return b, nil
+		}
+
+		b, err := convertToPDF(rp.body)
+		if err != nil {
+			return nil, err
+		}
+
+		pdfCache.set(hash, b, len(b))
+
+		return b, nil
+	})
+	if err != nil {
+		air.ERROR(
+			"failed to convert post into pdf",
+			map[string]interface{}{
+				"post_id": p.ID,
+				"error":   err.Error(),
+			},
+		)
+		return err
+	}
+
+	if p.Protected() || p.MembersOnly {
+		res.SetHeader("cache-control", "private, no-cache")
+	}
+
+	res.SetHeader("content-type", "application/pdf")
+	res.SetHeader(
+		"content-disposition",
+		fmt.Sprintf("inline; filename=%q", p.ID+".pdf"),
+	)
+	res.SetHeader("etag", `"`+hash+`"`)
+	res.SetHeader(
+		"link",
+		"<"+config.BaseURL+p.Permalink+`>; rel="canonical"`,
+	)
+
+	return res.WriteBlob(v.([]byte))
+}
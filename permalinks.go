@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// defaultPostSection is the section of the posts right under the post root.
+const defaultPostSection = "posts"
+
+// datePrefixPattern matches the date that the post files are usually named
+// after, such as the "2018-02-23-" of the "2018-02-23-hi-there.md".
+var datePrefixPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}-`)
+
+// postSection returns the section of the post of the id, which is the first
+// directory of the id, or the `defaultPostSection` for the posts right under
+// the post root.
+func postSection(id string) string {
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		return id[:i]
+	}
+
+	return defaultPostSection
+}
+
+// postSlug returns the slug of the p. Unless set in the p's front matter, it
+// is the last element of the p's ID without the date prefix.
+func postSlug(p post) string {
+	if p.Slug != "" {
+		return p.Slug
+	}
+
+	return datePrefixPattern.ReplaceAllString(path.Base(p.ID), "")
+}
+
+// checkPermalinks reports whether the `config.Permalinks` make sense.
+func checkPermalinks() error {
+	for section, pattern := range config.Permalinks {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf(
+				"permalink of section %s must start with /",
+				section,
+			)
+		} else if !strings.Contains(pattern, ":slug") &&
+			!strings.Contains(pattern, ":id") {
+			return fmt.Errorf(
+				"permalink of section %s needs :slug or :id",
+				section,
+			)
+		}
+	}
+
+	return nil
+}
+
+// postPermalink returns the path that the p is served at, made from the
+// pattern of the p's section in the `config.Permalinks`. The patterns may
+// have ":year", ":month", ":day", ":section", ":slug" and ":id".
+func postPermalink(p post) string {
+	section := postSection(p.ID)
+	pattern, ok := config.Permalinks[section]
+	if !ok {
+		return "/posts/" + p.ID
+	}
+
+	return strings.NewReplacer(
+		":year", p.Datetime.Format("2006"),
+		":month", p.Datetime.Format("01"),
+		":day", p.Datetime.Format("02"),
+		":section", section,
+		":slug", postSlug(p),
+		":id", p.ID,
+	).Replace(pattern)
+}
+
+// buildPermalinkPosts returns the permalinks of the ops mapped to their IDs,
+// and the collisions of them. The oldest of the posts sharing a permalink
+// keeps it, the others fall back to their "/posts/:ID".
+func buildPermalinkPosts(ops []post) (map[string]string, []postCollision) {
+	pps := make(map[string]string, len(ops))
+	files := make(map[string]string, len(ops))
+	pcs := []postCollision{}
+	for i := len(ops) - 1; i >= 0; i-- {
+		p := &ops[i]
+		if p.Permalink == "/posts/"+p.ID {
+			continue
+		}
+
+		if id, ok := pps[p.Permalink]; ok {
+			air.WARN(
+				"permalink taken",
+				map[string]interface{}{
+					"permalink": p.Permalink,
+					"post_id":   p.ID,
+					"taken_by":  id,
+				},
+			)
+			pcs = append(pcs, postCollision{
+				Kind:    postCollisionPermalink,
+				Key:     p.Permalink,
+				Kept:    files[p.Permalink],
+				Dropped: p.File,
+			})
+			p.Permalink = "/posts/" + p.ID
+			continue
+		}
+
+		pps[p.Permalink] = p.ID
+		files[p.Permalink] = p.File
+	}
+
+	return pps, pcs
+}
+
+// permalinkGas is an `air.Gas` that routes the permalinks of the posts (and
+// their ".md" and ".txt" variants) to the "/posts/*" and redirects the old
+// "/posts/:ID" to the permalinks. It must be a pregas, since it rewrites the
+// path that the routing goes by.
+func permalinkGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if len(config.Permalinks) == 0 {
+			return next(req, res)
+		}
+
+		snap := loadedPosts()
+
+		u := httpRequest(req).URL
+		ext := path.Ext(u.Path)
+		if ext != ".md" && ext != ".txt" {
+			ext = ""
+		}
+
+		pp := strings.TrimSuffix(u.Path, ext)
+		if id, ok := snap.permalinkPosts[pp]; ok {
+			u.Path = "/posts/" + id + ext
+			u.RawPath = ""
+			return next(req, res)
+		}
+
+		if req.Method != "GET" && req.Method != "HEAD" ||
+			!strings.HasPrefix(u.Path, "/posts/") {
+			return next(req, res)
+		}
+
+		p, ok := snap.posts[strings.TrimPrefix(pp, "/posts/")]
+		if !ok || p.Permalink+ext == u.Path {
+			return next(req, res)
+		}
+
+		location := sitePath(p.Permalink + ext)
+		if u.RawQuery != "" {
+			location += "?" + u.RawQuery
+		}
+
+		res.Status = 301
+
+		return res.Redirect(location)
+	}
+}
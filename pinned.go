@@ -0,0 +1,36 @@
+package main
+
+// pinnedPostsFirst returns the ops with the pinned ones moved to the top, each
+// part staying in its order.
+func pinnedPostsFirst(ops []post) []post {
+	pps := make([]post, 0, len(ops))
+	for _, p := range ops {
+		if p.Pinned {
+			pps = append(pps, p)
+		}
+	}
+
+	if len(pps) == 0 {
+		return ops
+	}
+
+	for _, p := range ops {
+		if !p.Pinned {
+			pps = append(pps, p)
+		}
+	}
+
+	return pps
+}
+
+// featuredPostsOf returns the featured posts of the ops, in their order.
+func featuredPostsOf(ops []post) []post {
+	fps := []post{}
+	for _, p := range ops {
+		if p.Featured {
+			fps = append(fps, p)
+		}
+	}
+
+	return fps
+}
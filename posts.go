@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// postsWatcherDebounce is how long the posts watcher waits for the file events
+// to stop before it reloads the posts, so that a burst of them, as an editor
+// makes when it saves, reloads the posts only once.
+const postsWatcherDebounce = 500 * time.Millisecond
+
+// postFiles returns the names of all the post files under the root, including
+// the ones in its subdirectories.
+func postFiles(root string) ([]string, error) {
+	fns := []string{}
+	err := filepath.Walk(
+		root,
+		func(filename string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name := strings.TrimSuffix(filename, encryptedPostExt)
+			if !fi.IsDir() && strings.HasSuffix(name, ".md") &&
+				!isTempFile(filename) {
+				fns = append(fns, filename)
+			}
+
+			return nil
+		},
+	)
+
+	return fns, err
+}
+
+// postID returns the ID of the post file named filename under the root, which
+// is its slash-separated path relative to the root without the extensions.
+// For example, "posts/2018/hi-there.md" becomes "2018/hi-there".
+func postID(root, filename string) string {
+	id, err := filepath.Rel(root, filename)
+	if err != nil {
+		id = filepath.Base(filename)
+	}
+
+	id = strings.TrimSuffix(id, encryptedPostExt)
+	id = strings.TrimSuffix(id, ".md")
+
+	return filepath.ToSlash(id)
+}
+
+// isTempFile reports whether the file named filename is one of the temporary,
+// backup or lock files that the editors leave around, such as the ".#foo.md"
+// and the "#foo.md#" of the Emacs or the "foo.md~" and the ".foo.md.swp" of
+// the Vim.
+func isTempFile(filename string) bool {
+	base := filepath.Base(filename)
+	switch {
+	case strings.HasPrefix(base, ".#"),
+		strings.HasPrefix(base, "#") && strings.HasSuffix(base, "#"),
+		strings.HasSuffix(base, "~"),
+		base == "4913": // The Vim checks if it may write with it.
+		return true
+	}
+
+	switch filepath.Ext(base) {
+	case ".swp", ".swo", ".swx", ".tmp":
+		return true
+	}
+
+	return false
+}
+
+// watchDirs adds the root and all the directories under it to the w. It does
+// nothing if the root is not a directory.
+func watchDirs(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(
+		root,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if fi.IsDir() {
+				return w.Add(path)
+			}
+
+			return nil
+		},
+	)
+}
+
+// watchPostFiles adds the files that are loaded along with the posts, such as
+// the `config.BlogrollFile`, to the w, so that they are reloaded with the
+// posts whenever they change. The missing ones are left out.
+func watchPostFiles(w *fsnotify.Watcher) {
+	for _, name := range []string{
+		config.AuthorsFile,
+		config.RelatedFile,
+		config.BlogrollFile,
+	} {
+		if name != "" {
+			w.Add(name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// The templates that the posts are rendered with by default.
+const (
+	defaultPostTemplate = "post.html"
+	defaultPostLayout   = "layouts/default.html"
+)
+
+// checkPostTemplates checks that the `Template` and the `Layout` of the p, if
+// any, are HTML templates in the `air.TemplateRoot`.
+func checkPostTemplates(p post) error {
+	for _, t := range []struct {
+		kind, name string
+	}{
+		{"template", p.Template},
+		{"layout", p.Layout},
+	} {
+		if t.name == "" {
+			continue
+		}
+
+		if path.Clean(t.name) != t.name ||
+			path.IsAbs(t.name) ||
+			strings.HasPrefix(t.name, "../") ||
+			path.Ext(t.name) != ".html" {
+			return fmt.Errorf("bad %s %q", t.kind, t.name)
+		}
+
+		fi, err := os.Stat(filepath.Join(
+			air.TemplateRoot,
+			filepath.FromSlash(t.name),
+		))
+		if err != nil || fi.IsDir() {
+			return fmt.Errorf("%s %q not found", t.kind, t.name)
+		}
+	}
+
+	return nil
+}
+
+// postTemplate returns the template that the p is rendered with.
+func postTemplate(p post) string {
+	if p.Template != "" {
+		return p.Template
+	}
+
+	return defaultPostTemplate
+}
+
+// postLayout returns the layout that the p is rendered in.
+func postLayout(p post) string {
+	if p.Layout != "" {
+		return p.Layout
+	}
+
+	return defaultPostLayout
+}
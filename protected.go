@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+)
+
+// postAccessCookiePrefix is the prefix of the names of the cookies that grant
+// the access to the password-protected posts.
+const postAccessCookiePrefix = "post_access_"
+
+// postAccessMaxAge is how long, in seconds, a correct password is remembered.
+const postAccessMaxAge = 30 * 24 * 60 * 60
+
+var (
+	cookieSecretOnce sync.Once
+	cookieSecret     []byte
+)
+
+// Listed reports whether the p appears in the listings, the feeds and the
+// sitemaps, which it does unless it is "unlisted".
+func (p post) Listed() bool {
+	return p.Visibility != "unlisted"
+}
+
+// Protected reports whether the content of the p is only shown to those who
+// know its password.
+func (p post) Protected() bool {
+	return p.Password != ""
+}
+
+// checkVisibility checks that the visibility v of a post is a known one.
+func checkVisibility(v string) error {
+	switch v {
+	case "", "public", "unlisted":
+		return nil
+	}
+
+	return fmt.Errorf("unknown visibility %q", v)
+}
+
+// listedPosts returns the ops that are listed, with the content of the
+// protected ones withheld and that of the members-only ones cut down to their
+// teasers, so that nothing built from them gives it away.
+func listedPosts(ops []post) []post {
+	lps := make([]post, 0, len(ops))
+	for _, p := range ops {
+		if !p.Listed() {
+			continue
+		}
+
+		if p.Protected() {
+			p.Content = ""
+			p.Source = nil
+		} else if p.MembersOnly {
+			p.Content = p.Teaser()
+			p.Source = nil
+		}
+
+		lps = append(lps, p)
+	}
+
+	return lps
+}
+
+// getCookieSecret returns the key that the cookies are signed with, which is
+// the `config.CookieSecret` or, if that is not set, a random one that lasts
+// until the next start.
+func getCookieSecret() []byte {
+	cookieSecretOnce.Do(func() {
+		if config.CookieSecret != "" {
+			cookieSecret = []byte(config.CookieSecret)
+			return
+		}
+
+		cookieSecret = make([]byte, 32)
+		if _, err := rand.Read(cookieSecret); err != nil {
+			panic(fmt.Errorf(
+				"failed to generate cookie secret: %v",
+				err,
+			))
+		}
+	})
+
+	return cookieSecret
+}
+
+// postAccessCookieName returns the name of the cookie that grants the access
+// to the p.
+func postAccessCookieName(p post) string {
+	h := sha256.Sum256([]byte(p.ID))
+	return postAccessCookiePrefix + fmt.Sprintf("%x", h[:8])
+}
+
+// postAccessToken returns the value of the cookie that grants the access to
+// the p. It changes along with the password of the p, which revokes the
+// cookies of the old one.
+func postAccessToken(p post) string {
+	mac := hmac.New(sha256.New, getCookieSecret())
+	mac.Write([]byte(p.ID + "\x00" + p.Password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hasPostAccess reports whether the req may see the content of the p.
+func hasPostAccess(req *air.Request, p post) bool {
+	if p.MembersOnly && requestMember(req) == "" {
+		return false
+	}
+
+	return hasPostPassword(req, p)
+}
+
+// hasPostPassword reports whether the req has been granted the access to the
+// p by its password, or the p has none.
+func hasPostPassword(req *air.Request, p post) bool {
+	if !p.Protected() {
+		return true
+	}
+
+	c := req.Cookie(postAccessCookieName(p))
+	if c == nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(c.Value), []byte(postAccessToken(p)))
+}
+
+// hasPostAccessCookies reports whether the req carries any cookie granting the
+// access to a protected or members-only post. Such requests are not answered
+// from the shared caches.
+func hasPostAccessCookies(req *air.Request) bool {
+	for _, c := range req.Cookies() {
+		if strings.HasPrefix(c.Name, postAccessCookiePrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unlockPostHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	id := strings.TrimSuffix(paramValue(req, "*"), "/unlock")
+	p, ok := snap.posts[id]
+	if !ok || !p.Protected() {
+		return air.NotFoundHandler(req, res)
+	}
+
+	if subtle.ConstantTimeCompare(
+		[]byte(paramValue(req, "password")),
+		[]byte(p.Password),
+	) != 1 {
+		return res.Redirect(sitePath(p.Permalink + "?unlock=failed"))
+	}
+
+	setCookie(res, &http.Cookie{
+		Name:     postAccessCookieName(p),
+		Value:    postAccessToken(p),
+		MaxAge:   postAccessMaxAge,
+		Path:     sitePath("/"),
+		Secure:   requestScheme(req) == "https",
+		HttpOnly: true,
+	})
+
+	return res.Redirect(sitePath(p.Permalink))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// tokenBucket is a token bucket of a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	trustedProxies []*net.IPNet
+
+	rateLimitMutex   sync.Mutex
+	rateLimitBuckets = map[string]*tokenBucket{}
+)
+
+// parseCIDRs parses the ss into IP networks. Both CIDRs and plain IPs are
+// accepted.
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	ns := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		ns = append(ns, n)
+	}
+
+	return ns, nil
+}
+
+// containsIP reports whether any of the ns contains the ip.
+func containsIP(ns []*net.IPNet, ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies parses the `config.TrustedProxies` into the
+// `trustedProxies`.
+func parseTrustedProxies() error {
+	ns, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	trustedProxies = ns
+
+	return nil
+}
+
+// isTrustedProxy reports whether the ip belongs to a trusted proxy.
+func isTrustedProxy(ip net.IP) bool {
+	return containsIP(trustedProxies, ip)
+}
+
+// clientIP returns the IP of the client that sent the req. The
+// "X-Forwarded-For" is only believed as far as it was appended by the trusted
+// proxies, since anything before them may be forged by the client.
+func clientIP(req *air.Request) string {
+	host := httpRequest(req).RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	xff := strings.Split(req.Header("x-forwarded-for").Value(), ",")
+	for i := len(xff) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(xff[i]))
+		if fip == nil {
+			break
+		}
+
+		host = fip.String()
+		if !isTrustedProxy(fip) {
+			break
+		}
+	}
+
+	return host
+}
+
+// rateLimitGas is an `air.Gas` that limits the rate of the requests of every
+// client to the `config.RateLimitRate` per second, with bursts of up to the
+// `config.RateLimitBurst`.
+func rateLimitGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !config.RateLimitEnabled {
+			return next(req, res)
+		}
+
+		ip := clientIP(req)
+		now := time.Now()
+		burst := float64(config.RateLimitBurst)
+
+		rateLimitMutex.Lock()
+		tb, ok := rateLimitBuckets[ip]
+		if !ok {
+			tb = &tokenBucket{
+				tokens: burst,
+				last:   now,
+			}
+			rateLimitBuckets[ip] = tb
+		}
+
+		elapsed := now.Sub(tb.last).Seconds()
+		tb.tokens = math.Min(
+			burst,
+			tb.tokens+elapsed*config.RateLimitRate,
+		)
+		tb.last = now
+
+		allowed := tb.tokens >= 1
+		if allowed {
+			tb.tokens--
+		}
+
+		wait := (1 - tb.tokens) / config.RateLimitRate
+		rateLimitMutex.Unlock()
+
+		if allowed {
+			return next(req, res)
+		}
+
+		air.WARN(
+			"rate limit exceeded",
+			map[string]interface{}{
+				"client_ip": ip,
+				"path":      req.Path,
+			},
+		)
+
+		res.Status = 429
+		res.SetHeader(
+			"retry-after",
+			strconv.Itoa(int(math.Ceil(wait))),
+		)
+
+		return res.WriteString("Too Many Requests")
+	}
+}
+
+// sweepRateLimitBuckets drops the buckets that have refilled. A refilled
+// bucket is no different from a new one.
+func sweepRateLimitBuckets() error {
+	now := time.Now()
+	burst := float64(config.RateLimitBurst)
+
+	rateLimitMutex.Lock()
+	for ip, tb := range rateLimitBuckets {
+		elapsed := now.Sub(tb.last).Seconds()
+		if tb.tokens+elapsed*config.RateLimitRate >= burst {
+			delete(rateLimitBuckets, ip)
+		}
+	}
+	rateLimitMutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// textBlockTags is the tags that start a new line in the plain text.
+var textBlockTags = map[string]bool{
+	"address":    true,
+	"blockquote": true,
+	"br":         true,
+	"dd":         true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"figcaption": true,
+	"figure":     true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"hr":         true,
+	"li":         true,
+	"ol":         true,
+	"p":          true,
+	"pre":        true,
+	"table":      true,
+	"tr":         true,
+	"ul":         true,
+}
+
+// blankLinesPattern matches the runs of blank lines.
+var blankLinesPattern = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+
+// htmlToText returns the text of the h with the tags stripped, one block per
+// paragraph.
+func htmlToText(h string) string {
+	buf := bytes.Buffer{}
+	skip := 0
+	z := html.NewTokenizer(strings.NewReader(h))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		switch tt {
+		case html.TextToken:
+			if skip == 0 {
+				buf.WriteString(t.Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if t.Data == "script" || t.Data == "style" {
+				if tt == html.StartTagToken {
+					skip++
+				}
+			} else if t.Data == "img" && skip == 0 {
+				buf.WriteString(attr(t, "alt"))
+			} else if textBlockTags[t.Data] {
+				buf.WriteString("\n")
+			}
+		case html.EndTagToken:
+			if t.Data == "script" || t.Data == "style" {
+				if skip > 0 {
+					skip--
+				}
+			} else if textBlockTags[t.Data] {
+				buf.WriteString("\n\n")
+			}
+		}
+	}
+
+	return strings.TrimSpace(
+		blankLinesPattern.ReplaceAllString(buf.String(), "\n\n"),
+	) + "\n"
+}
+
+// rawPostHandler serves the markdown source of the post of the id in the snap,
+// or its plain text if the ext is ".txt". The front matter of the source is
+// left out when the "front_matter" param is "false".
+func rawPostHandler(
+	req *air.Request,
+	res *air.Response,
+	snap *postsSnapshot,
+	id string,
+	ext string,
+) error {
+	p, ok := snap.posts[id]
+	if !ok || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader(
+		"link",
+		"<"+config.BaseURL+p.Permalink+`>; rel="canonical"`,
+	)
+
+	if ext == ".txt" {
+		res.SetHeader("content-type", "text/plain; charset=utf-8")
+		return res.WriteString(
+			p.Title + "\n\n" + htmlToText(string(p.Content)),
+		)
+	}
+
+	b := p.Source
+	if paramValue(req, "front_matter") == "false" {
+		if _, md, err := splitFrontMatter(b); err == nil {
+			b = bytes.TrimLeft(md, "\r\n")
+		}
+	}
+
+	res.SetHeader("content-type", "text/markdown; charset=utf-8")
+
+	return res.WriteBlob(b)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// reactionKind is a reaction that the readers may leave on the posts.
+type reactionKind struct {
+	Name  string
+	Emoji string
+	Label string
+}
+
+// reactionKinds is the reactions that the readers may leave, in the order
+// they are shown. The labels are localized.
+var reactionKinds = []reactionKind{
+	{"like", "👍", "Like"},
+	{"heart", "❤️", "Love"},
+}
+
+// reactionCounts is the persisted counts of the reactions, by the IDs of the
+// posts and then by the names of the `reactionKinds`.
+type reactionCounts map[string]map[string]uint64
+
+// postReaction is the count of a kind of the reactions to a post.
+type postReaction struct {
+	reactionKind
+	Count uint64
+}
+
+var (
+	reactionsMutex sync.Mutex
+	reactions      = reactionCounts{}
+	reactionsDirty bool
+
+	// reactionsSalt and reactionsSeen tell the readers apart for the
+	// reactionsDay only, in the same way as the `viewsSeen`.
+	reactionsSalt []byte
+	reactionsSeen map[[sha256.Size]byte]bool
+	reactionsDay  string
+)
+
+// isReactionKind reports whether the name is of one of the `reactionKinds`.
+func isReactionKind(name string) bool {
+	for _, rk := range reactionKinds {
+		if rk.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadReactions loads the `reactions` from the `store`.
+func loadReactions() error {
+	rc, err := store.Reactions()
+	if err != nil {
+		return err
+	}
+
+	if rc == nil {
+		rc = reactionCounts{}
+	}
+
+	reactionsMutex.Lock()
+	reactions = rc
+	reactionsMutex.Unlock()
+
+	return nil
+}
+
+// saveReactions saves the `reactions` to the `store` if they have changed.
+func saveReactions() error {
+	reactionsMutex.Lock()
+	if !reactionsDirty {
+		reactionsMutex.Unlock()
+		return nil
+	}
+
+	rc := make(reactionCounts, len(reactions))
+	for postID, counts := range reactions {
+		rc[postID] = make(map[string]uint64, len(counts))
+		for kind, c := range counts {
+			rc[postID][kind] = c
+		}
+	}
+
+	reactionsDirty = false
+	reactionsMutex.Unlock()
+
+	return store.SaveReactions(rc)
+}
+
+// react counts a reaction of the kind to the post of the postID by the reader
+// of the ip and the ua, unless the reader has reacted so to it today. It
+// reports whether the reaction is counted.
+func react(postID, kind, ip, ua string) bool {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	reactionsMutex.Lock()
+	defer reactionsMutex.Unlock()
+
+	if day != reactionsDay {
+		reactionsSalt = make([]byte, 32)
+		if _, err := rand.Read(reactionsSalt); err != nil {
+			return false
+		}
+
+		reactionsSeen = map[[sha256.Size]byte]bool{}
+		reactionsDay = day
+	}
+
+	h := sha256.New()
+	h.Write(reactionsSalt)
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", ip, ua, postID, kind)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if reactionsSeen[sum] {
+		return false
+	}
+
+	reactionsSeen[sum] = true
+	if reactions[postID] == nil {
+		reactions[postID] = map[string]uint64{}
+	}
+
+	reactions[postID][kind]++
+	reactionsDirty = true
+
+	return true
+}
+
+// postReactions returns the counts of all the `reactionKinds` to the post of
+// the postID.
+func postReactions(postID string) []postReaction {
+	reactionsMutex.Lock()
+	defer reactionsMutex.Unlock()
+
+	prs := make([]postReaction, 0, len(reactionKinds))
+	for _, rk := range reactionKinds {
+		prs = append(prs, postReaction{
+			reactionKind: rk,
+			Count:        reactions[postID][rk.Name],
+		})
+	}
+
+	return prs
+}
+
+// reactHandler counts a reaction of the "kind" param to the post of the path,
+// which ends with "/react". The readers with the scripts get the new counts as
+// JSON, the others are sent back to the post.
+func reactHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	postID := strings.TrimSuffix(paramValue(req, "*"), "/react")
+	p, ok := snap.posts[postID]
+	if !ok || !config.ReactionsEnabled || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	kind := paramValue(req, "kind")
+	if !isReactionKind(kind) {
+		res.Status = 400
+		return fmt.Errorf("unknown reaction %q", kind)
+	}
+
+	if req.Values["BotClass"] == humanBotClass {
+		ua := req.Header("user-agent").Value()
+		react(p.ID, kind, clientIP(req), ua)
+	}
+
+	res.SetHeader("cache-control", "no-store")
+	if prefersJSON(req) {
+		counts := map[string]uint64{}
+		for _, pr := range postReactions(p.ID) {
+			counts[pr.Name] = pr.Count
+		}
+
+		return res.WriteJSON(counts)
+	}
+
+	return res.Redirect(sitePath(p.Permalink + "?reacted=" + kind +
+		"#reactions"))
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	htemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// relatedLinkMaxAge is how long a resolved related link is trusted before it
+// is resolved again.
+const relatedLinkMaxAge = 7 * 24 * time.Hour
+
+// relatedFaviconMaxBytes is the maximum size of a favicon that is inlined.
+const relatedFaviconMaxBytes = 16 << 10
+
+// relatedLink is an external link related to a post, with its title and
+// favicon resolved from the linked page.
+type relatedLink struct {
+	URL        string    `json:"url"`
+	Title      string    `json:"title"`
+	Host       string    `json:"host"`
+	Favicon    string    `json:"favicon,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// FaviconURL returns the favicon of the rl as a URL that the templates may
+// put into the "src".
+func (rl relatedLink) FaviconURL() htemplate.URL {
+	return htemplate.URL(rl.Favicon)
+}
+
+var (
+	relatedLinksMutex sync.Mutex
+	relatedLinks      = map[string]relatedLink{}
+	relatedLinksBusy  int32
+)
+
+// relatedLinksFilename returns the name of the file of the `relatedLinks`.
+func relatedLinksFilename() string {
+	return filepath.Join(config.DataRoot, "related-links.json")
+}
+
+// loadRelatedLinks loads the `relatedLinks` from the disk.
+func loadRelatedLinks() error {
+	b, err := ioutil.ReadFile(relatedLinksFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	relatedLinksMutex.Lock()
+	defer relatedLinksMutex.Unlock()
+
+	return json.Unmarshal(b, &relatedLinks)
+}
+
+// saveRelatedLinks saves the `relatedLinks`. It must be called with the
+// `relatedLinksMutex` held.
+func saveRelatedLinks() error {
+	b, err := json.MarshalIndent(relatedLinks, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	filename := relatedLinksFilename()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// curatedRelatedURLs returns the related links of the posts by their IDs from
+// the `config.RelatedFile`, a TOML file such as:
+//
+//	"foo" = ["https://example.com/bar"]
+func curatedRelatedURLs() (map[string][]string, error) {
+	cru := map[string][]string{}
+	if config.RelatedFile == "" {
+		return cru, nil
+	}
+
+	_, err := toml.DecodeFile(config.RelatedFile, &cru)
+	if os.IsNotExist(err) {
+		return cru, nil
+	}
+
+	return cru, err
+}
+
+// postRelatedLinks returns the related links of the p. The ones that aren't
+// resolved yet are titled with their hosts.
+func postRelatedLinks(p post) []relatedLink {
+	relatedLinksMutex.Lock()
+	defer relatedLinksMutex.Unlock()
+
+	rls := make([]relatedLink, 0, len(p.Related))
+	for _, ru := range p.Related {
+		rl, ok := relatedLinks[ru]
+		if !ok {
+			rl = relatedLink{URL: ru}
+			if u, err := url.Parse(ru); err == nil {
+				rl.Host = u.Host
+			}
+
+			rl.Title = rl.Host
+		}
+
+		rls = append(rls, rl)
+	}
+
+	return rls
+}
+
+// resolveRelatedLinks resolves the related links of the ops that aren't yet,
+// or were too long ago, and forgets the ones that are no longer needed. It is
+// meant to be run in the background after the posts are parsed, and only one
+// run happens at a time.
+func resolveRelatedLinks(ops []post) {
+	if !atomic.CompareAndSwapInt32(&relatedLinksBusy, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&relatedLinksBusy, 0)
+
+	needed := map[string]bool{}
+	resolved := 0
+	for _, p := range ops {
+		for _, ru := range p.Related {
+			needed[ru] = true
+
+			relatedLinksMutex.Lock()
+			rl, ok := relatedLinks[ru]
+			relatedLinksMutex.Unlock()
+			if ok && time.Since(rl.ResolvedAt) < relatedLinkMaxAge {
+				continue
+			}
+
+			rl, err := resolveRelatedLink(ru)
+			if err != nil {
+				air.WARN(
+					"failed to resolve related link",
+					map[string]interface{}{
+						"post_id": p.ID,
+						"url":     ru,
+						"error":   err.Error(),
+					},
+				)
+				continue
+			}
+
+			relatedLinksMutex.Lock()
+			relatedLinks[ru] = rl
+			relatedLinksMutex.Unlock()
+			resolved++
+		}
+	}
+
+	relatedLinksMutex.Lock()
+	defer relatedLinksMutex.Unlock()
+
+	forgotten := 0
+	for ru := range relatedLinks {
+		if !needed[ru] {
+			delete(relatedLinks, ru)
+			forgotten++
+		}
+	}
+
+	if resolved == 0 && forgotten == 0 {
+		return
+	}
+
+	if err := saveRelatedLinks(); err != nil {
+		air.ERROR(
+			"failed to save related links",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+	}
+
+	if resolved > 0 {
+		bumpContentVersion()
+	}
+}
+
+// resolveRelatedLink fetches the page at the ru and returns it as a related
+// link, titled with the "og:title" or the "<title>" of the page, and with its
+// favicon inlined as a data URL.
+func resolveRelatedLink(ru string) (relatedLink, error) {
+	u, err := url.Parse(ru)
+	if err != nil {
+		return relatedLink{}, err
+	}
+
+	rl := relatedLink{
+		URL:        ru,
+		Title:      u.Host,
+		Host:       u.Host,
+		ResolvedAt: time.Now().UTC(),
+	}
+
+	fr, err := fetch("GET", ru, nil, nil)
+	if err != nil {
+		return relatedLink{}, err
+	} else if fr.Status != http.StatusOK {
+		// Keep it titled with its host, so it isn't asked for again
+		// until the `relatedLinkMaxAge` has passed.
+		return rl, nil
+	}
+
+	title, ogTitle, icon := "", "", "/favicon.ico"
+	inTitle := false
+	z := html.NewTokenizer(strings.NewReader(string(fr.Body)))
+tokens:
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			attrs := map[string]string{}
+			for _, a := range t.Attr {
+				attrs[a.Key] = a.Val
+			}
+
+			switch t.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				if attrs["property"] == "og:title" {
+					ogTitle = attrs["content"]
+				}
+			case "link":
+				rel := strings.ToLower(attrs["rel"])
+				for _, r := range strings.Fields(rel) {
+					if r == "icon" && attrs["href"] != "" {
+						icon = attrs["href"]
+					}
+				}
+			}
+		case html.EndTagToken:
+			if t.Data == "title" {
+				inTitle = false
+			} else if t.Data == "head" {
+				break tokens
+			}
+		case html.TextToken:
+			if inTitle {
+				title += t.Data
+			}
+		}
+	}
+
+	if t := strings.TrimSpace(ogTitle); t != "" {
+		rl.Title = t
+	} else if t := strings.Join(strings.Fields(title), " "); t != "" {
+		rl.Title = t
+	}
+
+	if iu, err := u.Parse(icon); err == nil {
+		rl.Favicon = fetchFavicon(iu.String())
+	}
+
+	return rl, nil
+}
+
+// fetchFavicon returns the favicon at the iu as a data URL, or an empty string
+// if it can't be inlined.
+func fetchFavicon(iu string) string {
+	fr, err := fetch("GET", iu, nil, nil)
+	if err != nil || fr.Status != http.StatusOK ||
+		len(fr.Body) == 0 || len(fr.Body) > relatedFaviconMaxBytes {
+		return ""
+	}
+
+	mt, _, err := mime.ParseMediaType(fr.Header.Get("content-type"))
+	if err != nil || !strings.HasPrefix(mt, "image/") {
+		mt = http.DetectContentType(fr.Body)
+		if !strings.HasPrefix(mt, "image/") {
+			return ""
+		}
+	}
+
+	return "data:" + mt + ";base64," +
+		base64.StdEncoding.EncodeToString(fr.Body)
+}
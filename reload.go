@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// postsSnapshot is all that the `parsePosts` makes of the posts. Each parse
+// builds a new one and swaps it in whole, so that a request reads the posts
+// of a single parse throughout, however many parses happen meanwhile.
+type postsSnapshot struct {
+	// posts is the posts by their IDs, and the orderedPosts is the listed
+	// ones of them from the newest.
+	posts         map[string]post
+	orderedPosts  []post
+	pinnedPosts   []post
+	featuredPosts []post
+
+	// err is why the last parse failed, in which case the rest is what
+	// the one before it made, except the postErrors.
+	err        error
+	postErrors []postError
+
+	// pages is the pages by their slugs.
+	pages map[string]page
+
+	// series is the posts of each series by its name, in the order of
+	// their parts.
+	series map[string][]post
+
+	// permalinkPosts maps the permalinks of the posts to their IDs, and
+	// the shortCodePosts maps their short codes to their IDs.
+	permalinkPosts map[string]string
+	shortCodePosts map[string]string
+
+	// searchDocs is the search index of the posts.
+	searchDocs []searchDoc
+
+	// authors is the authors by their IDs.
+	authors map[string]*author
+
+	// blogroll is the blogs followed, loaded at the blogrollUpdated.
+	blogroll        []blogrollEntry
+	blogrollUpdated time.Time
+
+	postCollisions []postCollision
+	seoIssues      []seoIssue
+	sitemaps       map[string][]byte
+
+	webFonts        []*webFont
+	webFontsCSSURL  string
+	webFontsByPaths map[string][]byte
+
+	feed             []byte
+	feedEncodeds     map[string][]byte
+	feedETag         string
+	feedLastModified string
+	feedTombstones   []feedTombstone
+
+	// feedVariants is the cache of the `feedVariant`s of the posts by
+	// their numbers of entries.
+	feedVariants *sync.Map
+}
+
+var (
+	// postsReloadMutex keeps the parses of the posts from overlapping.
+	postsReloadMutex sync.Mutex
+
+	// postsSnapshotValue is the `postsSnapshot` swapped in last.
+	postsSnapshotValue atomic.Value
+
+	// postsReloads is the pending request for a reload of the posts by
+	// the `runPostsReloader`.
+	postsReloads = make(chan struct{}, 1)
+)
+
+// loadedPosts returns the `postsSnapshot` of the posts, parsing them first if
+// they never have been. A request should load it once and read only that.
+func loadedPosts() *postsSnapshot {
+	postsOnce.Do(parsePosts)
+	return lastPostsSnapshot()
+}
+
+// lastPostsSnapshot returns the `postsSnapshot` swapped in last, or an empty
+// one if there is none yet.
+func lastPostsSnapshot() *postsSnapshot {
+	if s, ok := postsSnapshotValue.Load().(*postsSnapshot); ok {
+		return s
+	}
+
+	return &postsSnapshot{feedVariants: &sync.Map{}}
+}
+
+// reloadPosts parses the posts again right away. Unlike the `postsOnce`, it
+// doesn't hold up the requests meanwhile, which keep being served the previous
+// posts until the `parsePosts` swaps in the new ones.
+func reloadPosts() {
+	parsePosts()
+	if err := lastPostsSnapshot().err; err != nil {
+		fireWebhooks(webhookReloadFailed, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// reloadUnwatchedPosts reparses the posts after they were changed in the
+// `store`. Only the post files are watched, so this is only done for the other
+// stores.
+func reloadUnwatchedPosts() {
+	if _, ok := store.(fsPostStore); !ok {
+		reloadPosts()
+	}
+}
+
+// requestPostsReload asks the `runPostsReloader` to reload the posts in the
+// background. The requests made while one is pending are merged into it.
+func requestPostsReload() {
+	select {
+	case postsReloads <- struct{}{}:
+	default:
+	}
+}
+
+// runPostsReloader reloads the posts whenever the `requestPostsReload` asks.
+func runPostsReloader() {
+	generation := heartbeatGeneration("posts_reloader")
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-postsReloads:
+			reloadPosts()
+		}
+
+		if !beat("posts_reloader", generation) {
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+	"golang.org/x/net/html"
+)
+
+// renderOptions is the options for rendering Markdown into HTML. It can be set
+// globally in the configuration file and overridden per post in the front
+// matter. The nil or empty fields are left to the defaults.
+type renderOptions struct {
+	HardLineBreaks   *bool  `toml:"hard_line_breaks"`
+	UnsafeHTML       *bool  `toml:"unsafe_html"`
+	FootnoteStyle    string `toml:"footnote_style"`
+	HeadingIDPrefix  string `toml:"heading_id_prefix"`
+	DefinitionLists  *bool  `toml:"definition_lists"`
+	TaskLists        *bool  `toml:"task_lists"`
+	SmartPunctuation *bool  `toml:"smart_punctuation"`
+
+	ExternalLinksNewTab *bool `toml:"external_links_new_tab"`
+	LazyImages          *bool `toml:"lazy_images"`
+	HeadingAnchors      *bool `toml:"heading_anchors"`
+}
+
+// merge returns a copy of the ro with the fields set in the o overriding.
+func (ro renderOptions) merge(o renderOptions) renderOptions {
+	if o.HardLineBreaks != nil {
+		ro.HardLineBreaks = o.HardLineBreaks
+	}
+
+	if o.UnsafeHTML != nil {
+		ro.UnsafeHTML = o.UnsafeHTML
+	}
+
+	if o.FootnoteStyle != "" {
+		ro.FootnoteStyle = o.FootnoteStyle
+	}
+
+	if o.HeadingIDPrefix != "" {
+		ro.HeadingIDPrefix = o.HeadingIDPrefix
+	}
+
+	if o.DefinitionLists != nil {
+		ro.DefinitionLists = o.DefinitionLists
+	}
+
+	if o.TaskLists != nil {
+		ro.TaskLists = o.TaskLists
+	}
+
+	if o.SmartPunctuation != nil {
+		ro.SmartPunctuation = o.SmartPunctuation
+	}
+
+	if o.ExternalLinksNewTab != nil {
+		ro.ExternalLinksNewTab = o.ExternalLinksNewTab
+	}
+
+	if o.LazyImages != nil {
+		ro.LazyImages = o.LazyImages
+	}
+
+	if o.HeadingAnchors != nil {
+		ro.HeadingAnchors = o.HeadingAnchors
+	}
+
+	return ro
+}
+
+// renderMarkdown renders the Markdown b into HTML with the ro. The HTML goes
+// through the `sanitizer`, after which the `shortcodes` are expanded, so they
+// work even if the unsafe HTML is off.
+//
+// The footnote style is one of "none" (the default, footnotes are not
+// recognized), "plain" and "return-links". The definition lists and the smart
+// punctuation are on unless turned off, and the task lists are off unless
+// turned on.
+func renderMarkdown(b []byte, ro renderOptions) []byte {
+	extensions := blackfriday.CommonExtensions
+	flags := blackfriday.CommonHTMLFlags
+
+	if ro.HardLineBreaks != nil && *ro.HardLineBreaks {
+		extensions |= blackfriday.HardLineBreak
+	}
+
+	if ro.UnsafeHTML != nil && !*ro.UnsafeHTML {
+		flags |= blackfriday.SkipHTML
+	}
+
+	switch ro.FootnoteStyle {
+	case "plain":
+		extensions |= blackfriday.Footnotes
+	case "return-links":
+		extensions |= blackfriday.Footnotes
+		flags |= blackfriday.FootnoteReturnLinks
+	}
+
+	if ro.DefinitionLists != nil && !*ro.DefinitionLists {
+		extensions &^= blackfriday.DefinitionLists
+	}
+
+	if ro.SmartPunctuation != nil && !*ro.SmartPunctuation {
+		flags &^= blackfriday.Smartypants |
+			blackfriday.SmartypantsFractions |
+			blackfriday.SmartypantsDashes |
+			blackfriday.SmartypantsLatexDashes
+	}
+
+	b, htmls := extractShortcodes(b)
+
+	h := sanitizeHTML(blackfriday.Run(
+		b,
+		blackfriday.WithExtensions(extensions),
+		blackfriday.WithRenderer(blackfriday.NewHTMLRenderer(
+			blackfriday.HTMLRendererParameters{
+				Flags:           flags,
+				HeadingIDPrefix: ro.HeadingIDPrefix,
+			},
+		)),
+	))
+	if ro.TaskLists != nil && *ro.TaskLists {
+		h = renderTaskLists(h)
+	}
+
+	return expandShortcodes(h, htmls)
+}
+
+// taskListItemRE matches the start of a list item of a task list, which begins
+// with a "[ ]" or a "[x]".
+var taskListItemRE = regexp.MustCompile(`<li>(<p>)?\[([ xX])\]\s`)
+
+// renderTaskLists turns the "[ ]" and the "[x]" at the start of the list items
+// of the HTML h into checkboxes. It comes after the `sanitizer`, which would
+// strip the checkboxes.
+func renderTaskLists(h []byte) []byte {
+	return taskListItemRE.ReplaceAllFunc(h, func(m []byte) []byte {
+		sm := taskListItemRE.FindSubmatch(m)
+		checked := ""
+		if sm[2][0] != ' ' {
+			checked = " checked"
+		}
+
+		return []byte(fmt.Sprintf(
+			`<li class="task-list-item">%s`+
+				`<input type="checkbox" disabled%s> `,
+			sm[1],
+			checked,
+		))
+	})
+}
+
+// headingTags is the tags of the headings.
+var headingTags = map[string]bool{
+	"h1": true,
+	"h2": true,
+	"h3": true,
+	"h4": true,
+	"h5": true,
+	"h6": true,
+}
+
+// postProcessHTML rewrites the HTML h rendered from the Markdown as the ro
+// asks: the external links are opened in new tabs without leaking the
+// referrer, the images are loaded lazily and decoded asynchronously, and the
+// headings with IDs get the anchor links to themselves.
+func postProcessHTML(h []byte, ro renderOptions) []byte {
+	newTab := ro.ExternalLinksNewTab != nil && *ro.ExternalLinksNewTab
+	lazy := ro.LazyImages != nil && *ro.LazyImages
+	anchors := ro.HeadingAnchors != nil && *ro.HeadingAnchors
+	if !newTab && !lazy && !anchors {
+		return h
+	}
+
+	buf := bytes.Buffer{}
+	heading, headingID := "", ""
+	z := html.NewTokenizer(bytes.NewReader(h))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		// The `z.Token` may change what the `z.Raw` returns.
+		raw := append([]byte(nil), z.Raw()...)
+		t := z.Token()
+		switch {
+		case tt == html.StartTagToken && t.Data == "a" && newTab &&
+			isExternalURL(attr(t, "href")):
+			setTokenAttr(&t, "target", "_blank")
+			setTokenAttr(&t, "rel", "noopener noreferrer")
+			buf.WriteString(t.String())
+		case (tt == html.StartTagToken ||
+			tt == html.SelfClosingTagToken) &&
+			t.Data == "img" && lazy:
+			setTokenAttr(&t, "loading", "lazy")
+			setTokenAttr(&t, "decoding", "async")
+			buf.WriteString(t.String())
+		case tt == html.StartTagToken && headingTags[t.Data] && anchors:
+			heading, headingID = t.Data, attr(t, "id")
+			buf.Write(raw)
+		case tt == html.EndTagToken && t.Data == heading:
+			if headingID != "" {
+				fmt.Fprintf(
+					&buf,
+					` <a class="anchor" href="#%s" `+
+						`aria-hidden="true" `+
+						`tabindex="-1">#</a>`,
+					html.EscapeString(headingID),
+				)
+			}
+
+			heading, headingID = "", ""
+			buf.Write(raw)
+		default:
+			buf.Write(raw)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// isExternalURL reports whether the rawURL leads to another host than the
+// `canonicalURL`.
+func isExternalURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	return u.Scheme != "mailto" &&
+		!strings.EqualFold(u.Hostname(), canonicalURL.Hostname())
+}
+
+// setTokenAttr sets the attribute of the key of the t to the val, unless it
+// is already set.
+func setTokenAttr(t *html.Token, key, val string) {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return
+		}
+	}
+
+	t.Attr = append(t.Attr, html.Attribute{Key: key, Val: val})
+}
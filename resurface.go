@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+var (
+	randomPostMutex sync.Mutex
+	randomPostRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// postsOnThisDay returns the ops that were published on the same day of the
+// year as the now in the previous years, from the newest.
+func postsOnThisDay(ops []post, now time.Time) []post {
+	ps := []post{}
+	for _, p := range ops {
+		if p.Datetime.Month() == now.Month() &&
+			p.Datetime.Day() == now.Day() &&
+			p.Datetime.Year() < now.Year() {
+			ps = append(ps, p)
+		}
+	}
+
+	return ps
+}
+
+func randomHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	ops := snap.orderedPosts
+	if len(ops) == 0 {
+		return air.NotFoundHandler(req, res)
+	}
+
+	randomPostMutex.Lock()
+	p := ops[randomPostRand.Intn(len(ops))]
+	randomPostMutex.Unlock()
+
+	res.Status = 302
+	res.SetHeader("cache-control", "no-store")
+
+	return res.Redirect(sitePath(p.Permalink))
+}
+
+func todayHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	now := time.Now()
+	ps := postsOnThisDay(snap.orderedPosts, now)
+
+	// The page changes with the day, not only with the content, so it is
+	// neither put into the page cache nor kept by the others for long.
+	res.SetHeader("cache-control", "public, max-age=3600")
+
+	req.Values["PageTitle"] = req.LocalizedString("On this day")
+	req.Values["CanonicalPath"] = "/today"
+	req.Values["NoIndex"] = true
+	req.Values["Posts"] = ps
+	req.Values["Summaries"] = translatedSummaries(ps, requestLocale(req))
+	return res.Render(req.Values, "today.html", "layouts/default.html")
+}
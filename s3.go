@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// s3MaxObjectBytes is the maximum size of an object read from the bucket.
+const s3MaxObjectBytes = 32 << 20
+
+// s3Client is a minimal client of an S3-compatible object storage, using the
+// path-style URLs and the signature version 4.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Object is an object listed in a bucket.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// s3Escape returns the s escaped the way the signature version 4 wants it,
+// leaving the slashes alone if the slash is true.
+func s3Escape(s string, slash bool) string {
+	buf := bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' ||
+			'0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' ||
+			c == '/' && slash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// do sends a signed request of the method for the object of the key (or the
+// bucket itself if the key is empty) with the query and the body.
+func (c *s3Client) do(
+	method string,
+	key string,
+	query url.Values,
+	body []byte,
+) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	canonicalURI := "/" + s3Escape(c.bucket, false) + "/" +
+		s3Escape(key, true)
+
+	qks := make([]string, 0, len(query))
+	for k := range query {
+		qks = append(qks, k)
+	}
+
+	sort.Strings(qks)
+
+	qps := make([]string, 0, len(qks))
+	for _, k := range qks {
+		qps = append(
+			qps,
+			s3Escape(k, false)+"="+s3Escape(query.Get(k), false),
+		)
+	}
+
+	canonicalQuery := strings.Join(qps, "&")
+
+	rawURL := u.Scheme + "://" + u.Host + canonicalURI
+	if canonicalQuery != "" {
+		rawURL += "?" + canonicalQuery
+	}
+
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHex)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQuery,
+		"host:" + u.Host,
+		"x-amz-content-sha256:" + payloadHex,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(crHash[:])
+
+	sk := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	sk = hmacSHA256(sk, c.region)
+	sk = hmacSHA256(sk, "s3")
+	sk = hmacSHA256(sk, "aws4_request")
+
+	req.Header.Set("authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, "+
+			"Signature=%s",
+		c.accessKey,
+		scope,
+		signedHeaders,
+		hex.EncodeToString(hmacSHA256(sk, stringToSign)),
+	))
+
+	return c.client.Do(req)
+}
+
+// list returns all the objects under the prefix.
+func (c *s3Client) list(prefix string) ([]s3Object, error) {
+	objs := []s3Object{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		res, err := c.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		r := struct {
+			Contents    []s3Object `xml:"Contents"`
+			IsTruncated bool       `xml:"IsTruncated"`
+			NextToken   string     `xml:"NextContinuationToken"`
+		}{}
+		err = xml.NewDecoder(res.Body).Decode(&r)
+		res.Body.Close()
+		if status := res.StatusCode; status != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", status)
+		} else if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, r.Contents...)
+		if !r.IsTruncated || r.NextToken == "" {
+			return objs, nil
+		}
+
+		token = r.NextToken
+	}
+}
+
+// get returns the content of the object of the key. It returns the
+// `os.ErrNotExist` if there is no such object.
+func (c *s3Client) get(key string) ([]byte, error) {
+	res, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, s3MaxObjectBytes))
+}
+
+// put stores the b as the object of the key.
+func (c *s3Client) put(key string, b []byte) error {
+	res, err := c.do("PUT", key, nil, b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// remove deletes the object of the key.
+func (c *s3Client) remove(key string) error {
+	res, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent &&
+		res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// s3Store is a `postStore` of an S3-compatible bucket. The posts (and the
+// assets) are synced from the bucket into the memory and the assets of the
+// default theme by the `sync`, so that the blog needs no persistent disk. The
+// comments and the view counts are read from and written to the bucket
+// directly.
+type s3Store struct {
+	c *s3Client
+
+	mutex  sync.Mutex
+	posts  map[string]storedPost
+	etags  map[string]string
+	synced time.Time
+}
+
+// newS3Client returns a new `s3Client` of the configured bucket.
+func newS3Client() (*s3Client, error) {
+	if config.S3Endpoint == "" || config.S3Bucket == "" {
+		return nil, errors.New("missing s3 endpoint or bucket")
+	}
+
+	return &s3Client{
+		endpoint:  config.S3Endpoint,
+		region:    config.S3Region,
+		bucket:    config.S3Bucket,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// newS3Store returns a new `s3Store` from the configuration.
+func newS3Store() (*s3Store, error) {
+	c, err := newS3Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Store{
+		c:     c,
+		posts: map[string]storedPost{},
+		etags: map[string]string{},
+	}, nil
+}
+
+// s3Key returns the key of the p under the `config.S3Prefix`.
+func s3Key(p string) string {
+	return path.Join(config.S3Prefix, p)
+}
+
+// sync brings the posts and the assets up to date with the bucket, fetching
+// only the objects that have changed. It reports whether anything has.
+func (s *s3Store) sync() (bool, error) {
+	postsPrefix := s3Key("posts") + "/"
+	pobjs, err := s.c.list(postsPrefix)
+	if err != nil {
+		return false, err
+	}
+
+	assetsPrefix := s3Key("assets") + "/"
+	aobjs, err := s.c.list(assetsPrefix)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	etags := make(map[string]string, len(s.etags))
+	for k, v := range s.etags {
+		etags[k] = v
+	}
+	s.mutex.Unlock()
+
+	changed := false
+	nposts := map[string]storedPost{}
+	netags := map[string]string{}
+	for _, obj := range pobjs {
+		name := strings.TrimPrefix(obj.Key, postsPrefix)
+		if !strings.HasSuffix(
+			strings.TrimSuffix(name, encryptedPostExt),
+			".md",
+		) {
+			continue
+		}
+
+		id := strings.TrimSuffix(name, encryptedPostExt)
+		id = strings.TrimSuffix(id, ".md")
+
+		netags[obj.Key] = obj.ETag
+		s.mutex.Lock()
+		sp, ok := s.posts[id]
+		s.mutex.Unlock()
+		if ok && etags[obj.Key] == obj.ETag {
+			nposts[id] = sp
+			continue
+		}
+
+		changed = true
+		sp = storedPost{
+			ID:      id,
+			File:    "s3:" + obj.Key,
+			ModTime: obj.LastModified,
+		}
+		if sp.Source, sp.Err = s.c.get(obj.Key); sp.Err == nil &&
+			strings.HasSuffix(name, encryptedPostExt) {
+			sp.Source, sp.Err = decryptPost(sp.Source)
+		}
+
+		nposts[id] = sp
+	}
+
+	s.mutex.Lock()
+	changed = changed || len(nposts) != len(s.posts)
+	s.mutex.Unlock()
+
+	for _, obj := range aobjs {
+		netags[obj.Key] = obj.ETag
+		if etags[obj.Key] == obj.ETag {
+			continue
+		}
+
+		b, err := s.c.get(obj.Key)
+		if err != nil {
+			return false, err
+		}
+
+		filename := filepath.Join(
+			defaultAssetRoot,
+			filepath.FromSlash(strings.TrimPrefix(
+				obj.Key,
+				assetsPrefix,
+			)),
+		)
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			return false, err
+		}
+
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	s.mutex.Lock()
+	s.posts = nposts
+	s.etags = netags
+	s.synced = time.Now()
+	s.mutex.Unlock()
+
+	return changed, nil
+}
+
+// syncAndReload syncs the s and reparses the posts if anything has changed.
+func (s *s3Store) syncAndReload() error {
+	changed, err := s.sync()
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		if err := buildTheme(); err != nil {
+			return err
+		}
+
+		hashAssets()
+		reloadPosts()
+	}
+
+	return nil
+}
+
+// Posts implements the `postStore`.
+func (s *s3Store) Posts() ([]storedPost, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sps := make([]storedPost, 0, len(s.posts))
+	for _, sp := range s.posts {
+		sps = append(sps, sp)
+	}
+
+	return sps, nil
+}
+
+// PublishPost implements the `postStore`.
+func (s *s3Store) PublishPost(id string, source []byte) error {
+	s.mutex.Lock()
+	_, ok := s.posts[id]
+	s.mutex.Unlock()
+	if ok {
+		return errors.New("post already exists")
+	}
+
+	if err := s.c.put(s3Key("posts/"+id+".md"), source); err != nil {
+		return err
+	}
+
+	_, err := s.sync()
+
+	return err
+}
+
+// UpdatePost implements the `postStore`.
+func (s *s3Store) UpdatePost(id string, source []byte) error {
+	s.mutex.Lock()
+	sp, ok := s.posts[id]
+	s.mutex.Unlock()
+	if !ok {
+		return errors.New("post not found")
+	}
+
+	key := strings.TrimPrefix(sp.File, "s3:")
+	if strings.HasSuffix(key, encryptedPostExt) {
+		var err error
+		if source, err = encryptPost(source); err != nil {
+			return err
+		}
+	}
+
+	if err := s.c.put(key, source); err != nil {
+		return err
+	}
+
+	_, err := s.sync()
+
+	return err
+}
+
+// commentsKey returns the key of the comments of the post of the postID.
+func (s *s3Store) commentsKey(postID string) string {
+	return s3Key("data/comments/" + url.PathEscape(postID) + ".json")
+}
+
+// Comments implements the `postStore`.
+func (s *s3Store) Comments(postID string) ([]comment, error) {
+	b, err := s.c.get(s.commentsKey(postID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cs := []comment{}
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// AllComments implements the `postStore`.
+func (s *s3Store) AllComments() ([]comment, error) {
+	prefix := s3Key("data/comments") + "/"
+	objs, err := s.c.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	acs := []comment{}
+	for _, obj := range objs {
+		postID, err := url.PathUnescape(strings.TrimSuffix(
+			strings.TrimPrefix(obj.Key, prefix),
+			".json",
+		))
+		if err != nil {
+			continue
+		}
+
+		cs, err := s.Comments(postID)
+		if err != nil {
+			return nil, err
+		}
+
+		acs = append(acs, cs...)
+	}
+
+	sort.Slice(acs, func(i, j int) bool {
+		return acs[i].CreatedAt.Before(acs[j].CreatedAt)
+	})
+
+	return acs, nil
+}
+
+// SaveComments implements the `postStore`.
+func (s *s3Store) SaveComments(postID string, cs []comment) error {
+	if len(cs) == 0 {
+		return s.c.remove(s.commentsKey(postID))
+	}
+
+	b, err := json.MarshalIndent(cs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return s.c.put(s.commentsKey(postID), b)
+}
+
+// Views implements the `postStore`.
+func (s *s3Store) Views() (viewStats, error) {
+	vs := viewStats{}
+	b, err := s.c.get(s3Key("data/views.json"))
+	if os.IsNotExist(err) {
+		return vs, nil
+	} else if err != nil {
+		return vs, err
+	}
+
+	err = json.Unmarshal(b, &vs)
+
+	return vs, err
+}
+
+// SaveViews implements the `postStore`.
+func (s *s3Store) SaveViews(vs viewStats) error {
+	b, err := json.MarshalIndent(vs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return s.c.put(s3Key("data/views.json"), b)
+}
+
+// Reactions implements the `postStore`.
+func (s *s3Store) Reactions() (reactionCounts, error) {
+	rc := reactionCounts{}
+	b, err := s.c.get(s3Key("data/reactions.json"))
+	if os.IsNotExist(err) {
+		return rc, nil
+	} else if err != nil {
+		return rc, err
+	}
+
+	err = json.Unmarshal(b, &rc)
+
+	return rc, err
+}
+
+// SaveReactions implements the `postStore`.
+func (s *s3Store) SaveReactions(rc reactionCounts) error {
+	b, err := json.MarshalIndent(rc, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return s.c.put(s3Key("data/reactions.json"), b)
+}
+
+// s3SyncHandler syncs the `store` with its bucket on demand, so that the
+// bucket notifications (or a CI job) can publish the changes right away. It
+// is authorized by the `config.S3SyncToken` in the "token" param.
+func s3SyncHandler(req *air.Request, res *air.Response) error {
+	s, ok := store.(*s3Store)
+	if !ok || config.S3SyncToken == "" && len(config.APITokens) == 0 {
+		return air.NotFoundHandler(req, res)
+	}
+
+	actor := ""
+	if p, ok, _ := authenticate(req); ok && p.Token &&
+		p.HasScope(scopeHooks) {
+		actor = p.Actor()
+	} else if config.S3SyncToken != "" && subtle.ConstantTimeCompare(
+		[]byte(paramValue(req, "token")),
+		[]byte(config.S3SyncToken),
+	) == 1 {
+		actor = "token:s3_sync_token"
+	} else {
+		audit(req, "", "hooks.denied", 403)
+		res.Status = 403
+		return errors.New("Forbidden")
+	}
+
+	if err := s.syncAndReload(); err != nil {
+		audit(req, actor, scopeHooks, 502)
+		res.Status = 502
+		return err
+	}
+
+	audit(req, actor, scopeHooks, 200)
+
+	return res.WriteString("ok")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// sanitizer is the policy that the HTML rendered from the Markdown goes
+// through, or nil if it is trusted as is.
+var sanitizer *bluemonday.Policy
+
+// setupSanitizer builds the `sanitizer` of the `config.SanitizePolicy`, which
+// is one of:
+//
+//   - "none" (the default): the HTML is trusted as is.
+//   - "ugc": the formatting, the links, the images, the tables and the code
+//     only, with the classes that the Markdown gives them.
+//   - "strict": no HTML at all, only its text.
+//
+// The `config.SanitizeAllowedAttrs` allows more attributes (by the elements
+// they are on) under the "ugc".
+func setupSanitizer() error {
+	switch config.SanitizePolicy {
+	case "", "none":
+		sanitizer = nil
+		return nil
+	case "strict":
+		sanitizer = bluemonday.StrictPolicy()
+		return nil
+	case "ugc":
+	default:
+		return fmt.Errorf(
+			"unknown sanitize policy %q",
+			config.SanitizePolicy,
+		)
+	}
+
+	p := bluemonday.UGCPolicy()
+
+	// The posts are written by the authors of the blog, whose links are
+	// vouched for.
+	p.RequireNoFollowOnLinks(false)
+
+	// The classes of the highlighted code and the footnotes.
+	p.AllowAttrs("class").Matching(
+		regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`),
+	).OnElements("code", "div", "sup", "li", "a")
+
+	for element, attrs := range config.SanitizeAllowedAttrs {
+		p.AllowAttrs(attrs...).OnElements(element)
+	}
+
+	sanitizer = p
+
+	return nil
+}
+
+// sanitizeHTML returns the HTML h through the `sanitizer`.
+func sanitizeHTML(h []byte) []byte {
+	if sanitizer == nil {
+		return h
+	}
+
+	return sanitizer.SanitizeBytes(h)
+}
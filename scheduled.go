@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// nextScheduledPost is when the next of the posts dated in the future is due,
+// or the zero time if there is none. Those posts are held back until then.
+var nextScheduledPost atomic.Value
+
+// holdScheduledPost reports whether the p is dated after the now, and so is
+// to be held back, noting its time in the next.
+func holdScheduledPost(p post, now time.Time, next *time.Time) bool {
+	if !p.Datetime.After(now) {
+		return false
+	}
+
+	if next.IsZero() || p.Datetime.Before(*next) {
+		*next = p.Datetime
+	}
+
+	return true
+}
+
+// promoteScheduledPosts reloads the posts once the `nextScheduledPost` is due,
+// which publishes it and whatever else is due by then.
+func promoteScheduledPosts() error {
+	t, _ := nextScheduledPost.Load().(time.Time)
+	if t.IsZero() || time.Now().Before(t) {
+		return nil
+	}
+
+	reloadPosts()
+
+	return lastPostsSnapshot().err
+}
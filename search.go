@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// searchMaxSuggestions is the maximum number of the search suggestions.
+const searchMaxSuggestions = 10
+
+// searchSnippetRunes is the number of the runes of a search result snippet.
+const searchSnippetRunes = 160
+
+// openSearchMediaType is the media type of the OpenSearch descriptions.
+const openSearchMediaType = "application/opensearchdescription+xml"
+
+// searchFields is the fields of the posts that are searched, each with its
+// default boost.
+var searchFields = map[string]float64{
+	"title":    5,
+	"headings": 3,
+	"code":     1,
+	"body":     1,
+}
+
+// searchDoc is a post prepared for the search.
+type searchDoc struct {
+	ID     string
+	Text   string
+	Tags   map[string]bool
+	fields map[string]map[string]int
+}
+
+// searchResult is a post matching a search.
+type searchResult struct {
+	Post    post
+	Score   float64
+	Snippet string
+}
+
+// searchQuery is a parsed search query.
+type searchQuery struct {
+	Terms  []string
+	Tags   []string
+	Before time.Time
+	After  time.Time
+}
+
+// searchTerms returns the lowercased terms of the s. Han characters are terms
+// on their own, since there are no spaces between the words.
+func searchTerms(s string) []string {
+	terms := []string{}
+	term := []rune{}
+	flush := func() {
+		if len(term) > 0 {
+			terms = append(terms, string(term))
+			term = term[:0]
+		}
+	}
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			terms = append(terms, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			term = append(term, r)
+		default:
+			flush()
+		}
+	}
+
+	flush()
+
+	return terms
+}
+
+// countTerms returns the number of the occurrences of each term of the s.
+func countTerms(s string) map[string]int {
+	tc := map[string]int{}
+	for _, t := range searchTerms(s) {
+		tc[t]++
+	}
+
+	return tc
+}
+
+// searchFieldTexts returns the texts of the headings, the code and the rest
+// of the content.
+func searchFieldTexts(content string) (string, string, string) {
+	headings := bytes.Buffer{}
+	code := bytes.Buffer{}
+	body := bytes.Buffer{}
+	inHeading, inCode := 0, 0
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		delta := 0
+		switch tt {
+		case html.StartTagToken:
+			delta = 1
+		case html.EndTagToken:
+			delta = -1
+		case html.TextToken:
+			switch {
+			case inCode > 0:
+				code.WriteString(t.Data + " ")
+			case inHeading > 0:
+				headings.WriteString(t.Data + " ")
+			default:
+				body.WriteString(t.Data + " ")
+			}
+		}
+
+		switch t.Data {
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			inHeading += delta
+		case "code", "pre":
+			inCode += delta
+		}
+	}
+
+	return headings.String(), code.String(), body.String()
+}
+
+// buildSearchDocs returns the search index of the ops.
+func buildSearchDocs(ops []post) []searchDoc {
+	sds := make([]searchDoc, 0, len(ops))
+	for _, p := range ops {
+		headings, code, body := searchFieldTexts(string(p.Content))
+		tags := map[string]bool{}
+		for _, t := range p.Tags {
+			tags[strings.ToLower(t)] = true
+		}
+
+		sds = append(sds, searchDoc{
+			ID:   p.ID,
+			Text: htmlToText(string(p.Content)),
+			Tags: tags,
+			fields: map[string]map[string]int{
+				"title":    countTerms(p.Title),
+				"headings": countTerms(headings),
+				"code":     countTerms(code),
+				"body":     countTerms(body),
+			},
+		})
+	}
+
+	return sds
+}
+
+// parseSearchDate parses the s as a year, a month or a day, and returns the
+// start of the period and the start of the next one.
+func parseSearchDate(s string) (time.Time, time.Time, bool) {
+	for _, f := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		if t, err := time.Parse(f.layout, s); err == nil {
+			return t, t.AddDate(f.years, f.months, f.days), true
+		}
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+// parseSearchQuery parses the q. Besides the terms, the q may have the filters
+// "tag:NAME", "before:DATE" and "after:DATE", where a DATE is a year, a month
+// ("2006-01") or a day ("2006-01-02").
+func parseSearchQuery(q string) searchQuery {
+	sq := searchQuery{}
+	for _, f := range strings.Fields(q) {
+		i := strings.IndexByte(f, ':')
+		if i < 0 {
+			sq.Terms = append(sq.Terms, searchTerms(f)...)
+			continue
+		}
+
+		k, v := strings.ToLower(f[:i]), f[i+1:]
+		switch k {
+		case "tag":
+			sq.Tags = append(sq.Tags, strings.ToLower(v))
+			continue
+		case "before":
+			if start, _, ok := parseSearchDate(v); ok {
+				sq.Before = start
+				continue
+			}
+		case "after":
+			if _, end, ok := parseSearchDate(v); ok {
+				sq.After = end
+				continue
+			}
+		}
+
+		sq.Terms = append(sq.Terms, searchTerms(f)...)
+	}
+
+	return sq
+}
+
+// searchBoost returns the boost of the field, as configured in the
+// `config.SearchBoosts` or by default.
+func searchBoost(field string) float64 {
+	if b, ok := config.SearchBoosts[field]; ok {
+		return b
+	}
+
+	return searchFields[field]
+}
+
+// searchPosts returns the posts of the snap matching all the terms and the
+// filters of the q, best first. A query of filters only matches the newest
+// posts first.
+func searchPosts(snap *postsSnapshot, q string) []searchResult {
+	sq := parseSearchQuery(q)
+	if len(sq.Terms) == 0 && len(sq.Tags) == 0 &&
+		sq.Before.IsZero() && sq.After.IsZero() {
+		return nil
+	}
+
+	srs := []searchResult{}
+	for _, sd := range snap.searchDocs {
+		p, ok := snap.posts[sd.ID]
+		if !ok ||
+			!sq.Before.IsZero() && !p.Datetime.Before(sq.Before) ||
+			!sq.After.IsZero() && p.Datetime.Before(sq.After) {
+			continue
+		}
+
+		matched := true
+		for _, t := range sq.Tags {
+			matched = matched && sd.Tags[t]
+		}
+
+		score := 0.0
+		for _, t := range sq.Terms {
+			s := 0.0
+			for field, tc := range sd.fields {
+				s += searchBoost(field) * float64(tc[t])
+			}
+
+			matched = matched && s > 0
+			score += s
+		}
+
+		if !matched {
+			continue
+		}
+
+		snippet := searchSnippet(sd.Text, "")
+		if len(sq.Terms) > 0 {
+			snippet = searchSnippet(sd.Text, sq.Terms[0])
+		}
+
+		srs = append(srs, searchResult{
+			Post:    p,
+			Score:   score,
+			Snippet: snippet,
+		})
+	}
+
+	sort.SliceStable(srs, func(i, j int) bool {
+		return srs[i].Score > srs[j].Score
+	})
+
+	return srs
+}
+
+// searchSnippet returns the part of the text around the first occurrence of
+// the term.
+func searchSnippet(text, term string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	i := strings.Index(strings.ToLower(text), term)
+	if i < 0 || i > len(text) {
+		i = 0
+	}
+
+	start := utf8.RuneCountInString(text[:i]) - searchSnippetRunes/4
+	if start < 0 {
+		start = 0
+	}
+
+	rs := []rune(text)
+	end := start + searchSnippetRunes
+	if end > len(rs) {
+		end = len(rs)
+	}
+
+	snippet := string(rs[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+
+	if end < len(rs) {
+		snippet += "…"
+	}
+
+	return snippet
+}
+
+func searchHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	q := strings.TrimSpace(paramValue(req, "q"))
+
+	req.Values["PageTitle"] = req.LocalizedString("Search")
+	req.Values["CanonicalPath"] = "/search"
+	req.Values["Query"] = q
+	if q != "" {
+		req.Values["Results"] = searchPosts(snap, q)
+	}
+
+	return res.Render(req.Values, "search.html", "layouts/default.html")
+}
+
+// searchSuggestHandler answers the search suggestions in the OpenSearch
+// suggestions format.
+func searchSuggestHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	q := strings.TrimSpace(paramValue(req, "q"))
+	suggestions := []string{}
+	if q != "" {
+		lq := strings.ToLower(q)
+		for _, p := range snap.orderedPosts {
+			if strings.Contains(strings.ToLower(p.Title), lq) {
+				suggestions = append(suggestions, p.Title)
+			}
+
+			if len(suggestions) == searchMaxSuggestions {
+				break
+			}
+		}
+	}
+
+	res.SetHeader("content-type", "application/x-suggestions+json")
+	res.SetHeader("cache-control", "max-age=300")
+
+	return res.WriteJSON([]interface{}{q, suggestions})
+}
+
+// openSearchDescription is an OpenSearch description document.
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"OpenSearchDescription"`
+	XMLNS         string          `xml:"xmlns,attr"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+// openSearchURL is a URL template of an `openSearchDescription`.
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+// openSearchHandler serves the OpenSearch description of the blog, so that
+// browsers can add it as a search engine.
+func openSearchHandler(req *air.Request, res *air.Response) error {
+	b, err := xml.MarshalIndent(openSearchDescription{
+		XMLNS:         "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:     config.Title,
+		Description:   req.LocalizedString("Jon Snow's blog."),
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{
+			{
+				Type: "text/html",
+				Template: config.BaseURL +
+					"/search?q={searchTerms}",
+			},
+			{
+				Type: "application/x-suggestions+json",
+				Template: config.BaseURL +
+					"/search/suggest?q={searchTerms}",
+			},
+			{
+				Type:     openSearchMediaType,
+				Rel:      "self",
+				Template: config.BaseURL + "/opensearch.xml",
+			},
+		},
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", openSearchMediaType+"; charset=utf-8")
+	res.SetHeader("cache-control", "max-age=86400")
+
+	return res.WriteBlob(append([]byte(xml.Header), b...))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+)
+
+const (
+	// seoMaxTitleLength is the most characters of a title that the search
+	// engines are known to show.
+	seoMaxTitleLength = 60
+
+	// seoMaxDescriptionLength is the most characters of a description that
+	// the search engines are known to show.
+	seoMaxDescriptionLength = 160
+)
+
+// seoIssue is a problem of a post that may hurt how it shows up in the search
+// engines.
+type seoIssue struct {
+	PostID    string
+	PostTitle string
+	Problem   string
+}
+
+// MetaDescription returns the description of the p for its meta tags. Unless
+// set in the p's front matter, it is the summary of the p, which is left out
+// for the posts whose content is not given out.
+func (p post) MetaDescription() string {
+	if p.Description != "" {
+		return p.Description
+	} else if p.Protected() || p.MembersOnly {
+		return ""
+	}
+
+	return postSummary(p)
+}
+
+// MetaKeywords returns the keywords of the p for its meta tags. Unless set in
+// the p's front matter, they are the tags of the p.
+func (p post) MetaKeywords() string {
+	if len(p.Keywords) > 0 {
+		return strings.Join(p.Keywords, ", ")
+	}
+
+	return strings.Join(p.Tags, ", ")
+}
+
+// auditSEO returns the `seoIssue`s of the ps, ordered by the IDs of the posts.
+func auditSEO(ps []post) []seoIssue {
+	sis := []seoIssue{}
+	slugs := map[string][]string{}
+	titles := map[string][]string{}
+	for _, p := range ps {
+		add := func(format string, args ...interface{}) {
+			sis = append(sis, seoIssue{
+				PostID:    p.ID,
+				PostTitle: p.Title,
+				Problem:   fmt.Sprintf(format, args...),
+			})
+		}
+
+		if p.Description == "" {
+			add("no description")
+		} else if n := utf8.RuneCountInString(
+			p.Description,
+		); n > seoMaxDescriptionLength {
+			add(
+				"description has %d characters (%d at most)",
+				n,
+				seoMaxDescriptionLength,
+			)
+		}
+
+		if n := utf8.RuneCountInString(p.Title); n > seoMaxTitleLength {
+			add(
+				"title has %d characters (%d at most)",
+				n,
+				seoMaxTitleLength,
+			)
+		}
+
+		slug := strings.ToLower(postSlug(p))
+		slugs[slug] = append(slugs[slug], p.ID)
+
+		title := strings.ToLower(strings.TrimSpace(p.Title))
+		titles[title] = append(titles[title], p.ID)
+	}
+
+	for _, p := range ps {
+		for _, id := range slugs[strings.ToLower(postSlug(p))] {
+			if id != p.ID {
+				sis = append(sis, seoIssue{
+					PostID:    p.ID,
+					PostTitle: p.Title,
+					Problem:   "same slug as " + id,
+				})
+			}
+		}
+
+		title := strings.ToLower(strings.TrimSpace(p.Title))
+		for _, id := range titles[title] {
+			if id != p.ID {
+				sis = append(sis, seoIssue{
+					PostID:    p.ID,
+					PostTitle: p.Title,
+					Problem:   "same title as " + id,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(sis, func(i, j int) bool {
+		return sis[i].PostID < sis[j].PostID
+	})
+
+	return sis
+}
+
+func adminSEOHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	req.Values["PageTitle"] = "SEO"
+	req.Values["SEOIssues"] = snap.seoIssues
+
+	return res.Render(req.Values, "admin/seo.html", "layouts/default.html")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/aofei/air"
+)
+
+// postSeries is where a post stands in its series, for the navigation between
+// the parts.
+type postSeries struct {
+	Name  string
+	Path  string
+	Part  int
+	Total int
+	Parts []post
+	Prev  *post
+	Next  *post
+}
+
+// seriesPath returns the path of the index page of the series of the name.
+func seriesPath(name string) string {
+	return "/series/" + url.PathEscape(name)
+}
+
+// buildSeries returns the posts of each series among the ops, ordered by their
+// `SeriesPart` and then by their `Datetime`.
+func buildSeries(ops []post) map[string][]post {
+	s := map[string][]post{}
+	for _, p := range ops {
+		if p.Series != "" {
+			s[p.Series] = append(s[p.Series], p)
+		}
+	}
+
+	for _, ps := range s {
+		sort.SliceStable(ps, func(i, j int) bool {
+			if ps[i].SeriesPart != ps[j].SeriesPart {
+				return ps[i].SeriesPart < ps[j].SeriesPart
+			}
+
+			return ps[i].Datetime.Before(ps[j].Datetime)
+		})
+	}
+
+	return s
+}
+
+// postSeriesOf returns where the p stands in its series of the snap, or nil if
+// the p is in none or is not listed in it.
+func postSeriesOf(snap *postsSnapshot, p post) *postSeries {
+	ps, ok := snap.series[p.Series]
+	if !ok {
+		return nil
+	}
+
+	s := &postSeries{
+		Name:  p.Series,
+		Path:  seriesPath(p.Series),
+		Total: len(ps),
+		Parts: ps,
+	}
+	for i := range ps {
+		if ps[i].ID != p.ID {
+			continue
+		}
+
+		s.Part = i + 1
+		if i > 0 {
+			s.Prev = &ps[i-1]
+		}
+
+		if i < len(ps)-1 {
+			s.Next = &ps[i+1]
+		}
+
+		return s
+	}
+
+	return nil
+}
+
+func seriesHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	name := paramValue(req, "Name")
+	ps, ok := snap.series[name]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	req.Values["PageTitle"] = name
+	req.Values["CanonicalPath"] = seriesPath(name)
+	req.Values["SeriesName"] = name
+	req.Values["Posts"] = ps
+	req.Values["Summaries"] = translatedSummaries(ps, requestLocale(req))
+	return res.Render(req.Values, "series.html", "layouts/default.html")
+}
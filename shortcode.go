@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// shortcode expands the args of a shortcode into HTML. The args are
+// untrusted, so anything taken from them must be escaped.
+type shortcode func(args []string) (htemplate.HTML, error)
+
+// shortcodes is the registry of the shortcodes by their names. Adding one is
+// all it takes to make it available to the posts.
+var shortcodes = map[string]shortcode{
+	"youtube": youtubeShortcode,
+	"gist":    gistShortcode,
+	"figure":  figureShortcode,
+	"tweet":   tweetShortcode,
+}
+
+// shortcodeMarker is the prefix of the markers the shortcodes are replaced
+// with while the Markdown is rendered.
+const shortcodeMarker = "BLOGSHORTCODE"
+
+var (
+	shortcodeRE = regexp.MustCompile(
+		`\{\{\s*([a-z][a-z0-9_-]*)(\s[^}]*)?\}\}`,
+	)
+	youtubeIDRE = regexp.MustCompile(`^[A-Za-z0-9_-]{6,64}$`)
+	gistUserRE  = regexp.MustCompile(`^[A-Za-z0-9-]{1,39}$`)
+	gistIDRE    = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+	tweetHosts  = map[string]bool{"twitter.com": true, "x.com": true}
+)
+
+// extractShortcodes replaces the shortcodes in the Markdown b, except those in
+// the code, with markers, and returns the HTML of each marker. The markers
+// are plain words, so they come through the Markdown intact, and the HTML is
+// put back by the `expandShortcodes`. A shortcode that is unknown or fails
+// is left as is.
+func extractShortcodes(b []byte) ([]byte, []htemplate.HTML) {
+	if !bytes.Contains(b, []byte("{{")) {
+		return b, nil
+	}
+
+	htmls := []htemplate.HTML{}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	fence := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(string(line))
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+
+			continue
+		} else if strings.HasPrefix(trimmed, "```") {
+			fence = "```"
+			continue
+		} else if strings.HasPrefix(trimmed, "~~~") {
+			fence = "~~~"
+			continue
+		} else if bytes.HasPrefix(line, []byte("    ")) ||
+			bytes.HasPrefix(line, []byte("\t")) {
+			continue
+		}
+
+		// The odd parts are inside the inline code.
+		parts := bytes.Split(line, []byte("`"))
+		for j := 0; j < len(parts); j += 2 {
+			parts[j] = shortcodeRE.ReplaceAllFunc(
+				parts[j],
+				func(m []byte) []byte {
+					h, err := runShortcode(m)
+					if err != nil {
+						return m
+					}
+
+					htmls = append(htmls, h)
+
+					return []byte(fmt.Sprintf(
+						"%s%dX",
+						shortcodeMarker,
+						len(htmls)-1,
+					))
+				},
+			)
+		}
+
+		lines[i] = bytes.Join(parts, []byte("`"))
+	}
+
+	return bytes.Join(lines, nil), htmls
+}
+
+// expandShortcodes replaces the markers in the HTML b with the htmls. A
+// marker that is a paragraph by itself takes the place of the paragraph.
+func expandShortcodes(b []byte, htmls []htemplate.HTML) []byte {
+	for i := len(htmls) - 1; i >= 0; i-- {
+		marker := []byte(fmt.Sprintf("%s%dX", shortcodeMarker, i))
+		h := []byte(htmls[i])
+		b = bytes.Replace(
+			b,
+			append(append([]byte("<p>"), marker...), "</p>"...),
+			h,
+			-1,
+		)
+		b = bytes.Replace(b, marker, h, -1)
+	}
+
+	return b
+}
+
+// runShortcode returns the HTML of the shortcode m.
+func runShortcode(m []byte) (htemplate.HTML, error) {
+	sm := shortcodeRE.FindSubmatch(m)
+	sc, ok := shortcodes[string(sm[1])]
+	if !ok {
+		return "", fmt.Errorf("unknown shortcode %q", sm[1])
+	}
+
+	return sc(shortcodeArgs(string(sm[2])))
+}
+
+// shortcodeArgs splits the s into the args of a shortcode, which are separated
+// by spaces unless double-quoted.
+func shortcodeArgs(s string) []string {
+	args := []string{}
+	arg, quoted, inArg := "", false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg)
+			}
+
+			arg, inArg = "", false
+		default:
+			arg += string(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, arg)
+	}
+
+	return args
+}
+
+// youtubeShortcode embeds the YouTube video of the ID in the args, from the
+// domain that sets no cookies until it is played.
+func youtubeShortcode(args []string) (htemplate.HTML, error) {
+	if len(args) != 1 || !youtubeIDRE.MatchString(args[0]) {
+		return "", errors.New("usage: youtube ID")
+	}
+
+	return htemplate.HTML(fmt.Sprintf(
+		`<div class="embed embed-youtube"><iframe `+
+			`src="https://www.youtube-nocookie.com/embed/%s" `+
+			`title="YouTube video" loading="lazy" `+
+			`allowfullscreen></iframe></div>`,
+		args[0],
+	)), nil
+}
+
+// gistShortcode embeds the GitHub Gist of the user and the ID in the args,
+// with a link to it for when the scripts are off.
+func gistShortcode(args []string) (htemplate.HTML, error) {
+	if len(args) != 2 || !gistUserRE.MatchString(args[0]) ||
+		!gistIDRE.MatchString(args[1]) {
+		return "", errors.New("usage: gist USER ID")
+	}
+
+	u := "https://gist.github.com/" + args[0] + "/" + args[1]
+
+	return htemplate.HTML(fmt.Sprintf(
+		`<div class="embed embed-gist"><script src="%s.js"></script>`+
+			`<noscript><a href="%s">%s</a></noscript></div>`,
+		u,
+		u,
+		u,
+	)), nil
+}
+
+// figureShortcode shows the image at the src in the args, with the optional
+// caption in the args as its caption and alternative text. An src under the
+// "/assets/" is fingerprinted.
+func figureShortcode(args []string) (htemplate.HTML, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errors.New(`usage: figure SRC ["CAPTION"]`)
+	}
+
+	src := args[0]
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" &&
+		u.Scheme != "https") {
+		return "", errors.New("bad figure src")
+	} else if strings.HasPrefix(src, "/assets/") {
+		src = assetURL(src)
+	}
+
+	caption := ""
+	if len(args) == 2 {
+		caption = args[1]
+	}
+
+	h := fmt.Sprintf(
+		`<figure><img src="%s" alt="%s" loading="lazy">`,
+		htemplate.HTMLEscapeString(src),
+		htemplate.HTMLEscapeString(caption),
+	)
+	if caption != "" {
+		h += "<figcaption>" + htemplate.HTMLEscapeString(caption) +
+			"</figcaption>"
+	}
+
+	return htemplate.HTML(h + "</figure>"), nil
+}
+
+// tweetShortcode quotes the tweet at the URL in the args as a link, which the
+// widgets of the Twitter may turn into an embed if a theme loads them. The
+// widgets are not loaded here, so that no reader is tracked by default.
+func tweetShortcode(args []string) (htemplate.HTML, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: tweet URL")
+	}
+
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme != "https" ||
+		!tweetHosts[strings.TrimPrefix(u.Host, "www.")] {
+		return "", errors.New("bad tweet url")
+	}
+
+	tu := htemplate.HTMLEscapeString(u.String())
+
+	return htemplate.HTML(fmt.Sprintf(
+		`<blockquote class="twitter-tweet"><a href="%s">%s</a>`+
+			`</blockquote>`,
+		tu,
+		tu,
+	)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/aofei/air"
+)
+
+// base62Digits is the digits of the short codes.
+const base62Digits = "0123456789" +
+	"abcdefghijklmnopqrstuvwxyz" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var shortCodesMutex sync.Mutex
+
+// base62 returns the n in base 62.
+func base62(n int) string {
+	if n == 0 {
+		return base62Digits[:1]
+	}
+
+	b := []byte{}
+	for ; n > 0; n /= 62 {
+		b = append([]byte{base62Digits[n%62]}, b...)
+	}
+
+	return string(b)
+}
+
+// shortCodesFilename returns the name of the file of the short codes.
+func shortCodesFilename() string {
+	return filepath.Join(config.DataRoot, "short-codes.json")
+}
+
+// assignShortCodes sets the short codes of the ops, and returns the IDs of the
+// posts by their short codes. The codes are kept in the
+// `shortCodesFilename`, where each new post, from the oldest, is given the
+// next one of a sequence. A code is never reassigned, even after its post is
+// gone, so that a short URL never leads to another post. The unlisted posts
+// get none, since the sequence would give them away.
+func assignShortCodes(ops []post) (map[string]string, error) {
+	shortCodesMutex.Lock()
+	defer shortCodesMutex.Unlock()
+
+	codes := map[string]string{}
+	b, err := ioutil.ReadFile(shortCodesFilename())
+	if err == nil {
+		err = json.Unmarshal(b, &codes)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	nps := []*post{}
+	for i := range ops {
+		if _, ok := codes[ops[i].ID]; !ok && ops[i].Listed() {
+			nps = append(nps, &ops[i])
+		}
+	}
+
+	sort.SliceStable(nps, func(i, j int) bool {
+		return nps[i].Datetime.Before(nps[j].Datetime)
+	})
+
+	for _, p := range nps {
+		codes[p.ID] = base62(len(codes) + 1)
+	}
+
+	if len(nps) > 0 {
+		b, err := json.MarshalIndent(codes, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeFileAtomically(shortCodesFilename(), b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scps := make(map[string]string, len(codes))
+	for id, code := range codes {
+		scps[code] = id
+	}
+
+	for i := range ops {
+		if ops[i].Listed() {
+			ops[i].ShortCode = codes[ops[i].ID]
+		}
+	}
+
+	return scps, nil
+}
+
+// ShortURL returns the short URL of the p, or an empty string if it has no
+// short code.
+func (p post) ShortURL() string {
+	if p.ShortCode == "" {
+		return ""
+	}
+
+	return config.BaseURL + "/p/" + p.ShortCode
+}
+
+func shortURLHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	p, ok := snap.posts[snap.shortCodePosts[paramValue(req, "Code")]]
+	if !ok || !p.Listed() {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.Status = 301
+
+	return res.Redirect(sitePath(p.Permalink))
+}
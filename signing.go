@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aofei/air"
+)
+
+// signingKeyPath is the path of the public key that the posts are signed with.
+const signingKeyPath = "/.well-known/signing-key"
+
+// signingKey is the private key that the posts are signed with, or nil if they
+// are not signed.
+var signingKey ed25519.PrivateKey
+
+// setupSigning sets up the `signingKey`. It comes from the "BLOG_SIGNING_KEY"
+// environment variable, or the `config.SigningKey` if the variable is not set,
+// as the 32-byte seed of an Ed25519 key encoded in base64.
+func setupSigning() error {
+	s := os.Getenv("BLOG_SIGNING_KEY")
+	if s == "" {
+		s = config.SigningKey
+	}
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("malformed signing key: %v", err)
+	} else if len(b) != ed25519.SeedSize {
+		return errors.New("signing key must be 32 bytes long")
+	}
+
+	signingKey = ed25519.NewKeyFromSeed(b)
+
+	return nil
+}
+
+// Signed reports whether the content of the p is signed. The password-protected
+// posts are not, since their content is not given out.
+func (p post) Signed() bool {
+	return signingKey != nil && !p.Protected()
+}
+
+// ContentDigest returns the SHA-256 of the `AbsoluteContent` of the p in hex,
+// or an empty string if it is not `Signed`.
+func (p post) ContentDigest() string {
+	if !p.Signed() {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(p.AbsoluteContent())))
+}
+
+// ContentSignature returns the Ed25519 signature of the `AbsoluteContent` of
+// the p in base64, or an empty string if it is not `Signed`. The content is
+// the same as that of the feed entry of the p, so the readers of the feed can
+// verify it against the public key at the `signingKeyPath`.
+func (p post) ContentSignature() string {
+	if !p.Signed() {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(
+		ed25519.Sign(signingKey, []byte(p.AbsoluteContent())),
+	)
+}
+
+func signingKeyHandler(req *air.Request, res *air.Response) error {
+	if signingKey == nil {
+		return air.NotFoundHandler(req, res)
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"algorithm": "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(
+			signingKey.Public().(ed25519.PublicKey),
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/json; charset=utf-8")
+	res.SetHeader("cache-control", "max-age=86400")
+
+	return res.WriteBlob(b)
+}
+
+func postSignatureHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	p, ok := snap.posts[paramValue(req, "ID")]
+	if !ok || !p.Signed() || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"id":        p.ID,
+		"url":       config.BaseURL + p.Permalink,
+		"algorithm": "ed25519",
+		"sha256":    p.ContentDigest(),
+		"signature": p.ContentSignature(),
+		"key_url":   config.BaseURL + signingKeyPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/json; charset=utf-8")
+
+	return res.WriteBlob(b)
+}
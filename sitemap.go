@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/net/html"
+)
+
+// sitemapMaxURLs is the maximum number of URLs a single sitemap can hold.
+const sitemapMaxURLs = 50000
+
+// sitemapNewsMaxAge is the maximum age of a post to appear in the news
+// sitemap.
+const sitemapNewsMaxAge = 48 * time.Hour
+
+// The XML namespaces of the sitemap extensions.
+const (
+	sitemapImageXMLNS = "http://www.google.com/schemas/sitemap-image/1.1"
+	sitemapNewsXMLNS  = "http://www.google.com/schemas/sitemap-news/0.9"
+)
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapRef `xml:"sitemap"`
+}
+
+type sitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName    xml.Name     `xml:"urlset"`
+	XMLNS      string       `xml:"xmlns,attr"`
+	XMLNSImage string       `xml:"xmlns:image,attr,omitempty"`
+	XMLNSNews  string       `xml:"xmlns:news,attr,omitempty"`
+	URLs       []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string         `xml:"loc"`
+	LastMod string         `xml:"lastmod,omitempty"`
+	Images  []sitemapImage `xml:"image:image"`
+	News    *sitemapNews   `xml:"news:news"`
+}
+
+type sitemapImage struct {
+	Loc string `xml:"image:loc"`
+}
+
+type sitemapNews struct {
+	Publication     sitemapNewsPublication `xml:"news:publication"`
+	PublicationDate string                 `xml:"news:publication_date"`
+	Title           string                 `xml:"news:title"`
+}
+
+type sitemapNewsPublication struct {
+	Name     string `xml:"news:name"`
+	Language string `xml:"news:language"`
+}
+
+// buildSitemaps builds the sitemap index and all the sitemaps it refers to
+// from the ops and the pgs, keyed by their paths.
+func buildSitemaps(
+	ops []post,
+	pgs map[string]page,
+) (map[string][]byte, error) {
+	sms := map[string][]byte{}
+	index := sitemapIndex{
+		XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9",
+	}
+
+	lastMod := ""
+	if len(ops) > 0 {
+		lastMod = lastUpdated(ops).Format(time.RFC3339)
+	}
+
+	add := func(path string, us sitemapURLSet) error {
+		us.XMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+		b, err := xml.Marshal(us)
+		if err != nil {
+			return err
+		}
+
+		sms[path] = append([]byte(xml.Header), b...)
+		index.Sitemaps = append(index.Sitemaps, sitemapRef{
+			Loc:     config.BaseURL + path,
+			LastMod: lastMod,
+		})
+
+		return nil
+	}
+
+	pus := sitemapURLSet{
+		URLs: []sitemapURL{
+			{Loc: config.BaseURL + "/"},
+			{Loc: config.BaseURL + "/posts", LastMod: lastMod},
+		},
+	}
+	if _, ok := pgs["bio"]; !ok {
+		pus.URLs = append(pus.URLs, sitemapURL{
+			Loc: config.BaseURL + "/bio",
+		})
+	}
+
+	slugs := make([]string, 0, len(pgs))
+	for slug, pg := range pgs {
+		if pg.InSitemap() {
+			slugs = append(slugs, slug)
+		}
+	}
+
+	sort.Strings(slugs)
+	for _, slug := range slugs {
+		pus.URLs = append(pus.URLs, sitemapURL{
+			Loc:     config.BaseURL + pgs[slug].Path(),
+			LastMod: pgs[slug].Updated.Format(time.RFC3339),
+		})
+	}
+
+	if err := add("/sitemaps/pages.xml", pus); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i == 0 || i < len(ops); i += sitemapMaxURLs {
+		chunk := ops[i:]
+		if len(chunk) > sitemapMaxURLs {
+			chunk = chunk[:sitemapMaxURLs]
+		}
+
+		us := sitemapURLSet{
+			XMLNSImage: sitemapImageXMLNS,
+			URLs:       make([]sitemapURL, 0, len(chunk)),
+		}
+		for _, p := range chunk {
+			if p.Canonical != "" {
+				continue
+			}
+
+			su := sitemapURL{
+				Loc:     config.BaseURL + p.Permalink,
+				LastMod: p.Updated.Format(time.RFC3339),
+			}
+			for _, src := range postImages(p) {
+				su.Images = append(su.Images, sitemapImage{
+					Loc: src,
+				})
+			}
+
+			us.URLs = append(us.URLs, su)
+		}
+
+		path := fmt.Sprintf(
+			"/sitemaps/posts-%d.xml",
+			i/sitemapMaxURLs+1,
+		)
+		if err := add(path, us); err != nil {
+			return nil, err
+		}
+	}
+
+	language := strings.ToLower(strings.SplitN(air.LocaleBase, "-", 2)[0])
+	news := sitemapURLSet{
+		XMLNSNews: sitemapNewsXMLNS,
+		URLs:      []sitemapURL{},
+	}
+	for _, p := range ops {
+		if time.Since(p.Datetime) > sitemapNewsMaxAge {
+			break
+		}
+
+		if p.Canonical != "" {
+			continue
+		}
+
+		news.URLs = append(news.URLs, sitemapURL{
+			Loc: config.BaseURL + p.Permalink,
+			News: &sitemapNews{
+				Publication: sitemapNewsPublication{
+					Name:     config.Title,
+					Language: language,
+				},
+				PublicationDate: p.Datetime.Format(
+					time.RFC3339,
+				),
+				Title: p.Title,
+			},
+		})
+	}
+
+	if err := add("/sitemaps/news.xml", news); err != nil {
+		return nil, err
+	}
+
+	b, err := xml.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+
+	sms["/sitemap.xml"] = append([]byte(xml.Header), b...)
+
+	return sms, nil
+}
+
+// postImages returns the absolute URLs of all the images in the p's content.
+func postImages(p post) []string {
+	base, err := url.Parse(config.BaseURL + p.Permalink)
+	if err != nil {
+		return nil
+	}
+
+	srcs := []string{}
+	z := html.NewTokenizer(bytes.NewReader([]byte(p.Content)))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		} else if tt != html.StartTagToken &&
+			tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		t := z.Token()
+		if t.Data != "img" {
+			continue
+		}
+
+		if u, err := base.Parse(attr(t, "src")); err == nil {
+			srcs = append(srcs, u.String())
+		}
+	}
+
+	return srcs
+}
+
+func sitemapHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	b, ok := snap.sitemaps[routePath(req)]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("content-type", "application/xml; charset=utf-8")
+	res.SetHeader("cache-control", "max-age=3600")
+
+	return res.WriteBlob(b)
+}
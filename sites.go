@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+)
+
+// sitesConfig is the sites file, which lists the blogs served by their hosts.
+type sitesConfig struct {
+	Address string `toml:"address"`
+	Sites   []site `toml:"sites"`
+}
+
+// site is a blog of a sites file. It lives in its own directory, with its own
+// configuration file, posts, templates and data, and is served by its own
+// child process on the address of that configuration file.
+type site struct {
+	Hosts   []string `toml:"hosts"`
+	Dir     string   `toml:"dir"`
+	Config  string   `toml:"config"`
+	Default bool     `toml:"default"`
+
+	proxy *httputil.ReverseProxy
+}
+
+// loadSites returns the sites of the sites file named filename.
+func loadSites(filename string) (*sitesConfig, error) {
+	sc := &sitesConfig{}
+	if _, err := toml.DecodeFile(filename, sc); err != nil {
+		return nil, err
+	}
+
+	if sc.Address == "" {
+		return nil, errors.New("missing address")
+	} else if len(sc.Sites) == 0 {
+		return nil, errors.New("no sites")
+	}
+
+	hosts := map[string]bool{}
+	defaults := 0
+	for i := range sc.Sites {
+		s := &sc.Sites[i]
+		if s.Dir == "" {
+			return nil, fmt.Errorf("site %d has no dir", i+1)
+		} else if len(s.Hosts) == 0 && !s.Default {
+			return nil, fmt.Errorf("site %s has no hosts", s.Dir)
+		}
+
+		if !filepath.IsAbs(s.Dir) {
+			s.Dir = filepath.Join(filepath.Dir(filename), s.Dir)
+		}
+
+		if s.Config == "" {
+			s.Config = "config.toml"
+		}
+
+		for j, h := range s.Hosts {
+			h = strings.ToLower(h)
+			if hosts[h] {
+				return nil, fmt.Errorf("duplicate host %s", h)
+			}
+
+			hosts[h] = true
+			s.Hosts[j] = h
+		}
+
+		if s.Default {
+			defaults++
+		}
+
+		ac := struct {
+			Address string `toml:"address"`
+		}{}
+		if _, err := toml.DecodeFile(
+			filepath.Join(s.Dir, s.Config),
+			&ac,
+		); err != nil {
+			return nil, fmt.Errorf("site %s: %v", s.Dir, err)
+		} else if ac.Address == "" {
+			return nil, fmt.Errorf("site %s has no address", s.Dir)
+		}
+
+		s.proxy = httputil.NewSingleHostReverseProxy(&url.URL{
+			Scheme: "http",
+			Host:   ac.Address,
+		})
+	}
+
+	if defaults > 1 {
+		return nil, errors.New("more than one default site")
+	}
+
+	return sc, nil
+}
+
+// siteOfHost returns the site of the host among the ss, or the default one if
+// none has it.
+func siteOfHost(ss []site, host string) *site {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	var def *site
+	for i := range ss {
+		for _, h := range ss[i].Hosts {
+			if h == host {
+				return &ss[i]
+			}
+		}
+
+		if ss[i].Default {
+			def = &ss[i]
+		}
+	}
+
+	return def
+}
+
+// runSite runs the child process of the s until the ctx is done, restarting it
+// whenever it exits.
+func runSite(ctx context.Context, s *site, executable string) {
+	for {
+		cmd := exec.Command(
+			executable,
+			"-site",
+			"-config",
+			s.Config,
+		)
+		cmd.Dir = s.Dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			air.ERROR(
+				"failed to start site",
+				map[string]interface{}{
+					"dir":   s.Dir,
+					"error": err.Error(),
+				},
+			)
+		} else {
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+
+			select {
+			case err := <-done:
+				fields := map[string]interface{}{
+					"dir": s.Dir,
+				}
+				if err != nil {
+					fields["error"] = err.Error()
+				}
+
+				air.ERROR("site exited", fields)
+			case <-ctx.Done():
+				cmd.Process.Signal(syscall.SIGTERM)
+				<-done
+				return
+			}
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trustSiteProxy adds the loopback addresses to the `config.TrustedProxies`
+// of a blog run by the `runSite`. The requests only reach it through the proxy
+// of its parent, which appends the IP of the client to the "X-Forwarded-For",
+// so without that every client would be the loopback one.
+func trustSiteProxy() {
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		trusted := false
+		for _, tp := range config.TrustedProxies {
+			if tp == ip {
+				trusted = true
+				break
+			}
+		}
+
+		if !trusted {
+			config.TrustedProxies = append(
+				config.TrustedProxies,
+				ip,
+			)
+		}
+	}
+}
+
+// serveSites serves the blogs of the sites file named filename, each by its
+// own child process, and proxies the requests to them by their hosts. Air can
+// only serve one blog per process, so that is how each of them keeps its own
+// posts, templates and feeds.
+func serveSites(filename string) error {
+	sc, err := loadSites(filename)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for i := range sc.Sites {
+		wg.Add(1)
+		go func(s *site) {
+			defer wg.Done()
+			runSite(ctx, s, executable)
+		}(&sc.Sites[i])
+	}
+
+	hs := &http.Server{
+		Addr: sc.Address,
+		Handler: http.HandlerFunc(func(
+			rw http.ResponseWriter,
+			r *http.Request,
+		) {
+			s := siteOfHost(sc.Sites, r.Host)
+			if s == nil {
+				http.NotFound(rw, r)
+				return
+			}
+
+			s.proxy.ServeHTTP(rw, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- hs.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errChan:
+	case <-shutdownChan:
+		sctx, scancel := context.WithTimeout(
+			context.Background(),
+			time.Minute,
+		)
+		err = hs.Shutdown(sctx)
+		scancel()
+	}
+
+	cancel()
+	wg.Wait()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aofei/air"
+)
+
+// spamLinkRE matches the links in a text.
+var spamLinkRE = regexp.MustCompile(`(?i)https?://[^\s"'<>]+`)
+
+// spamBlockedIPs is the parsed `config.SpamBlockedIPs`.
+var spamBlockedIPs []*net.IPNet
+
+// spamCandidate is something sent in by the readers, such as a comment, to be
+// checked for spam.
+type spamCandidate struct {
+	Type      string
+	Author    string
+	Email     string
+	URL       string
+	Content   string
+	ClientIP  string
+	UserAgent string
+	Referrer  string
+	Permalink string
+}
+
+// spamCheck is a stage of the spam checks. It returns why the sc is spam, or
+// an empty string if it is not.
+type spamCheck struct {
+	Name  string
+	Check func(sc spamCandidate) (string, error)
+}
+
+// spamChecks returns the stages of the spam checks, in the order they run.
+func spamChecks() []spamCheck {
+	scs := []spamCheck{
+		{Name: "blocklist", Check: checkSpamBlocklists},
+		{Name: "links", Check: checkSpamLinks},
+	}
+
+	if config.AkismetKey != "" {
+		scs = append(scs, spamCheck{
+			Name:  "akismet",
+			Check: checkAkismet,
+		})
+	}
+
+	return scs
+}
+
+// parseSpamBlockedIPs parses the `config.SpamBlockedIPs`.
+func parseSpamBlockedIPs() error {
+	ns, err := parseCIDRs(config.SpamBlockedIPs)
+	if err != nil {
+		return err
+	}
+
+	spamBlockedIPs = ns
+
+	return nil
+}
+
+// newSpamCandidate returns the c sent in with the req as a `spamCandidate`.
+func newSpamCandidate(c comment, req *air.Request, p post) spamCandidate {
+	return spamCandidate{
+		Type:      "comment",
+		Author:    c.Name,
+		Email:     c.Email,
+		URL:       c.Website,
+		Content:   c.Content,
+		ClientIP:  c.ClientIP,
+		UserAgent: req.Header("user-agent").Value(),
+		Referrer:  req.Header("referer").Value(),
+		Permalink: config.BaseURL + p.Permalink,
+	}
+}
+
+// checkSpam runs the sc through the `spamChecks` and returns why it is spam,
+// or nil if it is not. A stage that fails is skipped, since whatever it lets
+// through still has to pass the moderation.
+func checkSpam(sc spamCandidate) []string {
+	reasons := []string{}
+	for _, c := range spamChecks() {
+		reason, err := c.Check(sc)
+		if err != nil {
+			air.ERROR(
+				"failed to check spam",
+				map[string]interface{}{
+					"check": c.Name,
+					"error": err.Error(),
+				},
+			)
+		} else if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	return reasons
+}
+
+// honeypotFilled reports whether the req has the field hidden from the humans
+// filled in. Bots fill in every field, including that one.
+func honeypotFilled(req *air.Request) bool {
+	return paramValue(req, "nickname") != ""
+}
+
+// holdForModeration checks the sc sent in on the post of the postID for spam
+// and has the hold keep it for the moderation, with why it is spam. The spam
+// is held like anything else, only marked as such and without bothering
+// anyone about it, so the announce is only run for the rest. It reports
+// whether the hold kept the sc.
+func holdForModeration(
+	sc spamCandidate,
+	postID string,
+	hold func(spam []string) (bool, error),
+	announce func(),
+) (bool, error) {
+	spam := checkSpam(sc)
+	if held, err := hold(spam); err != nil || !held {
+		return false, err
+	}
+
+	air.INFO(
+		sc.Type+" awaits moderation",
+		map[string]interface{}{
+			"post_id": postID,
+			"name":    sc.Author,
+			"spam":    spam,
+		},
+	)
+	if spam == nil {
+		announce()
+	}
+
+	return true, nil
+}
+
+// checkSpamBlocklists checks the sc against the `config.SpamBlockedIPs`, the
+// `config.SpamBlockedDomains` and the `config.SpamBlockedKeywords`.
+func checkSpamBlocklists(sc spamCandidate) (string, error) {
+	if ip := net.ParseIP(sc.ClientIP); ip != nil &&
+		containsIP(spamBlockedIPs, ip) {
+		return "blocked ip " + sc.ClientIP, nil
+	}
+
+	hosts := []string{}
+	for _, u := range append(
+		spamLinkRE.FindAllString(sc.Content, -1),
+		sc.URL,
+	) {
+		if pu, err := url.Parse(u); err == nil && pu.Host != "" {
+			hosts = append(hosts, strings.ToLower(pu.Hostname()))
+		}
+	}
+
+	if i := strings.LastIndexByte(sc.Email, '@'); i >= 0 {
+		hosts = append(hosts, strings.ToLower(sc.Email[i+1:]))
+	}
+
+	for _, d := range config.SpamBlockedDomains {
+		d = strings.ToLower(d)
+		for _, h := range hosts {
+			if h == d || strings.HasSuffix(h, "."+d) {
+				return "blocked domain " + d, nil
+			}
+		}
+	}
+
+	text := strings.ToLower(sc.Author + "\n" + sc.Content)
+	for _, k := range config.SpamBlockedKeywords {
+		if strings.Contains(text, strings.ToLower(k)) {
+			return fmt.Sprintf("blocked keyword %q", k), nil
+		}
+	}
+
+	return "", nil
+}
+
+// checkSpamLinks checks that the content of the sc has no more links than the
+// `config.SpamMaxLinks`.
+func checkSpamLinks(sc spamCandidate) (string, error) {
+	n := len(spamLinkRE.FindAllString(sc.Content, -1))
+	if config.SpamMaxLinks > 0 && n > config.SpamMaxLinks {
+		return fmt.Sprintf("%d links", n), nil
+	}
+
+	return "", nil
+}
+
+// checkAkismet asks the `config.AkismetEndpoint`, an Akismet-compatible API,
+// whether the sc is spam.
+func checkAkismet(sc spamCandidate) (string, error) {
+	form := url.Values{
+		"api_key":              {config.AkismetKey},
+		"blog":                 {config.BaseURL},
+		"user_ip":              {sc.ClientIP},
+		"user_agent":           {sc.UserAgent},
+		"referrer":             {sc.Referrer},
+		"permalink":            {sc.Permalink},
+		"comment_type":         {sc.Type},
+		"comment_author":       {sc.Author},
+		"comment_author_email": {sc.Email},
+		"comment_author_url":   {sc.URL},
+		"comment_content":      {sc.Content},
+	}
+
+	endpoint := strings.TrimSuffix(config.AkismetEndpoint, "/")
+	fr, err := fetch(
+		"POST",
+		endpoint+"/comment-check",
+		http.Header{
+			"Content-Type": {"application/x-www-form-urlencoded"},
+		},
+		[]byte(form.Encode()),
+	)
+	if err != nil {
+		return "", err
+	} else if fr.Status != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	switch strings.TrimSpace(string(fr.Body)) {
+	case "true":
+		return "akismet", nil
+	case "false":
+		return "", nil
+	}
+
+	return "", fmt.Errorf(
+		"unexpected response %q",
+		fr.Header.Get("X-akismet-debug-help"),
+	)
+}
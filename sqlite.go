@@ -0,0 +1,457 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // The pure Go "sqlite" driver.
+)
+
+// sqliteSchema is the schema of the `sqliteStore`.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS posts (
+	id TEXT PRIMARY KEY,
+	source BLOB NOT NULL,
+	encrypted INTEGER NOT NULL DEFAULT 0,
+	mod_time TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS comments (
+	id TEXT PRIMARY KEY,
+	post_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	website TEXT NOT NULL,
+	content TEXT NOT NULL,
+	client_ip TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	approved INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS comments_post_id ON comments (post_id);
+CREATE TABLE IF NOT EXISTS views (
+	kind TEXT NOT NULL,
+	key TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (kind, key)
+);
+CREATE TABLE IF NOT EXISTS reactions (
+	post_id TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (post_id, kind)
+);
+`
+
+// sqliteStore is a `postStore` of a SQLite database. Unlike the
+// `fsPostStore`, it changes several entities in one transaction, so a failed
+// change leaves nothing half done.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens the SQLite database at the path as a `sqliteStore`,
+// creating it if it doesn't exist.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("missing sqlite path")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+// inTx runs the f in a transaction, which is committed if the f succeeds and
+// rolled back otherwise.
+func (s *sqliteStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Posts implements the `postStore`.
+func (s *sqliteStore) Posts() ([]storedPost, error) {
+	rows, err := s.db.Query(
+		"SELECT id, source, encrypted, mod_time FROM posts",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sps := []storedPost{}
+	for rows.Next() {
+		sp := storedPost{}
+		encrypted := false
+		modTime := ""
+		if err := rows.Scan(
+			&sp.ID,
+			&sp.Source,
+			&encrypted,
+			&modTime,
+		); err != nil {
+			return nil, err
+		}
+
+		sp.File = "sqlite:" + sp.ID
+		sp.ModTime, _ = time.Parse(time.RFC3339Nano, modTime)
+		if encrypted {
+			sp.Source, sp.Err = decryptPost(sp.Source)
+		}
+
+		sps = append(sps, sp)
+	}
+
+	return sps, rows.Err()
+}
+
+// PublishPost implements the `postStore`.
+func (s *sqliteStore) PublishPost(id string, source []byte) error {
+	return s.importPost(id, source, false, time.Now())
+}
+
+// UpdatePost implements the `postStore`.
+func (s *sqliteStore) UpdatePost(id string, source []byte) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		encrypted := false
+		if err := tx.QueryRow(
+			"SELECT encrypted FROM posts WHERE id = ?",
+			id,
+		).Scan(&encrypted); err == sql.ErrNoRows {
+			return errors.New("post not found")
+		} else if err != nil {
+			return err
+		}
+
+		if encrypted {
+			var err error
+			if source, err = encryptPost(source); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(
+			"UPDATE posts SET source = ?, mod_time = ? "+
+				"WHERE id = ?",
+			source,
+			time.Now().UTC().Format(time.RFC3339Nano),
+			id,
+		)
+
+		return err
+	})
+}
+
+// importPost adds the source as the post of the id, which may be encrypted,
+// last modified at the modTime.
+func (s *sqliteStore) importPost(
+	id string,
+	source []byte,
+	encrypted bool,
+	modTime time.Time,
+) error {
+	_, err := s.db.Exec(
+		"INSERT INTO posts (id, source, encrypted, mod_time) "+
+			"VALUES (?, ?, ?, ?)",
+		id,
+		source,
+		encrypted,
+		modTime.UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return errors.New("post already exists")
+	}
+
+	return err
+}
+
+// queryComments returns the comments matching the where.
+func (s *sqliteStore) queryComments(
+	where string,
+	args ...interface{},
+) ([]comment, error) {
+	rows, err := s.db.Query(
+		"SELECT id, post_id, name, email, website, content, "+
+			"client_ip, created_at, approved FROM comments "+
+			where+" ORDER BY created_at",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cs := []comment{}
+	for rows.Next() {
+		c := comment{}
+		createdAt := ""
+		if err := rows.Scan(
+			&c.ID,
+			&c.PostID,
+			&c.Name,
+			&c.Email,
+			&c.Website,
+			&c.Content,
+			&c.ClientIP,
+			&createdAt,
+			&c.Approved,
+		); err != nil {
+			return nil, err
+		}
+
+		c.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		cs = append(cs, c)
+	}
+
+	return cs, rows.Err()
+}
+
+// Comments implements the `postStore`.
+func (s *sqliteStore) Comments(postID string) ([]comment, error) {
+	return s.queryComments("WHERE post_id = ?", postID)
+}
+
+// AllComments implements the `postStore`.
+func (s *sqliteStore) AllComments() ([]comment, error) {
+	return s.queryComments("")
+}
+
+// SaveComments implements the `postStore`.
+func (s *sqliteStore) SaveComments(postID string, cs []comment) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			"DELETE FROM comments WHERE post_id = ?",
+			postID,
+		); err != nil {
+			return err
+		}
+
+		for _, c := range cs {
+			if _, err := tx.Exec(
+				"INSERT INTO comments (id, post_id, name, "+
+					"email, website, content, client_ip, "+
+					"created_at, approved) "+
+					"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				c.ID,
+				postID,
+				c.Name,
+				c.Email,
+				c.Website,
+				c.Content,
+				c.ClientIP,
+				c.CreatedAt.UTC().Format(time.RFC3339Nano),
+				c.Approved,
+			); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Views implements the `postStore`.
+func (s *sqliteStore) Views() (viewStats, error) {
+	vs := viewStats{
+		Posts:         map[string]uint64{},
+		Referrers:     map[string]uint64{},
+		PostReferrers: map[string]uint64{},
+		Campaigns:     map[string]uint64{},
+	}
+
+	rows, err := s.db.Query("SELECT kind, key, count FROM views")
+	if err != nil {
+		return vs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		kind, key, count := "", "", uint64(0)
+		if err := rows.Scan(&kind, &key, &count); err != nil {
+			return vs, err
+		}
+
+		switch kind {
+		case "post":
+			vs.Posts[key] = count
+		case "referrer":
+			vs.Referrers[key] = count
+		case "post_referrer":
+			vs.PostReferrers[key] = count
+		case "campaign":
+			vs.Campaigns[key] = count
+		}
+	}
+
+	return vs, rows.Err()
+}
+
+// SaveViews implements the `postStore`.
+func (s *sqliteStore) SaveViews(vs viewStats) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM views"); err != nil {
+			return err
+		}
+
+		for kind, counts := range map[string]map[string]uint64{
+			"post":          vs.Posts,
+			"referrer":      vs.Referrers,
+			"post_referrer": vs.PostReferrers,
+			"campaign":      vs.Campaigns,
+		} {
+			for key, count := range counts {
+				if _, err := tx.Exec(
+					"INSERT INTO views (kind, key, count) "+
+						"VALUES (?, ?, ?)",
+					kind,
+					key,
+					count,
+				); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Reactions implements the `postStore`.
+func (s *sqliteStore) Reactions() (reactionCounts, error) {
+	rc := reactionCounts{}
+	rows, err := s.db.Query("SELECT post_id, kind, count FROM reactions")
+	if err != nil {
+		return rc, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		postID, kind, count := "", "", uint64(0)
+		if err := rows.Scan(&postID, &kind, &count); err != nil {
+			return rc, err
+		}
+
+		if rc[postID] == nil {
+			rc[postID] = map[string]uint64{}
+		}
+
+		rc[postID][kind] = count
+	}
+
+	return rc, rows.Err()
+}
+
+// SaveReactions implements the `postStore`.
+func (s *sqliteStore) SaveReactions(rc reactionCounts) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM reactions"); err != nil {
+			return err
+		}
+
+		for postID, counts := range rc {
+			for kind, count := range counts {
+				if _, err := tx.Exec(
+					"INSERT INTO reactions "+
+						"(post_id, kind, count) "+
+						"VALUES (?, ?, ?)",
+					postID,
+					kind,
+					count,
+				); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrateToSQLite copies the posts, the comments, the view counts and the
+// reaction counts of the fs into the s. The encrypted posts stay encrypted.
+func migrateToSQLite(fs fsPostStore, s *sqliteStore) error {
+	fns, err := postFiles(fs.root)
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range fns {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+
+		modTime := time.Now()
+		if fi, err := os.Stat(fn); err == nil {
+			modTime = fi.ModTime()
+		}
+
+		if err := s.importPost(
+			postID(fs.root, fn),
+			b,
+			strings.HasSuffix(fn, encryptedPostExt),
+			modTime,
+		); err != nil {
+			return err
+		}
+	}
+
+	acs, err := fs.AllComments()
+	if err != nil {
+		return err
+	}
+
+	pcs := map[string][]comment{}
+	for _, c := range acs {
+		pcs[c.PostID] = append(pcs[c.PostID], c)
+	}
+
+	for postID, cs := range pcs {
+		if err := s.SaveComments(postID, cs); err != nil {
+			return err
+		}
+	}
+
+	vs, err := fs.Views()
+	if err != nil {
+		return err
+	}
+
+	if err := s.SaveViews(vs); err != nil {
+		return err
+	}
+
+	rc, err := fs.Reactions()
+	if err != nil {
+		return err
+	}
+
+	return s.SaveReactions(rc)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storedPost is a post as kept in a `postStore`, before it is parsed.
+type storedPost struct {
+	ID      string
+	File    string
+	Source  []byte
+	ModTime time.Time
+
+	// Err is the error of reading the post, if any. It is reported
+	// along with the post errors instead of failing all the posts.
+	Err error
+}
+
+// postStore is where the posts, their comments and their view counts live.
+// The comments are only ever changed with the `commentsMutex` held.
+type postStore interface {
+	// Posts returns all the posts.
+	Posts() ([]storedPost, error)
+
+	// PublishPost adds the source as the post of the id.
+	PublishPost(id string, source []byte) error
+
+	// UpdatePost replaces the source of the existing post of the id,
+	// keeping it encrypted if it is.
+	UpdatePost(id string, source []byte) error
+
+	// Comments returns the comments of the post of the postID, oldest
+	// first.
+	Comments(postID string) ([]comment, error)
+
+	// AllComments returns the comments of all the posts, oldest first.
+	AllComments() ([]comment, error)
+
+	// SaveComments replaces the comments of the post of the postID with
+	// the cs at once.
+	SaveComments(postID string, cs []comment) error
+
+	// Views returns the view counts.
+	Views() (viewStats, error)
+
+	// SaveViews replaces the view counts with the vs at once.
+	SaveViews(vs viewStats) error
+
+	// Reactions returns the reaction counts.
+	Reactions() (reactionCounts, error)
+
+	// SaveReactions replaces the reaction counts with the rc at once.
+	SaveReactions(rc reactionCounts) error
+}
+
+// store is the `postStore` selected by the `config.Store`.
+var store postStore
+
+// setupStore opens the `store`.
+func setupStore() error {
+	switch config.Store {
+	case "", "fs":
+		store = fsPostStore{root: "posts"}
+	case "sqlite":
+		s, err := openSQLiteStore(config.SQLitePath)
+		if err != nil {
+			return err
+		}
+
+		store = s
+	case "s3":
+		s, err := newS3Store()
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.sync(); err != nil {
+			return fmt.Errorf("failed to sync s3: %v", err)
+		} else if err := buildTheme(); err != nil {
+			return err
+		}
+
+		store = s
+	default:
+		return fmt.Errorf("unknown store %q", config.Store)
+	}
+
+	return nil
+}
+
+// fsPostStore is a `postStore` of the post files under the root and the JSON
+// files under the `config.DataRoot`.
+type fsPostStore struct {
+	root string
+}
+
+// Posts implements the `postStore`.
+func (s fsPostStore) Posts() ([]storedPost, error) {
+	fns, err := postFiles(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	sps := make([]storedPost, 0, len(fns))
+	for _, fn := range fns {
+		sp := storedPost{
+			ID:   postID(s.root, fn),
+			File: fn,
+		}
+		if sp.Source, sp.Err = readPostFile(fn); sp.Err == nil {
+			if fi, err := os.Stat(fn); err == nil {
+				sp.ModTime = fi.ModTime()
+			}
+		}
+
+		sps = append(sps, sp)
+	}
+
+	return sps, nil
+}
+
+// PublishPost implements the `postStore`. The posts watcher takes it from
+// there.
+func (s fsPostStore) PublishPost(id string, source []byte) error {
+	filename := filepath.Join(s.root, filepath.FromSlash(id)+".md")
+	if _, err := os.Stat(filename); err == nil {
+		return errors.New("post already exists")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, source, 0644)
+}
+
+// UpdatePost implements the `postStore`. The posts watcher takes it from
+// there.
+func (s fsPostStore) UpdatePost(id string, source []byte) error {
+	filename := filepath.Join(s.root, filepath.FromSlash(id)+".md")
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		filename += encryptedPostExt
+		if _, err := os.Stat(filename); err != nil {
+			return errors.New("post not found")
+		}
+
+		if source, err = encryptPost(source); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(filename, source)
+}
+
+// commentsFilename returns the name of the file of the comments of the post
+// of the postID.
+func (fsPostStore) commentsFilename(postID string) string {
+	return filepath.Join(
+		config.DataRoot,
+		"comments",
+		url.PathEscape(postID)+".json",
+	)
+}
+
+// Comments implements the `postStore`.
+func (s fsPostStore) Comments(postID string) ([]comment, error) {
+	b, err := ioutil.ReadFile(s.commentsFilename(postID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cs := []comment{}
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// AllComments implements the `postStore`.
+func (s fsPostStore) AllComments() ([]comment, error) {
+	fns, err := filepath.Glob(filepath.Join(
+		config.DataRoot,
+		"comments",
+		"*.json",
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	acs := []comment{}
+	for _, fn := range fns {
+		postID, err := url.PathUnescape(strings.TrimSuffix(
+			filepath.Base(fn),
+			".json",
+		))
+		if err != nil {
+			continue
+		}
+
+		cs, err := s.Comments(postID)
+		if err != nil {
+			return nil, err
+		}
+
+		acs = append(acs, cs...)
+	}
+
+	sort.Slice(acs, func(i, j int) bool {
+		return acs[i].CreatedAt.Before(acs[j].CreatedAt)
+	})
+
+	return acs, nil
+}
+
+// SaveComments implements the `postStore`.
+func (s fsPostStore) SaveComments(postID string, cs []comment) error {
+	filename := s.commentsFilename(postID)
+	if len(cs) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	b, err := json.MarshalIndent(cs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(filename, b)
+}
+
+// viewsFilename returns the name of the file of the view counts.
+func (fsPostStore) viewsFilename() string {
+	return filepath.Join(config.DataRoot, "views.json")
+}
+
+// Views implements the `postStore`.
+func (s fsPostStore) Views() (viewStats, error) {
+	vs := viewStats{}
+	b, err := ioutil.ReadFile(s.viewsFilename())
+	if os.IsNotExist(err) {
+		return vs, nil
+	} else if err != nil {
+		return vs, err
+	}
+
+	err = json.Unmarshal(b, &vs)
+
+	return vs, err
+}
+
+// SaveViews implements the `postStore`.
+func (s fsPostStore) SaveViews(vs viewStats) error {
+	b, err := json.MarshalIndent(vs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(s.viewsFilename(), b)
+}
+
+// reactionsFilename returns the name of the file of the reaction counts.
+func (fsPostStore) reactionsFilename() string {
+	return filepath.Join(config.DataRoot, "reactions.json")
+}
+
+// Reactions implements the `postStore`.
+func (s fsPostStore) Reactions() (reactionCounts, error) {
+	rc := reactionCounts{}
+	b, err := ioutil.ReadFile(s.reactionsFilename())
+	if os.IsNotExist(err) {
+		return rc, nil
+	} else if err != nil {
+		return rc, err
+	}
+
+	err = json.Unmarshal(b, &rc)
+
+	return rc, err
+}
+
+// SaveReactions implements the `postStore`.
+func (s fsPostStore) SaveReactions(rc reactionCounts) error {
+	b, err := json.MarshalIndent(rc, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(s.reactionsFilename(), b)
+}
+
+// writeFileAtomically writes the b as the file named filename, so that the
+// file is either the old one or the new one even if the writing fails.
+func writeFileAtomically(filename string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
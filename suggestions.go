@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+)
+
+const (
+	// suggestionMaxLength is the maximum number of characters of the text
+	// that a suggestion replaces and of the text it replaces it with.
+	suggestionMaxLength = 2000
+
+	// suggestionNoteMaxLength is the maximum number of characters of the
+	// note of a suggestion.
+	suggestionNoteMaxLength = 500
+
+	// suggestionsPerClient is the most suggestions a client may have
+	// waiting for moderation at a time.
+	suggestionsPerClient = 5
+)
+
+// suggestion is an edit of a post suggested by a reader, such as a typo fix:
+// the Original, which must appear exactly once in the Markdown of the post,
+// is to be replaced with the Replacement.
+type suggestion struct {
+	ID          string    `json:"id"`
+	PostID      string    `json:"post_id"`
+	Name        string    `json:"name,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Original    string    `json:"original"`
+	Replacement string    `json:"replacement"`
+	Note        string    `json:"note,omitempty"`
+	ClientIP    string    `json:"client_ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	Spam        []string  `json:"spam,omitempty"`
+}
+
+// pendingSuggestion is a `suggestion` as the administrators review it, with
+// the diff it makes to the current Markdown of its post, or the error of
+// making it if it no longer applies.
+type pendingSuggestion struct {
+	suggestion
+	PostTitle string
+	DiffLines []postDiffLine
+	Error     string
+}
+
+var suggestionsMutex sync.Mutex
+
+// suggestionsFilename returns the name of the file of the suggestions waiting
+// for moderation.
+func suggestionsFilename() string {
+	return filepath.Join(config.DataRoot, "suggestions.json")
+}
+
+// loadSuggestions returns the suggestions waiting for moderation, oldest
+// first. It must be called with the `suggestionsMutex` held.
+func loadSuggestions() ([]suggestion, error) {
+	b, err := ioutil.ReadFile(suggestionsFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ss := []suggestion{}
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// saveSuggestions saves the ss as the suggestions waiting for moderation. It
+// must be called with the `suggestionsMutex` held.
+func saveSuggestions(ss []suggestion) error {
+	b, err := json.MarshalIndent(ss, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(suggestionsFilename(), b)
+}
+
+// addSuggestion adds the s as a new suggestion waiting for moderation, unless
+// its client already has the `suggestionsPerClient`.
+func addSuggestion(s suggestion) (bool, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return false, err
+	}
+
+	s.ID = fmt.Sprintf("%x", b)
+	s.CreatedAt = time.Now().UTC()
+
+	suggestionsMutex.Lock()
+	defer suggestionsMutex.Unlock()
+
+	ss, err := loadSuggestions()
+	if err != nil {
+		return false, err
+	}
+
+	n := 0
+	for _, o := range ss {
+		if o.ClientIP == s.ClientIP {
+			n++
+		}
+	}
+
+	if n >= suggestionsPerClient {
+		return false, nil
+	}
+
+	return true, saveSuggestions(append(ss, s))
+}
+
+// takeSuggestion removes the suggestion of the id, having the f do whatever is
+// to be done with it first. The suggestion is kept if the f fails.
+func takeSuggestion(id string, f func(s suggestion) error) error {
+	suggestionsMutex.Lock()
+	defer suggestionsMutex.Unlock()
+
+	ss, err := loadSuggestions()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range ss {
+		if s.ID != id {
+			continue
+		}
+
+		if err := f(s); err != nil {
+			return err
+		}
+
+		return saveSuggestions(append(ss[:i], ss[i+1:]...))
+	}
+
+	return errors.New("suggestion not found")
+}
+
+// locateSuggestion returns the Markdown of the source and where the original
+// is in it, which must be exactly once.
+func locateSuggestion(source []byte, original string) (string, int, error) {
+	_, md, err := splitFrontMatter(source)
+	if err != nil {
+		return "", 0, err
+	}
+
+	s := string(md)
+	switch strings.Count(s, original) {
+	case 0:
+		return "", 0, errors.New("original text not found in post")
+	case 1:
+		return s, strings.Index(s, original), nil
+	}
+
+	return "", 0, errors.New("original text found more than once in post")
+}
+
+// applySuggestion returns the source of a post with the s applied to it.
+func applySuggestion(source []byte, s suggestion) ([]byte, error) {
+	md, i, err := locateSuggestion(source, s.Original)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(source)+len(s.Replacement))
+	b = append(b, source[:len(source)-len(md)]...)
+	b = append(b, md[:i]...)
+	b = append(b, s.Replacement...)
+	b = append(b, md[i+len(s.Original):]...)
+
+	return b, nil
+}
+
+// suggestionDiff returns the diff that the s makes to the Markdown of the
+// source, line by line.
+func suggestionDiff(source []byte, s suggestion) ([]postDiffLine, error) {
+	md, i, err := locateSuggestion(source, s.Original)
+	if err != nil {
+		return nil, err
+	}
+
+	start := strings.LastIndexByte(md[:i], '\n') + 1
+	j := i + len(s.Original)
+	end := len(md)
+	if k := strings.IndexByte(md[j:], '\n'); k >= 0 {
+		end = j + k + 1
+	}
+
+	chunks := []fdiff.Chunk{}
+	for _, fc := range []fileChunk{
+		{md[:start], fdiff.Equal},
+		{md[start:end], fdiff.Delete},
+		{md[start:i] + s.Replacement + md[j:end], fdiff.Add},
+		{md[end:], fdiff.Equal},
+	} {
+		if fc.content != "" {
+			chunks = append(chunks, fc)
+		}
+	}
+
+	return postDiffLines(chunks), nil
+}
+
+func suggestHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	postID := strings.TrimSuffix(paramValue(req, "*"), "/suggest")
+	p, ok := snap.posts[postID]
+	if !ok || !config.SuggestionsEnabled || !hasPostAccess(req, p) {
+		return air.NotFoundHandler(req, res)
+	}
+
+	location := sitePath(p.Permalink + "?suggestion=pending#suggest")
+
+	if honeypotFilled(req) {
+		return res.Redirect(location)
+	}
+
+	s := suggestion{
+		PostID:      postID,
+		Name:        strings.TrimSpace(paramValue(req, "name")),
+		Email:       strings.TrimSpace(paramValue(req, "email")),
+		Original:    paramValue(req, "original"),
+		Replacement: paramValue(req, "replacement"),
+		Note:        strings.TrimSpace(paramValue(req, "note")),
+		ClientIP:    clientIP(req),
+	}
+	s.Original = strings.Replace(s.Original, "\r\n", "\n", -1)
+	s.Replacement = strings.Replace(s.Replacement, "\r\n", "\n", -1)
+
+	if strings.TrimSpace(s.Original) == "" ||
+		s.Original == s.Replacement ||
+		utf8.RuneCountInString(s.Original) > suggestionMaxLength ||
+		utf8.RuneCountInString(s.Replacement) > suggestionMaxLength ||
+		utf8.RuneCountInString(s.Note) > suggestionNoteMaxLength {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	if _, _, err := locateSuggestion(p.Source, s.Original); err != nil {
+		res.Status = 400
+		return errors.New("Bad Request")
+	}
+
+	held, err := holdForModeration(
+		spamCandidate{
+			Type:   "suggestion",
+			Author: s.Name,
+			Email:  s.Email,
+			Content: strings.TrimSpace(
+				s.Replacement + "\n\n" + s.Note,
+			),
+			ClientIP:  s.ClientIP,
+			UserAgent: req.Header("user-agent").Value(),
+			Referrer:  req.Header("referer").Value(),
+			Permalink: config.BaseURL + p.Permalink,
+		},
+		postID,
+		func(spam []string) (bool, error) {
+			s.Spam = spam
+			return addSuggestion(s)
+		},
+		func() {
+			notify(fmt.Sprintf(
+				"New suggestion on %s%s awaits moderation.",
+				config.BaseURL,
+				p.Permalink,
+			))
+		},
+	)
+	if err != nil {
+		return err
+	} else if !held {
+		res.Status = 429
+		return errors.New("Too Many Requests")
+	}
+
+	return res.Redirect(location)
+}
+
+func adminSuggestionsHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	suggestionsMutex.Lock()
+	ss, err := loadSuggestions()
+	suggestionsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	pss := make([]pendingSuggestion, 0, len(ss))
+	for _, s := range ss {
+		ps := pendingSuggestion{suggestion: s}
+		if p, ok := snap.posts[s.PostID]; !ok {
+			ps.Error = "post not found"
+		} else if ps.DiffLines, err = suggestionDiff(
+			p.Source,
+			s,
+		); err != nil {
+			ps.Error = err.Error()
+		} else {
+			ps.PostTitle = p.Title
+		}
+
+		pss = append(pss, ps)
+	}
+
+	req.Values["PageTitle"] = "Pending Suggestions"
+	req.Values["PendingSuggestions"] = pss
+
+	return res.Render(
+		req.Values,
+		"admin/suggestions.html",
+		"layouts/default.html",
+	)
+}
+
+// adminReviewSuggestionHandler applies or rejects a suggestion. Applying it
+// replaces the source of its post in the `store`.
+func adminReviewSuggestionHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	apply := paramValue(req, "action") == "apply"
+	err := takeSuggestion(paramValue(req, "id"), func(s suggestion) error {
+		if !apply {
+			return nil
+		}
+
+		p, ok := snap.posts[s.PostID]
+		if !ok {
+			return errors.New("post not found")
+		}
+
+		source, err := applySuggestion(p.Source, s)
+		if err != nil {
+			return err
+		}
+
+		return store.UpdatePost(p.ID, source)
+	})
+	if err != nil {
+		res.Status = 409
+		return err
+	}
+
+	if apply {
+		reloadUnwatchedPosts()
+	}
+
+	return res.Redirect(sitePath("/admin/suggestions"))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+)
+
+// blueskyMaxTitleRunes is the maximum number of the runes of a title that goes
+// into a Bluesky post, which leaves room for the link within its limit.
+const blueskyMaxTitleRunes = 200
+
+// syndication is a copy of a post elsewhere.
+type syndication struct {
+	Name string    `json:"name"`
+	URL  string    `json:"url"`
+	At   time.Time `json:"at,omitempty"`
+}
+
+// syndicationTarget is a place where the new posts are syndicated to.
+type syndicationTarget struct {
+	Name    string
+	Enabled func() bool
+	Post    func(p post, link string) (string, error)
+}
+
+var (
+	syndicationsMutex sync.Mutex
+	syndications      = map[string][]syndication{}
+)
+
+// syndicationTargets returns all the known syndication targets.
+func syndicationTargets() []syndicationTarget {
+	return []syndicationTarget{
+		{
+			Name: "Mastodon",
+			Enabled: func() bool {
+				return config.MastodonInstance != "" &&
+					config.MastodonAccessToken != ""
+			},
+			Post: syndicateToMastodon,
+		},
+		{
+			Name: "Bluesky",
+			Enabled: func() bool {
+				return config.BlueskyHandle != "" &&
+					config.BlueskyAppPassword != ""
+			},
+			Post: syndicateToBluesky,
+		},
+		{
+			Name: "Webhook",
+			Enabled: func() bool {
+				return config.SyndicationWebhookURL != ""
+			},
+			Post: syndicateToWebhook,
+		},
+	}
+}
+
+// syndicationsFilename returns the name of the file of the `syndications`.
+func syndicationsFilename() string {
+	return filepath.Join(config.DataRoot, "syndications.json")
+}
+
+// loadSyndications loads the `syndications` from the disk.
+func loadSyndications() error {
+	b, err := ioutil.ReadFile(syndicationsFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	syndicationsMutex.Lock()
+	defer syndicationsMutex.Unlock()
+
+	return json.Unmarshal(b, &syndications)
+}
+
+// saveSyndications saves the `syndications`. It must be called with the
+// `syndicationsMutex` held.
+func saveSyndications() error {
+	b, err := json.MarshalIndent(syndications, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(syndicationsFilename(), b)
+}
+
+// postSyndications returns the copies of the p elsewhere, those recorded when
+// the p was syndicated followed by those in its front matter.
+func postSyndications(p post) []syndication {
+	syndicationsMutex.Lock()
+	ss := append([]syndication{}, syndications[p.ID]...)
+	syndicationsMutex.Unlock()
+
+	for _, su := range p.Syndication {
+		s := syndication{Name: su, URL: su}
+		if u, err := url.Parse(su); err == nil && u.Host != "" {
+			s.Name = u.Host
+		}
+
+		ss = append(ss, s)
+	}
+
+	return ss
+}
+
+// syndicate publishes the link and the title of the p to each of the enabled
+// syndication targets it isn't yet on, and records where it ended up. It is
+// meant to be run in the background when the p is newly published.
+func syndicate(p post) {
+	if p.Protected() {
+		return
+	}
+
+	link := config.BaseURL + p.Permalink
+	for _, st := range syndicationTargets() {
+		if !st.Enabled() {
+			continue
+		}
+
+		syndicationsMutex.Lock()
+		done := false
+		for _, s := range syndications[p.ID] {
+			done = done || s.Name == st.Name
+		}
+		syndicationsMutex.Unlock()
+		if done {
+			continue
+		}
+
+		su, err := st.Post(p, link)
+		if err != nil {
+			air.ERROR(
+				"failed to syndicate post",
+				map[string]interface{}{
+					"post_id": p.ID,
+					"target":  st.Name,
+					"error":   err.Error(),
+				},
+			)
+			continue
+		} else if su == "" {
+			continue
+		}
+
+		syndicationsMutex.Lock()
+		syndications[p.ID] = append(syndications[p.ID], syndication{
+			Name: st.Name,
+			URL:  su,
+			At:   time.Now().UTC(),
+		})
+		err = saveSyndications()
+		syndicationsMutex.Unlock()
+		if err != nil {
+			air.ERROR(
+				"failed to save syndications",
+				map[string]interface{}{
+					"error": err.Error(),
+				},
+			)
+		}
+
+		bumpContentVersion()
+	}
+}
+
+// postJSON posts the v as JSON to the u with the header, and decodes the
+// response into the r.
+func postJSON(u string, header http.Header, v, r interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if header == nil {
+		header = http.Header{}
+	}
+
+	header.Set("Content-Type", "application/json")
+
+	fr, err := fetch("POST", u, header, b)
+	if err != nil {
+		return err
+	} else if fr.Status < 200 || fr.Status >= 300 {
+		return fmt.Errorf("unexpected status %d", fr.Status)
+	} else if r == nil ||
+		!strings.Contains(fr.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+
+	return json.Unmarshal(fr.Body, r)
+}
+
+// syndicateToMastodon posts the p to the `config.MastodonInstance` and returns
+// the URL of the status.
+func syndicateToMastodon(p post, link string) (string, error) {
+	var r struct {
+		URL string `json:"url"`
+	}
+
+	if err := postJSON(
+		strings.TrimSuffix(config.MastodonInstance, "/")+
+			"/api/v1/statuses",
+		http.Header{
+			"Authorization": {
+				"Bearer " + config.MastodonAccessToken,
+			},
+			"Idempotency-Key": {p.ID},
+		},
+		map[string]string{
+			"status": p.Title + "\n\n" + link,
+		},
+		&r,
+	); err != nil {
+		return "", err
+	}
+
+	return r.URL, nil
+}
+
+// syndicateToBluesky posts the p to the `config.BlueskyHandle` on the
+// `config.BlueskyPDS` and returns the URL of the post.
+func syndicateToBluesky(p post, link string) (string, error) {
+	pds := strings.TrimSuffix(config.BlueskyPDS, "/")
+
+	var session struct {
+		AccessJWT string `json:"accessJwt"`
+		DID       string `json:"did"`
+	}
+
+	if err := postJSON(
+		pds+"/xrpc/com.atproto.server.createSession",
+		nil,
+		map[string]string{
+			"identifier": config.BlueskyHandle,
+			"password":   config.BlueskyAppPassword,
+		},
+		&session,
+	); err != nil {
+		return "", err
+	}
+
+	title := p.Title
+	if utf8.RuneCountInString(title) > blueskyMaxTitleRunes {
+		title = string([]rune(title)[:blueskyMaxTitleRunes-1]) + "…"
+	}
+
+	text := title + "\n\n" + link
+	facet := map[string]interface{}{
+		"index": map[string]int{
+			"byteStart": len(text) - len(link),
+			"byteEnd":   len(text),
+		},
+		"features": []interface{}{map[string]string{
+			"$type": "app.bsky.richtext.facet#link",
+			"uri":   link,
+		}},
+	}
+
+	now := time.Now().UTC()
+
+	var r struct {
+		URI string `json:"uri"`
+	}
+
+	if err := postJSON(
+		pds+"/xrpc/com.atproto.repo.createRecord",
+		http.Header{"Authorization": {"Bearer " + session.AccessJWT}},
+		map[string]interface{}{
+			"repo":       session.DID,
+			"collection": "app.bsky.feed.post",
+			"record": map[string]interface{}{
+				"$type":     "app.bsky.feed.post",
+				"text":      text,
+				"createdAt": now.Format(time.RFC3339),
+				"facets":    []interface{}{facet},
+			},
+		},
+		&r,
+	); err != nil {
+		return "", err
+	}
+
+	// The URI is "at://<did>/app.bsky.feed.post/<rkey>".
+	parts := strings.Split(r.URI, "/")
+	if len(parts) != 5 {
+		return "", errors.New("unexpected record uri")
+	}
+
+	return fmt.Sprintf(
+		"https://bsky.app/profile/%s/post/%s",
+		parts[2],
+		parts[4],
+	), nil
+}
+
+// syndicateToWebhook posts the p to the `config.SyndicationWebhookURL`. The
+// webhook may answer with the URL of the copy it made as the "url" of a JSON
+// object.
+func syndicateToWebhook(p post, link string) (string, error) {
+	var r struct {
+		URL string `json:"url"`
+	}
+
+	if err := postJSON(
+		config.SyndicationWebhookURL,
+		nil,
+		map[string]interface{}{
+			"id":    p.ID,
+			"title": p.Title,
+			"url":   link,
+			"tags":  p.Tags,
+		},
+		&r,
+	); err != nil {
+		return "", err
+	}
+
+	return r.URL, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	htemplate "html/template"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aofei/air"
+)
+
+// templateFuncs returns the funcs of all the templates, the feed template
+// included:
+//
+//   - markdownify: renders the Markdown as a post, sanitized.
+//   - truncate: cuts the text down to the most characters, with an ellipsis.
+//   - slugify: turns the text into a slug, such as "hello-world".
+//   - absURL: resolves the path against the `config.BaseURL`.
+//   - jsonify: marshals the value as JSON that is safe in a script.
+//   - dateIn: gives the time in the time zone, such as "Asia/Shanghai".
+//   - xmlescape: escapes the text for XML.
+//   - timefmt: formats the time with the layout.
+//   - archived: gives the archived copy of the URL, if any.
+func templateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"markdownify": markdownify,
+		"truncate":    truncate,
+		"slugify":     slugify,
+		"absURL":      absURL,
+		"jsonify":     jsonify,
+		"dateIn":      dateIn,
+		"xmlescape":   xmlEscape,
+		"timefmt":     air.TemplateFuncMap["timefmt"],
+		"archived":    archivedURL,
+	}
+}
+
+// markdownify returns the Markdown s rendered into HTML as the content of the
+// posts is, with the `config.Render`.
+func markdownify(s string) htemplate.HTML {
+	return htemplate.HTML(postProcessHTML(
+		renderMarkdown([]byte(s), config.Render),
+		config.Render,
+	))
+}
+
+// truncate returns the s cut down to the n characters at most, ending with an
+// ellipsis if it is cut. It cuts at a space if there is one in the second half
+// of what is kept.
+func truncate(n int, s string) string {
+	if n < 1 {
+		return ""
+	} else if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	kept := string([]rune(s)[:n-1])
+	if i := strings.LastIndexFunc(kept, unicode.IsSpace); i > len(kept)/2 {
+		kept = strings.TrimRightFunc(kept[:i], unicode.IsSpace)
+	}
+
+	return kept + "…"
+}
+
+// slugify returns the s as a slug: the letters and the digits in lower case,
+// with anything else between them turned into single hyphens.
+func slugify(s string) string {
+	b := strings.Builder{}
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+
+	return b.String()
+}
+
+// absURL returns the p, a path of a route, as an absolute URL under the
+// `config.BaseURL`. The p is returned as it is if it is already absolute.
+func absURL(p string) string {
+	if strings.HasPrefix(p, "http://") ||
+		strings.HasPrefix(p, "https://") ||
+		strings.HasPrefix(p, "//") {
+		return p
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return config.BaseURL + p
+}
+
+// jsonify returns the v as JSON, which escapes the "<", the ">" and the "&" so
+// that it can be put into a script as it is.
+func jsonify(v interface{}) (htemplate.JS, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return htemplate.JS(b), nil
+}
+
+var (
+	// templateLocations is the cache of the time zones of the `dateIn`.
+	templateLocations      = map[string]*time.Location{}
+	templateLocationsMutex sync.Mutex
+)
+
+// dateIn returns the t in the time zone of the name, or in the UTC if there is
+// no such time zone.
+func dateIn(name string, t time.Time) time.Time {
+	templateLocationsMutex.Lock()
+	defer templateLocationsMutex.Unlock()
+
+	loc, ok := templateLocations[name]
+	if !ok {
+		var err error
+		if loc, err = time.LoadLocation(name); err != nil {
+			air.WARN("unknown time zone", map[string]interface{}{
+				"time_zone": name,
+			})
+			loc = time.UTC
+		}
+
+		templateLocations[name] = loc
+	}
+
+	return t.In(loc)
+}
+
+// xmlEscape returns the s escaped for the text and the attributes of XML.
+func xmlEscape(s string) string {
+	buf := bytes.Buffer{}
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{0, "Hello", ""},
+		{5, "Hello", "Hello"},
+		{4, "Hello", "Hel…"},
+		{13, "Hello, world and more", "Hello, world…"},
+		{10, "Hello, world and more", "Hello,…"},
+		{3, "你好世界", "你好…"},
+		{4, "你好世界", "你好世界"},
+		{7, "Ünïcödé ßtring", "Ünïcöd…"},
+		{9, "こんにちは 世界です", "こんにちは…"},
+	} {
+		if got := truncate(tc.n, tc.s); got != tc.want {
+			t.Errorf(
+				"truncate(%d, %q) = %q, want %q",
+				tc.n,
+				tc.s,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string
+	}{
+		{"", ""},
+		{"Hello, World!", "hello-world"},
+		{"  Go 1.11  ", "go-1-11"},
+		{"--already-a-slug--", "already-a-slug"},
+		{"Ünïcödé Straße", "ünïcödé-straße"},
+		{"你好，世界", "你好-世界"},
+		{"C++ & Go", "c-go"},
+	} {
+		if got := slugify(tc.s); got != tc.want {
+			t.Errorf(
+				"slugify(%q) = %q, want %q",
+				tc.s,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
+
+func TestAbsURL(t *testing.T) {
+	baseURL := config.BaseURL
+	defer func() {
+		config.BaseURL = baseURL
+	}()
+
+	for _, tc := range []struct {
+		baseURL string
+		p       string
+		want    string
+	}{
+		{
+			"https://example.com",
+			"/posts/foo",
+			"https://example.com/posts/foo",
+		},
+		{
+			"https://example.com",
+			"posts/foo",
+			"https://example.com/posts/foo",
+		},
+		{"https://example.com", "/", "https://example.com/"},
+		{
+			"https://example.com/blog",
+			"/posts/foo",
+			"https://example.com/blog/posts/foo",
+		},
+		{"https://example.com/blog", "/", "https://example.com/blog/"},
+		{
+			"https://example.com/blog",
+			"https://cdn.example.com/a.png",
+			"https://cdn.example.com/a.png",
+		},
+		{
+			"https://example.com/blog",
+			"//cdn.example.com/a.png",
+			"//cdn.example.com/a.png",
+		},
+		{
+			"https://example.com",
+			"/posts/你好",
+			"https://example.com/posts/你好",
+		},
+	} {
+		config.BaseURL = tc.baseURL
+		if got := absURL(tc.p); got != tc.want {
+			t.Errorf(
+				"absURL(%q) under %q = %q, want %q",
+				tc.p,
+				tc.baseURL,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
+
+func TestDateIn(t *testing.T) {
+	tm := time.Date(2018, 2, 23, 23, 36, 24, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"UTC", "2018-02-23T23:36:24Z"},
+		{"Asia/Shanghai", "2018-02-24T07:36:24+08:00"},
+		{"America/New_York", "2018-02-23T18:36:24-05:00"},
+		{"Asia/Kolkata", "2018-02-24T05:06:24+05:30"},
+		{"No/Such_Zone", "2018-02-23T23:36:24Z"},
+	} {
+		got := dateIn(tc.name, tm)
+		if s := got.Format(time.RFC3339); s != tc.want {
+			t.Errorf(
+				"dateIn(%q) = %s, want %s",
+				tc.name,
+				s,
+				tc.want,
+			)
+		} else if !got.Equal(tm) {
+			t.Errorf("dateIn(%q) changed the instant", tc.name)
+		}
+	}
+}
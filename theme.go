@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+)
+
+var (
+	themeMutex sync.Mutex
+
+	// defaultTemplateRoot and defaultAssetRoot are the roots of the
+	// default theme, which the `config.Theme` falls back to.
+	defaultTemplateRoot string
+	defaultAssetRoot    string
+)
+
+// themeDir returns the directory of the dir ("templates" or "assets") of the
+// `config.Theme`.
+func themeDir(dir string) string {
+	return filepath.Join("themes", config.Theme, dir)
+}
+
+// setupTheme switches the `air.TemplateRoot` and the `air.AssetRoot` to the
+// `config.Theme`, if any. As the air renders from a single root, the roots
+// become temporary directories holding the files of the default theme with
+// the ones of the `config.Theme` on top, so a theme only has to have the
+// files it changes.
+func setupTheme() error {
+	defaultTemplateRoot = air.TemplateRoot
+	defaultAssetRoot = air.AssetRoot
+	if config.Theme == "" {
+		return nil
+	}
+
+	if fi, err := os.Stat(
+		filepath.Join("themes", config.Theme),
+	); err != nil || !fi.IsDir() {
+		return fmt.Errorf("unknown theme %q", config.Theme)
+	}
+
+	for _, root := range []*string{&air.TemplateRoot, &air.AssetRoot} {
+		tmp, err := ioutil.TempDir("", "blog-theme-")
+		if err != nil {
+			return err
+		}
+
+		*root = tmp
+	}
+
+	return buildTheme()
+}
+
+// buildTheme fills the `air.TemplateRoot` and the `air.AssetRoot` from the
+// default theme and the `config.Theme`. The files removed from them stay until
+// the next start, so that nothing goes missing while being rendered. It does
+// nothing without a theme.
+func buildTheme() error {
+	if config.Theme == "" {
+		return nil
+	}
+
+	themeMutex.Lock()
+	defer themeMutex.Unlock()
+
+	for _, r := range []struct {
+		dir, from, to string
+	}{
+		{"templates", defaultTemplateRoot, air.TemplateRoot},
+		{"assets", defaultAssetRoot, air.AssetRoot},
+	} {
+		if err := copyDir(r.from, r.to); err != nil &&
+			!os.IsNotExist(err) {
+			return err
+		}
+
+		if err := copyDir(themeDir(r.dir), r.to); err != nil &&
+			!os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// themeSourceRoots returns the directories the files of the
+// `air.TemplateRoot` and the `air.AssetRoot` come from, which are the ones to
+// watch for changes.
+func themeSourceRoots() []string {
+	if config.Theme == "" {
+		return []string{air.TemplateRoot, air.AssetRoot}
+	}
+
+	return []string{
+		defaultTemplateRoot,
+		defaultAssetRoot,
+		themeDir("templates"),
+		themeDir("assets"),
+	}
+}
+
+// isAssetSource reports whether the file named filename is an asset of the
+// default theme or of the `config.Theme`.
+func isAssetSource(filename string) bool {
+	roots := []string{defaultAssetRoot}
+	if config.Theme != "" {
+		roots = append(roots, themeDir("assets"))
+	}
+
+	filename = filepath.Clean(filename)
+	for _, root := range roots {
+		if strings.HasPrefix(filename, filepath.Clean(root)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// errHandlerTimeout is the error of a request whose handler took longer than
+// its `handlerTimeout`.
+var errHandlerTimeout = errors.New("Service Unavailable")
+
+// handlerTimeouts is the parsed `config.HandlerTimeouts`.
+var handlerTimeouts map[string]time.Duration
+
+// handlerTimeoutExemptPaths is the prefixes of the paths that are never given
+// up on, whatever the `handlerTimeouts` say. Their handlers stream the files
+// and the archives as they read them, which must not be held in memory.
+var handlerTimeoutExemptPaths = []string{
+	"/admin/export",
+	"/assets/",
+	"/fonts/",
+	"/images/",
+	"/uploads/",
+	"/videos/",
+}
+
+// setupTimeouts checks the `config.HandlerTimeouts` into the `handlerTimeouts`
+// and sets the timeouts of the server.
+func setupTimeouts() error {
+	for _, t := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"request_header_timeout", config.RequestHeaderTimeout,
+			&air.ReadHeaderTimeout},
+		{"request_read_timeout", config.RequestReadTimeout,
+			&air.ReadTimeout},
+		{"response_write_timeout", config.ResponseWriteTimeout,
+			&air.WriteTimeout},
+	} {
+		if t.value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(t.value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad %s %q", t.name, t.value)
+		}
+
+		*t.d = d
+	}
+
+	hts := make(map[string]time.Duration, len(config.HandlerTimeouts))
+	for prefix, s := range config.HandlerTimeouts {
+		d, err := time.ParseDuration(s)
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("bad timeout prefix %q", prefix)
+		} else if err != nil || d < 0 {
+			return fmt.Errorf("bad handler timeout of %s", prefix)
+		} else if air.WriteTimeout > 0 && d >= air.WriteTimeout {
+			return fmt.Errorf(
+				"handler timeout of %s is not shorter than "+
+					"the response write timeout",
+				prefix,
+			)
+		}
+
+		hts[prefix] = d
+	}
+
+	handlerTimeouts = hts
+
+	return nil
+}
+
+// handlerTimeout returns how long the handling of the requests to the path may
+// take, which is that of the longest of the path prefixes of the
+// `handlerTimeouts` that the path has. Zero means no limit, as for the
+// `handlerTimeoutExemptPaths` and the paths that no prefix matches.
+func handlerTimeout(path string) time.Duration {
+	for _, prefix := range handlerTimeoutExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return 0
+		}
+	}
+
+	longest := ""
+	for prefix := range handlerTimeouts {
+		if strings.HasPrefix(path, prefix) &&
+			len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+
+	return handlerTimeouts[longest]
+}
+
+// handlerTimeoutGas is an `air.Gas` that gives up on the requests whose
+// handling takes longer than the `handlerTimeout` and answers them with a 503,
+// so that a stuck handler (or a slow `parsePosts` that all the others wait
+// for) can't hold the clients forever. It must be a pregas after the
+// `earlyHintsGas`, whose 103 is to be sent right away.
+//
+// Since a handler can't be stopped, the next runs on copies of the req and the
+// res that it may keep changing after being given up on, and what it writes is
+// recorded and only sent if it finishes in time. The copy of the res shares
+// nothing with the res, which is answered with the 503 meanwhile.
+func handlerTimeoutGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		d := handlerTimeout(httpRequest(req).URL.Path)
+		if d <= 0 {
+			return next(req, res)
+		}
+
+		// The headers and the cookies are parsed once for all the
+		// copies of the req, so they must be parsed into this one.
+		req.Headers()
+		req.Cookies()
+
+		hreq := *req
+		hreq.Values = make(map[string]interface{}, len(req.Values))
+		for k, v := range req.Values {
+			hreq.Values[k] = v
+		}
+
+		rec := &pageRecorder{
+			header: http.Header{},
+		}
+		hrw := httpResponseWriter(req, res)
+		for k, vs := range hrw.Header() {
+			rec.header[k] = append([]string{}, vs...)
+		}
+
+		hres := copyResponse(&hreq, res)
+		setHTTPResponseWriter(&hreq, hres, rec)
+
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- fmt.Errorf("%v", r)
+				}
+			}()
+
+			done <- next(&hreq, hres)
+		}()
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case err := <-done:
+			for k, v := range hreq.Values {
+				req.Values[k] = v
+			}
+
+			res.Status = hres.Status
+			if !hres.Written {
+				return err
+			}
+
+			for k, vs := range rec.header {
+				hrw.Header()[k] = vs
+			}
+
+			if rec.status == 0 {
+				rec.status = 200
+			}
+
+			hrw.WriteHeader(rec.status)
+			if _, werr := hrw.Write(rec.body.Bytes()); werr != nil {
+				return werr
+			}
+
+			res.Status = rec.status
+			res.Written = true
+
+			return err
+		case <-timer.C:
+		}
+
+		air.WARN("handler timed out", map[string]interface{}{
+			"path":    req.Path,
+			"timeout": d.String(),
+		})
+
+		res.Status = 503
+		res.SetHeader("retry-after", "30")
+
+		return errHandlerTimeout
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// writeTestCertificate writes a self-signed certificate for the "localhost"
+// and its key into the dir, returning their filenames.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: kb,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+// TestHandlerTimeoutGasHTTP2 checks that the responses held by the
+// `handlerTimeoutGas` keep their statuses over HTTP/2, where the
+// `earlyHintsGas` sends a 103 ahead of them.
+func TestHandlerTimeoutGasHTTP2(t *testing.T) {
+	address := air.Address
+	certFile, keyFile := air.TLSCertFile, air.TLSKeyFile
+	pregases, gases := air.Pregases, air.Gases
+	earlyHintsEnabled, preloads := config.EarlyHintsEnabled, config.Preloads
+	hts := handlerTimeouts
+	defer func() {
+		air.Close()
+		air.Address, air.TLSCertFile, air.TLSKeyFile =
+			address, certFile, keyFile
+		air.Pregases, air.Gases = pregases, gases
+		config.EarlyHintsEnabled, config.Preloads =
+			earlyHintsEnabled, preloads
+		handlerTimeouts = hts
+	}()
+
+	// The preloads of the assets need no posts.
+	postsOnce.Do(func() {})
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	air.Address = l.Addr().String()
+	l.Close()
+
+	air.TLSCertFile, air.TLSKeyFile = writeTestCertificate(t, t.TempDir())
+	air.Pregases = []air.Gas{
+		func(next air.Handler) air.Handler {
+			return func(req *air.Request, res *air.Response) error {
+				res.SetHeader("x-test", "before")
+				return next(req, res)
+			}
+		},
+		earlyHintsGas,
+		handlerTimeoutGas,
+	}
+	air.Gases = nil
+	config.EarlyHintsEnabled = true
+	config.Preloads = map[string][]string{"/": {"/assets/main.css"}}
+	handlerTimeouts = map[string]time.Duration{
+		"/":                  time.Minute,
+		"/timeout-test/slow": 10 * time.Millisecond,
+	}
+
+	for path, status := range map[string]int{
+		"/timeout-test/ok":       200,
+		"/timeout-test/missing":  404,
+		"/timeout-test/failed":   500,
+		"/timeout-test/redirect": 302,
+	} {
+		status := status
+		air.GET(path, func(req *air.Request, res *air.Response) error {
+			if status == 302 {
+				return res.Redirect("/timeout-test/ok")
+			}
+
+			res.Status = status
+			return res.WriteString(http.StatusText(status))
+		})
+	}
+
+	// The slow handler keeps changing its response after being given up
+	// on, which must not reach the one answered with the 503.
+	givenUp, slowDone := make(chan struct{}), make(chan struct{})
+	defer func() {
+		<-slowDone
+	}()
+
+	air.GET("/timeout-test/slow", func(
+		req *air.Request,
+		res *air.Response,
+	) error {
+		defer close(slowDone)
+
+		for {
+			res.SetHeader("x-test", "after")
+			select {
+			case <-givenUp:
+				res.SetHeader("x-test-after", "after")
+				return res.WriteString("late")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	go air.Serve()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	get := func(path string) (*http.Response, int, error) {
+		earlyHints := 0
+		req, err := http.NewRequest(
+			"GET",
+			"https://"+air.Address+path,
+			nil,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		req.Header.Set("accept", "text/html")
+		req = req.WithContext(httptrace.WithClientTrace(
+			req.Context(),
+			&httptrace.ClientTrace{
+				Got1xxResponse: func(
+					code int,
+					_ textproto.MIMEHeader,
+				) error {
+					if code == http.StatusEarlyHints {
+						earlyHints++
+					}
+
+					return nil
+				},
+			},
+		))
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		res.Body.Close()
+
+		return res, earlyHints, nil
+	}
+
+	for i := 0; ; i++ {
+		if _, _, err := get("/timeout-test/ok"); err == nil {
+			break
+		} else if i == 100 {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/timeout-test/ok", 200},
+		{"/timeout-test/missing", 404},
+		{"/timeout-test/failed", 500},
+		{"/timeout-test/redirect", 302},
+		{"/timeout-test/slow", 503},
+	} {
+		res, earlyHints, err := get(tc.path)
+		if tc.status == 503 {
+			close(givenUp)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.ProtoMajor != 2 {
+			t.Fatalf("%s: got %s, want HTTP/2", tc.path, res.Proto)
+		}
+
+		if res.StatusCode != tc.status {
+			t.Errorf(
+				"%s: got %d, want %d",
+				tc.path,
+				res.StatusCode,
+				tc.status,
+			)
+		}
+
+		if earlyHints != 1 {
+			t.Errorf(
+				"%s: got %d early hints, want 1",
+				tc.path,
+				earlyHints,
+			)
+		}
+
+		if res.Header.Get("link") == "" {
+			t.Errorf("%s: got no link header", tc.path)
+		}
+
+		if res.Header.Get("x-test") != "before" {
+			t.Errorf(
+				"%s: got x-test %q, want \"before\"",
+				tc.path,
+				res.Header.Get("x-test"),
+			)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// feedTombstoneMaxAge is how long a removed post keeps being announced as
+// deleted in the feed.
+const feedTombstoneMaxAge = 30 * 24 * time.Hour
+
+// feedTombstone is a post removed from the feed (RFC 6721).
+type feedTombstone struct {
+	Ref  string    `json:"ref"`
+	When time.Time `json:"when"`
+}
+
+// feedEntries is the record of the feed entries across reloads.
+type feedEntries struct {
+	Refs       []string        `json:"refs"`
+	Tombstones []feedTombstone `json:"tombstones"`
+}
+
+var (
+	feedEntriesLoaded bool
+	lastFeedEntries   feedEntries
+)
+
+// feedEntryID returns the stable ID of the p's feed entry. Unless pinned in
+// the p's front matter, it is a tag URI (RFC 4151) made of the host of the
+// `config.BaseURL`, the p's date and the p's ID, so it survives changes of
+// the URLs.
+func feedEntryID(p post) string {
+	if p.EntryID != "" {
+		return p.EntryID
+	}
+
+	host := config.BaseURL
+	if u, err := url.Parse(config.BaseURL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+
+	return fmt.Sprintf(
+		"tag:%s,%s:%s",
+		host,
+		p.Datetime.Format("2006-01-02"),
+		p.ID,
+	)
+}
+
+// updateFeedTombstones returns the tombstones of the entries that were in the
+// feed before but are not among the ops anymore. The record of the entries is
+// kept in the `config.FeedEntriesFile` (if any) so that removals made while
+// the blog is down are noticed too.
+func updateFeedTombstones(ops []post) []feedTombstone {
+	if !feedEntriesLoaded {
+		feedEntriesLoaded = true
+		if err := loadFeedEntries(); err != nil {
+			air.ERROR(
+				"failed to load feed entries",
+				map[string]interface{}{
+					"file":  config.FeedEntriesFile,
+					"error": err.Error(),
+				},
+			)
+		}
+	}
+
+	refs := make([]string, 0, len(ops))
+	current := make(map[string]bool, len(ops))
+	for _, p := range ops {
+		refs = append(refs, p.EntryID)
+		current[p.EntryID] = true
+	}
+
+	now := time.Now().UTC()
+	tombstones := []feedTombstone{}
+	for _, t := range lastFeedEntries.Tombstones {
+		if !current[t.Ref] && now.Sub(t.When) < feedTombstoneMaxAge {
+			tombstones = append(tombstones, t)
+		}
+	}
+
+	for _, ref := range lastFeedEntries.Refs {
+		if !current[ref] {
+			tombstones = append(tombstones, feedTombstone{
+				Ref:  ref,
+				When: now,
+			})
+		}
+	}
+
+	sort.SliceStable(tombstones, func(i, j int) bool {
+		return tombstones[i].When.After(tombstones[j].When)
+	})
+
+	sort.Strings(refs)
+	lastFeedEntries = feedEntries{
+		Refs:       refs,
+		Tombstones: tombstones,
+	}
+
+	if err := saveFeedEntries(); err != nil {
+		air.ERROR(
+			"failed to save feed entries",
+			map[string]interface{}{
+				"file":  config.FeedEntriesFile,
+				"error": err.Error(),
+			},
+		)
+	}
+
+	return tombstones
+}
+
+// loadFeedEntries loads the `lastFeedEntries` from the
+// `config.FeedEntriesFile`.
+func loadFeedEntries() error {
+	if config.FeedEntriesFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(config.FeedEntriesFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, &lastFeedEntries)
+}
+
+// saveFeedEntries saves the `lastFeedEntries` to the `config.FeedEntriesFile`.
+func saveFeedEntries() error {
+	if config.FeedEntriesFile == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(lastFeedEntries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if ob, err := ioutil.ReadFile(config.FeedEntriesFile); err == nil &&
+		string(ob) == string(b) {
+		return nil
+	}
+
+	tmp := config.FeedEntriesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, config.FeedEntriesFile)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aofei/air"
+	"golang.org/x/text/language"
+)
+
+// translationLabel is the locale key of the label of the automatic
+// translations.
+const translationLabel = "Automatic translation"
+
+// translator is a machine translation backend.
+type translator interface {
+	// Translate translates the plain text from the language from to the
+	// language to. Both are BCP 47 tags.
+	Translate(text, from, to string) (string, error)
+}
+
+// translators is the available translation backends by their names in the
+// `config.TranslationBackend`.
+var translators = map[string]func() translator{
+	"libretranslate": func() translator {
+		return libreTranslator{}
+	},
+}
+
+var (
+	translationBackend translator
+
+	// translationLocales is the configured locales, which are the ones
+	// that have a locale file, and translationLocaleStrings is their
+	// strings.
+	translationLocales       []string
+	translationLocaleStrings map[string]map[string]string
+	translationMatcher       language.Matcher
+
+	translationsMutex sync.Mutex
+	translations      = map[string]string{}
+	translationsBusy  int32
+)
+
+// translationsFilename returns the name of the file of the `translations`.
+func translationsFilename() string {
+	return filepath.Join(config.DataRoot, "translations.json")
+}
+
+// setupTranslation finds the configured locales and, if the
+// `config.TranslationBackend` is set, prepares it and loads the cached
+// `translations`.
+func setupTranslation() error {
+	lfs, err := filepath.Glob(filepath.Join(air.LocaleRoot, "*.toml"))
+	if err != nil {
+		return err
+	}
+
+	ls := make([]string, 0, len(lfs))
+	lss := make(map[string]map[string]string, len(lfs))
+	ts := make([]language.Tag, 0, len(lfs))
+	for _, lf := range lfs {
+		l := strings.TrimSuffix(filepath.Base(lf), ".toml")
+		t, err := language.Parse(l)
+		if err != nil {
+			return err
+		}
+
+		strs := map[string]string{}
+		if _, err := toml.DecodeFile(lf, &strs); err != nil {
+			return err
+		}
+
+		ls = append(ls, l)
+		lss[l] = strs
+		ts = append(ts, t)
+	}
+
+	translationLocales = ls
+	translationLocaleStrings = lss
+	translationMatcher = language.NewMatcher(ts)
+
+	if config.TranslationBackend == "" {
+		return nil
+	}
+
+	nt, ok := translators[config.TranslationBackend]
+	if !ok {
+		return fmt.Errorf(
+			"unknown translation backend %q",
+			config.TranslationBackend,
+		)
+	}
+
+	translationBackend = nt()
+
+	b, err := ioutil.ReadFile(translationsFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	translationsMutex.Lock()
+	defer translationsMutex.Unlock()
+
+	return json.Unmarshal(b, &translations)
+}
+
+// saveTranslations saves the `translations`. It must be called with the
+// `translationsMutex` held.
+func saveTranslations() error {
+	b, err := json.MarshalIndent(translations, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	filename := translationsFilename()
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// requestLocale returns the configured locale that best matches the
+// "Accept-Language" of the req, the same way as Air localizes the req.
+func requestLocale(req *air.Request) string {
+	if len(translationLocales) == 0 {
+		return air.LocaleBase
+	}
+
+	als := []string{}
+	if alh := req.Header("accept-language"); alh != nil {
+		als = alh.Values
+	}
+
+	_, i := language.MatchStrings(translationMatcher, als...)
+
+	return translationLocales[i]
+}
+
+// postLanguage returns the language of the p, which is the `language` of its
+// front matter or the `air.LocaleBase`.
+func postLanguage(p post) string {
+	if p.Language != "" {
+		return p.Language
+	}
+
+	return air.LocaleBase
+}
+
+// baseLanguage returns the base language of the tag, such as the "zh" of the
+// "zh-CN".
+func baseLanguage(tag string) string {
+	b, _ := language.Make(tag).Base()
+	return b.String()
+}
+
+// postSummary returns the summary of the p in its own language.
+func postSummary(p post) string {
+	return searchSnippet(htmlToText(string(p.Content)), "")
+}
+
+// translationKey returns the key of the translation of the text to the
+// locale in the `translations`.
+func translationKey(text, locale string) string {
+	return fmt.Sprintf(
+		"%s|%x",
+		locale,
+		sha256.Sum256([]byte(text)),
+	)
+}
+
+// translatedSummary returns the automatically translated summary of the p for
+// the locale, labeled as such in the locale. It is empty if the p is already
+// in the language of the locale, or if there is no translation yet.
+func translatedSummary(p post, locale string) string {
+	if translationBackend == nil ||
+		baseLanguage(postLanguage(p)) == baseLanguage(locale) {
+		return ""
+	}
+
+	translationsMutex.Lock()
+	t, ok := translations[translationKey(postSummary(p), locale)]
+	translationsMutex.Unlock()
+	if !ok {
+		return ""
+	}
+
+	label := translationLabel
+	if l, ok := translationLocaleStrings[locale][label]; ok {
+		label = l
+	}
+
+	return fmt.Sprintf("[%s] %s", label, t)
+}
+
+// translatedSummaries returns the `translatedSummary` of each of the ops for
+// the locale by the IDs of the ops.
+func translatedSummaries(ops []post, locale string) map[string]string {
+	tss := map[string]string{}
+	for _, p := range ops {
+		if ts := translatedSummary(p, locale); ts != "" {
+			tss[p.ID] = ts
+		}
+	}
+
+	return tss
+}
+
+// translateSummaries translates the summaries of the ops into all the other
+// configured locales that they aren't already translated into, and forgets
+// the translations that are no longer needed. It is meant to be run in the
+// background after the posts are parsed, and only one run happens at a time.
+func translateSummaries(ops []post) {
+	if translationBackend == nil ||
+		!atomic.CompareAndSwapInt32(&translationsBusy, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&translationsBusy, 0)
+
+	needed := map[string]bool{}
+	translated := 0
+	for _, p := range ops {
+		summary := postSummary(p)
+		from := postLanguage(p)
+		for _, l := range translationLocales {
+			if baseLanguage(from) == baseLanguage(l) {
+				continue
+			}
+
+			key := translationKey(summary, l)
+			needed[key] = true
+
+			translationsMutex.Lock()
+			_, ok := translations[key]
+			translationsMutex.Unlock()
+			if ok {
+				continue
+			}
+
+			t, err := translationBackend.Translate(summary, from, l)
+			if err != nil {
+				air.ERROR(
+					"failed to translate post summary",
+					map[string]interface{}{
+						"post_id": p.ID,
+						"locale":  l,
+						"error":   err.Error(),
+					},
+				)
+				continue
+			}
+
+			translationsMutex.Lock()
+			translations[key] = t
+			translationsMutex.Unlock()
+			translated++
+		}
+	}
+
+	translationsMutex.Lock()
+	defer translationsMutex.Unlock()
+
+	forgotten := 0
+	for key := range translations {
+		if !needed[key] {
+			delete(translations, key)
+			forgotten++
+		}
+	}
+
+	if translated == 0 && forgotten == 0 {
+		return
+	}
+
+	if err := saveTranslations(); err != nil {
+		air.ERROR(
+			"failed to save translations",
+			map[string]interface{}{
+				"error": err.Error(),
+			},
+		)
+	}
+
+	if translated > 0 {
+		bumpContentVersion()
+	}
+}
+
+// libreTranslator is a `translator` backed by a LibreTranslate server at the
+// `config.TranslationURL`.
+type libreTranslator struct{}
+
+// Translate implements the `translator`.
+func (libreTranslator) Translate(text, from, to string) (string, error) {
+	b, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  baseLanguage(from),
+		"target":  baseLanguage(to),
+		"format":  "text",
+		"api_key": config.TranslationAPIKey,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	fr, err := fetch(
+		"POST",
+		strings.TrimSuffix(config.TranslationURL, "/")+"/translate",
+		http.Header{"Content-Type": {"application/json"}},
+		b,
+	)
+	if err != nil {
+		return "", err
+	} else if fr.Status != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", fr.Status)
+	}
+
+	r := struct {
+		TranslatedText string `json:"translatedText"`
+	}{}
+	if err := json.Unmarshal(fr.Body, &r); err != nil {
+		return "", err
+	} else if r.TranslatedText == "" {
+		return "", errors.New("empty translation")
+	}
+
+	return r.TranslatedText, nil
+}
+
+// localizedFeedHandler serves the feed for the locale of the ":Locale" param,
+// where the entries in the other languages carry their automatically
+// translated summaries.
+func localizedFeedHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	locale := paramValue(req, "Locale")
+	if _, ok := translationLocaleStrings[locale]; !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	latestPosts := snap.orderedPosts
+	if len(latestPosts) > config.FeedEntries {
+		latestPosts = latestPosts[:config.FeedEntries]
+	}
+
+	b, err := renderFeed(map[string]interface{}{
+		"BaseURL":   config.BaseURL,
+		"Title":     config.Title,
+		"FeedPath":  "/feeds/" + locale,
+		"Locale":    locale,
+		"Summaries": translatedSummaries(latestPosts, locale),
+		"Posts":     latestPosts,
+		"Updated":   lastUpdated(latestPosts),
+	})
+	if err != nil {
+		return err
+	}
+
+	res.SetHeader("content-type", "application/atom+xml; charset=utf-8")
+	res.SetHeader("cache-control", "max-age=3600")
+
+	return res.WriteBlob(b)
+}
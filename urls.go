@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// urlAttrs is the attributes that hold URLs.
+var urlAttrs = map[string]bool{
+	"action": true,
+	"cite":   true,
+	"href":   true,
+	"poster": true,
+	"src":    true,
+}
+
+// absolutizeURLs returns the h with all the relative URLs in it resolved
+// against the base, for the places such as feed readers and mail clients
+// where the h isn't seen at its own URL.
+func absolutizeURLs(h string, base string) string {
+	bu, err := url.Parse(base)
+	if err != nil {
+		return h
+	}
+
+	resolve := func(s string) string {
+		u, err := bu.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return s
+		}
+
+		return u.String()
+	}
+
+	buf := bytes.Buffer{}
+	z := html.NewTokenizer(strings.NewReader(h))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		} else if tt != html.StartTagToken &&
+			tt != html.SelfClosingTagToken {
+			buf.Write(z.Raw())
+			continue
+		}
+
+		raw := string(z.Raw())
+		t := z.Token()
+		changed := false
+		for i, a := range t.Attr {
+			if urlAttrs[a.Key] {
+				t.Attr[i].Val = resolve(a.Val)
+			} else if a.Key == "srcset" {
+				cs := strings.Split(a.Val, ",")
+				for j, c := range cs {
+					fs := strings.Fields(c)
+					if len(fs) > 0 {
+						fs[0] = resolve(fs[0])
+						cs[j] = strings.Join(fs, " ")
+					}
+				}
+
+				t.Attr[i].Val = strings.Join(cs, ", ")
+			} else {
+				continue
+			}
+
+			changed = changed || t.Attr[i].Val != a.Val
+		}
+
+		if changed {
+			buf.WriteString(t.String())
+		} else {
+			buf.WriteString(raw)
+		}
+	}
+
+	return buf.String()
+}
+
+// AbsoluteContent returns the content of the p with all the relative URLs in
+// it resolved against the p's URL.
+func (p post) AbsoluteContent() string {
+	return absolutizeURLs(string(p.Content), config.BaseURL+p.Permalink)
+}
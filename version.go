@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+var (
+	contentVersion           = uint64(time.Now().UnixNano())
+	contentVersionReloadedAt atomic.Value
+)
+
+// currentContentVersion returns the version of the content being served. It
+// increases every time the posts, the templates or the assets are successfully
+// reloaded, and never goes back. It starts at the time the blog started in
+// nanoseconds, so that it doesn't go back across restarts either.
+func currentContentVersion() uint64 {
+	return atomic.LoadUint64(&contentVersion)
+}
+
+// bumpContentVersion moves the content to the next version. Everything cached
+// for the previous versions is dropped.
+func bumpContentVersion() {
+	atomic.AddUint64(&contentVersion, 1)
+	contentVersionReloadedAt.Store(time.Now().UTC())
+	pageCache.purge()
+}
+
+// contentVersionGas is an `air.Gas` that tells the clients which version of
+// the content they are being served.
+func contentVersionGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		res.SetHeader(
+			"x-content-version",
+			strconv.FormatUint(currentContentVersion(), 10),
+		)
+		return next(req, res)
+	}
+}
+
+func statusHandler(req *air.Request, res *air.Response) error {
+	loadedPosts()
+
+	status := map[string]interface{}{
+		"content_version": currentContentVersion(),
+	}
+	if t, ok := contentVersionReloadedAt.Load().(time.Time); ok {
+		status["reloaded_at"] = t.Format(time.RFC3339)
+	}
+
+	subsystems := map[string]interface{}{}
+	for _, hb := range heartbeatSnapshot() {
+		subsystems[hb.Name] = map[string]interface{}{
+			"last_beat": hb.Last.Format(time.RFC3339),
+			"stale":     hb.Stale(),
+			"restarts":  hb.Restarts,
+		}
+	}
+
+	status["subsystems"] = subsystems
+
+	res.SetHeader("cache-control", "no-cache")
+
+	return res.WriteJSON(status)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+)
+
+// postVideo is the video of a post.
+type postVideo struct {
+	Sources []videoSource `toml:"sources"`
+	Poster  string        `toml:"poster"`
+	Width   int           `toml:"width"`
+	Height  int           `toml:"height"`
+	Preview string        `toml:"-"`
+}
+
+// videoSource is one of the encodings of a `postVideo`.
+type videoSource struct {
+	Src  string `toml:"src"`
+	Type string `toml:"type"`
+}
+
+var videoPreviewsGenerating sync.Map
+
+// prepareVideo fills in the missing parts of the v, and starts generating its
+// preview if it doesn't have one yet.
+func prepareVideo(v *postVideo) {
+	for i := range v.Sources {
+		if s := &v.Sources[i]; s.Type == "" {
+			s.Type = mime.TypeByExtension(path.Ext(s.Src))
+		}
+	}
+
+	if len(v.Sources) == 0 || !config.VideoPreviewEnabled {
+		return
+	}
+
+	src := v.Sources[0].Src
+	if !strings.HasPrefix(src, "/videos/") {
+		return
+	}
+
+	preview := strings.TrimSuffix(src, path.Ext(src)) + ".preview.gif"
+	in, ok := videoFilename(src)
+	if !ok {
+		return
+	}
+
+	out, ok := videoFilename(preview)
+	if !ok {
+		return
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		v.Preview = preview
+		if v.Poster == "" {
+			v.Poster = preview
+		}
+
+		return
+	}
+
+	if _, loaded := videoPreviewsGenerating.LoadOrStore(
+		src,
+		true,
+	); !loaded {
+		go generateVideoPreview(src, in, out)
+	}
+}
+
+// generateVideoPreview generates the animated preview of the video at the src
+// of the file in into the file out using the FFmpeg. The posts are reparsed
+// afterwards to pick the preview up.
+func generateVideoPreview(src, in, out string) {
+	defer videoPreviewsGenerating.Delete(src)
+
+	b, err := exec.Command(
+		config.FFmpegPath,
+		"-y",
+		"-loglevel", "error",
+		"-t", "3",
+		"-i", in,
+		"-vf", "fps=10,scale=320:-1:flags=lanczos",
+		out,
+	).CombinedOutput()
+	if err != nil {
+		air.ERROR(
+			"failed to generate video preview",
+			map[string]interface{}{
+				"video":  src,
+				"error":  err.Error(),
+				"output": string(b),
+			},
+		)
+		return
+	}
+
+	requestPostsReload()
+}
+
+// videoFilename returns the name of the file that the video path p refers to.
+// It reports false if the p refers to nothing under the `config.VideoRoot`.
+func videoFilename(p string) (string, bool) {
+	return rootedFilename(config.VideoRoot, "/videos", p)
+}
+
+// rootedFilename returns the name of the file under the root that the p,
+// whose prefix stands for the root, refers to. It reports false if the root
+// is unset or if the file resolves outside of it, symbolic links included.
+func rootedFilename(root, prefix, p string) (string, bool) {
+	if root == "" {
+		return "", false
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+
+	filename := filepath.Join(
+		root,
+		filepath.FromSlash(path.Clean(
+			"/"+strings.TrimPrefix(p, prefix),
+		)),
+	)
+	if !withinRoot(root, filename) {
+		return "", false
+	}
+
+	// The files that don't exist yet, like the ones about to be generated,
+	// can only be checked by their names.
+	rfn, err := filepath.EvalSymlinks(filename)
+	if os.IsNotExist(err) {
+		return filename, true
+	} else if err != nil {
+		return "", false
+	}
+
+	if rr, err := filepath.EvalSymlinks(root); err != nil ||
+		!withinRoot(rr, rfn) {
+		return "", false
+	}
+
+	return filename, true
+}
+
+// withinRoot reports whether the filename is the root or is under it.
+func withinRoot(root, filename string) bool {
+	rel, err := filepath.Rel(root, filename)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator)) &&
+		!filepath.IsAbs(rel)
+}
+
+func videoHandler(req *air.Request, res *air.Response) error {
+	filename, ok := videoFilename(routePath(req))
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("cache-control", "max-age=86400")
+	return serveFile(req, res, filename)
+}
+
+// serveFile serves the file named filename with the support of the ranges.
+func serveFile(req *air.Request, res *air.Response, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return air.NotFoundHandler(req, res)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("accept-ranges", "bytes")
+
+	http.ServeContent(
+		httpResponseWriter(req, res),
+		httpRequest(req),
+		fi.Name(),
+		fi.ModTime(),
+		f,
+	)
+
+	return nil
+}
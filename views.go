@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// viewStats is the persisted view counts of the posts, the referrer domains,
+// the referrer domains of each post (by the `postReferrerKey`s) and the
+// campaigns.
+type viewStats struct {
+	Posts         map[string]uint64 `json:"posts"`
+	Referrers     map[string]uint64 `json:"referrers"`
+	PostReferrers map[string]uint64 `json:"post_referrers"`
+	Campaigns     map[string]uint64 `json:"campaigns"`
+}
+
+// viewCount is the count of a key of the `viewStats`.
+type viewCount struct {
+	Key   string
+	Count uint64
+}
+
+var (
+	viewsMutex sync.Mutex
+	views      = viewStats{
+		Posts:         map[string]uint64{},
+		Referrers:     map[string]uint64{},
+		PostReferrers: map[string]uint64{},
+		Campaigns:     map[string]uint64{},
+	}
+	viewsDirty bool
+
+	// viewsSalt and viewsSeen tell the visitors apart for the viewsDay
+	// only. Both are thrown away once the day is over, so the hashes
+	// can't be linked across days, and neither ever touches the disk.
+	viewsSalt []byte
+	viewsSeen map[[sha256.Size]byte]bool
+	viewsDay  string
+)
+
+// loadViews loads the `views` from the `store`.
+func loadViews() error {
+	vs, err := store.Views()
+	if err != nil {
+		return err
+	}
+
+	if vs.Posts == nil {
+		vs.Posts = map[string]uint64{}
+	}
+
+	if vs.Referrers == nil {
+		vs.Referrers = map[string]uint64{}
+	}
+
+	if vs.PostReferrers == nil {
+		vs.PostReferrers = map[string]uint64{}
+	}
+
+	if vs.Campaigns == nil {
+		vs.Campaigns = map[string]uint64{}
+	}
+
+	viewsMutex.Lock()
+	views = vs
+	viewsMutex.Unlock()
+
+	return nil
+}
+
+// saveViews saves the `views` to the `store` if they have changed.
+func saveViews() error {
+	viewsMutex.Lock()
+	if !viewsDirty {
+		viewsMutex.Unlock()
+		return nil
+	}
+
+	vs := viewStats{
+		Posts:     make(map[string]uint64, len(views.Posts)),
+		Referrers: make(map[string]uint64, len(views.Referrers)),
+		PostReferrers: make(
+			map[string]uint64,
+			len(views.PostReferrers),
+		),
+		Campaigns: make(map[string]uint64, len(views.Campaigns)),
+	}
+	for k, v := range views.Posts {
+		vs.Posts[k] = v
+	}
+
+	for k, v := range views.Referrers {
+		vs.Referrers[k] = v
+	}
+
+	for k, v := range views.PostReferrers {
+		vs.PostReferrers[k] = v
+	}
+
+	for k, v := range views.Campaigns {
+		vs.Campaigns[k] = v
+	}
+
+	viewsDirty = false
+	viewsMutex.Unlock()
+
+	return store.SaveViews(vs)
+}
+
+// countView counts a view of the post of the postID by the visitor of the ip
+// and the ua coming from the referrer, unless the visitor has viewed it
+// today.
+func countView(postID, ip, ua, referrer string) {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	viewsMutex.Lock()
+	defer viewsMutex.Unlock()
+
+	if day != viewsDay {
+		viewsSalt = make([]byte, 32)
+		if _, err := rand.Read(viewsSalt); err != nil {
+			return
+		}
+
+		viewsSeen = map[[sha256.Size]byte]bool{}
+		viewsDay = day
+	}
+
+	h := sha256.New()
+	h.Write(viewsSalt)
+	fmt.Fprintf(h, "%s\x00%s\x00%s", ip, ua, postID)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if viewsSeen[sum] {
+		return
+	}
+
+	viewsSeen[sum] = true
+	views.Posts[postID]++
+	if d := referrerDomain(referrer); d != "" {
+		views.Referrers[d]++
+		views.PostReferrers[postReferrerKey(postID, d)]++
+	}
+
+	viewsDirty = true
+}
+
+// referrerDomain returns the domain of the referrer, without the "www.", or
+// an empty string if it is not of another site. Nothing more of the referrer
+// is ever kept.
+func referrerDomain(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+
+	d := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if d == strings.TrimPrefix(
+		strings.ToLower(canonicalURL.Hostname()),
+		"www.",
+	) {
+		return ""
+	}
+
+	return d
+}
+
+// postReferrerKey returns the key of the referrer domain d of the post of the
+// postID in the `viewStats`.
+func postReferrerKey(postID, d string) string {
+	return postID + " " + d
+}
+
+// topPostReferrers returns the n referrer domains of the post of the postID
+// with the most views. The `viewsMutex` must be held.
+func topPostReferrers(postID string, n int) []viewCount {
+	prefix := postReferrerKey(postID, "")
+	m := map[string]uint64{}
+	for k, c := range views.PostReferrers {
+		if strings.HasPrefix(k, prefix) {
+			m[strings.TrimPrefix(k, prefix)] = c
+		}
+	}
+
+	return topViewCounts(m, n)
+}
+
+// viewCountGas is an `air.Gas` that counts the views of the posts by the
+// humans. It must come before the `pageCacheGas`, since the cached pages
+// never reach the handler. Only the HTML pages of the posts are counted, not
+// their other formats, histories and diffs.
+func viewCountGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		postID := paramValue(req, "*")
+		_, ok := loadedPosts().posts[postID]
+		ok = ok && negotiatePostFormat(req) == postFormatHTML
+
+		if err := next(req, res); err != nil {
+			return err
+		}
+
+		if ok && config.ViewCounterEnabled && res.Status == 200 &&
+			req.Values["BotClass"] == humanBotClass {
+			countView(
+				postID,
+				clientIP(req),
+				req.Header("user-agent").Value(),
+				req.Header("referer").Value(),
+			)
+		}
+
+		return nil
+	}
+}
+
+// postViews returns the number of the views of the post of the postID.
+func postViews(postID string) uint64 {
+	viewsMutex.Lock()
+	defer viewsMutex.Unlock()
+	return views.Posts[postID]
+}
+
+// humanizeCount returns the n in a short form, such as "1.2k".
+func humanizeCount(n uint64) string {
+	switch {
+	case n < 1000:
+		return fmt.Sprint(n)
+	case n < 1000000:
+		return strings.Replace(
+			fmt.Sprintf("%.1fk", float64(n)/1e3),
+			".0k",
+			"k",
+			1,
+		)
+	}
+
+	return strings.Replace(
+		fmt.Sprintf("%.1fM", float64(n)/1e6),
+		".0M",
+		"M",
+		1,
+	)
+}
+
+// topViewCounts returns the n keys of the m with the highest counts.
+func topViewCounts(m map[string]uint64, n int) []viewCount {
+	vcs := make([]viewCount, 0, len(m))
+	for k, c := range m {
+		vcs = append(vcs, viewCount{k, c})
+	}
+
+	sort.Slice(vcs, func(i, j int) bool {
+		if vcs[i].Count != vcs[j].Count {
+			return vcs[i].Count > vcs[j].Count
+		}
+
+		return vcs[i].Key < vcs[j].Key
+	})
+
+	if len(vcs) > n {
+		vcs = vcs[:n]
+	}
+
+	return vcs
+}
+
+func adminStatsHandler(req *air.Request, res *air.Response) error {
+	snap := loadedPosts()
+
+	viewsMutex.Lock()
+	total := uint64(0)
+	for _, c := range views.Posts {
+		total += c
+	}
+
+	topPosts := topViewCounts(views.Posts, 20)
+	topReferrers := topViewCounts(views.Referrers, 20)
+	topCampaigns := topViewCounts(views.Campaigns, 20)
+	postReferrers := make(map[string][]viewCount, len(topPosts))
+	for _, vc := range topPosts {
+		postReferrers[vc.Key] = topPostReferrers(vc.Key, 5)
+	}
+	viewsMutex.Unlock()
+
+	titles := map[string]string{}
+	for _, vc := range topPosts {
+		if p, ok := snap.posts[vc.Key]; ok {
+			titles[vc.Key] = p.Title
+		}
+	}
+
+	req.Values["PageTitle"] = "Stats"
+	req.Values["TotalViews"] = total
+	req.Values["TopPosts"] = topPosts
+	req.Values["TopReferrers"] = topReferrers
+	req.Values["TopCampaigns"] = topCampaigns
+	req.Values["PostReferrers"] = postReferrers
+	req.Values["PostTitles"] = titles
+
+	return res.Render(
+		req.Values,
+		"admin/stats.html",
+		"layouts/default.html",
+	)
+}
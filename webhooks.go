@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// The events that the webhooks are fired on.
+const (
+	webhookPostPublished   = "post.published"
+	webhookPostUpdated     = "post.updated"
+	webhookCommentReceived = "comment.received"
+	webhookReloadFailed    = "reload.failed"
+)
+
+// webhookEvents is all the events that the webhooks are fired on.
+var webhookEvents = []string{
+	webhookPostPublished,
+	webhookPostUpdated,
+	webhookCommentReceived,
+	webhookReloadFailed,
+}
+
+// webhookAttempts is how many times the delivery of an event to a webhook is
+// tried before giving up.
+const webhookAttempts = 3
+
+// webhookConfig is an outbound webhook that is posted the events it is for, or
+// all of them if the Events is empty. The body is signed with the Secret, if
+// any.
+type webhookConfig struct {
+	URL    string   `toml:"url"`
+	Secret string   `toml:"secret"`
+	Events []string `toml:"events"`
+}
+
+// checkWebhooks checks the `config.Webhooks`.
+func checkWebhooks() error {
+	for _, wc := range config.Webhooks {
+		u, err := url.Parse(wc.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("bad webhook url %q", wc.URL)
+		}
+
+		for _, e := range wc.Events {
+			if !stringSliceContains(webhookEvents, e) {
+				return fmt.Errorf("unknown webhook event %q", e)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stringSliceContains reports whether the ss contains the s.
+func stringSliceContains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fireWebhooks posts the event with the data to each of the `config.Webhooks`
+// that is for it in the background.
+func fireWebhooks(event string, data interface{}) {
+	for _, wc := range config.Webhooks {
+		if len(wc.Events) > 0 &&
+			!stringSliceContains(wc.Events, event) {
+			continue
+		}
+
+		go func(wc webhookConfig) {
+			if err := deliverWebhook(wc, event, data); err != nil {
+				air.ERROR(
+					"failed to deliver webhook",
+					map[string]interface{}{
+						"url":   wc.URL,
+						"event": event,
+						"error": err.Error(),
+					},
+				)
+			}
+		}(wc)
+	}
+}
+
+// deliverWebhook posts the event with the data to the wc as JSON, trying again
+// a few times if it fails. The "X-Blog-Signature" of the request is the
+// HMAC-SHA256 of the body with the secret of the wc, so that the receiver can
+// tell it is from the blog.
+func deliverWebhook(wc webhookConfig, event string, data interface{}) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"event": event,
+		"time":  time.Now().UTC(),
+		"data":  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{
+		"Content-Type": {"application/json"},
+		"X-Blog-Event": {event},
+	}
+	if wc.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wc.Secret))
+		mac.Write(b)
+		header.Set(
+			"X-Blog-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)),
+		)
+	}
+
+	for i := 0; ; i++ {
+		fr, err := fetch("POST", wc.URL, header, b)
+		if err == nil && (fr.Status < 200 || fr.Status >= 300) {
+			err = fmt.Errorf("unexpected status %d", fr.Status)
+		}
+
+		if err == nil || i == webhookAttempts-1 {
+			return err
+		}
+
+		time.Sleep(time.Duration(i+1) * 10 * time.Second)
+	}
+}
+
+// webhookPost returns the data of the events of the p.
+func webhookPost(p post) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        p.ID,
+		"title":     p.Title,
+		"url":       config.BaseURL + p.Permalink,
+		"tags":      p.Tags,
+		"published": p.Datetime,
+		"updated":   p.Updated,
+	}
+}
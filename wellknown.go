@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+// wellKnownMaxAge is how long the clients may cache a `wellKnownConfig` that
+// sets no max age.
+const wellKnownMaxAge = 24 * time.Hour
+
+// wellKnownConfig is a file served at a fixed path, such as a
+// "/.well-known/security.txt" or a "/humans.txt". Its content is the File,
+// read on each request, or the Content, or else the clients are redirected to
+// the Redirect.
+type wellKnownConfig struct {
+	Path        string `toml:"path"`
+	File        string `toml:"file"`
+	Content     string `toml:"content"`
+	Redirect    string `toml:"redirect"`
+	ContentType string `toml:"content_type"`
+	MaxAge      string `toml:"max_age"`
+}
+
+// wellKnownFile is a `wellKnownConfig` ready to be served.
+type wellKnownFile struct {
+	wellKnownConfig
+	cacheControl string
+}
+
+// wellKnownFiles is the `wellKnownFile`s by their paths.
+var wellKnownFiles = map[string]*wellKnownFile{}
+
+// setupWellKnown checks the `config.WellKnown` into the `wellKnownFiles`. The
+// paths must be either under the "/.well-known/" or of the files with an
+// extension at the root, and may not be of the files that the blog serves
+// itself.
+func setupWellKnown() error {
+	reserved := map[string]bool{
+		"/robots.txt":     true,
+		"/sitemap.xml":    true,
+		"/blogroll.opml":  true,
+		"/opensearch.xml": true,
+		"/activity.atom":  true,
+		"/archive.epub":   true,
+		manifestPath:      true,
+		serviceWorkerPath: true,
+		signingKeyPath:    true,
+	}
+	if config.IndexNowKey != "" {
+		reserved[indexNowKeyPath()] = true
+	}
+
+	wkfs := make(map[string]*wellKnownFile, len(config.WellKnown))
+	for _, wkc := range config.WellKnown {
+		p := wkc.Path
+		switch {
+		case path.Clean(p) != p:
+			return fmt.Errorf("bad well-known path %q", p)
+		case strings.HasPrefix(p, "/.well-known/"):
+			name := strings.TrimPrefix(p, "/.well-known/")
+			if strings.Contains(name, "/") ||
+				name == "signatures" ||
+				name == "acme-challenge" {
+				return fmt.Errorf("bad well-known path %q", p)
+			}
+		case strings.Count(p, "/") != 1 || path.Ext(p) == "":
+			return fmt.Errorf("bad well-known path %q", p)
+		}
+
+		if reserved[p] || wkfs[p] != nil {
+			return fmt.Errorf("well-known path %q is taken", p)
+		}
+
+		sources := 0
+		for _, s := range []string{
+			wkc.File,
+			wkc.Content,
+			wkc.Redirect,
+		} {
+			if s != "" {
+				sources++
+			}
+		}
+
+		if sources != 1 {
+			return fmt.Errorf(
+				"well-known %s needs one of file, content and "+
+					"redirect",
+				p,
+			)
+		}
+
+		maxAge := wellKnownMaxAge
+		if wkc.MaxAge != "" {
+			d, err := time.ParseDuration(wkc.MaxAge)
+			if err != nil || d < 0 {
+				return fmt.Errorf(
+					"bad max age of well-known %s",
+					p,
+				)
+			}
+
+			maxAge = d
+		}
+
+		if wkc.ContentType == "" {
+			wkc.ContentType = mime.TypeByExtension(path.Ext(p))
+			if wkc.ContentType == "" {
+				wkc.ContentType = "text/plain; charset=utf-8"
+			}
+		}
+
+		wkfs[p] = &wellKnownFile{
+			wellKnownConfig: wkc,
+			cacheControl: fmt.Sprintf(
+				"max-age=%d",
+				int(maxAge/time.Second),
+			),
+		}
+	}
+
+	wellKnownFiles = wkfs
+
+	return nil
+}
+
+func wellKnownHandler(req *air.Request, res *air.Response) error {
+	wkf, ok := wellKnownFiles[routePath(req)]
+	if !ok {
+		return air.NotFoundHandler(req, res)
+	}
+
+	res.SetHeader("cache-control", wkf.cacheControl)
+	if wkf.Redirect != "" {
+		return res.Redirect(wkf.Redirect)
+	}
+
+	b := []byte(wkf.Content)
+	if wkf.File != "" {
+		var err error
+		if b, err = ioutil.ReadFile(wkf.File); err != nil {
+			return err
+		}
+	}
+
+	res.SetHeader("content-type", wkf.ContentType)
+
+	return res.WriteBlob(b)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// postWidgetSize is the number of posts in each widget.
+const postWidgetSize = 5
+
+var (
+	postWidgetsMutex sync.RWMutex
+	popularPosts     []post
+	recentlyUpdated  []post
+)
+
+// updatePostWidgets recomputes the `popularPosts` from the view counts and the
+// `recentlyUpdated` from the update times of the posts of the snap. It reports
+// whether either of them has changed.
+func updatePostWidgets(snap *postsSnapshot) bool {
+	ops := snap.orderedPosts
+
+	pps := make([]post, 0, len(ops))
+	for _, p := range ops {
+		if postViews(p.ID) > 0 {
+			pps = append(pps, p)
+		}
+	}
+
+	sort.SliceStable(pps, func(i, j int) bool {
+		return postViews(pps[i].ID) > postViews(pps[j].ID)
+	})
+
+	if len(pps) > postWidgetSize {
+		pps = pps[:postWidgetSize]
+	}
+
+	rups := make([]post, 0, len(ops))
+	for _, p := range ops {
+		if p.Updated.After(p.Datetime) {
+			rups = append(rups, p)
+		}
+	}
+
+	sort.SliceStable(rups, func(i, j int) bool {
+		return rups[i].Updated.After(rups[j].Updated)
+	})
+
+	if len(rups) > postWidgetSize {
+		rups = rups[:postWidgetSize]
+	}
+
+	postWidgetsMutex.Lock()
+	defer postWidgetsMutex.Unlock()
+
+	changed := !samePostIDs(pps, popularPosts) ||
+		!samePostIDs(rups, recentlyUpdated)
+	popularPosts = pps
+	recentlyUpdated = rups
+
+	return changed
+}
+
+// refreshPostWidgets runs the `updatePostWidgets`. The cached pages are thrown
+// away when the widgets change, since they show them.
+func refreshPostWidgets() error {
+	if updatePostWidgets(loadedPosts()) {
+		bumpContentVersion()
+	}
+
+	return nil
+}
+
+// postWidgets returns the `popularPosts` and the `recentlyUpdated`.
+func postWidgets() ([]post, []post) {
+	postWidgetsMutex.RLock()
+	defer postWidgetsMutex.RUnlock()
+	return popularPosts, recentlyUpdated
+}
+
+// samePostIDs reports whether the a and the b are the same posts in the same
+// order.
+func samePostIDs(a, b []post) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+
+	return true
+}